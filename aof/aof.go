@@ -0,0 +1,247 @@
+// Append only file. Every write command is logged in RESP format so the
+// dataset can be rebuilt by replaying the file at startup.
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type FsyncPolicy int
+
+const (
+	FsyncEverySec FsyncPolicy = iota
+	FsyncAlways
+	FsyncNo
+)
+
+var fsyncPolicyNames = map[FsyncPolicy]string{
+	FsyncEverySec: "everysec",
+	FsyncAlways:   "always",
+	FsyncNo:       "no",
+}
+
+func (p FsyncPolicy) String() string {
+	return fsyncPolicyNames[p]
+}
+
+func ParseFsyncPolicy(value string) (FsyncPolicy, error) {
+	for policy, name := range fsyncPolicyNames {
+		if strings.EqualFold(name, value) {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("argument must be one of always, everysec or no")
+}
+
+var ErrCorrupt = errors.New("bad file format reading the append only file")
+
+// Longest argument accepted, the proto-max-bulk-len default of Redis. Larger
+// lengths can only come from a corrupt file and would be allocated up front.
+const maxBulkLen = 512 * 1024 * 1024
+
+// An open append only file. Appends come from the executor while the
+// everysec policy syncs from its own goroutine, hence the mutex.
+type File struct {
+	mutex   sync.Mutex
+	file    *os.File
+	policy  FsyncPolicy
+	dirty   bool
+	done    chan struct{}
+	written int64
+	synced  atomic.Int64
+}
+
+func Open(path string, policy FsyncPolicy) (*File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{file: file, policy: policy, done: make(chan struct{})}
+	go f.syncEverySecond()
+	return f, nil
+}
+
+func (f *File) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			f.mutex.Lock()
+			if f.policy == FsyncEverySec && f.dirty {
+				if err := f.file.Sync(); err != nil {
+					log.Printf("fsync of the append only file failed: %s", err.Error())
+				} else {
+					f.synced.Store(f.written)
+				}
+				f.dirty = false
+			}
+			f.mutex.Unlock()
+		}
+	}
+}
+
+func (f *File) SetPolicy(policy FsyncPolicy) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.policy = policy
+}
+
+// Write data to the end of the file, with the always policy it is on disk
+// when Append returns.
+func (f *File) Append(data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n, err := f.file.Write(data)
+	f.written += int64(n)
+	if err != nil {
+		return err
+	}
+	switch f.policy {
+	case FsyncAlways:
+		if err := f.file.Sync(); err != nil {
+			return err
+		}
+		f.synced.Store(f.written)
+	case FsyncNo:
+		// Left to the operating system, nobody waits for the disk
+		f.synced.Store(f.written)
+	default:
+		f.dirty = true
+	}
+	return nil
+}
+
+// The number of bytes appended since the file was opened that are known to
+// be on disk.
+func (f *File) Synced() int64 {
+	return f.synced.Load()
+}
+
+func (f *File) Close() error {
+	close(f.done)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// Reads the commands of an append only file one by one, Offset is the end
+// of the last complete command.
+type Reader struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(r)}
+}
+
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Returns io.EOF at the end of the input and io.ErrUnexpectedEOF when the
+// input ends in the middle of a command.
+func (r *Reader) ReadCommand() ([]string, error) {
+	read := int64(0)
+	count, err := r.readHeader('*', &read)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF && read == 0 {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	// The count is not trusted for the allocation either
+	args := make([]string, 0, min(count, 1024))
+	for i := 0; i < count; i++ {
+		size, err := r.readHeader('$', &read)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBulkLen {
+			return nil, ErrCorrupt
+		}
+		data := make([]byte, size+2)
+		n, err := io.ReadFull(r.reader, data)
+		read += int64(n)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, ErrCorrupt
+		}
+		args = append(args, string(data[:size]))
+	}
+	r.offset += read
+	return args, nil
+}
+
+func (r *Reader) readHeader(prefix byte, read *int64) (int, error) {
+	line, err := r.reader.ReadString('\n')
+	*read += int64(len(line))
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, ErrCorrupt
+	}
+	value, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil || value < 0 {
+		return 0, ErrCorrupt
+	}
+	return value, nil
+}
+
+// Replay the file at path, handing every command to apply. A missing file
+// is an empty dataset. A file that ends in the middle of a command, e.g.
+// after a crash, is truncated to its last complete command if
+// repairTruncated is set and refused otherwise.
+func Load(path string, repairTruncated bool, apply func(args []string) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := NewReader(file)
+	for {
+		args, err := reader.ReadCommand()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == io.ErrUnexpectedEOF:
+			if !repairTruncated {
+				return fmt.Errorf("unexpected end of file reading the append only file at offset %d", reader.Offset())
+			}
+			log.Printf("append only file %s is truncated, removing the incomplete command at offset %d", path, reader.Offset())
+			return os.Truncate(path, reader.Offset())
+		case err != nil:
+			return fmt.Errorf("%w at offset %d", err, reader.Offset())
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%w at offset %d", ErrCorrupt, reader.Offset())
+		}
+		if err := apply(args); err != nil {
+			return fmt.Errorf("error replaying the append only file at offset %d: %w", reader.Offset(), err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const setCommand = "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+
+func loadAll(path string, repair bool) ([][]string, error) {
+	commands := [][]string{}
+	err := Load(path, repair, func(args []string) error {
+		commands = append(commands, args)
+		return nil
+	})
+	return commands, err
+}
+
+func TestAppendAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	commands, err := loadAll(path, false)
+	require.NoError(t, err)
+	require.Empty(t, commands)
+
+	file, err := Open(path, FsyncAlways)
+	require.NoError(t, err)
+	require.NoError(t, file.Append([]byte(setCommand)))
+	require.NoError(t, file.Append([]byte("*1\r\n$7\r\nFLUSHDB\r\n")))
+	require.NoError(t, file.Close())
+
+	commands, err = loadAll(path, false)
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"SET", "k", "v"}, {"FLUSHDB"}}, commands)
+}
+
+func TestLoadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	require.NoError(t, os.WriteFile(path, []byte(setCommand+"*2\r\n$3\r\nDEL\r\n$1\r"), 0644))
+
+	_, err := loadAll(path, false)
+	require.ErrorContains(t, err, "unexpected end of file")
+
+	commands, err := loadAll(path, true)
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"SET", "k", "v"}}, commands)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, setCommand, string(data))
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	require.NoError(t, os.WriteFile(path, []byte(setCommand+"+garbage\r\n"+setCommand), 0644))
+	_, err := loadAll(path, true)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	require.NoError(t, os.WriteFile(path, []byte("*1\r\n$9999999999\r\nSET\r\n"), 0644))
+	_, err = loadAll(path, true)
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	policy, err := ParseFsyncPolicy("Always")
+	require.NoError(t, err)
+	require.Equal(t, FsyncAlways, policy)
+	require.Equal(t, "everysec", FsyncEverySec.String())
+	_, err = ParseFsyncPolicy("sometimes")
+	require.Error(t, err)
+}
+
+func TestSynced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	file, err := Open(path, FsyncAlways)
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, file.Append([]byte(setCommand)))
+	require.Equal(t, int64(len(setCommand)), file.Synced())
+
+	file.SetPolicy(FsyncEverySec)
+	require.NoError(t, file.Append([]byte(setCommand)))
+	require.Equal(t, int64(len(setCommand)), file.Synced())
+	require.Eventually(t, func() bool { return file.Synced() == int64(2*len(setCommand)) }, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,138 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeBase = "b"
+	TypeIncr = "i"
+)
+
+type FileInfo struct {
+	Name string
+	Seq  int64
+	Type string
+}
+
+// Multi part append only file: a base file with a snapshot of the dataset
+// followed by incremental files with the writes since. The manifest lists
+// them in the order they must be loaded.
+type Manifest struct {
+	Base  *FileInfo
+	Incrs []FileInfo
+}
+
+// Files in load order.
+func (m *Manifest) Files() []FileInfo {
+	files := []FileInfo{}
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	return append(files, m.Incrs...)
+}
+
+// Add a new incremental file named after prefix, e.g. appendonly.aof.3.incr.aof.
+func (m *Manifest) NextIncr(prefix string) FileInfo {
+	seq := int64(1)
+	if len(m.Incrs) > 0 {
+		seq = m.Incrs[len(m.Incrs)-1].Seq + 1
+	}
+	incr := FileInfo{Name: fmt.Sprintf("%s.%d.incr.aof", prefix, seq), Seq: seq, Type: TypeIncr}
+	m.Incrs = append(m.Incrs, incr)
+	return incr
+}
+
+// The base that replaces the current one after a rewrite.
+func (m *Manifest) NextBase(prefix string) FileInfo {
+	seq := int64(1)
+	if m.Base != nil {
+		seq = m.Base.Seq + 1
+	}
+	return FileInfo{Name: fmt.Sprintf("%s.%d.base.aof", prefix, seq), Seq: seq, Type: TypeBase}
+}
+
+// Lines have the form "file <name> seq <seq> type <b|i>".
+func LoadManifest(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &Manifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line: %s", line)
+		}
+		info := FileInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.Name = fields[i+1]
+			case "seq":
+				if info.Seq, err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid manifest line: %s", line)
+				}
+			case "type":
+				info.Type = fields[i+1]
+			}
+		}
+		if info.Name == "" || filepath.Base(info.Name) != info.Name {
+			return nil, fmt.Errorf("invalid manifest line: %s", line)
+		}
+		switch info.Type {
+		case TypeBase:
+			if manifest.Base != nil {
+				return nil, fmt.Errorf("manifest %s has more than one base file", path)
+			}
+			manifest.Base = &info
+		case TypeIncr:
+			manifest.Incrs = append(manifest.Incrs, info)
+		default:
+			return nil, fmt.Errorf("invalid manifest line: %s", line)
+		}
+	}
+	return manifest, scanner.Err()
+}
+
+// Written to a temporary file that is renamed over the old manifest, so
+// a crash leaves either the old or the new one.
+func (m *Manifest) Save(path string) error {
+	var content strings.Builder
+	for _, info := range m.Files() {
+		fmt.Fprintf(&content, "file %s seq %d type %s\n", info.Name, info.Seq, info.Type)
+	}
+	return WriteFileAtomic(path, []byte(content.String()))
+}
+
+func WriteFileAtomic(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "temp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,44 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+	manifest := &Manifest{}
+	base := manifest.NextBase("appendonly.aof")
+	manifest.Base = &base
+	manifest.NextIncr("appendonly.aof")
+	manifest.NextIncr("appendonly.aof")
+	require.NoError(t, manifest.Save(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "file appendonly.aof.1.base.aof seq 1 type b\n"+
+		"file appendonly.aof.1.incr.aof seq 1 type i\n"+
+		"file appendonly.aof.2.incr.aof seq 2 type i\n", string(data))
+
+	loaded, err := LoadManifest(path)
+	require.NoError(t, err)
+	require.Equal(t, manifest, loaded)
+	require.Equal(t, "appendonly.aof.2.base.aof", loaded.NextBase("appendonly.aof").Name)
+}
+
+func TestManifestInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+	for _, content := range []string{
+		"file a seq 1 type x\n",
+		"file ../a seq 1 type b\n",
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq one type i\n",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		_, err := LoadManifest(path)
+		require.Error(t, err, content)
+	}
+}
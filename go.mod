@@ -2,9 +2,15 @@ module github.com/johanlantz/redis
 
 go 1.22.1
 
+require (
+	github.com/stretchr/testify v1.9.0
+	github.com/yuin/gopher-lua v1.1.1
+	go.etcd.io/bbolt v1.3.11
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,11 +1,29 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"github.com/johanlantz/redis/network"
-	"github.com/johanlantz/redis/storage"
 )
 
+// Usage: godis [/path/to/godis.conf] [--name value ...]
+//
+// The configuration file has one "name value" directive per line, options
+// on the command line override it. Every CONFIG SET parameter can be given
+// as well as bind, port, databases, storage (memory or disk), diskfile,
+// tcp-keepalive, unixsocket, unixsocketperm and the tls-* settings. The
+// disk storage does not support maxmemory, its data is not held in memory.
+// Only string keys are loaded from the RDB file in dir/dbfilename, keys of
+// other types are skipped and counted in the log.
 func main() {
-	storage := storage.NewSimpleStorage()
-	network.StartServer(network.DefaultConfig(), storage)
+	config, err := network.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error in the configuration: %s", err.Error())
+	}
+	databases, err := config.OpenDatabases()
+	if err != nil {
+		log.Fatal(err)
+	}
+	network.StartServer(config, databases...)
 }
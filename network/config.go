@@ -0,0 +1,316 @@
+// Configuration loading the way redis-server does it: an optional file with
+// one directive per line, "name arguments...", followed by overrides from
+// the command line given as --name arguments. Directives of the network
+// layer and the storage end up in the ServerConfig, all others are
+// parameters of the command processor, see resp.ConfigLoad. These are only
+// set once the whole configuration is valid.
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/resp"
+	"github.com/johanlantz/redis/storage"
+)
+
+type configLoader struct {
+	config ServerConfig
+
+	// save directives add to each other, see apply
+	saves []string
+
+	// Parameters of the command processor in the order they were given
+	parameters []processorParameter
+}
+
+type processorParameter struct {
+	// Where the parameter was given, for errors
+	where string
+	name  string
+	value string
+}
+
+// Load the configuration from args, e.g. os.Args[1:]. The first argument is
+// the path of a configuration file unless it starts with --. The result is
+// validated so that the server fails at startup rather than later.
+func LoadConfig(args []string) (ServerConfig, error) {
+	loader := &configLoader{config: DefaultConfig()}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		if err := loader.loadFile(args[0]); err != nil {
+			return ServerConfig{}, err
+		}
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		if !strings.HasPrefix(args[0], "--") {
+			return ServerConfig{}, fmt.Errorf("command line: '%s' is not a --name option", args[0])
+		}
+		end := 1
+		for end < len(args) && !strings.HasPrefix(args[end], "--") {
+			end++
+		}
+		where := "command line: " + strings.Join(args[:end], " ")
+		if err := loader.apply(where, strings.TrimPrefix(args[0], "--"), args[1:end]); err != nil {
+			return ServerConfig{}, fmt.Errorf("%s: %w", where, err)
+		}
+		args = args[end:]
+	}
+
+	if err := loader.config.validate(); err != nil {
+		return ServerConfig{}, err
+	}
+	for _, parameter := range loader.parameters {
+		if err := resp.ConfigLoad(parameter.name, parameter.value); err != nil {
+			return ServerConfig{}, fmt.Errorf("%s: %w", parameter.where, err)
+		}
+	}
+	return loader.config, nil
+}
+
+func (loader *configLoader) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open the configuration file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d: %s", path, number, line)
+		fields, err := splitConfigLine(line)
+		if err == nil {
+			err = loader.apply(where, fields[0], fields[1:])
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read the configuration file: %w", err)
+	}
+	return nil
+}
+
+// Split a line into words, which may be quoted to contain spaces or be
+// empty. Double quoted words know the escapes \n, \r, \t, \" and \\.
+func splitConfigLine(line string) ([]string, error) {
+	var words []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		var word strings.Builder
+		quote := byte(0)
+		if line[i] == '"' || line[i] == '\'' {
+			quote = line[i]
+			i++
+		}
+		for ; i < len(line); i++ {
+			c := line[i]
+			if quote == 0 && (c == ' ' || c == '\t') {
+				break
+			}
+			if c == quote {
+				quote = 0
+				i++
+				if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+					return nil, errors.New("closing quote must be followed by a space")
+				}
+				break
+			}
+			if c == '\\' && i+1 < len(line) && (quote == '"' || (quote == '\'' && line[i+1] == '\'')) {
+				i++
+				switch c = line[i]; c {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				case 't':
+					c = '\t'
+				}
+			}
+			word.WriteByte(c)
+		}
+		if quote != 0 {
+			return nil, errors.New("unbalanced quotes")
+		}
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// Parameters of the command processor are queued for LoadConfig to set,
+// maxmemory is also parsed here since validate needs it.
+func (loader *configLoader) apply(where string, name string, args []string) error {
+	name = strings.ToLower(name)
+	config := &loader.config
+	var err error
+	switch name {
+	case "bind":
+		if len(args) != 1 {
+			return errors.New("exactly one address is supported")
+		}
+		// * means all interfaces, as does an empty host for net.Listen
+		config.addr = args[0]
+		if config.addr == "*" {
+			config.addr = ""
+		}
+	case "port":
+		config.port, err = parsePort(args)
+	case "tls-port":
+		config.tlsPort, err = parsePort(args)
+	case "tls-cert-file":
+		config.tlsCertFile, err = singleArgument(args)
+	case "tls-key-file":
+		config.tlsKeyFile, err = singleArgument(args)
+	case "tls-ca-cert-file":
+		config.tlsCACertFile, err = singleArgument(args)
+	case "tls-auth-clients":
+		config.tlsAuthClients, err = oneOf(args, "yes", "no", "optional")
+	case "tls-auth-clients-user":
+		config.tlsAuthClientsUser, err = oneOf(args, "CN", "off")
+	case "unixsocket":
+		config.unixSocket, err = singleArgument(args)
+	case "unixsocketperm":
+		var value string
+		if value, err = singleArgument(args); err == nil {
+			perm, parseErr := strconv.ParseUint(value, 8, 32)
+			if parseErr != nil || perm > 0777 {
+				return errors.New("argument must be octal permissions, e.g. 700")
+			}
+			config.unixSocketPerm = os.FileMode(perm)
+		}
+	case "tcp-keepalive":
+		var seconds int
+		if seconds, err = parseInt(args, 0); err == nil {
+			config.tcpKeepAlive = time.Duration(seconds) * time.Second
+		}
+	case "databases":
+		config.databases, err = parseInt(args, 1)
+	case "storage":
+		config.storage, err = oneOf(args, "memory", "disk")
+	case "diskfile":
+		config.diskFile, err = singleArgument(args)
+	case "dir":
+		if config.dir, err = singleArgument(args); err == nil {
+			loader.addParameter(where, name, config.dir)
+		}
+	case "maxmemory":
+		var value string
+		if value, err = singleArgument(args); err == nil {
+			if config.maxMemory, err = resp.ParseMemory(value); err == nil {
+				loader.addParameter(where, name, value)
+			}
+		}
+	case "save":
+		// Every save directive adds a policy, an empty one removes them all
+		if len(args) == 1 && args[0] == "" {
+			loader.saves = []string{}
+		} else {
+			loader.saves = append(loader.saves, args...)
+		}
+		loader.addParameter(where, name, strings.Join(loader.saves, " "))
+	default:
+		loader.addParameter(where, name, strings.Join(args, " "))
+	}
+	return err
+}
+
+func (loader *configLoader) addParameter(where string, name string, value string) {
+	loader.parameters = append(loader.parameters, processorParameter{where, name, value})
+}
+
+func singleArgument(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("wrong number of arguments")
+	}
+	return args[0], nil
+}
+
+func oneOf(args []string, values ...string) (string, error) {
+	value, err := singleArgument(args)
+	if err != nil {
+		return "", err
+	}
+	for _, allowed := range values {
+		if strings.EqualFold(value, allowed) {
+			return allowed, nil
+		}
+	}
+	return "", fmt.Errorf("argument must be one of %s", strings.Join(values, ", "))
+}
+
+func parseInt(args []string, min int) (int, error) {
+	value, err := singleArgument(args)
+	if err != nil {
+		return 0, err
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min {
+		return 0, fmt.Errorf("argument must be an integer of at least %d", min)
+	}
+	return number, nil
+}
+
+func parsePort(args []string) (int, error) {
+	port, err := parseInt(args, 0)
+	if err != nil || port > 65535 {
+		return 0, errors.New("argument must be a port number")
+	}
+	return port, nil
+}
+
+// Settings that are only wrong in combination with others.
+func (config ServerConfig) validate() error {
+	if config.port == 0 && config.tlsPort == 0 && config.unixSocket == "" {
+		return errors.New("at least one of port, tls-port and unixsocket must be set")
+	}
+	if config.tlsPort != 0 {
+		if config.tlsCertFile == "" || config.tlsKeyFile == "" {
+			return errors.New("tls-port needs tls-cert-file and tls-key-file")
+		}
+		if _, err := tlsConfig(config); err != nil {
+			return err
+		}
+	}
+	if config.storage == "disk" && config.maxMemory != 0 {
+		return resp.ErrMaxMemoryOnDisk
+	}
+	return nil
+}
+
+// Open the configured number of databases in the configured storage, to
+// be passed to StartServer.
+func (config ServerConfig) OpenDatabases() ([]resp.KVStorage, error) {
+	databases := make([]resp.KVStorage, config.databases)
+	switch config.storage {
+	case "memory":
+		for i := range databases {
+			databases[i] = storage.NewSimpleStorage()
+		}
+	case "disk":
+		storages, err := storage.OpenBoltStorages(filepath.Join(config.dir, config.diskFile), config.databases)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the disk storage: %w", err)
+		}
+		for i, kv := range storages {
+			databases[i] = kv
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage %s, must be memory or disk", config.storage)
+	}
+	return databases, nil
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitConfigLine(t *testing.T) {
+	words, err := splitConfigLine(`requirepass "with space\"s" '' 'it\'s'`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"requirepass", `with space"s`, "", "it's"}, words)
+	_, err = splitConfigLine(`dir "open`)
+	require.ErrorContains(t, err, "unbalanced quotes")
+	_, err = splitConfigLine(`dir "a"b`)
+	require.ErrorContains(t, err, "closing quote")
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godis.conf")
+	require.NoError(t, os.WriteFile(path, []byte("# Listen everywhere\nbind *\nport 7000\n\ndatabases 4\n"+
+		"tcp-keepalive 0\nunixsocket /tmp/godis.sock\nunixsocketperm 770\n"), 0600))
+
+	// The command line overrides the file
+	config, err := LoadConfig([]string{path, "--port", "7001", "--storage", "disk", "--diskfile", "data.db"})
+	require.NoError(t, err)
+	require.Equal(t, "", config.addr)
+	require.Equal(t, 7001, config.port)
+	require.Equal(t, 4, config.databases)
+	require.Equal(t, time.Duration(0), config.tcpKeepAlive)
+	require.Equal(t, "/tmp/godis.sock", config.unixSocket)
+	require.Equal(t, os.FileMode(0770), config.unixSocketPerm)
+	require.Equal(t, "disk", config.storage)
+	require.Equal(t, "data.db", config.diskFile)
+
+	config, err = LoadConfig(nil)
+	require.NoError(t, err)
+	require.Equal(t, DefaultConfig(), config)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godis.conf")
+	require.NoError(t, os.WriteFile(path, []byte("port 7000\nport 70000\n"), 0600))
+	_, err := LoadConfig([]string{path})
+	require.EqualError(t, err, path+":2: port 70000: argument must be a port number")
+	require.NoError(t, os.WriteFile(path, []byte("port 7000\n"), 0600))
+	_, err = LoadConfig([]string{path, "port", "7001"})
+	require.EqualError(t, err, "command line: 'port' is not a --name option")
+
+	for message, args := range map[string][]string{
+		"command line: --databases 0: argument must be an integer of at least 1":            {"--databases", "0"},
+		"command line: --nosuchthing 1: Bad directive or wrong number of arguments":         {"--nosuchthing", "1"},
+		"command line: --maxmemory lots: argument must be a memory value":                   {"--maxmemory", "lots"},
+		"command line: --storage cloud: argument must be one of memory, disk":               {"--storage", "cloud"},
+		"command line: --port 7000 6379: argument must be a port number":                    {"--port", "7000", "6379"},
+		"at least one of port, tls-port and unixsocket must be set":                         {"--port", "0"},
+		"tls-port needs tls-cert-file and tls-key-file":                                     {"--tls-port", "6380"},
+		"command line: --tls-auth-clients maybe: argument must be one of yes, no, optional": {"--tls-auth-clients", "maybe"},
+		"maxmemory is not supported by the disk storage":                                    {"--storage", "disk", "--maxmemory", "1mb"},
+	} {
+		_, err := LoadConfig(args)
+		require.EqualError(t, err, message)
+	}
+	// Parameters of the command processor are only set once the rest is valid
+	_, err = LoadConfig([]string{"--nosuchthing", "1", "--port", "0"})
+	require.EqualError(t, err, "at least one of port, tls-port and unixsocket must be set")
+	_, err = LoadConfig([]string{"missing.conf"})
+	require.ErrorContains(t, err, "failed to open the configuration file")
+}
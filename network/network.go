@@ -3,9 +3,16 @@ package network
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/johanlantz/redis/resp"
 )
@@ -13,11 +20,45 @@ import (
 const defaultPort = 6379
 const defaultProtocol = "tcp"
 const defaultAddress = "localhost"
+const defaultDatabases = 16
+const defaultTCPKeepAlive = 300 * time.Second
+
+// Clients that do not finish the TLS handshake in time are disconnected.
+const tlsHandshakeTimeout = 10 * time.Second
 
 type ServerConfig struct {
 	addr     string
 	port     int
 	protocol string
+
+	// Idle TCP connections are probed at this interval, 0 disables it
+	tcpKeepAlive time.Duration
+
+	// TLS is served on a port of its own, 0 disables it. Clients must
+	// present a certificate signed by the CA unless tlsAuthClients is
+	// "no" or "optional", with tlsAuthClientsUser "CN" the common name
+	// of that certificate is the ACL user the client is logged in as.
+	tlsPort            int
+	tlsCertFile        string
+	tlsKeyFile         string
+	tlsCACertFile      string
+	tlsAuthClients     string
+	tlsAuthClientsUser string
+
+	// Local clients may connect through a Unix socket at this path, empty
+	// disables it. A permission of 0 leaves the mode to the umask.
+	unixSocket     string
+	unixSocketPerm os.FileMode
+
+	// Where the logical databases are kept, see OpenDatabases
+	databases int
+	storage   string
+	dir       string
+	diskFile  string
+
+	// Also a parameter of the command processor, kept here to be checked
+	// against the storage
+	maxMemory int64
 }
 
 // Default server parameters for local testing purposes
@@ -26,64 +67,358 @@ func DefaultConfig() ServerConfig {
 		addr:     defaultAddress,
 		port:     defaultPort,
 		protocol: defaultProtocol,
+
+		tcpKeepAlive: defaultTCPKeepAlive,
+
+		tlsAuthClients:     "yes",
+		tlsAuthClientsUser: "off",
+
+		databases: defaultDatabases,
+		storage:   "memory",
+		dir:       ".",
+		diskFile:  "godis.db",
+	}
+}
+
+func (config ServerConfig) WithPort(port int) ServerConfig {
+	config.port = port
+	return config
+}
+
+// Serve TLS on port with the certificate and key in certFile and keyFile.
+// Client certificates are verified against the CA in caCertFile. A port of
+// 0 for the plaintext listener, see WithPort, leaves only TLS.
+func (config ServerConfig) WithTLS(port int, certFile string, keyFile string, caCertFile string) ServerConfig {
+	config.tlsPort = port
+	config.tlsCertFile, config.tlsKeyFile, config.tlsCACertFile = certFile, keyFile, caCertFile
+	return config
+}
+
+// Whether TLS clients must present a certificate, "yes", "no" or "optional",
+// and which field of it names their ACL user, "CN" or "off".
+func (config ServerConfig) WithTLSAuthClients(mode string, userField string) ServerConfig {
+	config.tlsAuthClients, config.tlsAuthClientsUser = mode, userField
+	return config
+}
+
+// Also listen on a Unix socket at path, created with the permissions perm.
+func (config ServerConfig) WithUnixSocket(path string, perm os.FileMode) ServerConfig {
+	config.unixSocket, config.unixSocketPerm = path, perm
+	return config
+}
+
+func tlsConfig(config ServerConfig) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.tlsCertFile, config.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+	result := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+
+	switch config.tlsAuthClients {
+	case "yes":
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		result.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		result.ClientAuth = tls.NoClientCert
+	default:
+		return nil, errors.New("tls-auth-clients must be 'yes', 'no' or 'optional'")
+	}
+	if config.tlsAuthClientsUser != "CN" && config.tlsAuthClientsUser != "off" {
+		return nil, errors.New("tls-auth-clients-user must be 'CN' or 'off'")
+	}
+	if config.tlsCACertFile == "" {
+		if result.ClientAuth != tls.NoClientCert {
+			return nil, errors.New("tls-ca-cert-file is needed to authenticate clients")
+		}
+		return result, nil
+	}
+	pem, err := os.ReadFile(config.tlsCACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS CA certificate: %w", err)
+	}
+	result.ClientCAs = x509.NewCertPool()
+	if !result.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.tlsCACertFile)
+	}
+	return result, nil
+}
+
+// Open a listener for plaintext TCP, TLS and the Unix socket, each unless
+// disabled, closing those already open if one fails.
+func listen(config ServerConfig) (listeners []net.Listener, err error) {
+	defer func() {
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			listeners = nil
+		}
+	}()
+	// A negative period disables keep alive, 0 would mean the default
+	listenConfig := net.ListenConfig{KeepAlive: config.tcpKeepAlive}
+	if config.tcpKeepAlive == 0 {
+		listenConfig.KeepAlive = -1
+	}
+	if config.port != 0 {
+		listener, err := listenConfig.Listen(context.Background(), config.protocol, fmt.Sprintf("%s:%d", config.addr, config.port))
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if config.tlsPort != 0 {
+		tlsConf, err := tlsConfig(config)
+		if err != nil {
+			return listeners, err
+		}
+		listener, err := listenConfig.Listen(context.Background(), config.protocol, fmt.Sprintf("%s:%d", config.addr, config.tlsPort))
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, tls.NewListener(listener, tlsConf))
+	}
+	if config.unixSocket != "" {
+		listener, err := listenUnix(config.unixSocket, config.unixSocketPerm)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("neither port, tls-port nor unixsocket is set")
+	}
+	return listeners, nil
+}
+
+// A socket file left behind by a previous run is replaced. The file is
+// removed again when the listener is closed. With permissions the socket is
+// created in a private directory and only moved into place once it has
+// them, so that it is never reachable with the mode of the umask.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if perm == 0 {
+		return net.Listen("unix", path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, err
 	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, filepath.Base(path))
+	listener, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	unixListener := listener.(*net.UnixListener)
+	unixListener.SetUnlinkOnClose(false)
+	if err = os.Chmod(private, perm); err == nil {
+		err = os.Rename(private, path)
+	}
+	if err != nil {
+		unixListener.Close()
+		return nil, err
+	}
+	return &movedUnixListener{unixListener, path}, nil
+}
+
+// A Unix listener whose socket file was moved, the listener itself would
+// only remove the file at the path it was created at.
+type movedUnixListener struct {
+	*net.UnixListener
+	path string
 }
 
-func StartServer(config ServerConfig, storage resp.KVStorage) {
-	listener, err := net.Listen(config.protocol, fmt.Sprintf("%s:%d", config.addr, config.port))
+func (listener *movedUnixListener) Close() error {
+	err := listener.UnixListener.Close()
+	os.Remove(listener.path)
+	return err
+}
+
+// Every storage passed in becomes one logical database, index 0 first.
+func StartServer(config ServerConfig, databases ...resp.KVStorage) {
+	listeners, err := listen(config)
 	if err != nil {
 		log.Panic("Error starting server:", err.Error())
-		return
 	}
-	defer listener.Close()
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
 
 	requestChannel := make(chan resp.NetworkRequest)
 
-	resp.StartCommandProcessor(requestChannel, storage)
+	if err := resp.ConfigSet("port", fmt.Sprint(config.port)); err != nil {
+		log.Panic("Error starting server:", err.Error())
+	}
+	resp.StartCommandProcessor(requestChannel, databases...)
 
+	// The server stops when any listener fails
+	stopped := make(chan struct{}, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			acceptConnections(listener, config, requestChannel)
+			stopped <- struct{}{}
+		}(listener)
+	}
+	<-stopped
+}
+
+func acceptConnections(listener net.Listener, config ServerConfig, requestChannel chan<- resp.NetworkRequest) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			log.Println("Error accepting connection:", err.Error())
 			return
 		}
-		go handleConnection(conn, requestChannel)
+		if resp.MaxClientsReached() {
+			go refuseConnection(conn)
+			continue
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			go handleTLSConnection(tlsConn, config, requestChannel)
+		} else {
+			go handleConnection(conn, requestChannel)
+		}
+	}
+}
+
+// Written in its own goroutine as a TLS connection has to be handshaken
+// first, which must not hold up accepting others.
+func refuseConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	conn.Write([]byte("-ERR max number of clients reached\r\n"))
+}
+
+// The handshake is done before the first request so that the client
+// certificate can log the client in.
+func handleTLSConnection(conn *tls.Conn, config ServerConfig, requestChannel chan<- resp.NetworkRequest) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		log.Println("Error during TLS handshake:", err.Error())
+		return
+	}
+
+	client := newConnectionClient(conn)
+	defer resp.CloseClient(client)
+	if certificates := conn.ConnectionState().PeerCertificates; config.tlsAuthClientsUser == "CN" && len(certificates) > 0 {
+		if name := certificates[0].Subject.CommonName; !resp.AuthenticateAs(client, name) {
+			log.Printf("TLS client certificate user %s is unknown or disabled", name)
+		}
 	}
+	serveClient(conn, client, requestChannel)
 }
 
 func handleConnection(conn net.Conn, requestChannel chan<- resp.NetworkRequest) {
 	defer conn.Close()
 
+	client := newConnectionClient(conn)
+	defer resp.CloseClient(client)
+	serveClient(conn, client, requestChannel)
+}
+
+func newConnectionClient(conn net.Conn) *resp.Client {
+	client := resp.NewClient()
+	if addr := conn.RemoteAddr(); addr != nil {
+		client.SetAddr(addr.String())
+	}
+	return client
+}
+
+func serveClient(conn net.Conn, client *resp.Client, requestChannel chan<- resp.NetworkRequest) {
 	responseChannel := make(chan []byte)
 
+	// Reading is done separately so that pushes, e.g. pub/sub messages,
+	// can be written while the client is idle.
+	incoming := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	go readConnection(conn, incoming, done)
+
 	var buffer bytes.Buffer
-	readBuffer := make([]byte, 10) // Only to demonstrate segmentation support
 	for {
+		select {
+		case data, ok := <-incoming:
+			if !ok {
+				log.Printf("closing connection")
+				return
+			}
+			buffer.Write(data)
+
+			request := resp.NetworkRequest{ResponseChannel: responseChannel, Data: buffer.Bytes()[:len(buffer.Bytes())], Client: client}
+
+			requestChannel <- request
+			response, err := awaitResponse(conn, responseChannel, client.Pushes())
+			if err != nil {
+				log.Println("Error writing:", err.Error())
+				return
+			}
+
+			// A nil response means the command is still incomplete
+			if response != nil {
+				if _, err = conn.Write(response); err != nil {
+					log.Println("Error writing:", err.Error())
+					return
+				}
+				buffer.Reset()
+			}
+		case push := <-client.Pushes():
+			if _, err := conn.Write(push); err != nil {
+				log.Println("Error writing:", err.Error())
+				return
+			}
+		case <-client.Done():
+			log.Printf("closing connection on request of the server")
+			return
+		}
+	}
+}
+
+func readConnection(conn net.Conn, incoming chan<- []byte, done <-chan struct{}) {
+	defer close(incoming)
 
+	readBuffer := make([]byte, 10) // Only to demonstrate segmentation support
+	for {
 		n, err := conn.Read(readBuffer)
 		if err != nil {
 			fmt.Println("Error reading:", err.Error())
-			break
+			return
 		}
 
-		log.Printf("Received: %s\n", string(readBuffer[:n]))
-
-		buffer.Write(readBuffer[:n])
-
-		request := resp.NetworkRequest{ResponseChannel: responseChannel, Data: buffer.Bytes()[:len(buffer.Bytes())]}
-
-		requestChannel <- request
-		response := <-responseChannel
+		select {
+		case incoming <- bytes.Clone(readBuffer[:n]):
+		case <-done:
+			return
+		}
+	}
+}
 
-		if len(response) > 0 {
-			_, err = conn.Write([]byte(response))
-			if err != nil {
-				log.Println("Error writing:", err.Error())
-				break
+// Wait for the response to the current request, writing any pushes that
+// arrive meanwhile. Pushes that are queued when the response arrives were
+// produced before it and are therefore written first.
+func awaitResponse(conn net.Conn, responseChannel <-chan []byte, pushes <-chan []byte) ([]byte, error) {
+	for {
+		select {
+		case response := <-responseChannel:
+			for {
+				select {
+				case push := <-pushes:
+					if _, err := conn.Write(push); err != nil {
+						return nil, err
+					}
+				default:
+					return response, nil
+				}
+			}
+		case push := <-pushes:
+			if _, err := conn.Write(push); err != nil {
+				return nil, err
 			}
-			buffer.Reset()
 		}
-
 	}
-	log.Printf("closing connection")
 }
@@ -1,12 +1,27 @@
 package network
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/johanlantz/redis/resp"
+	"github.com/johanlantz/redis/storage"
+	"github.com/johanlantz/redis/utils"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,3 +70,192 @@ func TestDefaultConfig(t *testing.T) {
 	require.Equal(t, config.port, defaultPort)
 	require.Equal(t, config.protocol, defaultProtocol)
 }
+
+var testRequestChannel chan resp.NetworkRequest
+var startProcessor sync.Once
+
+// The command processor is shared by all tests of the package.
+func startTestProcessor() chan resp.NetworkRequest {
+	startProcessor.Do(func() {
+		testRequestChannel = make(chan resp.NetworkRequest)
+		resp.StartCommandProcessor(testRequestChannel, storage.NewSimpleStorage())
+	})
+	return testRequestChannel
+}
+
+func TestPushesWhileIdle(t *testing.T) {
+	requestChannel := startTestProcessor()
+
+	subscriber, server := net.Pipe()
+	go handleConnection(server, requestChannel)
+	defer subscriber.Close()
+
+	publisher, otherServer := net.Pipe()
+	go handleConnection(otherServer, requestChannel)
+	defer publisher.Close()
+
+	reader := bufio.NewReader(subscriber)
+	readReply := func(lines int) string {
+		reply := ""
+		for i := 0; i < lines; i++ {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			reply += line
+		}
+		return reply
+	}
+
+	_, err := subscriber.Write(utils.MarshalToResp("SUBSCRIBE events"))
+	require.NoError(t, err)
+	require.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$6\r\nevents\r\n:1\r\n", readReply(6))
+
+	go publisher.Write(utils.MarshalToResp("PUBLISH events ping"))
+	require.Equal(t, "*3\r\n$7\r\nmessage\r\n$6\r\nevents\r\n$4\r\nping\r\n", readReply(7))
+}
+
+// Write a certificate for commonName and its key as PEM files to dir,
+// signed by parent or self signed when parent is nil.
+func writeTestCertificate(t *testing.T, dir string, commonName string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, commonName+".crt"), certPem, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, commonName+".key"), keyPem, 0600))
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+	certificate.Leaf, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certificate
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, "server", nil)
+	config := DefaultConfig().WithTLS(6380, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "")
+
+	_, err := tlsConfig(config)
+	require.ErrorContains(t, err, "tls-ca-cert-file is needed")
+	_, err = tlsConfig(config.WithTLSAuthClients("maybe", "off"))
+	require.ErrorContains(t, err, "tls-auth-clients must be")
+	_, err = tlsConfig(config.WithTLSAuthClients("no", "OU"))
+	require.ErrorContains(t, err, "tls-auth-clients-user must be")
+	conf, err := tlsConfig(config.WithTLSAuthClients("no", "off"))
+	require.NoError(t, err)
+	require.Equal(t, tls.NoClientCert, conf.ClientAuth)
+	_, err = tlsConfig(config.WithTLS(6380, "missing.crt", "missing.key", ""))
+	require.ErrorContains(t, err, "failed to load the TLS certificate")
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	requestChannel := startTestProcessor()
+	dir := t.TempDir()
+	ca := writeTestCertificate(t, dir, "ca", nil)
+	writeTestCertificate(t, dir, "localhost", &ca)
+	alice := writeTestCertificate(t, dir, "alice", &ca)
+	config := DefaultConfig().
+		WithTLS(6380, filepath.Join(dir, "localhost.crt"), filepath.Join(dir, "localhost.key"), filepath.Join(dir, "ca.crt")).
+		WithTLSAuthClients("yes", "CN")
+	serverConf, err := tlsConfig(config)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	admin, adminServer := net.Pipe()
+	go handleConnection(adminServer, requestChannel)
+	defer admin.Close()
+	adminReader := bufio.NewReader(admin)
+	_, err = admin.Write(utils.MarshalToResp("ACL SETUSER alice on +acl|whoami"))
+	require.NoError(t, err)
+	line, err := adminReader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "+OK\r\n", line)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go acceptConnections(tls.NewListener(listener, serverConf), config, requestChannel)
+	connect := func(certificates ...tls.Certificate) *tls.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		return tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certificates})
+	}
+
+	// The common name of the certificate is the user the client is logged in as
+	client := connect(alice)
+	defer client.Close()
+	_, err = client.Write(utils.MarshalToResp("ACL WHOAMI"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(client)
+	reply := ""
+	for i := 0; i < 2; i++ {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		reply += line
+	}
+	require.Equal(t, "$5\r\nalice\r\n", reply)
+
+	// Clients without a certificate are refused
+	anonymous := connect()
+	defer anonymous.Close()
+	anonymous.Write(utils.MarshalToResp("PING"))
+	_, err = bufio.NewReader(anonymous).ReadString('\n')
+	require.Error(t, err)
+}
+
+func TestUnixSocket(t *testing.T) {
+	requestChannel := startTestProcessor()
+	path := filepath.Join(t.TempDir(), "godis.sock")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	// A socket file left behind by an earlier run is replaced
+	listeners, err := listen(DefaultConfig().WithPort(0).WithUnixSocket(path, 0770))
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	defer listeners[0].Close()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSocket|0770, info.Mode())
+	go acceptConnections(listeners[0], DefaultConfig(), requestChannel)
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(utils.MarshalToResp("PING"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "+PONG\r\n", line)
+
+	// Nothing is left of the private directory the socket was created in,
+	// and closing removes the socket
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NoError(t, listeners[0].Close())
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = listen(DefaultConfig().WithPort(0))
+	require.ErrorContains(t, err, "neither port")
+}
@@ -0,0 +1,397 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// Decoders for the compact encodings that Redis serializes as one blob.
+// Integers are returned as their decimal strings.
+
+func decodeIntset(blob []byte) ([]string, error) {
+	if len(blob) < 8 {
+		return nil, ErrCorrupt
+	}
+	width := int(binary.LittleEndian.Uint32(blob))
+	count := int(binary.LittleEndian.Uint32(blob[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(blob) != 8+width*count {
+		return nil, ErrCorrupt
+	}
+	elements := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		b := blob[8+i*width:]
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(b)))
+		default:
+			value = int64(binary.LittleEndian.Uint64(b))
+		}
+		elements = append(elements, strconv.FormatInt(value, 10))
+	}
+	return elements, nil
+}
+
+// Zipmaps are the hash encoding from before Redis 2.6, lengths are one
+// byte or 254 followed by four bytes, values have trailing free space.
+func decodeZipmap(blob []byte) ([]string, error) {
+	if len(blob) < 1 {
+		return nil, ErrCorrupt
+	}
+	pos := 1
+	readLength := func() (int, error) {
+		if pos >= len(blob) {
+			return 0, ErrCorrupt
+		}
+		length := int(blob[pos])
+		pos++
+		if length == 254 {
+			if pos+4 > len(blob) {
+				return 0, ErrCorrupt
+			}
+			length = int(binary.LittleEndian.Uint32(blob[pos:]))
+			pos += 4
+		}
+		return length, nil
+	}
+	readBytes := func(n int) (string, error) {
+		if n < 0 || pos+n > len(blob) {
+			return "", ErrCorrupt
+		}
+		value := string(blob[pos : pos+n])
+		pos += n
+		return value, nil
+	}
+
+	elements := []string{}
+	for {
+		if pos >= len(blob) {
+			return nil, ErrCorrupt
+		}
+		if blob[pos] == 255 {
+			return elements, nil
+		}
+		length, err := readLength()
+		if err != nil {
+			return nil, err
+		}
+		field, err := readBytes(length)
+		if err != nil {
+			return nil, err
+		}
+		if length, err = readLength(); err != nil {
+			return nil, err
+		}
+		if pos >= len(blob) {
+			return nil, ErrCorrupt
+		}
+		free := int(blob[pos])
+		pos++
+		value, err := readBytes(length)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := readBytes(free); err != nil {
+			return nil, err
+		}
+		elements = append(elements, field, value)
+	}
+}
+
+func decodeZiplist(blob []byte) ([]string, error) {
+	if len(blob) < 11 {
+		return nil, ErrCorrupt
+	}
+	pos := 10
+	elements := []string{}
+	for {
+		if pos >= len(blob) {
+			return nil, ErrCorrupt
+		}
+		if blob[pos] == 0xff {
+			return elements, nil
+		}
+		// Length of the previous entry
+		if blob[pos] == 0xfe {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(blob) {
+			return nil, ErrCorrupt
+		}
+		element, size, err := decodeZiplistEntry(blob[pos:])
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		pos += size
+	}
+}
+
+func decodeZiplistEntry(b []byte) (string, int, error) {
+	header := b[0]
+	str := func(offset int, length int) (string, int, error) {
+		if length < 0 || offset+length > len(b) {
+			return "", 0, ErrCorrupt
+		}
+		return string(b[offset : offset+length]), offset + length, nil
+	}
+	integer := func(width int) (string, int, error) {
+		if 1+width > len(b) {
+			return "", 0, ErrCorrupt
+		}
+		var value int64
+		switch width {
+		case 1:
+			value = int64(int8(b[1]))
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(b[1:])))
+		case 3:
+			value = int64(int32(uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24) >> 8)
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(b[1:])))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(b[1:]))
+		}
+		return strconv.FormatInt(value, 10), 1 + width, nil
+	}
+
+	switch header >> 6 {
+	case 0:
+		return str(1, int(header&0x3f))
+	case 1:
+		if len(b) < 2 {
+			return "", 0, ErrCorrupt
+		}
+		return str(2, int(header&0x3f)<<8|int(b[1]))
+	case 2:
+		if len(b) < 5 {
+			return "", 0, ErrCorrupt
+		}
+		return str(5, int(binary.BigEndian.Uint32(b[1:])))
+	}
+	switch header {
+	case 0xc0:
+		return integer(2)
+	case 0xd0:
+		return integer(4)
+	case 0xe0:
+		return integer(8)
+	case 0xf0:
+		return integer(3)
+	case 0xfe:
+		return integer(1)
+	}
+	if header >= 0xf1 && header <= 0xfd {
+		return strconv.Itoa(int(header&0x0f) - 1), 1, nil
+	}
+	return "", 0, ErrCorrupt
+}
+
+func decodeListpack(blob []byte) ([]string, error) {
+	if len(blob) < 7 {
+		return nil, ErrCorrupt
+	}
+	pos := 6
+	elements := []string{}
+	for {
+		if pos >= len(blob) {
+			return nil, ErrCorrupt
+		}
+		if blob[pos] == 0xff {
+			return elements, nil
+		}
+		element, size, err := decodeListpackEntry(blob[pos:])
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		pos += size + listpackBacklenSize(size)
+	}
+}
+
+// Returns the element and the size of its encoding and data, without the
+// trailing back length.
+func decodeListpackEntry(b []byte) (string, int, error) {
+	header := b[0]
+	str := func(offset int, length int) (string, int, error) {
+		if length < 0 || offset+length > len(b) {
+			return "", 0, ErrCorrupt
+		}
+		return string(b[offset : offset+length]), offset + length, nil
+	}
+	integer := func(width int) (string, int, error) {
+		if 1+width > len(b) {
+			return "", 0, ErrCorrupt
+		}
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(b[1:])))
+		case 3:
+			value = int64(int32(uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24) >> 8)
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(b[1:])))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(b[1:]))
+		}
+		return strconv.FormatInt(value, 10), 1 + width, nil
+	}
+
+	switch {
+	case header&0x80 == 0:
+		return strconv.Itoa(int(header)), 1, nil
+	case header&0xc0 == 0x80:
+		return str(1, int(header&0x3f))
+	case header&0xe0 == 0xc0:
+		if len(b) < 2 {
+			return "", 0, ErrCorrupt
+		}
+		// 13 bit two's complement
+		value := int(header&0x1f)<<8 | int(b[1])
+		if value >= 1<<12 {
+			value -= 1 << 13
+		}
+		return strconv.Itoa(value), 2, nil
+	case header&0xf0 == 0xe0:
+		if len(b) < 2 {
+			return "", 0, ErrCorrupt
+		}
+		return str(2, int(header&0x0f)<<8|int(b[1]))
+	}
+	switch header {
+	case 0xf0:
+		if len(b) < 5 {
+			return "", 0, ErrCorrupt
+		}
+		return str(5, int(binary.LittleEndian.Uint32(b[1:])))
+	case 0xf1:
+		return integer(2)
+	case 0xf2:
+		return integer(3)
+	case 0xf3:
+		return integer(4)
+	case 0xf4:
+		return integer(8)
+	}
+	return "", 0, ErrCorrupt
+}
+
+func listpackBacklenSize(size int) int {
+	switch {
+	case size < 128:
+		return 1
+	case size < 16384:
+		return 2
+	case size < 2097152:
+		return 3
+	case size < 268435456:
+		return 4
+	}
+	return 5
+}
+
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// Stream listpacks start with a master entry holding the fields most
+// entries share, ids are stored relative to the master id in the key.
+func decodeStreamListpack(master StreamID, blob []byte) ([]StreamEntry, error) {
+	elements, err := decodeListpack(blob)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	next := func() (string, error) {
+		if pos >= len(elements) {
+			return "", ErrCorrupt
+		}
+		pos++
+		return elements[pos-1], nil
+	}
+	nextInt := func() (int64, error) {
+		element, err := next()
+		if err != nil {
+			return 0, err
+		}
+		value, err := strconv.ParseInt(element, 10, 64)
+		if err != nil {
+			return 0, ErrCorrupt
+		}
+		return value, nil
+	}
+
+	// Valid and deleted counts
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	masterFieldCount, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	masterFields := []string{}
+	for i := int64(0); i < masterFieldCount; i++ {
+		field, err := next()
+		if err != nil {
+			return nil, err
+		}
+		masterFields = append(masterFields, field)
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+
+	entries := []StreamEntry{}
+	for pos < len(elements) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		entry := StreamEntry{ID: StreamID{master.Ms + uint64(msDiff), master.Seq + uint64(seqDiff)}}
+		if flags&streamItemSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, field, value)
+			}
+		} else {
+			count, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			for i := int64(0); i < count*2; i++ {
+				element, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, element)
+			}
+		}
+		// Number of listpack elements of the entry, used to iterate backwards
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,223 @@
+// Encoding primitives of the Redis RDB format, shared by snapshots and the
+// serialized payloads of DUMP and FUNCTION DUMP.
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"strconv"
+)
+
+// RDB version written by this implementation, payloads from newer
+// versions are refused since their encodings may be unknown.
+const Version = 11
+
+const (
+	OpcodeFunction2 = 245
+)
+
+const (
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	encVal   = 3
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLzf   = 3
+)
+
+var ErrCorrupt = errors.New("rdb payload is corrupt")
+
+// Redis uses the Jones polynomial, without the initial and final inversion
+// that hash/crc64 applies.
+var crcTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+func UpdateChecksum(crc uint64, data []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, data)
+}
+
+func Checksum(data []byte) uint64 {
+	return UpdateChecksum(0, data)
+}
+
+func AppendLength(buf []byte, length uint64) []byte {
+	switch {
+	case length < 1<<6:
+		return append(buf, byte(len6Bit<<6|length))
+	case length < 1<<14:
+		return append(buf, byte(len14Bit<<6|length>>8), byte(length))
+	case length <= 0xffffffff:
+		buf = append(buf, len32Bit)
+		return binary.BigEndian.AppendUint32(buf, uint32(length))
+	}
+	buf = append(buf, len64Bit)
+	return binary.BigEndian.AppendUint64(buf, length)
+}
+
+// Strings that are small integers are stored in their compact encoding
+// just like Redis does.
+func AppendString(buf []byte, value string) []byte {
+	if len(value) <= 11 {
+		if n, err := strconv.ParseInt(value, 10, 32); err == nil && strconv.FormatInt(n, 10) == value {
+			switch {
+			case n >= -1<<7 && n < 1<<7:
+				return append(buf, encVal<<6|encInt8, byte(n))
+			case n >= -1<<15 && n < 1<<15:
+				buf = append(buf, encVal<<6|encInt16)
+				return binary.LittleEndian.AppendUint16(buf, uint16(n))
+			default:
+				buf = append(buf, encVal<<6|encInt32)
+				return binary.LittleEndian.AppendUint32(buf, uint32(n))
+			}
+		}
+	}
+	buf = AppendLength(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// Serialized payloads end with the RDB version and a checksum of everything
+// before it, both little endian.
+func AppendFooter(payload []byte) []byte {
+	payload = binary.LittleEndian.AppendUint16(payload, Version)
+	return binary.LittleEndian.AppendUint64(payload, Checksum(payload))
+}
+
+// Validate the footer of a serialized payload and return the payload without it.
+func VerifyFooter(payload []byte) ([]byte, error) {
+	if len(payload) < 10 {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > Version {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	crc := binary.LittleEndian.Uint64(footer[2:])
+	if crc != 0 && crc != Checksum(payload[:len(payload)-8]) {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	return payload[:len(payload)-10], nil
+}
+
+// Reader decodes RDB primitives from an in memory payload.
+type Reader struct {
+	data []byte
+	pos  int
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+func (r *Reader) Remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *Reader) ReadByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, ErrCorrupt
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *Reader) ReadBytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, ErrCorrupt
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// Returns the decoded length, or the encoding type if the value is a
+// specially encoded string.
+func (r *Reader) readLength() (length uint64, encoded bool, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case len6Bit:
+		return uint64(first & 0x3f), false, nil
+	case len14Bit:
+		second, err := r.ReadByte()
+		return uint64(first&0x3f)<<8 | uint64(second), false, err
+	case encVal:
+		return uint64(first & 0x3f), true, nil
+	}
+	switch first {
+	case len32Bit:
+		b, err := r.ReadBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	case len64Bit:
+		b, err := r.ReadBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(b), false, nil
+	}
+	return 0, false, ErrCorrupt
+}
+
+func (r *Reader) ReadLength() (uint64, error) {
+	length, encoded, err := r.readLength()
+	if err == nil && encoded {
+		return 0, ErrCorrupt
+	}
+	return length, err
+}
+
+func (r *Reader) ReadString() (string, error) {
+	length, encoded, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := r.ReadBytes(int(length))
+		return string(b), err
+	}
+	switch length {
+	case encInt8:
+		b, err := r.ReadBytes(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case encInt16:
+		b, err := r.ReadBytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case encInt32:
+		b, err := r.ReadBytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case encLzf:
+		compressed, err := r.ReadLength()
+		if err != nil {
+			return "", err
+		}
+		uncompressed, err := r.ReadLength()
+		if err != nil {
+			return "", err
+		}
+		b, err := r.ReadBytes(int(compressed))
+		if err != nil {
+			return "", err
+		}
+		b, err = lzfDecompress(b, int(uncompressed))
+		return string(b), err
+	}
+	return "", ErrCorrupt
+}
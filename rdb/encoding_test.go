@@ -0,0 +1,45 @@
+package rdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksum(t *testing.T) {
+	// Reference value from the Redis crc64 implementation
+	require.Equal(t, uint64(0xe9c6d914c4b8d9ca), Checksum([]byte("123456789")))
+}
+
+func TestLengthRoundTrip(t *testing.T) {
+	for _, length := range []uint64{0, 63, 64, 16383, 16384, 1 << 32, 1<<32 + 1} {
+		r := NewReader(AppendLength(nil, length))
+		decoded, err := r.ReadLength()
+		require.NoError(t, err)
+		require.Equal(t, length, decoded)
+		require.Equal(t, 0, r.Remaining())
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	for _, value := range []string{"", "hello", "0", "-128", "127", "300", "-40000", "2147483647", "2147483648", "007", string(make([]byte, 20000))} {
+		r := NewReader(AppendString(nil, value))
+		decoded, err := r.ReadString()
+		require.NoError(t, err)
+		require.Equal(t, value, decoded)
+	}
+	require.Len(t, AppendString(nil, "12"), 2)
+}
+
+func TestFooter(t *testing.T) {
+	payload := AppendFooter(AppendString(nil, "value"))
+	body, err := VerifyFooter(payload)
+	require.NoError(t, err)
+	require.Equal(t, AppendString(nil, "value"), body)
+
+	payload[0] ^= 0xff
+	_, err = VerifyFooter(payload)
+	require.Error(t, err)
+	_, err = VerifyFooter([]byte("short"))
+	require.Error(t, err)
+}
@@ -0,0 +1,214 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	OpcodeSlotInfo      = 244
+	OpcodeFunctionPreGA = 246
+	OpcodeModuleAux     = 247
+	OpcodeIdle          = 248
+	OpcodeFreq          = 249
+	OpcodeAux           = 250
+	OpcodeResizeDB      = 251
+	OpcodeExpireTimeMs  = 252
+	OpcodeExpireTime    = 253
+	OpcodeSelectDB      = 254
+	OpcodeEOF           = 255
+)
+
+// Writes a snapshot file, the checksum is computed along the way.
+type Writer struct {
+	writer *bufio.Writer
+	crc    uint64
+	buf    []byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{writer: bufio.NewWriter(w)}
+}
+
+func (w *Writer) write(data []byte) error {
+	w.crc = UpdateChecksum(w.crc, data)
+	_, err := w.writer.Write(data)
+	return err
+}
+
+func (w *Writer) WriteHeader() error {
+	return w.write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+}
+
+func (w *Writer) WriteAux(key string, value string) error {
+	w.buf = append(w.buf[:0], OpcodeAux)
+	w.buf = AppendString(w.buf, key)
+	return w.write(AppendString(w.buf, value))
+}
+
+func (w *Writer) WriteFunction(code string) error {
+	w.buf = append(w.buf[:0], OpcodeFunction2)
+	return w.write(AppendString(w.buf, code))
+}
+
+func (w *Writer) WriteSelectDB(db int, size int, expires int) error {
+	w.buf = append(w.buf[:0], OpcodeSelectDB)
+	w.buf = AppendLength(w.buf, uint64(db))
+	w.buf = append(w.buf, OpcodeResizeDB)
+	w.buf = AppendLength(w.buf, uint64(size))
+	return w.write(AppendLength(w.buf, uint64(expires)))
+}
+
+// Write a string value, expireAt is a unix time in milliseconds or 0.
+func (w *Writer) WriteString(key string, value string, expireAt int64) error {
+	w.buf = w.buf[:0]
+	if expireAt != 0 {
+		w.buf = append(w.buf, OpcodeExpireTimeMs)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(expireAt))
+	}
+	w.buf = append(w.buf, TypeString)
+	w.buf = AppendString(w.buf, key)
+	return w.write(AppendString(w.buf, value))
+}
+
+// Terminate the file with the end marker and the checksum.
+func (w *Writer) Close() error {
+	if err := w.write([]byte{OpcodeEOF}); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(binary.LittleEndian.AppendUint64(nil, w.crc)); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// Callbacks for the contents of a snapshot, nil callbacks are skipped.
+type Handlers struct {
+	Aux      func(key string, value string)
+	Function func(code string) error
+	// expireAt is a unix time in milliseconds or 0
+	Key func(db int, key string, value Object, expireAt int64) error
+}
+
+// Parse a complete snapshot file. The checksum is verified unless it was
+// disabled when the file was written.
+func Parse(data []byte, handlers Handlers) error {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > Version {
+		return fmt.Errorf("can't handle RDB format version %s", data[5:9])
+	}
+
+	r := NewReader(data)
+	r.pos = 9
+	db := 0
+	expireAt := int64(0)
+	for {
+		opcode, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case OpcodeEOF:
+			if version < 5 {
+				return nil
+			}
+			end := r.pos
+			checksum, err := r.ReadBytes(8)
+			if err != nil {
+				return err
+			}
+			expected := binary.LittleEndian.Uint64(checksum)
+			if expected != 0 && expected != Checksum(data[:end]) {
+				return errors.New("wrong RDB checksum")
+			}
+			return nil
+		case OpcodeSelectDB:
+			index, err := r.ReadLength()
+			if err != nil {
+				return err
+			}
+			db = int(index)
+		case OpcodeResizeDB:
+			if _, err := r.ReadLength(); err != nil {
+				return err
+			}
+			if _, err := r.ReadLength(); err != nil {
+				return err
+			}
+		case OpcodeSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.ReadLength(); err != nil {
+					return err
+				}
+			}
+		case OpcodeExpireTimeMs:
+			b, err := r.ReadBytes(8)
+			if err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(b))
+		case OpcodeExpireTime:
+			b, err := r.ReadBytes(4)
+			if err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(b)) * 1000
+		case OpcodeIdle:
+			if _, err := r.ReadLength(); err != nil {
+				return err
+			}
+		case OpcodeFreq:
+			if _, err := r.ReadByte(); err != nil {
+				return err
+			}
+		case OpcodeAux:
+			key, err := r.ReadString()
+			if err != nil {
+				return err
+			}
+			value, err := r.ReadString()
+			if err != nil {
+				return err
+			}
+			if handlers.Aux != nil {
+				handlers.Aux(key, value)
+			}
+		case OpcodeFunction2:
+			code, err := r.ReadString()
+			if err != nil {
+				return err
+			}
+			if handlers.Function != nil {
+				if err := handlers.Function(code); err != nil {
+					return err
+				}
+			}
+		case OpcodeFunctionPreGA:
+			return errors.New("pre-release function format not supported")
+		case OpcodeModuleAux:
+			return errors.New("module data is not supported")
+		default:
+			key, err := r.ReadString()
+			if err != nil {
+				return err
+			}
+			value, err := r.ReadObject(opcode)
+			if err != nil {
+				return fmt.Errorf("error loading key '%s': %w", key, err)
+			}
+			if handlers.Key != nil {
+				if err := handlers.Key(db, key, value, expireAt); err != nil {
+					return err
+				}
+			}
+			expireAt = 0
+		}
+	}
+}
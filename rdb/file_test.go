@@ -0,0 +1,80 @@
+package rdb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type parsedKey struct {
+	db       int
+	key      string
+	value    string
+	expireAt int64
+}
+
+func parse(data []byte) (map[string]string, []string, []parsedKey, error) {
+	aux := map[string]string{}
+	functions := []string{}
+	keys := []parsedKey{}
+	err := Parse(data, Handlers{
+		Aux: func(key string, value string) { aux[key] = value },
+		Function: func(code string) error {
+			functions = append(functions, code)
+			return nil
+		},
+		Key: func(db int, key string, value Object, expireAt int64) error {
+			keys = append(keys, parsedKey{db, key, value.String, expireAt})
+			return nil
+		},
+	})
+	return aux, functions, keys, err
+}
+
+func TestWriteParse(t *testing.T) {
+	expireAt := time.Now().UnixMilli() + 1000
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer)
+	require.NoError(t, w.WriteHeader())
+	require.NoError(t, w.WriteAux("redis-ver", "7.2.0"))
+	require.NoError(t, w.WriteFunction("#!lua name=lib"))
+	require.NoError(t, w.WriteSelectDB(0, 1, 0))
+	require.NoError(t, w.WriteString("a", "1", 0))
+	require.NoError(t, w.WriteSelectDB(3, 1, 1))
+	require.NoError(t, w.WriteString("b", "hello", expireAt))
+	require.NoError(t, w.Close())
+
+	data := buffer.Bytes()
+	require.Equal(t, "REDIS0011", string(data[:9]))
+	aux, functions, keys, err := parse(data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"redis-ver": "7.2.0"}, aux)
+	require.Equal(t, []string{"#!lua name=lib"}, functions)
+	require.Equal(t, []parsedKey{{0, "a", "1", 0}, {3, "b", "hello", expireAt}}, keys)
+
+	data[20] ^= 0xff
+	_, _, _, err = parse(data)
+	require.Error(t, err)
+}
+
+func TestParseChecksumDisabled(t *testing.T) {
+	data := []byte("REDIS0009")
+	data = append(data, TypeString)
+	data = AppendString(data, "key")
+	data = AppendString(data, "value")
+	data = append(data, OpcodeEOF, 0, 0, 0, 0, 0, 0, 0, 0)
+	_, _, keys, err := parse(data)
+	require.NoError(t, err)
+	require.Equal(t, []parsedKey{{0, "key", "value", 0}}, keys)
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, _, _, err := parse([]byte("NOTREDIS0011"))
+	require.ErrorContains(t, err, "wrong signature")
+	_, _, _, err = parse([]byte("REDIS0099\xff"))
+	require.ErrorContains(t, err, "can't handle RDB format version")
+	_, _, _, err = parse([]byte("REDIS0011\x00\x03key"))
+	require.Error(t, err)
+}
@@ -0,0 +1,47 @@
+package rdb
+
+// Decompress LZF data as written by Redis for long strings, expected is
+// the uncompressed length stored next to the data.
+func lzfDecompress(in []byte, expected int) ([]byte, error) {
+	out := make([]byte, 0, min(expected, 1<<20))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes
+			run := ctrl + 1
+			if i+run > len(in) {
+				return nil, ErrCorrupt
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+		// Back reference, the length is in the top 3 bits with 7 meaning
+		// an extra length byte follows
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, ErrCorrupt
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrCorrupt
+		}
+		ref := len(out) - ((ctrl&0x1f)<<8 | int(in[i])) - 1
+		i++
+		if ref < 0 {
+			return nil, ErrCorrupt
+		}
+		// The reference may overlap the bytes being written
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != expected {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
@@ -0,0 +1,449 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Value types as stored in front of every key.
+const (
+	TypeString           = 0
+	TypeList             = 1
+	TypeSet              = 2
+	TypeZSet             = 3
+	TypeHash             = 4
+	TypeZSet2            = 5
+	TypeModule           = 6
+	TypeModule2          = 7
+	TypeHashZipmap       = 9
+	TypeListZiplist      = 10
+	TypeSetIntset        = 11
+	TypeZSetZiplist      = 12
+	TypeHashZiplist      = 13
+	TypeListQuicklist    = 14
+	TypeStreamListpacks  = 15
+	TypeHashListpack     = 16
+	TypeZSetListpack     = 17
+	TypeListQuicklist2   = 18
+	TypeStreamListpacks2 = 19
+	TypeSetListpack      = 20
+	TypeStreamListpacks3 = 21
+)
+
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindList
+	KindSet
+	KindZSet
+	KindHash
+	KindStream
+)
+
+var kindNames = map[Kind]string{
+	KindString: "string", KindList: "list", KindSet: "set", KindZSet: "zset", KindHash: "hash", KindStream: "stream",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+type ZSetEntry struct {
+	Member string
+	Score  float64
+}
+
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string // field value pairs
+}
+
+type StreamConsumer struct {
+	Name     string
+	SeenTime int64
+	Pending  []StreamID
+}
+
+type StreamGroup struct {
+	Name        string
+	LastID      StreamID
+	EntriesRead int64
+	Pending     []StreamID
+	Consumers   []StreamConsumer
+}
+
+type Stream struct {
+	Entries      []StreamEntry
+	Length       uint64
+	LastID       StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}
+
+// A decoded value, only the field matching Kind is set. Lists and sets use
+// Elements, hashes keep their field value pairs in Elements too.
+type Object struct {
+	Kind     Kind
+	String   string
+	Elements []string
+	ZSet     []ZSetEntry
+	Stream   *Stream
+}
+
+// Decode a value of the given type, covering every encoding Redis has used
+// since RDB version 1 except modules.
+func (r *Reader) ReadObject(valueType byte) (Object, error) {
+	switch valueType {
+	case TypeString:
+		value, err := r.ReadString()
+		return Object{Kind: KindString, String: value}, err
+	case TypeList, TypeSet, TypeHash:
+		count, err := r.ReadLength()
+		if err != nil {
+			return Object{}, err
+		}
+		if valueType == TypeHash {
+			count *= 2
+		}
+		elements, err := r.readStrings(count)
+		kind := map[byte]Kind{TypeList: KindList, TypeSet: KindSet, TypeHash: KindHash}[valueType]
+		return Object{Kind: kind, Elements: elements}, err
+	case TypeZSet, TypeZSet2:
+		return r.readZSet(valueType == TypeZSet2)
+	case TypeHashZipmap:
+		return r.readEncoded(KindHash, decodeZipmap)
+	case TypeListZiplist:
+		return r.readEncoded(KindList, decodeZiplist)
+	case TypeSetIntset:
+		return r.readEncoded(KindSet, decodeIntset)
+	case TypeHashZiplist:
+		return r.readEncoded(KindHash, decodeZiplist)
+	case TypeHashListpack:
+		return r.readEncoded(KindHash, decodeListpack)
+	case TypeSetListpack:
+		return r.readEncoded(KindSet, decodeListpack)
+	case TypeZSetZiplist, TypeZSetListpack:
+		decode := decodeZiplist
+		if valueType == TypeZSetListpack {
+			decode = decodeListpack
+		}
+		object, err := r.readEncoded(KindZSet, decode)
+		if err != nil {
+			return object, err
+		}
+		return zsetFromPairs(object.Elements)
+	case TypeListQuicklist, TypeListQuicklist2:
+		return r.readQuicklist(valueType == TypeListQuicklist2)
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return r.readStream(valueType)
+	case TypeModule, TypeModule2:
+		return Object{}, fmt.Errorf("module values are not supported")
+	}
+	return Object{}, fmt.Errorf("unknown value type %d", valueType)
+}
+
+func (r *Reader) readStrings(count uint64) ([]string, error) {
+	if count > uint64(r.Remaining()) {
+		return nil, ErrCorrupt
+	}
+	elements := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		element, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// Scores of the first zset type are strings with the length in one byte,
+// where 253 to 255 stand for nan, +inf and -inf.
+func (r *Reader) readDouble(binaryDouble bool) (float64, error) {
+	if binaryDouble {
+		b, err := r.ReadBytes(8)
+		if err != nil {
+			return 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	}
+	length, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.ReadBytes(int(length))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, ErrCorrupt
+	}
+	return value, nil
+}
+
+func (r *Reader) readZSet(binaryDouble bool) (Object, error) {
+	count, err := r.ReadLength()
+	if err != nil {
+		return Object{}, err
+	}
+	if count > uint64(r.Remaining()) {
+		return Object{}, ErrCorrupt
+	}
+	entries := make([]ZSetEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		member, err := r.ReadString()
+		if err != nil {
+			return Object{}, err
+		}
+		score, err := r.readDouble(binaryDouble)
+		if err != nil {
+			return Object{}, err
+		}
+		entries = append(entries, ZSetEntry{member, score})
+	}
+	return Object{Kind: KindZSet, ZSet: entries}, nil
+}
+
+func zsetFromPairs(pairs []string) (Object, error) {
+	if len(pairs)%2 != 0 {
+		return Object{}, ErrCorrupt
+	}
+	entries := make([]ZSetEntry, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(pairs[i+1], 64)
+		if err != nil {
+			return Object{}, ErrCorrupt
+		}
+		entries = append(entries, ZSetEntry{pairs[i], score})
+	}
+	return Object{Kind: KindZSet, ZSet: entries}, nil
+}
+
+// Compact encodings are stored as a single string blob.
+func (r *Reader) readEncoded(kind Kind, decode func([]byte) ([]string, error)) (Object, error) {
+	blob, err := r.ReadString()
+	if err != nil {
+		return Object{}, err
+	}
+	elements, err := decode([]byte(blob))
+	return Object{Kind: kind, Elements: elements}, err
+}
+
+// Quicklists are linked ziplists, version 2 uses listpacks and can store
+// large elements as plain nodes.
+func (r *Reader) readQuicklist(version2 bool) (Object, error) {
+	nodes, err := r.ReadLength()
+	if err != nil {
+		return Object{}, err
+	}
+	elements := []string{}
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(quicklistPacked)
+		if version2 {
+			if container, err = r.ReadLength(); err != nil {
+				return Object{}, err
+			}
+		}
+		blob, err := r.ReadString()
+		if err != nil {
+			return Object{}, err
+		}
+		if container == quicklistPlain {
+			elements = append(elements, blob)
+			continue
+		}
+		decode := decodeZiplist
+		if version2 {
+			decode = decodeListpack
+		}
+		node, err := decode([]byte(blob))
+		if err != nil {
+			return Object{}, err
+		}
+		elements = append(elements, node...)
+	}
+	return Object{Kind: KindList, Elements: elements}, nil
+}
+
+const (
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
+
+func (r *Reader) readStreamID() (StreamID, error) {
+	ms, err := r.ReadLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := r.ReadLength()
+	return StreamID{ms, seq}, err
+}
+
+// Raw ids in keys and pending entries are 128 bit big endian.
+func (r *Reader) readRawStreamID() (StreamID, error) {
+	b, err := r.ReadBytes(16)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return rawStreamID(b), nil
+}
+
+func rawStreamID(b []byte) StreamID {
+	return StreamID{binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])}
+}
+
+func (r *Reader) readMillis() (int64, error) {
+	b, err := r.ReadBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+func (r *Reader) readStream(valueType byte) (Object, error) {
+	stream := &Stream{}
+	nodes, err := r.ReadLength()
+	if err != nil {
+		return Object{}, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := r.ReadString()
+		if err != nil {
+			return Object{}, err
+		}
+		if len(key) != 16 {
+			return Object{}, ErrCorrupt
+		}
+		blob, err := r.ReadString()
+		if err != nil {
+			return Object{}, err
+		}
+		entries, err := decodeStreamListpack(rawStreamID([]byte(key)), []byte(blob))
+		if err != nil {
+			return Object{}, err
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+
+	if stream.Length, err = r.ReadLength(); err != nil {
+		return Object{}, err
+	}
+	if stream.LastID, err = r.readStreamID(); err != nil {
+		return Object{}, err
+	}
+	if valueType >= TypeStreamListpacks2 {
+		// First id and max deleted entry id are derived data
+		for i := 0; i < 2; i++ {
+			if _, err := r.readStreamID(); err != nil {
+				return Object{}, err
+			}
+		}
+		if stream.EntriesAdded, err = r.ReadLength(); err != nil {
+			return Object{}, err
+		}
+	}
+
+	groups, err := r.ReadLength()
+	if err != nil {
+		return Object{}, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		group, err := r.readStreamGroup(valueType)
+		if err != nil {
+			return Object{}, err
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+	return Object{Kind: KindStream, Stream: stream}, nil
+}
+
+func (r *Reader) readStreamGroup(valueType byte) (StreamGroup, error) {
+	group := StreamGroup{EntriesRead: -1}
+	var err error
+	if group.Name, err = r.ReadString(); err != nil {
+		return group, err
+	}
+	if group.LastID, err = r.readStreamID(); err != nil {
+		return group, err
+	}
+	if valueType >= TypeStreamListpacks2 {
+		read, err := r.ReadLength()
+		if err != nil {
+			return group, err
+		}
+		group.EntriesRead = int64(read)
+	}
+
+	pending, err := r.ReadLength()
+	if err != nil {
+		return group, err
+	}
+	for i := uint64(0); i < pending; i++ {
+		id, err := r.readRawStreamID()
+		if err != nil {
+			return group, err
+		}
+		// Delivery time and count
+		if _, err := r.readMillis(); err != nil {
+			return group, err
+		}
+		if _, err := r.ReadLength(); err != nil {
+			return group, err
+		}
+		group.Pending = append(group.Pending, id)
+	}
+
+	consumers, err := r.ReadLength()
+	if err != nil {
+		return group, err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		consumer := StreamConsumer{}
+		if consumer.Name, err = r.ReadString(); err != nil {
+			return group, err
+		}
+		if consumer.SeenTime, err = r.readMillis(); err != nil {
+			return group, err
+		}
+		if valueType >= TypeStreamListpacks3 {
+			// Active time
+			if _, err := r.readMillis(); err != nil {
+				return group, err
+			}
+		}
+		pending, err := r.ReadLength()
+		if err != nil {
+			return group, err
+		}
+		for j := uint64(0); j < pending; j++ {
+			id, err := r.readRawStreamID()
+			if err != nil {
+				return group, err
+			}
+			consumer.Pending = append(consumer.Pending, id)
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+	return group, nil
+}
@@ -0,0 +1,185 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Listpack with small integers and short strings only.
+func listpack(elements ...string) []byte {
+	entries := []byte{}
+	for _, element := range elements {
+		if n, err := strconv.Atoi(element); err == nil && n >= 0 && n < 128 {
+			entries = append(entries, byte(n), 1)
+		} else {
+			entries = append(entries, 0x80|byte(len(element)))
+			entries = append(entries, element...)
+			entries = append(entries, byte(1+len(element)))
+		}
+	}
+	blob := binary.LittleEndian.AppendUint32(nil, uint32(6+len(entries)+1))
+	blob = binary.LittleEndian.AppendUint16(blob, uint16(len(elements)))
+	blob = append(blob, entries...)
+	return append(blob, 0xff)
+}
+
+// Ziplist from raw entry encodings, the previous entry lengths are not
+// needed for decoding and left at zero.
+func ziplist(entries ...[]byte) []byte {
+	blob := make([]byte, 10)
+	for _, entry := range entries {
+		blob = append(blob, 0)
+		blob = append(blob, entry...)
+	}
+	return append(blob, 0xff)
+}
+
+func readObject(t *testing.T, valueType byte, payload []byte) Object {
+	r := NewReader(payload)
+	object, err := r.ReadObject(valueType)
+	require.NoError(t, err)
+	require.Equal(t, 0, r.Remaining())
+	return object
+}
+
+func TestLzfString(t *testing.T) {
+	payload := []byte{encVal<<6 | encLzf, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00}
+	value, err := NewReader(payload).ReadString()
+	require.NoError(t, err)
+	require.Equal(t, "aaaaaaaaaa", value)
+
+	payload[2] = 11
+	_, err = NewReader(payload).ReadString()
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestPlainEncodings(t *testing.T) {
+	payload := AppendLength(nil, 2)
+	payload = AppendString(payload, "a")
+	payload = AppendString(payload, "12")
+	require.Equal(t, Object{Kind: KindList, Elements: []string{"a", "12"}}, readObject(t, TypeList, payload))
+
+	payload = AppendLength(nil, 1)
+	payload = AppendString(payload, "field")
+	payload = AppendString(payload, "value")
+	require.Equal(t, Object{Kind: KindHash, Elements: []string{"field", "value"}}, readObject(t, TypeHash, payload))
+
+	payload = AppendLength(nil, 2)
+	payload = AppendString(payload, "one")
+	payload = append(payload, 3, '1', '.', '5')
+	payload = AppendString(payload, "inf")
+	payload = append(payload, 254)
+	object := readObject(t, TypeZSet, payload)
+	require.Equal(t, []ZSetEntry{{"one", 1.5}, {"inf", math.Inf(1)}}, object.ZSet)
+
+	payload = AppendLength(nil, 1)
+	payload = AppendString(payload, "two")
+	payload = binary.LittleEndian.AppendUint64(payload, math.Float64bits(2))
+	require.Equal(t, []ZSetEntry{{"two", 2}}, readObject(t, TypeZSet2, payload).ZSet)
+}
+
+func TestIntset(t *testing.T) {
+	blob := binary.LittleEndian.AppendUint32(nil, 2)
+	blob = binary.LittleEndian.AppendUint32(blob, 2)
+	blob = binary.LittleEndian.AppendUint16(blob, uint16(0xffff))
+	blob = binary.LittleEndian.AppendUint16(blob, 300)
+	object := readObject(t, TypeSetIntset, AppendString(nil, string(blob)))
+	require.Equal(t, Object{Kind: KindSet, Elements: []string{"-1", "300"}}, object)
+}
+
+func TestZiplist(t *testing.T) {
+	blob := ziplist(
+		[]byte{0x03, 'f', 'o', 'o'},       // 6 bit string
+		[]byte{0xf1},                      // immediate 0
+		[]byte{0xfe, 0x80},                // int8 -128
+		[]byte{0xc0, 0x10, 0x27},          // int16 10000
+		[]byte{0xf0, 0xff, 0xff, 0xff},    // int24 -1
+		[]byte{0xd0, 0x00, 0x00, 0x00, 1}, // int32 1<<24
+	)
+	object := readObject(t, TypeListZiplist, AppendString(nil, string(blob)))
+	require.Equal(t, []string{"foo", "0", "-128", "10000", "-1", "16777216"}, object.Elements)
+
+	blob = ziplist([]byte{0x01, 'a'}, []byte{0xf3}, []byte{0x01, 'b'}, []byte{0x03, '2', '.', '5'})
+	object = readObject(t, TypeZSetZiplist, AppendString(nil, string(blob)))
+	require.Equal(t, []ZSetEntry{{"a", 2}, {"b", 2.5}}, object.ZSet)
+}
+
+func TestListpack(t *testing.T) {
+	blob := listpack("field", "value", "count", "7")
+	object := readObject(t, TypeHashListpack, AppendString(nil, string(blob)))
+	require.Equal(t, Object{Kind: KindHash, Elements: []string{"field", "value", "count", "7"}}, object)
+
+	// 13 bit and 16 bit integers
+	blob = []byte{0, 0, 0, 0, 2, 0, 0xdf, 0xff, 2, 0xf1, 0x10, 0x27, 3, 0xff}
+	require.Equal(t, []string{"-1", "10000"}, readObject(t, TypeSetListpack, AppendString(nil, string(blob))).Elements)
+}
+
+func TestQuicklist(t *testing.T) {
+	payload := AppendLength(nil, 2)
+	payload = AppendLength(payload, quicklistPacked)
+	payload = AppendString(payload, string(listpack("a", "b")))
+	payload = AppendLength(payload, quicklistPlain)
+	payload = AppendString(payload, "large")
+	object := readObject(t, TypeListQuicklist2, payload)
+	require.Equal(t, Object{Kind: KindList, Elements: []string{"a", "b", "large"}}, object)
+
+	payload = AppendLength(nil, 1)
+	payload = AppendString(payload, string(ziplist([]byte{0x01, 'z'})))
+	require.Equal(t, []string{"z"}, readObject(t, TypeListQuicklist, payload).Elements)
+}
+
+func TestZipmap(t *testing.T) {
+	blob := []byte{1, 1, 'k', 2, 1, 'v', '1', 0, 255}
+	object := readObject(t, TypeHashZipmap, AppendString(nil, string(blob)))
+	require.Equal(t, Object{Kind: KindHash, Elements: []string{"k", "v1"}}, object)
+}
+
+func TestStream(t *testing.T) {
+	master := binary.BigEndian.AppendUint64(nil, 1000)
+	master = binary.BigEndian.AppendUint64(master, 0)
+	blob := listpack(
+		"1", "1", "1", "name", "0", // counts, master fields and terminator
+		"2", "0", "0", "first", "4", // same fields as the master entry
+		"0", "5", "1", "1", "other", "x", "6",
+		"3", "6", "0", "gone", "4", // deleted
+	)
+
+	payload := AppendLength(nil, 1)
+	payload = AppendString(payload, string(master))
+	payload = AppendString(payload, string(blob))
+	payload = AppendLength(payload, 2)
+	payload = AppendLength(payload, 1005)
+	payload = AppendLength(payload, 1)
+	payload = AppendLength(payload, 1) // groups
+	payload = AppendString(payload, "group")
+	payload = AppendLength(payload, 1000)
+	payload = AppendLength(payload, 0)
+	payload = AppendLength(payload, 1) // pending
+	payload = append(payload, master...)
+	payload = binary.LittleEndian.AppendUint64(payload, 123)
+	payload = AppendLength(payload, 1)
+	payload = AppendLength(payload, 1) // consumers
+	payload = AppendString(payload, "consumer")
+	payload = binary.LittleEndian.AppendUint64(payload, 456)
+	payload = AppendLength(payload, 1)
+	payload = append(payload, master...)
+
+	object := readObject(t, TypeStreamListpacks, payload)
+	require.Equal(t, KindStream, object.Kind)
+	stream := object.Stream
+	require.Equal(t, []StreamEntry{
+		{ID: StreamID{1000, 0}, Fields: []string{"name", "first"}},
+		{ID: StreamID{1005, 1}, Fields: []string{"other", "x"}},
+	}, stream.Entries)
+	require.Equal(t, "1005-1", stream.LastID.String())
+	require.Equal(t, uint64(2), stream.Length)
+	require.Len(t, stream.Groups, 1)
+	require.Equal(t, "group", stream.Groups[0].Name)
+	require.Equal(t, []StreamID{{1000, 0}}, stream.Groups[0].Pending)
+	require.Equal(t, "consumer", stream.Groups[0].Consumers[0].Name)
+	require.Equal(t, int64(456), stream.Groups[0].Consumers[0].SeenTime)
+}
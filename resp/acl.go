@@ -0,0 +1,806 @@
+// Access control lists. Every client runs as a user, the default user until
+// it authenticates as another one. Users may be limited to some commands,
+// keys and pub/sub channels, the rules are those of Redis:
+//
+//	on, off               enable or disable the user
+//	>pass, <pass          add or remove a password
+//	#hash, !hash          add or remove the SHA-256 of a password
+//	nopass, resetpass     allow any password or forget all of them
+//	~pattern, allkeys     keys that can be read and written
+//	%R~pattern            keys that can be read, %W~ written and %RW~ both
+//	resetkeys             forget all key patterns
+//	&pattern, allchannels pub/sub channels that can be used
+//	resetchannels         forget all channel patterns
+//	+command, -command    allow or deny a command, command|subcommand only
+//	                      matches its first argument
+//	+@category, -@category
+//	allcommands, nocommands
+//	reset                 back to a new user without any permissions
+package resp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/utils"
+)
+
+type keyPattern struct {
+	pattern     string
+	read, write bool
+}
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // SHA-256 in hex
+	// Replayed for every command, the last matching rule decides. This
+	// also covers commands registered after the rules were applied.
+	commandRules []string
+	keys         []keyPattern
+	channels     []string
+}
+
+// Set up in init, the rules refer to the commands
+var aclUsers = map[string]*aclUser{}
+
+var aclFile = ""
+
+// Why a command was refused, for the error and ACL LOG.
+type aclDenial struct {
+	reason string // command, key or channel
+	object string
+}
+
+type aclLogEntry struct {
+	id                   int64
+	count                int
+	reason, context      string
+	object, username     string
+	clientInfo           string
+	created, lastUpdated time.Time
+}
+
+var aclLog []*aclLogEntry
+var aclLogNextId int64 = 0
+var aclLogMaxLen = 128
+
+// Denials of the same kind within this time are counted in one entry.
+const aclLogGroupingTime = time.Minute
+
+var aclCategoryNames = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "bitmap", "hyperloglog",
+	"geo", "stream", "pubsub", "admin", "fast", "slow", "blocking", "dangerous", "connection",
+	"transaction", "scripting",
+}
+
+// Members of the categories that do not follow from the command flags,
+// read and write come from CMD_READONLY and CMD_WRITE and every command
+// that is not fast is slow.
+var aclCategories = map[string][]RespCommand{
+	"keyspace": {
+		RESP_DEL, RESP_MOVE, RESP_SWAPDB, RESP_FLUSHDB, RESP_FLUSHALL, RESP_EXPIRE, RESP_PEXPIRE, RESP_EXPIREAT,
+		RESP_PEXPIREAT, RESP_TTL, RESP_PTTL, RESP_PERSIST, RESP_DUMP, RESP_RESTORE, RESP_RESTORE_ASKING, RESP_MIGRATE,
+	},
+	"string": {RESP_GET, RESP_SET, RESP_INCR},
+	"pubsub": {
+		RESP_SUBSCRIBE, RESP_UNSUBSCRIBE, RESP_PSUBSCRIBE, RESP_PUNSUBSCRIBE, RESP_PUBLISH, RESP_PUBSUB,
+		RESP_SSUBSCRIBE, RESP_SUNSUBSCRIBE, RESP_SPUBLISH,
+	},
+	"admin": {
+		RESP_CONFIG, RESP_BGREWRITEAOF, RESP_SAVE, RESP_BGSAVE, RESP_LASTSAVE, RESP_PSYNC, RESP_REPLCONF,
+		RESP_ROLE, RESP_REPLICAOF, RESP_SLAVEOF, RESP_ACL, RESP_SENTINEL,
+	},
+	"fast": {
+		RESP_GET, RESP_INCR, RESP_SELECT, RESP_MOVE, RESP_SWAPDB, RESP_MULTI, RESP_DISCARD, RESP_WATCH,
+		RESP_UNWATCH, RESP_EXPIRE, RESP_PEXPIRE, RESP_EXPIREAT, RESP_PEXPIREAT, RESP_TTL, RESP_PTTL,
+		RESP_PERSIST, RESP_PING, RESP_HELLO, RESP_AUTH, RESP_PUBLISH, RESP_SPUBLISH, RESP_LASTSAVE,
+		RESP_ROLE, RESP_ASKING,
+	},
+	"dangerous": {
+		RESP_SWAPDB, RESP_FLUSHDB, RESP_FLUSHALL, RESP_CONFIG, RESP_BGREWRITEAOF, RESP_SAVE, RESP_BGSAVE,
+		RESP_LASTSAVE, RESP_PSYNC, RESP_REPLCONF, RESP_ROLE, RESP_REPLICAOF, RESP_SLAVEOF, RESP_RESTORE,
+		RESP_RESTORE_ASKING, RESP_MIGRATE, RESP_CLIENT, RESP_CLUSTER, RESP_ACL, RESP_SENTINEL,
+	},
+	"connection":  {RESP_SELECT, RESP_PING, RESP_HELLO, RESP_AUTH, RESP_CLIENT, RESP_ASKING, RESP_WAIT, RESP_WAITAOF},
+	"transaction": {RESP_MULTI, RESP_EXEC, RESP_DISCARD, RESP_WATCH, RESP_UNWATCH},
+	"scripting":   {RESP_EVAL, RESP_EVALSHA, RESP_SCRIPT, RESP_FCALL, RESP_FCALL_RO, RESP_FUNCTION},
+}
+
+// Writes that depend on the current value also need read access to the key.
+var readingWrites = map[RespCommand]bool{
+	RESP_INCR: true, RESP_MOVE: true, RESP_EXPIRE: true, RESP_PEXPIRE: true, RESP_EXPIREAT: true,
+	RESP_PEXPIREAT: true, RESP_PERSIST: true,
+}
+
+func init() {
+	aclUsers[defaultUser] = newDefaultUser()
+	configParameters["aclfile"] = configParameter{
+		get: func() string { return aclFile },
+		set: immutable(func(value string) error {
+			aclFile = value
+			return nil
+		}),
+	}
+	configParameters["acllog-max-len"] = configParameter{
+		get: func() string { return fmt.Sprint(aclLogMaxLen) },
+		set: func(value string) error {
+			length, err := parseNonNegative(value)
+			if err == nil {
+				aclLogMaxLen = int(length)
+				trimAclLog()
+			}
+			return err
+		},
+	}
+}
+
+func newAclUser(name string) *aclUser {
+	return &aclUser{name: name, commandRules: []string{"-@all"}}
+}
+
+// The default user can do anything until it is given a password or rules.
+func newDefaultUser() *aclUser {
+	user := newAclUser(defaultUser)
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "allcommands"} {
+		user.applyRule(rule)
+	}
+	return user
+}
+
+func (user *aclUser) clone() *aclUser {
+	clone := *user
+	clone.passwords = slices.Clone(user.passwords)
+	clone.commandRules = slices.Clone(user.commandRules)
+	clone.keys = slices.Clone(user.keys)
+	clone.channels = slices.Clone(user.channels)
+	return &clone
+}
+
+// The user of a client, nil meaning the default user.
+func (c *Client) aclUser() *aclUser {
+	if c.user == nil {
+		return aclUsers[defaultUser]
+	}
+	return c.user
+}
+
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+// All hashes are compared so that the time taken does not tell which one
+// matched.
+func (user *aclUser) checkPassword(password string) bool {
+	given, _ := hex.DecodeString(hashPassword(password))
+	matches := false
+	for _, hash := range user.passwords {
+		expected, _ := hex.DecodeString(hash)
+		if subtle.ConstantTimeCompare(given, expected) == 1 {
+			matches = true
+		}
+	}
+	return user.nopass || matches
+}
+
+func isPasswordHash(hash string) bool {
+	_, err := hex.DecodeString(hash)
+	return err == nil && len(hash) == sha256.Size*2
+}
+
+func errAclSyntax() error {
+	return errors.New("Syntax error")
+}
+
+func (user *aclUser) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		user.enabled = true
+	case lower == "off":
+		user.enabled = false
+	case lower == "nopass":
+		user.nopass, user.passwords = true, nil
+	case lower == "resetpass":
+		user.nopass, user.passwords = false, nil
+	case strings.HasPrefix(rule, ">"):
+		user.addPassword(hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if !isPasswordHash(rule[1:]) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		user.addPassword(strings.ToLower(rule[1:]))
+	case strings.HasPrefix(rule, "<"), strings.HasPrefix(rule, "!"):
+		hash := hashPassword(rule[1:])
+		if rule[0] == '!' {
+			hash = strings.ToLower(rule[1:])
+		}
+		index := slices.Index(user.passwords, hash)
+		if index < 0 {
+			return errors.New("The password you are trying to remove from the user does not exist")
+		}
+		user.passwords = slices.Delete(user.passwords, index, index+1)
+	case lower == "allkeys":
+		user.keys = []keyPattern{{"*", true, true}}
+	case lower == "resetkeys":
+		user.keys = nil
+	case strings.HasPrefix(rule, "~"), strings.HasPrefix(rule, "%"):
+		pattern, err := parseKeyPattern(rule)
+		if err != nil {
+			return err
+		}
+		user.keys = append(user.keys, pattern)
+	case lower == "allchannels":
+		user.channels = []string{"*"}
+	case lower == "resetchannels":
+		user.channels = nil
+	case strings.HasPrefix(rule, "&"):
+		user.channels = append(user.channels, rule[1:])
+	case lower == "allcommands":
+		return user.applyRule("+@all")
+	case lower == "nocommands":
+		return user.applyRule("-@all")
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		return user.applyCommandRule(rule)
+	case lower == "reset":
+		*user = *newAclUser(user.name)
+	default:
+		return errAclSyntax()
+	}
+	return nil
+}
+
+func (user *aclUser) addPassword(hash string) {
+	user.nopass = false
+	if !slices.Contains(user.passwords, hash) {
+		user.passwords = append(user.passwords, hash)
+	}
+}
+
+// ~pattern, %R~pattern, %W~pattern or %RW~pattern
+func parseKeyPattern(rule string) (keyPattern, error) {
+	if rule[0] == '~' {
+		return keyPattern{rule[1:], true, true}, nil
+	}
+	selectors, pattern, ok := strings.Cut(rule[1:], "~")
+	if !ok || selectors == "" {
+		return keyPattern{}, errAclSyntax()
+	}
+	key := keyPattern{pattern: pattern}
+	for _, selector := range strings.ToUpper(selectors) {
+		switch selector {
+		case 'R':
+			key.read = true
+		case 'W':
+			key.write = true
+		default:
+			return keyPattern{}, errAclSyntax()
+		}
+	}
+	return key, nil
+}
+
+func (user *aclUser) applyCommandRule(rule string) error {
+	name := strings.ToUpper(rule[1:])
+	command, subcommand, hasSubcommand := strings.Cut(name, "|")
+	if category, isCategory := strings.CutPrefix(name, "@"); isCategory {
+		if !isAclCategory(strings.ToLower(category)) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		// Nothing before it matters any more
+		if category == "ALL" {
+			user.commandRules = nil
+		}
+	} else if _, exists := processors[RespCommand(command)]; !exists || hasSubcommand && subcommand == "" {
+		return errors.New("Unknown command or category name in ACL")
+	}
+	user.commandRules = append(user.commandRules, strings.ToLower(rule))
+	return nil
+}
+
+func isAclCategory(category string) bool {
+	return category == "all" || slices.Contains(aclCategoryNames, category)
+}
+
+func inAclCategory(command RespCommand, category string) bool {
+	switch category {
+	case "all":
+		return true
+	case "read":
+		return processors[command].flags&CMD_READONLY != 0
+	case "write":
+		return processors[command].flags&CMD_WRITE != 0
+	case "slow":
+		return !slices.Contains(aclCategories["fast"], command)
+	}
+	return slices.Contains(aclCategories[category], command)
+}
+
+// The commands of a category, false for unknown categories.
+func commandsInCategory(category string) ([]RespCommand, bool) {
+	if !isAclCategory(category) {
+		return nil, false
+	}
+	commands := []RespCommand{}
+	for command := range processors {
+		if inAclCategory(command, category) {
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i] < commands[j] })
+	return commands, true
+}
+
+// The rules that recreate the user, as in ACL LIST and the ACL file.
+func (user *aclUser) describe() string {
+	rules := []string{"user", user.name, "off"}
+	if user.enabled {
+		rules[2] = "on"
+	}
+	if user.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range user.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	rules = append(rules, user.describeKeys())
+	rules = append(rules, user.describeChannels())
+	rules = append(rules, user.commandRules...)
+	return strings.Join(slices.DeleteFunc(rules, func(rule string) bool { return rule == "" }), " ")
+}
+
+func (user *aclUser) describeKeys() string {
+	keys := []string{}
+	for _, key := range user.keys {
+		switch {
+		case key.read && key.write:
+			keys = append(keys, "~"+key.pattern)
+		case key.read:
+			keys = append(keys, "%R~"+key.pattern)
+		default:
+			keys = append(keys, "%W~"+key.pattern)
+		}
+	}
+	return strings.Join(keys, " ")
+}
+
+func (user *aclUser) describeChannels() string {
+	if slices.Contains(user.channels, "*") {
+		return "&*"
+	}
+	channels := []string{"resetchannels"}
+	for _, channel := range user.channels {
+		channels = append(channels, "&"+channel)
+	}
+	return strings.Join(channels, " ")
+}
+
+// Whether the user may run the command and its name for errors, which
+// includes the subcommand when the rules tell subcommands apart.
+func (user *aclUser) commandAllowed(command RespCommand, args []string) (bool, string) {
+	name := strings.ToLower(string(command))
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand = name + "|" + strings.ToLower(args[0])
+	}
+	allowed, bySubcommand := false, false
+	for _, rule := range user.commandRules {
+		target := rule[1:]
+		if category, isCategory := strings.CutPrefix(target, "@"); isCategory {
+			if !inAclCategory(command, category) {
+				continue
+			}
+		} else if strings.HasPrefix(target, name+"|") {
+			bySubcommand = true
+			if target != subcommand {
+				continue
+			}
+		} else if target != name {
+			continue
+		}
+		allowed = rule[0] == '+'
+	}
+	if bySubcommand && subcommand != "" {
+		name = subcommand
+	}
+	return allowed, name
+}
+
+func (user *aclUser) keyAllowed(key string, read bool, write bool) bool {
+	for _, pattern := range user.keys {
+		if (!read || pattern.read) && (!write || pattern.write) && utils.GlobMatch(pattern.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Patterns of PSUBSCRIBE have to be allowed as they are, anything they
+// match could be published.
+func (user *aclUser) channelAllowed(channel string, literal bool) bool {
+	for _, pattern := range user.channels {
+		if pattern == "*" || literal && pattern == channel || !literal && utils.GlobMatch(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// The channels a pub/sub command uses, the keys of the sharded commands
+// are channels too.
+func commandChannels(command RespCommand, args []string) (channels []string, literal bool) {
+	switch command {
+	case RESP_SUBSCRIBE, RESP_SSUBSCRIBE:
+		return args, false
+	case RESP_PSUBSCRIBE:
+		return args, true
+	case RESP_PUBLISH, RESP_SPUBLISH:
+		if len(args) > 0 {
+			return args[:1], false
+		}
+	}
+	return nil, false
+}
+
+func (user *aclUser) check(request *RespRequest) *aclDenial {
+	if allowedWithoutAuth[request.command] {
+		return nil
+	}
+	allowed, name := user.commandAllowed(request.command, request.args)
+	if !allowed {
+		return &aclDenial{"command", name}
+	}
+	channels, literal := commandChannels(request.command, request.args)
+	for _, channel := range channels {
+		if !user.channelAllowed(channel, literal) {
+			return &aclDenial{"channel", channel}
+		}
+	}
+	if slices.Contains(aclCategories["pubsub"], request.command) {
+		return nil
+	}
+	flags := processors[request.command].flags
+	read := flags&CMD_WRITE == 0 || readingWrites[request.command]
+	write := flags&CMD_READONLY == 0
+	for _, key := range commandKeys(request) {
+		if !user.keyAllowed(key, read, write) {
+			return &aclDenial{"key", key}
+		}
+	}
+	return nil
+}
+
+func (denial *aclDenial) error(user *aclUser) error {
+	switch denial.reason {
+	case "command":
+		return &respError{RESP_NOPERM, fmt.Sprintf("User %s has no permissions to run the '%s' command", user.name, denial.object)}
+	case "key":
+		return &respError{RESP_NOPERM, "No permissions to access a key"}
+	}
+	return &respError{RESP_NOPERM, "No permissions to access a channel"}
+}
+
+// Refuse what the user of the client may not do, context tells ACL LOG
+// where the command came from.
+func aclCheck(client *Client, request *RespRequest, context string) error {
+	user := client.aclUser()
+	denial := user.check(request)
+	if denial == nil {
+		return nil
+	}
+	addAclLogEntry(denial.reason, context, denial.object, user.name, client)
+	return denial.error(user)
+}
+
+func aclContext(client *Client) string {
+	if client.multi {
+		return "multi"
+	}
+	return "toplevel"
+}
+
+func addAclLogEntry(reason string, context string, object string, username string, client *Client) {
+	now := time.Now()
+	for _, entry := range aclLog {
+		if entry.reason == reason && entry.context == context && entry.object == object &&
+			entry.username == username && now.Sub(entry.lastUpdated) < aclLogGroupingTime {
+			entry.count++
+			entry.lastUpdated = now
+			return
+		}
+	}
+	clientInfo := fmt.Sprintf("id=%d addr=%s user=%s db=%d", client.id, client.addr, client.aclUser().name, client.db)
+	aclLog = append([]*aclLogEntry{{
+		id: aclLogNextId, count: 1, reason: reason, context: context, object: object, username: username,
+		clientInfo: clientInfo, created: now, lastUpdated: now,
+	}}, aclLog...)
+	aclLogNextId++
+	trimAclLog()
+}
+
+func trimAclLog() {
+	if len(aclLog) > aclLogMaxLen {
+		aclLog = aclLog[:aclLogMaxLen]
+	}
+}
+
+func aclLogResponse(count int) *RespResponse {
+	entries := []*RespResponse{}
+	for _, entry := range aclLog[:min(count, len(aclLog))] {
+		entries = append(entries, newRespMapResponse([]*RespResponse{
+			newRespResponse(DT_BULK_STRINGS, []string{"count"}), integerResponse(entry.count),
+			newRespResponse(DT_BULK_STRINGS, []string{"reason"}), newRespResponse(DT_BULK_STRINGS, []string{entry.reason}),
+			newRespResponse(DT_BULK_STRINGS, []string{"context"}), newRespResponse(DT_BULK_STRINGS, []string{entry.context}),
+			newRespResponse(DT_BULK_STRINGS, []string{"object"}), newRespResponse(DT_BULK_STRINGS, []string{entry.object}),
+			newRespResponse(DT_BULK_STRINGS, []string{"username"}), newRespResponse(DT_BULK_STRINGS, []string{entry.username}),
+			newRespResponse(DT_BULK_STRINGS, []string{"age-seconds"}), newRespResponse(DT_DOUBLES, []string{fmt.Sprintf("%.3f", time.Since(entry.created).Seconds())}),
+			newRespResponse(DT_BULK_STRINGS, []string{"client-info"}), newRespResponse(DT_BULK_STRINGS, []string{entry.clientInfo}),
+			newRespResponse(DT_BULK_STRINGS, []string{"entry-id"}), newRespResponse(DT_INTEGER, []string{fmt.Sprint(entry.id)}),
+			newRespResponse(DT_BULK_STRINGS, []string{"timestamp-created"}), newRespResponse(DT_INTEGER, []string{fmt.Sprint(entry.created.UnixMilli())}),
+			newRespResponse(DT_BULK_STRINGS, []string{"timestamp-last-updated"}), newRespResponse(DT_INTEGER, []string{fmt.Sprint(entry.lastUpdated.UnixMilli())}),
+		}))
+	}
+	return newRespArrayResponse(entries)
+}
+
+// Apply the rules to a copy so that a bad rule changes nothing.
+func setUser(name string, rules []string) error {
+	user := newAclUser(name)
+	if existing := aclUsers[name]; existing != nil {
+		user = existing.clone()
+	}
+	for _, rule := range rules {
+		if err := user.applyRule(rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err.Error())
+		}
+	}
+	if existing := aclUsers[name]; existing != nil {
+		*existing = *user
+	} else {
+		aclUsers[name] = user
+	}
+	return nil
+}
+
+// Clients of users that are gone are disconnected, the others are moved
+// over to the new definition of their user.
+func replaceAclUsers(users map[string]*aclUser) {
+	aclUsers = users
+	clientsById.Range(func(id any, value any) bool {
+		client := value.(*Client)
+		if client.user != nil {
+			if user := users[client.user.name]; user != nil {
+				client.user = user
+			} else {
+				client.kill()
+			}
+		}
+		return true
+	})
+}
+
+// Read the users of an ACL file, every line is "user <name> <rules>".
+func readAclFile(path string) (map[string]*aclUser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]*aclUser{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d should start with user keyword", path, line)
+		}
+		if users[fields[1]] != nil {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s' found", path, line, fields[1])
+		}
+		user := newAclUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := user.applyRule(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s. Error in user declaration '%s'", path, line, err.Error(), rule)
+			}
+		}
+		users[user.name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if users[defaultUser] == nil {
+		users[defaultUser] = newDefaultUser()
+	}
+	return users, nil
+}
+
+func loadAclFile() error {
+	users, err := readAclFile(aclFile)
+	if err != nil {
+		return err
+	}
+	replaceAclUsers(users)
+	return nil
+}
+
+func saveAclFile() error {
+	var content strings.Builder
+	for _, name := range sortedAclUsers() {
+		content.WriteString(aclUsers[name].describe() + "\n")
+	}
+	temp := aclFile + ".tmp"
+	if err := os.WriteFile(temp, []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, aclFile)
+}
+
+func sortedAclUsers() []string {
+	names := []string{}
+	for name := range aclUsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func process_acl(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("wrong number of arguments for 'acl' command")
+	}
+	args := request.args[1:]
+	ok := newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK})
+	switch strings.ToUpper(request.args[0]) {
+	case "SETUSER":
+		if len(args) < 1 {
+			return nil, errors.New("wrong number of arguments for 'acl|setuser' command")
+		}
+		if err := setUser(args[0], args[1:]); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case "GETUSER":
+		if len(args) != 1 {
+			return nil, errors.New("wrong number of arguments for 'acl|getuser' command")
+		}
+		user := aclUsers[args[0]]
+		if user == nil {
+			return newRespResponse(DT_NULLS, []string{}), nil
+		}
+		return aclGetUserResponse(user), nil
+	case "DELUSER":
+		if len(args) < 1 {
+			return nil, errors.New("wrong number of arguments for 'acl|deluser' command")
+		}
+		users := map[string]*aclUser{}
+		for name, user := range aclUsers {
+			users[name] = user
+		}
+		deleted := 0
+		for _, name := range args {
+			if name == defaultUser {
+				return nil, errors.New("The 'default' user cannot be removed")
+			}
+			if users[name] != nil {
+				delete(users, name)
+				deleted++
+			}
+		}
+		replaceAclUsers(users)
+		return integerResponse(deleted), nil
+	case "USERS":
+		return newRespArrayResponse(bulkStrings(sortedAclUsers()...)), nil
+	case "LIST":
+		users := []string{}
+		for _, name := range sortedAclUsers() {
+			users = append(users, aclUsers[name].describe())
+		}
+		return newRespArrayResponse(bulkStrings(users...)), nil
+	case "WHOAMI":
+		return newRespResponse(DT_BULK_STRINGS, []string{request.client.aclUser().name}), nil
+	case "CAT":
+		if len(args) == 0 {
+			return newRespArrayResponse(bulkStrings(aclCategoryNames...)), nil
+		}
+		commands, ok := commandsInCategory(strings.ToLower(args[0]))
+		if !ok || args[0] == "all" {
+			return nil, fmt.Errorf("Unknown category '%s'", args[0])
+		}
+		names := []string{}
+		for _, command := range commands {
+			names = append(names, strings.ToLower(string(command)))
+		}
+		return newRespArrayResponse(bulkStrings(names...)), nil
+	case "LOG":
+		count := len(aclLog)
+		if len(args) == 1 && strings.ToUpper(args[0]) == "RESET" {
+			aclLog = nil
+			return ok, nil
+		}
+		if len(args) == 1 {
+			if _, err := fmt.Sscan(args[0], &count); err != nil || count < 0 {
+				return nil, errors.New("value is out of range, must be positive")
+			}
+		}
+		return aclLogResponse(count), nil
+	case "DRYRUN":
+		return aclDryRun(args)
+	case "SAVE", "LOAD":
+		if aclFile == "" {
+			return nil, errors.New("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+		}
+		if strings.ToUpper(request.args[0]) == "SAVE" {
+			if err := saveAclFile(); err != nil {
+				return nil, fmt.Errorf("There was an error trying to save the ACLs. Please check the server logs for more information: %s", err.Error())
+			}
+		} else if err := loadAclFile(); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+}
+
+func aclGetUserResponse(user *aclUser) *RespResponse {
+	flags := []string{"off"}
+	if user.enabled {
+		flags[0] = "on"
+	}
+	if user.nopass {
+		flags = append(flags, "nopass")
+	}
+	return newRespMapResponse([]*RespResponse{
+		newRespResponse(DT_BULK_STRINGS, []string{"flags"}), newRespArrayResponse(bulkStrings(flags...)),
+		newRespResponse(DT_BULK_STRINGS, []string{"passwords"}), newRespArrayResponse(bulkStrings(user.passwords...)),
+		newRespResponse(DT_BULK_STRINGS, []string{"commands"}), newRespResponse(DT_BULK_STRINGS, []string{strings.Join(user.commandRules, " ")}),
+		newRespResponse(DT_BULK_STRINGS, []string{"keys"}), newRespResponse(DT_BULK_STRINGS, []string{user.describeKeys()}),
+		newRespResponse(DT_BULK_STRINGS, []string{"channels"}), newRespResponse(DT_BULK_STRINGS, []string{strings.Join(user.channelRules(), " ")}),
+		newRespResponse(DT_BULK_STRINGS, []string{"selectors"}), newRespArrayResponse([]*RespResponse{}),
+	})
+}
+
+func (user *aclUser) channelRules() []string {
+	rules := []string{}
+	for _, channel := range user.channels {
+		rules = append(rules, "&"+channel)
+	}
+	return rules
+}
+
+// ACL DRYRUN username command [arg ...]
+func aclDryRun(args []string) (*RespResponse, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments for 'acl|dryrun' command")
+	}
+	user := aclUsers[args[0]]
+	if user == nil {
+		return nil, fmt.Errorf("User '%s' not found", args[0])
+	}
+	command := RespCommand(strings.ToUpper(args[1]))
+	if _, exists := processors[command]; !exists {
+		return nil, fmt.Errorf("Command '%s' not found", args[1])
+	}
+	denial := user.check(&RespRequest{command: command, args: args[2:]})
+	if denial == nil {
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	}
+	message := fmt.Sprintf("User %s has no permissions to run the '%s' command", user.name, denial.object)
+	if denial.reason != "command" {
+		message = fmt.Sprintf("User %s has no permissions to access the '%s' %s", user.name, denial.object, denial.reason)
+	}
+	return newRespResponse(DT_BULK_STRINGS, []string{message}), nil
+}
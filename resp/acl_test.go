@@ -0,0 +1,132 @@
+package resp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func resetAcl(t *testing.T) {
+	t.Cleanup(func() {
+		onExecutor(func() error {
+			replaceAclUsers(map[string]*aclUser{defaultUser: newDefaultUser()})
+			aclLog, aclFile = nil, ""
+			return nil
+		})
+	})
+}
+
+func TestAclCommandsAndKeys(t *testing.T) {
+	resetAcl(t)
+	admin := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(admin, "ACL SETUSER alice on >pw ~app:* %R~shared:* +@read +set -ttl +config|get +acl|whoami +@transaction"))
+	require.Equal(t, "*2\r\n$5\r\nalice\r\n$7\r\ndefault\r\n", sendCommand(admin, "ACL USERS"))
+
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "AUTH alice pw"))
+	require.Equal(t, "$5\r\nalice\r\n", sendCommand(client, "ACL WHOAMI"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET app:1 one"))
+	require.Equal(t, "+one\r\n", sendCommand(client, "GET app:1"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET shared:1"))
+	require.Equal(t, "-NOPERM No permissions to access a key\r\n", sendCommand(client, "SET shared:1 one"))
+	require.Equal(t, "-NOPERM No permissions to access a key\r\n", sendCommand(client, "GET other"))
+	require.Equal(t, "-NOPERM User alice has no permissions to run the 'del' command\r\n", sendCommand(client, "DEL app:1"))
+	require.Equal(t, "-NOPERM User alice has no permissions to run the 'ttl' command\r\n", sendCommand(client, "TTL app:1"))
+	require.Contains(t, sendCommand(client, "CONFIG GET port"), "port")
+	require.Equal(t, "-NOPERM User alice has no permissions to run the 'config|set' command\r\n", sendCommand(client, "CONFIG SET port 1"))
+
+	// Commands queued in a transaction are checked right away
+	require.Equal(t, "+OK\r\n", sendCommand(client, "MULTI"))
+	require.Contains(t, sendCommand(client, "DEL app:1"), "NOPERM")
+	require.Contains(t, sendCommand(client, "EXEC"), "EXECABORT")
+
+	log := sendCommand(admin, "ACL LOG 1")
+	require.Contains(t, log, "reason\r\n$7\r\ncommand")
+	require.Contains(t, log, "context\r\n$5\r\nmulti")
+	require.Contains(t, log, "object\r\n$3\r\ndel")
+	require.Equal(t, "+OK\r\n", sendCommand(admin, "ACL LOG RESET"))
+	require.Equal(t, "*0\r\n", sendCommand(admin, "ACL LOG"))
+
+	sendCommand(admin, "DEL app:1")
+}
+
+func TestAclSetUser(t *testing.T) {
+	resetAcl(t)
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "ACL SETUSER bob"))
+	require.Contains(t, sendCommand(client, "ACL SETUSER bob on +nosuchcommand"), "Error in ACL SETUSER modifier '+nosuchcommand': Unknown command or category name in ACL")
+	require.Contains(t, sendCommand(client, "ACL SETUSER bob %X~key"), "Syntax error")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "ACL SETUSER bob >pw &news.* allkeys +@all -@dangerous"))
+	require.Contains(t, sendCommand(client, "ACL LIST"), "user bob off #"+hashPassword("pw")+" ~* resetchannels &news.* +@all -@dangerous")
+	require.Contains(t, sendCommand(client, "ACL GETUSER bob"), "flags\r\n*1\r\n$3\r\noff")
+	require.Equal(t, "_\r\n", sendCommand(client, "ACL GETUSER nobody"))
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "ACL DRYRUN bob PUBLISH news.tech hello"))
+	require.Equal(t, "$57\r\nUser bob has no permissions to access the 'sport' channel\r\n", sendCommand(client, "ACL DRYRUN bob PUBLISH sport hello"))
+	require.Equal(t, "$57\r\nUser bob has no permissions to run the 'flushall' command\r\n", sendCommand(client, "ACL DRYRUN bob FLUSHALL"))
+	require.Contains(t, sendCommand(client, "ACL DRYRUN bob PSUBSCRIBE news.*"), "OK")
+	require.Contains(t, sendCommand(client, "ACL DRYRUN bob PSUBSCRIBE news.t*"), "channel")
+
+	// Disabled users cannot authenticate
+	require.Contains(t, sendCommand(NewClient(), "AUTH bob pw"), "WRONGPASS")
+	require.Contains(t, sendCommand(client, "ACL LOG"), "reason\r\n$4\r\nauth")
+
+	other := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "ACL SETUSER bob on"))
+	require.Equal(t, "+OK\r\n", sendCommand(other, "AUTH bob pw"))
+	require.Contains(t, sendCommand(client, "ACL DELUSER default"), "cannot be removed")
+	require.Equal(t, ":1\r\n", sendCommand(client, "ACL DELUSER bob nobody"))
+	select {
+	case <-other.Done():
+	default:
+		t.Fatal("the client of a deleted user is disconnected")
+	}
+
+	require.Contains(t, sendCommand(client, "ACL CAT"), "keyspace")
+	require.Contains(t, sendCommand(client, "ACL CAT scripting"), "$4\r\neval\r\n")
+}
+
+func TestAclScripts(t *testing.T) {
+	resetAcl(t)
+	require.Equal(t, "+OK\r\n", sendCommand(NewClient(), "ACL SETUSER carol on nopass ~* +eval +get"))
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "AUTH carol any"))
+	require.Contains(t, sendArgs(client, "EVAL", "return redis.call('SET', KEYS[1], 'x')", "1", "aclScriptKey"), "no permissions to run the 'set' command")
+	require.Contains(t, sendCommand(NewClient(), "ACL LOG 1"), "context\r\n$3\r\nlua")
+}
+
+func TestAclMigrateKeys(t *testing.T) {
+	resetAcl(t)
+	require.Equal(t, "+OK\r\n", sendCommand(NewClient(), "ACL SETUSER mallory on nopass ~allowed:* +migrate"))
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "AUTH mallory any"))
+	require.Equal(t, "-NOPERM No permissions to access a key\r\n", sendArgs(client, "MIGRATE", "127.0.0.1", "1", "secret", "0", "100"))
+	require.Equal(t, "-NOPERM No permissions to access a key\r\n", sendArgs(client, "MIGRATE", "127.0.0.1", "1", "", "0", "100", "AUTH", "KEYS", "KEYS", "allowed:1", "secret"))
+	require.Equal(t, "+NOKEY\r\n", sendArgs(client, "MIGRATE", "127.0.0.1", "1", "", "0", "100", "KEYS", "allowed:1"))
+}
+
+func TestAclFile(t *testing.T) {
+	resetAcl(t)
+	path := filepath.Join(t.TempDir(), "users.acl")
+	require.NoError(t, os.WriteFile(path, []byte("user dave on >pw ~dave:* +get\n"), 0600))
+	require.NoError(t, onExecutor(func() error {
+		aclFile = path
+		return loadAclFile()
+	}))
+	client := NewClient()
+	require.Equal(t, "*2\r\n$4\r\ndave\r\n$7\r\ndefault\r\n", sendCommand(client, "ACL USERS"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "ACL SETUSER erin on nopass"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "ACL SAVE"))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "user dave on #"+hashPassword("pw")+" ~dave:* resetchannels -@all +get\n"+
+		"user default on nopass ~* &* +@all\n"+
+		"user erin on nopass resetchannels -@all\n", string(content))
+
+	require.NoError(t, os.WriteFile(path, []byte("user frank on +nosuchcommand\n"), 0600))
+	require.Contains(t, sendCommand(client, "ACL LOAD"), "users.acl:1")
+	require.Contains(t, sendCommand(client, "ACL USERS"), "erin")
+}
@@ -0,0 +1,490 @@
+// Append only file persistence. Successful write commands are logged with
+// their effects, e.g. relative expiry times become absolute, so replaying
+// the file at startup rebuilds the same dataset.
+//
+// The file is split in parts listed by a manifest: a base with a snapshot
+// of the dataset and incremental files with the writes since. A rewrite
+// switches to a new incremental file right away and writes the new base in
+// the background, the old parts are removed once the manifest refers to it.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/johanlantz/redis/aof"
+	"github.com/johanlantz/redis/storage"
+	"github.com/johanlantz/redis/utils"
+)
+
+var appendOnly = false
+var appendFsync = aof.FsyncEverySec
+var appendFilename = "appendonly.aof"
+var appendDirname = "appendonlydir"
+var aofLoadTruncated = true
+var autoAofRewritePercentage = 100
+var autoAofRewriteMinSize int64 = 64 * 1024 * 1024
+
+var aofFile *aof.File
+var aofManifest *aof.Manifest
+var aofRewriting = false
+
+// The current incremental file is not in the manifest on disk yet, see
+// enableAppendOnly.
+var aofWaitRewrite = false
+
+// The database the commands in the file currently apply to.
+var aofSelectedDb = -1
+
+// Sizes for the automatic rewrite, the current size of all parts and their
+// size right after the last rewrite or load.
+var aofCurrentSize int64
+var aofBaseSize int64
+
+// Bytes appended to the file across all its parts since the server started
+// and where the current part starts in that count, for WAITAOF.
+var aofWritten int64
+var aofFileStart int64
+
+func init() {
+	configParameters["appendonly"] = configParameter{
+		get: func() string { return yesNo(appendOnly) },
+		set: func(value string) error {
+			enable, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			if databases != nil && enable && aofFile == nil {
+				if err := enableAppendOnly(); err != nil {
+					return err
+				}
+			}
+			if !enable && aofFile != nil {
+				stopAppendOnly()
+			}
+			appendOnly = enable
+			return nil
+		},
+	}
+	configParameters["appendfsync"] = configParameter{
+		get: func() string { return appendFsync.String() },
+		set: func(value string) error {
+			policy, err := aof.ParseFsyncPolicy(value)
+			if err != nil {
+				return err
+			}
+			appendFsync = policy
+			if aofFile != nil {
+				aofFile.SetPolicy(policy)
+			}
+			return nil
+		},
+	}
+	configParameters["appendfilename"] = configParameter{
+		get: func() string { return appendFilename },
+		set: immutable(func(value string) error {
+			if value == "" || filepath.Base(value) != value {
+				return errors.New("appendfilename can't be a path, just a filename")
+			}
+			appendFilename = value
+			return nil
+		}),
+	}
+	configParameters["appenddirname"] = configParameter{
+		get: func() string { return appendDirname },
+		set: immutable(func(value string) error {
+			if value == "" || filepath.Base(value) != value {
+				return errors.New("appenddirname can't be a path, just a dirname")
+			}
+			appendDirname = value
+			return nil
+		}),
+	}
+	configParameters["aof-load-truncated"] = configParameter{
+		get: func() string { return yesNo(aofLoadTruncated) },
+		set: func(value string) error {
+			enable, err := parseYesNo(value)
+			if err == nil {
+				aofLoadTruncated = enable
+			}
+			return err
+		},
+	}
+	configParameters["auto-aof-rewrite-percentage"] = configParameter{
+		get: func() string { return fmt.Sprint(autoAofRewritePercentage) },
+		set: func(value string) error {
+			percentage, err := parseNonNegative(value)
+			if err == nil {
+				autoAofRewritePercentage = int(percentage)
+			}
+			return err
+		},
+	}
+	configParameters["auto-aof-rewrite-min-size"] = configParameter{
+		get: func() string { return fmt.Sprint(autoAofRewriteMinSize) },
+		set: func(value string) error {
+			size, err := ParseMemory(value)
+			if err == nil {
+				autoAofRewriteMinSize = size
+			}
+			return err
+		},
+	}
+}
+
+func aofPath(name string) string {
+	return filepath.Join(workingDir, appendDirname, name)
+}
+
+func manifestPath() string {
+	return aofPath(appendFilename + ".manifest")
+}
+
+// Read the manifest, a single file append only file from an older version
+// becomes the base of a new one.
+func loadOrCreateManifest() (*aof.Manifest, error) {
+	if err := os.MkdirAll(filepath.Join(workingDir, appendDirname), 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := aof.LoadManifest(manifestPath())
+	if err == nil || !os.IsNotExist(err) {
+		return manifest, err
+	}
+
+	manifest = &aof.Manifest{}
+	legacy := filepath.Join(workingDir, appendFilename)
+	if _, err := os.Stat(legacy); err == nil {
+		base := manifest.NextBase(appendFilename)
+		if err := os.Rename(legacy, aofPath(base.Name)); err != nil {
+			return nil, err
+		}
+		manifest.Base = &base
+		log.Printf("Moved the append only file %s to %s", legacy, aofPath(base.Name))
+	}
+	return manifest, manifest.Save(manifestPath())
+}
+
+// Replay the append only file if enabled and start logging to it.
+func startAppendOnly() error {
+	if !appendOnly {
+		return nil
+	}
+	manifest, err := loadOrCreateManifest()
+	if err != nil {
+		return err
+	}
+	files := manifest.Files()
+	aofCurrentSize = 0
+	for i, info := range files {
+		// Only the last part can have been cut short by a crash
+		repair := aofLoadTruncated && i == len(files)-1
+		if err := loadAppendOnlyFile(aofPath(info.Name), repair); err != nil {
+			return err
+		}
+		if stat, err := os.Stat(aofPath(info.Name)); err == nil {
+			aofCurrentSize += stat.Size()
+		}
+	}
+	aofBaseSize = aofCurrentSize
+	aofManifest = manifest
+
+	if len(manifest.Incrs) == 0 {
+		return openNextIncr()
+	}
+	file, err := aof.Open(aofPath(manifest.Incrs[len(manifest.Incrs)-1].Name), appendFsync)
+	if err != nil {
+		return err
+	}
+	aofFile, aofSelectedDb, aofFileStart = file, -1, aofWritten
+	return nil
+}
+
+// Enabling at runtime starts from the current dataset, whatever the
+// directory contains is replaced by the rewrite. Until the new base is
+// installed the manifest on disk keeps the previous history without the
+// incremental file opened here, listing both would replay the writes on
+// top of a stale dataset after a crash.
+func enableAppendOnly() error {
+	manifest, err := loadOrCreateManifest()
+	if err != nil {
+		return err
+	}
+	aofManifest = manifest
+	if err := rewriteAppendOnlyFile(); err != nil {
+		return err
+	}
+	manifest = &aof.Manifest{Base: aofManifest.Base, Incrs: append([]aof.FileInfo{}, aofManifest.Incrs...)}
+	incr := manifest.NextIncr(appendFilename)
+	file, err := aof.Open(aofPath(incr.Name), appendFsync)
+	if err != nil {
+		return err
+	}
+	aofFile, aofManifest, aofSelectedDb, aofFileStart = file, manifest, -1, aofWritten
+	aofWaitRewrite = true
+	return nil
+}
+
+func stopAppendOnly() {
+	if err := aofFile.Close(); err != nil {
+		log.Printf("Error closing the append only file: %s", err.Error())
+	}
+	aofFile = nil
+}
+
+// Continue logging in a new incremental file, the manifest is saved first
+// so that the new file is never missed at load.
+func openNextIncr() error {
+	manifest := &aof.Manifest{Base: aofManifest.Base, Incrs: append([]aof.FileInfo{}, aofManifest.Incrs...)}
+	incr := manifest.NextIncr(appendFilename)
+	file, err := aof.Open(aofPath(incr.Name), appendFsync)
+	if err != nil {
+		return err
+	}
+	if err := manifest.Save(manifestPath()); err != nil {
+		file.Close()
+		os.Remove(aofPath(incr.Name))
+		return err
+	}
+	if aofFile != nil {
+		stopAppendOnly()
+	}
+	aofFile, aofManifest, aofSelectedDb, aofFileStart = file, manifest, -1, aofWritten
+	return nil
+}
+
+// Commands are replayed on behalf of a client of their own that follows
+// the SELECT commands in the file.
+func loadAppendOnlyFile(path string, repairTruncated bool) error {
+	client := newClient()
+	return aof.Load(path, repairTruncated, func(args []string) error {
+		command := RespCommand(args[0])
+		if _, ok := processors[command]; !ok {
+			return fmt.Errorf("unknown command '%s'", args[0])
+		}
+		_, err := executeRequest(&RespRequest{command: command, args: args[1:], client: client})
+		return err
+	})
+}
+
+// Log a successful write request to the append only file and the
+// replication stream, with its effects rather than as it was sent.
+func propagateWrite(request *RespRequest) {
+	if aofFile == nil && backlog == nil {
+		return
+	}
+	args := append([]string{string(request.command)}, request.args...)
+	switch request.command {
+	case RESP_EXPIRE, RESP_PEXPIRE, RESP_EXPIREAT:
+		key := request.args[0]
+		entry := databases[request.client.db].Get(key)
+		if entry.IsNull() {
+			args = []string{string(RESP_DEL), key}
+		} else {
+			args = []string{string(RESP_PEXPIREAT), key, fmt.Sprint(entry.ExpireAt)}
+		}
+	case RESP_RESTORE, RESP_RESTORE_ASKING:
+		key := request.args[0]
+		entry := databases[request.client.db].Get(key)
+		if entry.IsNull() {
+			args = []string{string(RESP_DEL), key}
+		} else {
+			args = []string{string(RESP_RESTORE), key, fmt.Sprint(entry.ExpireAt), dumpEntry(entry), "REPLACE", "ABSTTL"}
+		}
+	case RESP_MIGRATE:
+		// Only the removal of the migrated keys matters here
+		options, _ := parseMigrate(request.args)
+		if options.copy {
+			return
+		}
+		args = []string{string(RESP_DEL)}
+		for _, key := range options.keys {
+			if databases[request.client.db].Get(key).IsNull() {
+				args = append(args, key)
+			}
+		}
+		if len(args) == 1 {
+			return
+		}
+	}
+	propagate(request.client.db, args...)
+}
+
+func appendCommand(db int, args ...string) {
+	if aofFile == nil {
+		return
+	}
+	data := []byte{}
+	if db != aofSelectedDb {
+		data = utils.MarshalArgsToResp(string(RESP_SELECT), fmt.Sprint(db))
+		aofSelectedDb = db
+	}
+	data = append(data, utils.MarshalArgsToResp(args...)...)
+	if err := aofFile.Append(data); err != nil {
+		log.Printf("Error writing to the append only file: %s", err.Error())
+		return
+	}
+	aofCurrentSize += int64(len(data))
+	aofWritten += int64(len(data))
+
+	growth := (aofCurrentSize - aofBaseSize) * 100 / max(aofBaseSize, 1)
+	if autoAofRewritePercentage > 0 && !aofRewriting && aofCurrentSize >= autoAofRewriteMinSize &&
+		growth >= int64(autoAofRewritePercentage) {
+		log.Printf("Starting automatic rewriting of the append only file, %d%% growth", growth)
+		if err := rewriteAppendOnlyFile(); err != nil {
+			log.Printf("Error rewriting the append only file: %s", err.Error())
+		}
+	}
+}
+
+// How much of aofWritten is on disk. Parts are synced when they are closed.
+func aofFsyncedOffset() int64 {
+	if aofFile == nil {
+		return aofWritten
+	}
+	return aofFileStart + aofFile.Synced()
+}
+
+// Start writing a new base in the background, writes from now on go to a
+// new incremental file that follows it.
+func rewriteAppendOnlyFile() error {
+	if aofRewriting {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	// Without an open file the manifest may be stale, e.g. after a change of dir
+	if aofManifest == nil || aofFile == nil {
+		manifest, err := loadOrCreateManifest()
+		if err != nil {
+			return err
+		}
+		aofManifest = manifest
+	}
+	// Retrying after a failed rewrite keeps the file that is not listed yet
+	if aofFile != nil && !aofWaitRewrite {
+		if err := openNextIncr(); err != nil {
+			return err
+		}
+	}
+	obsolete := aofManifest.Files()
+	if aofFile != nil {
+		obsolete = obsolete[:len(obsolete)-1]
+	}
+
+	snapshot, libraryCode := snapshotDatabases(), snapshotLibraries()
+	aofRewriting = true
+	go func() {
+		temp, err := writeAofBase(snapshot, libraryCode)
+		closeSnapshot(snapshot)
+		taskChannel <- func() {
+			finishAofRewrite(temp, obsolete, err)
+		}
+	}()
+	return nil
+}
+
+func writeAofBase(snapshot []storage.Snapshot, libraryCode []string) (string, error) {
+	file, err := os.CreateTemp(filepath.Join(workingDir, appendDirname), "temp-rewriteaof-")
+	if err != nil {
+		return "", err
+	}
+	writer := bufio.NewWriter(file)
+	for _, code := range libraryCode {
+		writer.Write(utils.MarshalArgsToResp(string(RESP_FUNCTION), "LOAD", code))
+	}
+	for db, entries := range snapshot {
+		// Selected with the first entry, errors of the snapshot only show
+		// when it is read
+		selected := false
+		err = entries.ForEach(func(key string, entry storage.Entry) error {
+			if !selected {
+				writer.Write(utils.MarshalArgsToResp(string(RESP_SELECT), fmt.Sprint(db)))
+				selected = true
+			}
+			writer.Write(utils.MarshalArgsToResp(string(RESP_SET), key, string(entry.Value)))
+			if entry.ExpireAt != 0 {
+				writer.Write(utils.MarshalArgsToResp(string(RESP_PEXPIREAT), key, fmt.Sprint(entry.ExpireAt)))
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Runs on the executor once the new base is written.
+func finishAofRewrite(temp string, obsolete []aof.FileInfo, err error) {
+	aofRewriting = false
+	if err != nil {
+		log.Printf("Background append only file rewriting failed: %s", err.Error())
+		return
+	}
+
+	manifest := &aof.Manifest{}
+	base := aofManifest.NextBase(appendFilename)
+	manifest.Base = &base
+	for _, incr := range aofManifest.Incrs {
+		if !containsFile(obsolete, incr) {
+			manifest.Incrs = append(manifest.Incrs, incr)
+		}
+	}
+	if err := os.Rename(temp, aofPath(base.Name)); err != nil {
+		log.Printf("Background append only file rewriting failed: %s", err.Error())
+		os.Remove(temp)
+		return
+	}
+	if err := manifest.Save(manifestPath()); err != nil {
+		log.Printf("Background append only file rewriting failed: %s", err.Error())
+		os.Remove(aofPath(base.Name))
+		return
+	}
+	aofManifest, aofWaitRewrite = manifest, false
+	for _, info := range obsolete {
+		os.Remove(aofPath(info.Name))
+	}
+
+	aofCurrentSize = 0
+	for _, info := range manifest.Files() {
+		if stat, err := os.Stat(aofPath(info.Name)); err == nil {
+			aofCurrentSize += stat.Size()
+		}
+	}
+	aofBaseSize = aofCurrentSize
+	log.Printf("Background append only file rewriting terminated with success")
+}
+
+func containsFile(files []aof.FileInfo, file aof.FileInfo) bool {
+	for _, f := range files {
+		if f == file {
+			return true
+		}
+	}
+	return false
+}
+
+func process_bgrewriteaof(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 0 {
+		return nil, errors.New("bgrewriteaof command takes no arguments")
+	}
+	if err := rewriteAppendOnlyFile(); err != nil {
+		return nil, err
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{"Background append only file rewriting started"}), nil
+}
@@ -0,0 +1,189 @@
+package resp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/aof"
+	"github.com/stretchr/testify/require"
+)
+
+// Run f on the executor like the server does at startup.
+func onExecutor(f func() error) error {
+	done := make(chan error)
+	taskChannel <- func() { done <- f() }
+	return <-done
+}
+
+func TestAppendOnlyFeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	file, err := aof.Open(path, aof.FsyncAlways)
+	require.NoError(t, err)
+	onExecutor(func() error {
+		aofFile, aofSelectedDb = file, -1
+		return nil
+	})
+
+	client := NewClient()
+	sendCommand(client, "SELECT 11")
+	sendCommand(client, "SET aofKey 1")
+	sendCommand(client, "GET aofKey")
+	sendCommand(client, "INCR aofKey")
+	sendCommand(client, "EXPIRE aofKey 100")
+	sendCommand(client, "INCR notAnInteger extra")
+	onExecutor(func() error {
+		stopAppendOnly()
+		return nil
+	})
+
+	commands := [][]string{}
+	require.NoError(t, aof.Load(path, false, func(args []string) error {
+		commands = append(commands, args)
+		return nil
+	}))
+	require.Len(t, commands, 4)
+	require.Equal(t, []string{"SELECT", "11"}, commands[0])
+	require.Equal(t, []string{"SET", "aofKey", "1"}, commands[1])
+	require.Equal(t, []string{"INCR", "aofKey"}, commands[2])
+	require.Equal(t, "PEXPIREAT", commands[3][0])
+	expireAt, err := strconv.ParseInt(commands[3][2], 10, 64)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().UnixMilli()+100000, expireAt, 1000)
+}
+
+func TestAppendOnlyReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	content := "*2\r\n$6\r\nSELECT\r\n$2\r\n12\r\n" +
+		"*3\r\n$3\r\nSET\r\n$9\r\nreplayKey\r\n$5\r\nvalue\r\n" +
+		"*3\r\n$3\r\nSET\r\n$7\r\ngoneKey\r\n$1\r\nx\r\n" +
+		"*3\r\n$9\r\nPEXPIREAT\r\n$7\r\ngoneKey\r\n$1\r\n1\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nrep"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	require.NoError(t, onExecutor(func() error { return loadAppendOnlyFile(path, true) }))
+
+	client := NewClient()
+	sendCommand(client, "SELECT 12")
+	require.Equal(t, "+value\r\n", sendCommand(client, "GET replayKey"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET goneKey"))
+
+	require.NoError(t, os.WriteFile(path, []byte("*1\r\n$7\r\nUNKNOWN\r\n"), 0644))
+	require.ErrorContains(t, onExecutor(func() error { return loadAppendOnlyFile(path, true) }), "unknown command")
+}
+
+func waitForAofRewrite(t *testing.T) {
+	require.Eventually(t, func() bool {
+		return onExecutor(func() error {
+			if aofRewriting {
+				return errors.New("rewriting")
+			}
+			return nil
+		}) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAppendOnlyRewrite(t *testing.T) {
+	dir := t.TempDir()
+	sendArgs(NewClient(), "CONFIG", "SET", "dir", dir)
+	defer sendArgs(NewClient(), "CONFIG", "SET", "dir", ".")
+
+	client := NewClient()
+	sendCommand(client, "SELECT 13")
+	sendCommand(client, "SET rewriteKey a")
+	sendCommand(client, "SET volatileKey b")
+	sendCommand(client, "PEXPIRE volatileKey 100000")
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET appendonly yes"))
+	sendCommand(client, "SET incrKey c")
+	waitForAofRewrite(t)
+	manifest, err := os.ReadFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.manifest"))
+	require.NoError(t, err)
+	require.Equal(t, "file appendonly.aof.1.base.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n", string(manifest))
+
+	require.Equal(t, "+Background append only file rewriting started\r\n", sendCommand(client, "BGREWRITEAOF"))
+	sendCommand(client, "SET lateKey d")
+	waitForAofRewrite(t)
+	manifest, err = os.ReadFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.manifest"))
+	require.NoError(t, err)
+	require.Equal(t, "file appendonly.aof.2.base.aof seq 2 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n", string(manifest))
+	files, err := os.ReadDir(filepath.Join(dir, "appendonlydir"))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET appendonly no"))
+	sendCommand(client, "FLUSHDB")
+	require.NoError(t, onExecutor(func() error {
+		appendOnly = true
+		defer func() { appendOnly = false }()
+		defer stopAppendOnly()
+		return startAppendOnly()
+	}))
+	for key, value := range map[string]string{"rewriteKey": "a", "volatileKey": "b", "incrKey": "c", "lateKey": "d"} {
+		require.Equal(t, "+"+value+"\r\n", sendCommand(client, "GET "+key))
+	}
+	require.Equal(t, ":-1\r\n", sendCommand(client, "TTL rewriteKey"))
+	require.Equal(t, ":100\r\n", sendCommand(client, "TTL volatileKey"))
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestAppendOnlyReenable(t *testing.T) {
+	dir := t.TempDir()
+	sendArgs(NewClient(), "CONFIG", "SET", "dir", dir)
+	defer sendArgs(NewClient(), "CONFIG", "SET", "dir", ".")
+	manifestPath := filepath.Join(dir, "appendonlydir", "appendonly.aof.manifest")
+
+	client := NewClient()
+	sendCommand(client, "SELECT 14")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET appendonly yes"))
+	sendCommand(client, "SET staleKey a")
+	waitForAofRewrite(t)
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET appendonly no"))
+	sendCommand(client, "DEL staleKey")
+	sendCommand(client, "SET freshKey b")
+
+	// Until the new base is installed the manifest must not list the new
+	// incremental file next to the old history
+	var manifest []byte
+	require.NoError(t, onExecutor(func() error {
+		if err := ConfigSet("appendonly", "yes"); err != nil {
+			return err
+		}
+		var err error
+		manifest, err = os.ReadFile(manifestPath)
+		return err
+	}))
+	require.Equal(t, "file appendonly.aof.1.base.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n", string(manifest))
+	sendCommand(client, "SET lateKey c")
+	waitForAofRewrite(t)
+	manifest, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	require.Equal(t, "file appendonly.aof.2.base.aof seq 2 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n", string(manifest))
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET appendonly no"))
+	sendCommand(client, "FLUSHDB")
+	require.NoError(t, onExecutor(func() error {
+		appendOnly = true
+		defer func() { appendOnly = false }()
+		defer stopAppendOnly()
+		return startAppendOnly()
+	}))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET staleKey"))
+	require.Equal(t, "+b\r\n", sendCommand(client, "GET freshKey"))
+	require.Equal(t, "+c\r\n", sendCommand(client, "GET lateKey"))
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestAppendOnlyConfig(t *testing.T) {
+	client := NewClient()
+	require.Contains(t, sendCommand(client, "CONFIG SET appendfilename other.aof"), "immutable")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET appendfsync always"))
+	require.Equal(t, "*2\r\n$11\r\nappendfsync\r\n$6\r\nalways\r\n", sendCommand(client, "CONFIG GET appendfsync"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET appendfsync everysec"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET auto-aof-rewrite-min-size 1mb"))
+	require.Equal(t, "*2\r\n$25\r\nauto-aof-rewrite-min-size\r\n$7\r\n1048576\r\n", sendCommand(client, "CONFIG GET auto-aof-rewrite-min-size"))
+	require.Contains(t, sendCommand(client, "CONFIG SET auto-aof-rewrite-min-size lots"), "memory value")
+	sendCommand(client, "CONFIG SET auto-aof-rewrite-min-size 64mb")
+}
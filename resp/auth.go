@@ -0,0 +1,120 @@
+// Password protection of the server. Unless the default user needs no
+// password clients have to AUTH before they can run anything but the
+// commands needed to do so. requirepass is the password of the default
+// user, other users are created with ACL SETUSER, see acl.go.
+package resp
+
+import (
+	"errors"
+	"strings"
+)
+
+const defaultUser = "default"
+
+var requirePass = ""
+
+// The password to AUTH with at the master, see replication.go
+var masterAuth = ""
+
+var allowedWithoutAuth = map[RespCommand]bool{
+	RESP_AUTH: true, RESP_HELLO: true,
+}
+
+func init() {
+	configParameters["requirepass"] = configParameter{
+		get: func() string { return requirePass },
+		set: func(value string) error {
+			user := aclUsers[defaultUser]
+			if value == "" {
+				user.applyRule("nopass")
+			} else {
+				user.applyRule("resetpass")
+				user.applyRule(">" + value)
+			}
+			requirePass = value
+			return nil
+		},
+	}
+	configParameters["masterauth"] = configParameter{
+		get: func() string { return masterAuth },
+		set: func(value string) error {
+			masterAuth = value
+			return nil
+		},
+	}
+}
+
+func errNoAuth() error {
+	return &respError{RESP_NOAUTH, "Authentication required."}
+}
+
+func errWrongPass() error {
+	return &respError{RESP_WRONGPASS, "invalid username-password pair or user is disabled."}
+}
+
+func (c *Client) mustAuthenticate() bool {
+	user := aclUsers[defaultUser]
+	return !c.authenticated && (!user.nopass || !user.enabled)
+}
+
+func authenticate(client *Client, username string, password string) error {
+	user := aclUsers[username]
+	if user == nil || !user.enabled || !user.checkPassword(password) {
+		addAclLogEntry("auth", aclContext(client), "AUTH", username, client)
+		return errWrongPass()
+	}
+	client.user, client.authenticated = user, true
+	return nil
+}
+
+// Log in a client as username without a password, used by the network layer
+// for users named by TLS client certificates. Reports whether the user
+// exists and is enabled, otherwise the client is left as it is.
+func AuthenticateAs(client *Client, username string) bool {
+	done := make(chan bool)
+	taskChannel <- func() {
+		user := aclUsers[username]
+		ok := user != nil && user.enabled
+		if ok {
+			client.user, client.authenticated = user, true
+		}
+		done <- ok
+	}
+	return <-done
+}
+
+// AUTH [username] password
+func process_auth(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	username, password := defaultUser, ""
+	switch len(request.args) {
+	case 1:
+		password = request.args[0]
+		if aclUsers[defaultUser].nopass {
+			return nil, errors.New("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	case 2:
+		username, password = request.args[0], request.args[1]
+	default:
+		return nil, errors.New("wrong number of arguments for 'auth' command")
+	}
+	if err := authenticate(request.client, username, password); err != nil {
+		return nil, err
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+// HELLO [protover [AUTH username password]], authenticating first so that a
+// wrong password leaves the protocol alone.
+func helloAuth(request *RespRequest) error {
+	args := request.args
+	if len(args) > 1 {
+		if len(args) != 4 || !strings.EqualFold(args[1], "AUTH") {
+			return errors.New("syntax error in HELLO option")
+		}
+		return authenticate(request.client, args[2], args[3])
+	}
+	if request.client.mustAuthenticate() {
+		return &respError{RESP_NOAUTH, "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package resp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireTestPass(t *testing.T) {
+	require.NoError(t, onExecutor(func() error { return ConfigSet("requirepass", "secret") }))
+	t.Cleanup(func() {
+		onExecutor(func() error { return ConfigSet("requirepass", "") })
+	})
+}
+
+func TestAuth(t *testing.T) {
+	client := NewClient()
+	require.Contains(t, sendCommand(client, "AUTH secret"), "without any password configured")
+
+	requireTestPass(t)
+	require.Equal(t, "-NOAUTH Authentication required.\r\n", sendCommand(client, "GET authKey"))
+	require.Equal(t, "-ERR unknown command, NOPE\r\n", sendCommand(client, "NOPE"))
+	require.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", sendCommand(client, "AUTH wrong"))
+	require.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", sendCommand(client, "AUTH other secret"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "AUTH secret"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET authKey"))
+
+	other := NewClient()
+	require.Equal(t, "-NOAUTH Authentication required.\r\n", sendCommand(other, "MULTI"))
+	require.Equal(t, "+OK\r\n", sendCommand(other, "AUTH default secret"))
+	require.Equal(t, "+OK\r\n", sendCommand(other, "MULTI"))
+	require.Equal(t, "+QUEUED\r\n", sendCommand(other, "GET authKey"))
+	require.Equal(t, "*1\r\n_\r\n", sendCommand(other, "EXEC"))
+}
+
+func TestHelloAuth(t *testing.T) {
+	requireTestPass(t)
+	client := NewClient()
+	require.Contains(t, sendCommand(client, "HELLO 3"), "NOAUTH HELLO must be called with the client already authenticated")
+	require.Contains(t, sendCommand(client, "HELLO 3 AUTH default wrong"), "WRONGPASS")
+	require.Contains(t, sendCommand(client, "HELLO 3 AUTH default secret"), "proto")
+	require.Equal(t, "_\r\n", sendCommand(client, "GET authKey"))
+}
@@ -0,0 +1,254 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Out of band messages that may be queued for a client before it is
+// disconnected for not keeping up.
+const pushBufferSize = 1024
+
+var lastClientId atomic.Int64
+
+// Clients by id, for commands that refer to other clients. Only clients of
+// actual connections are registered.
+var clientsById sync.Map
+
+// Clients idle for longer are disconnected, 0 never disconnects them.
+var clientIdleTimeout time.Duration
+
+// Connections beyond maxclients are refused by the network layer, which
+// asks from its own goroutines, hence the atomics.
+var maxClients atomic.Int64
+var connectedClients atomic.Int64
+
+func init() {
+	maxClients.Store(10000)
+	configParameters["timeout"] = configParameter{
+		get: func() string { return fmt.Sprint(int64(clientIdleTimeout.Seconds())) },
+		set: func(value string) error {
+			seconds, err := parseNonNegative(value)
+			if err == nil {
+				clientIdleTimeout = time.Duration(seconds) * time.Second
+			}
+			return err
+		},
+	}
+	configParameters["maxclients"] = configParameter{
+		get: func() string { return fmt.Sprint(maxClients.Load()) },
+		set: func(value string) error {
+			number, err := parseNonNegative(value)
+			if err != nil || number < 1 {
+				return errors.New("argument must be a positive integer")
+			}
+			maxClients.Store(number)
+			return nil
+		},
+	}
+}
+
+// Per connection state. A Client is created by the network layer for each
+// accepted connection and is only ever read or modified by the executor
+// goroutine, so no locking is needed.
+type Client struct {
+	id       int64
+	addr     string
+	db       int
+	protocol int
+	pushes   chan []byte
+	done     chan struct{}
+	killed   bool
+
+	// Transaction state, see multi.go
+	multi        bool
+	multiAborted bool
+	queued       []*RespRequest
+
+	// Optimistic locking state, see watch.go
+	watched []watchedKey
+	dirty   bool
+
+	// Pub/sub state, see pubsub.go
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+
+	// Client side caching state, see tracking.go
+	tracking tracking
+
+	// Set once the client is a replica of this server, see replication.go
+	replica *replicaState
+
+	// Where the last write of the client ended in the replication stream
+	// and the append only file, and what it waits for, see wait.go
+	writeOffset    int64
+	aofWriteOffset int64
+	blocked        *durabilityWait
+
+	// Allowed once into a slot being imported, see cluster.go
+	asking bool
+
+	// Whether the client passed AUTH and as which user, nil being the
+	// default user, see auth.go and acl.go
+	authenticated bool
+	user          *aclUser
+
+	// When the client last ran a command, for the idle timeout
+	lastInteraction time.Time
+}
+
+func NewClient() *Client {
+	client := newClient()
+	clientsById.Store(client.id, client)
+	connectedClients.Add(1)
+	return client
+}
+
+// Whether another connection would exceed maxclients. The network layer
+// refuses such connections with the error.
+func MaxClientsReached() bool {
+	return connectedClients.Load() >= maxClients.Load()
+}
+
+func newClient() *Client {
+	return &Client{
+		id:       lastClientId.Add(1),
+		protocol: 2,
+		pushes:   make(chan []byte, pushBufferSize),
+		done:     make(chan struct{}),
+		channels: map[string]struct{}{},
+		patterns: map[string]struct{}{},
+
+		shardChannels: map[string]struct{}{},
+
+		lastInteraction: time.Now(),
+	}
+}
+
+// Messages the server sends without a preceding request, e.g. pub/sub
+// messages. The network layer writes them to the connection as they come.
+func (c *Client) Pushes() <-chan []byte {
+	return c.pushes
+}
+
+// Closed when the server wants the connection of the client to be closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// The address of the peer, set by the network layer.
+func (c *Client) SetAddr(addr string) {
+	c.addr = addr
+}
+
+func (c *Client) kill() {
+	if !c.killed {
+		c.killed = true
+		close(c.done)
+	}
+}
+
+// Disconnect clients that did nothing for longer than the timeout, except
+// those that wait for something else to happen: subscribers, replicas and
+// blocked clients.
+func closeIdleClients() {
+	if clientIdleTimeout == 0 {
+		return
+	}
+	now := time.Now()
+	clientsById.Range(func(_, value any) bool {
+		client := value.(*Client)
+		if client.isSubscribed() || client.replica != nil || client.blocked != nil {
+			return true
+		}
+		if now.Sub(client.lastInteraction) > clientIdleTimeout {
+			log.Printf("closing client %d, idle for longer than %s", client.id, clientIdleTimeout)
+			client.kill()
+		}
+		return true
+	})
+}
+
+func lookupClient(id int64) *Client {
+	if client, ok := clientsById.Load(id); ok {
+		return client.(*Client)
+	}
+	return nil
+}
+
+// Queue a push for the client. Like Redis' pubsub output buffer limit, a
+// client that is not reading its pushes is disconnected rather than blocking
+// the executor or silently losing messages.
+func (c *Client) push(elements []*RespResponse) {
+	if c.killed {
+		return
+	}
+	response := &RespResponse{t: DT_PUSHES, elements: elements}
+	if !c.pushRaw(response.forProtocol(c.protocol).marshalToBytes()) {
+		log.Printf("Client %d is not keeping up with its pushes, disconnecting it", c.id)
+		c.kill()
+	}
+}
+
+// Queue data that is written to the connection as is. Unlike pushes the
+// data must not be lost, false is returned when the buffer is full.
+func (c *Client) pushRaw(data []byte) bool {
+	select {
+	case c.pushes <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscribed RESP2 clients cannot tell a reply from a message, so they get
+// the pong as a message shaped array.
+func process_ping(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) > 1 {
+		return nil, errors.New("ping command takes at most one message argument")
+	}
+	if request.client.isSubscribed() && request.client.protocol < 3 {
+		message := ""
+		if len(request.args) == 1 {
+			message = request.args[0]
+		}
+		return newRespArrayResponse(bulkStrings(strings.ToLower(RESP_PONG), message)), nil
+	}
+	if len(request.args) == 1 {
+		return newRespResponse(DT_BULK_STRINGS, request.args), nil
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_PONG}), nil
+}
+
+// Switch protocol version, RESP3 gives clients pushes and maps. The client
+// may authenticate at the same time.
+func process_hello(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	protocol := request.client.protocol
+	if len(request.args) > 0 {
+		switch request.args[0] {
+		case "2", "3":
+			protocol = int(request.args[0][0] - '0')
+		default:
+			return nil, &respError{RESP_NOPROTO, "unsupported protocol version"}
+		}
+	}
+	if err := helloAuth(request); err != nil {
+		return nil, err
+	}
+	request.client.protocol = protocol
+	return newRespMapResponse([]*RespResponse{
+		newRespResponse(DT_BULK_STRINGS, []string{"server"}), newRespResponse(DT_BULK_STRINGS, []string{"redis"}),
+		newRespResponse(DT_BULK_STRINGS, []string{"version"}), newRespResponse(DT_BULK_STRINGS, []string{serverVersion}),
+		newRespResponse(DT_BULK_STRINGS, []string{"proto"}), integerResponse(protocol),
+		newRespResponse(DT_BULK_STRINGS, []string{"id"}), newRespResponse(DT_INTEGER, []string{fmt.Sprint(request.client.id)}),
+		newRespResponse(DT_BULK_STRINGS, []string{"mode"}), newRespResponse(DT_BULK_STRINGS, []string{"standalone"}),
+		newRespResponse(DT_BULK_STRINGS, []string{"role"}), newRespResponse(DT_BULK_STRINGS, []string{role()}),
+		newRespResponse(DT_BULK_STRINGS, []string{"modules"}), newRespArrayResponse([]*RespResponse{}),
+	}), nil
+}
@@ -0,0 +1,49 @@
+package resp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIdleTimeout(t *testing.T) {
+	idle, subscriber, active := NewClient(), NewClient(), NewClient()
+	defer CloseClient(subscriber)
+	defer CloseClient(active)
+	sendCommand(subscriber, "SUBSCRIBE idleEvents")
+
+	require.NoError(t, onExecutor(func() error {
+		idle.lastInteraction = time.Now().Add(-2 * time.Second)
+		subscriber.lastInteraction = idle.lastInteraction
+		return ConfigSet("timeout", "1")
+	}))
+	defer onExecutor(func() error { return ConfigSet("timeout", "0") })
+	sendCommand(active, "PING")
+	onExecutor(func() error {
+		closeIdleClients()
+		return nil
+	})
+
+	// Subscribers wait for messages rather than being idle
+	select {
+	case <-idle.Done():
+	default:
+		t.Fatal("an idle client is disconnected")
+	}
+	for _, client := range []*Client{subscriber, active} {
+		select {
+		case <-client.Done():
+			t.Fatal("only idle clients are disconnected")
+		default:
+		}
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	require.Contains(t, sendCommand(NewClient(), "CONFIG SET maxclients 0"), "positive integer")
+	require.False(t, MaxClientsReached())
+	require.NoError(t, onExecutor(func() error { return ConfigSet("maxclients", "1") }))
+	defer onExecutor(func() error { return ConfigSet("maxclients", "10000") })
+	require.True(t, MaxClientsReached())
+}
@@ -0,0 +1,870 @@
+// Cluster mode spreads the keys over several nodes by hash slot. Every node
+// knows which node serves each slot and redirects clients with MOVED, or
+// with ASK while a slot is migrated to another node. The nodes keep each
+// other up to date on the cluster bus, see cluster_bus.go.
+package resp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johanlantz/redis/storage"
+	"github.com/johanlantz/redis/utils"
+)
+
+type clusterNodeFlags int
+
+const (
+	NODE_MYSELF clusterNodeFlags = 1 << iota
+	NODE_MASTER
+	NODE_PFAIL     // not reachable according to this node
+	NODE_FAIL      // not reachable according to a majority of the masters
+	NODE_HANDSHAKE // met but the id is not known yet
+)
+
+var clusterEnabled = false
+var clusterConfigFile = "nodes.conf"
+var clusterPort = 0
+var clusterNodeTimeout = 15 * time.Second
+
+type clusterNode struct {
+	id          string
+	ip          string
+	port        int
+	busPort     int
+	flags       clusterNodeFlags
+	configEpoch int64
+	created     time.Time
+
+	link        *instanceLink
+	lastPing    time.Time
+	pingPending bool
+	// The first PING still waiting for a reply, zero when answered
+	pingSent     time.Time
+	pongReceived time.Time
+	// Masters that consider the node unreachable, by id
+	failReports map[string]time.Time
+}
+
+var myself *clusterNode
+var clusterNodes = map[string]*clusterNode{}
+var clusterCurrentEpoch int64 = 0
+
+// Who serves each slot and which slots are moving, only used by the
+// executor. Migrating slots are served here until the keys are gone,
+// importing slots only accept clients that were sent here with ASK.
+var clusterSlots [utils.HashSlots]*clusterNode
+var migratingSlots = map[int]*clusterNode{}
+var importingSlots = map[int]*clusterNode{}
+
+// A copy of the slot table for the network goroutine, which redirects
+// requests before they reach the executor. It is rebuilt by the executor
+// after every change, hence the mutex.
+var clusterRouting struct {
+	sync.RWMutex
+	ok     bool
+	served [utils.HashSlots]bool
+	moving [utils.HashSlots]bool
+	addrs  [utils.HashSlots]string
+}
+
+// Changes are applied to the routing copy and the nodes file in one go.
+var clusterRoutingDirty = false
+var clusterConfigDirty = false
+
+func init() {
+	configParameters["cluster-enabled"] = configParameter{
+		get: func() string { return yesNo(clusterEnabled) },
+		set: immutable(func(value string) error {
+			enable, err := parseYesNo(value)
+			if err == nil {
+				clusterEnabled = enable
+			}
+			return err
+		}),
+	}
+	configParameters["cluster-config-file"] = configParameter{
+		get: func() string { return clusterConfigFile },
+		set: immutable(func(value string) error {
+			clusterConfigFile = value
+			return nil
+		}),
+	}
+	configParameters["cluster-port"] = configParameter{
+		get: func() string { return fmt.Sprint(clusterPort) },
+		set: immutable(func(value string) error {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return errors.New("argument must be a port number")
+			}
+			clusterPort = port
+			return nil
+		}),
+	}
+	configParameters["cluster-node-timeout"] = configParameter{
+		get: func() string { return fmt.Sprint(clusterNodeTimeout.Milliseconds()) },
+		set: func(value string) error {
+			milliseconds, err := parseNonNegative(value)
+			if err != nil || milliseconds == 0 {
+				return errors.New("argument must be a positive number of milliseconds")
+			}
+			clusterNodeTimeout = time.Duration(milliseconds) * time.Millisecond
+			return nil
+		},
+	}
+}
+
+func newClusterNodeId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func newClusterNode(id string, ip string, port int, busPort int, flags clusterNodeFlags) *clusterNode {
+	return &clusterNode{
+		id: id, ip: ip, port: port, busPort: busPort, flags: flags,
+		created: time.Now(), failReports: map[string]time.Time{},
+	}
+}
+
+func (node *clusterNode) addr() string {
+	return net.JoinHostPort(node.ip, fmt.Sprint(node.port))
+}
+
+func (node *clusterNode) is(flags clusterNodeFlags) bool {
+	return node.flags&flags != 0
+}
+
+func (node *clusterNode) closeLink() {
+	if node.link != nil {
+		node.link.close()
+		node.link = nil
+	}
+	node.pingPending = false
+}
+
+func (node *clusterNode) slots() []int {
+	slots := []int{}
+	for slot, owner := range clusterSlots {
+		if owner == node {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+func clusterChanged() {
+	clusterRoutingDirty, clusterConfigDirty = true, true
+}
+
+// Apply pending changes, called by the executor after handling anything
+// that may change the cluster.
+func clusterFlushChanges() {
+	if clusterRoutingDirty {
+		updateClusterRouting()
+		clusterRoutingDirty = false
+	}
+	if clusterConfigDirty {
+		if err := saveClusterConfig(); err != nil {
+			log.Printf("Error saving the cluster config: %s", err.Error())
+		}
+		clusterConfigDirty = false
+	}
+}
+
+// Every slot has to be served by a node that is not failing.
+func clusterStateOk() bool {
+	for _, owner := range clusterSlots {
+		if owner == nil || owner.is(NODE_FAIL) {
+			return false
+		}
+	}
+	return true
+}
+
+func updateClusterRouting() {
+	clusterRouting.Lock()
+	defer clusterRouting.Unlock()
+	clusterRouting.ok = clusterStateOk()
+	for slot, owner := range clusterSlots {
+		clusterRouting.served[slot] = owner == myself
+		clusterRouting.moving[slot] = migratingSlots[slot] != nil || importingSlots[slot] != nil
+		clusterRouting.addrs[slot] = ""
+		if owner != nil {
+			clusterRouting.addrs[slot] = owner.addr()
+		}
+	}
+}
+
+func errCrossSlot() error {
+	return &respError{RESP_CROSSSLOT, "Keys in request don't hash to the same slot"}
+}
+
+// The slot all keys hash to, -1 without keys.
+func keysSlot(keys []string) (int, error) {
+	if len(keys) == 0 {
+		return -1, nil
+	}
+	slot := utils.HashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if utils.HashSlot(key) != slot {
+			return 0, errCrossSlot()
+		}
+	}
+	return slot, nil
+}
+
+// Redirect requests for slots served by other nodes before they reach the
+// executor. Whether a slot that is moving is served here depends on the
+// keys present, that is left to the executor.
+func clusterRedirection(request *RespRequest) error {
+	if !clusterEnabled {
+		return nil
+	}
+	slot, err := keysSlot(commandKeys(request))
+	if err != nil || slot < 0 {
+		return err
+	}
+	clusterRouting.RLock()
+	defer clusterRouting.RUnlock()
+	switch {
+	case !clusterRouting.ok:
+		return &respError{RESP_CLUSTERDOWN, "The cluster is down"}
+	case clusterRouting.served[slot] || clusterRouting.moving[slot]:
+		return nil
+	case clusterRouting.addrs[slot] == "":
+		return &respError{RESP_CLUSTERDOWN, "Hash slot not served"}
+	}
+	return &respError{RESP_MOVED, fmt.Sprintf("%d %s", slot, clusterRouting.addrs[slot])}
+}
+
+// The part of the redirection done by the executor, for slots that are
+// moving and for transactions as a whole.
+func clusterAdmit(request *RespRequest) error {
+	asking := request.client.asking || request.command == RESP_RESTORE_ASKING
+	if request.command != RESP_ASKING {
+		request.client.asking = false
+	}
+	if !clusterEnabled {
+		return nil
+	}
+	keys := commandKeys(request)
+	if request.command == RESP_EXEC {
+		for _, queued := range request.client.queued {
+			keys = append(keys, commandKeys(queued)...)
+		}
+	}
+	slot, err := keysSlot(keys)
+	if err != nil || slot < 0 {
+		return err
+	}
+
+	missing := 0
+	for _, key := range keys {
+		if databases[0].Get(key).IsNull() {
+			missing++
+		}
+	}
+	owner := clusterSlots[slot]
+	if target := migratingSlots[slot]; target != nil && owner == myself && missing > 0 {
+		if missing < len(keys) {
+			return &respError{RESP_TRYAGAIN, "Multiple keys request during rehashing of slot"}
+		}
+		return &respError{RESP_ASK, fmt.Sprintf("%d %s", slot, target.addr())}
+	}
+	if importingSlots[slot] != nil && owner != myself && asking {
+		if missing > 0 && len(keys) > 1 {
+			return &respError{RESP_TRYAGAIN, "Multiple keys request during rehashing of slot"}
+		}
+		return nil
+	}
+	switch owner {
+	case myself:
+		return nil
+	case nil:
+		return &respError{RESP_CLUSTERDOWN, "Hash slot not served"}
+	}
+	return &respError{RESP_MOVED, fmt.Sprintf("%d %s", slot, owner.addr())}
+}
+
+func process_asking(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if !clusterEnabled {
+		return nil, errors.New("This instance has cluster support disabled")
+	}
+	request.client.asking = true
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+func clusterConfigPath() string {
+	if filepath.IsAbs(clusterConfigFile) {
+		return clusterConfigFile
+	}
+	return filepath.Join(workingDir, clusterConfigFile)
+}
+
+// Load the nodes file or start as a new node without slots. The file keeps
+// the identity of the node and what it knew about the cluster.
+func loadClusterConfig() error {
+	file, err := os.Open(clusterConfigPath())
+	if errors.Is(err, os.ErrNotExist) {
+		myself = newClusterNode(newClusterNodeId(), "", serverPort, clusterBusPort(), NODE_MYSELF|NODE_MASTER)
+		clusterNodes[myself.id] = myself
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					clusterCurrentEpoch, _ = strconv.ParseInt(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("invalid line in the cluster config: %s", scanner.Text())
+		}
+		node, err := parseNodeLine(fields)
+		if err != nil {
+			return err
+		}
+		if node.is(NODE_MYSELF) {
+			myself = node
+		}
+		clusterNodes[node.id] = node
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if myself == nil {
+		return errors.New("the cluster config does not contain the node itself")
+	}
+	myself.port, myself.busPort = serverPort, clusterBusPort()
+	return nil
+}
+
+// A line of the nodes file, the same as in the output of CLUSTER NODES.
+func parseNodeLine(fields []string) (*clusterNode, error) {
+	address, busPort, _ := strings.Cut(fields[1], "@")
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address in the cluster config: %s", fields[1])
+	}
+	node := newClusterNode(fields[0], host, 0, 0, 0)
+	node.port, _ = strconv.Atoi(port)
+	node.busPort, _ = strconv.Atoi(busPort)
+	for _, flag := range strings.Split(fields[2], ",") {
+		switch flag {
+		case "myself":
+			node.flags |= NODE_MYSELF
+		case "master":
+			node.flags |= NODE_MASTER
+		case "fail":
+			node.flags |= NODE_FAIL
+		}
+	}
+	node.configEpoch, _ = strconv.ParseInt(fields[6], 10, 64)
+	for _, slots := range fields[8:] {
+		if strings.HasPrefix(slots, "[") {
+			continue
+		}
+		start, end, err := parseSlotRange(slots)
+		if err != nil {
+			return nil, err
+		}
+		for slot := start; slot <= end; slot++ {
+			clusterSlots[slot] = node
+		}
+	}
+	return node, nil
+}
+
+func saveClusterConfig() error {
+	var config strings.Builder
+	for _, node := range sortedClusterNodes() {
+		if !node.is(NODE_HANDSHAKE) {
+			config.WriteString(nodeLine(node) + "\n")
+		}
+	}
+	fmt.Fprintf(&config, "vars currentEpoch %d lastVoteEpoch 0\n", clusterCurrentEpoch)
+
+	path := clusterConfigPath()
+	file, err := os.CreateTemp(filepath.Dir(path), "temp-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(config.String())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func sortedClusterNodes() []*clusterNode {
+	nodes := []*clusterNode{}
+	for _, node := range clusterNodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+func nodeFlags(node *clusterNode) string {
+	flags := []string{}
+	if node.is(NODE_MYSELF) {
+		flags = append(flags, "myself")
+	}
+	if node.is(NODE_MASTER) {
+		flags = append(flags, "master")
+	}
+	if node.is(NODE_FAIL) {
+		flags = append(flags, "fail")
+	} else if node.is(NODE_PFAIL) {
+		flags = append(flags, "fail?")
+	}
+	if node.is(NODE_HANDSHAKE) {
+		flags = append(flags, "handshake")
+	}
+	if len(flags) == 0 {
+		return "noflags"
+	}
+	return strings.Join(flags, ",")
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func nodeLine(node *clusterNode) string {
+	linkState := "connected"
+	if !node.is(NODE_MYSELF) && (node.pongReceived.IsZero() || node.is(NODE_PFAIL|NODE_FAIL)) {
+		linkState = "disconnected"
+	}
+	fields := []string{
+		node.id, fmt.Sprintf("%s@%d", node.addr(), node.busPort), nodeFlags(node), "-",
+		fmt.Sprint(unixMilli(node.pingSent)), fmt.Sprint(unixMilli(node.pongReceived)),
+		fmt.Sprint(node.configEpoch), linkState,
+	}
+	for _, slots := range slotRanges(node.slots()) {
+		if slots[0] == slots[1] {
+			fields = append(fields, fmt.Sprint(slots[0]))
+		} else {
+			fields = append(fields, fmt.Sprintf("%d-%d", slots[0], slots[1]))
+		}
+	}
+	if node == myself {
+		for _, slot := range sortedSlots(migratingSlots) {
+			fields = append(fields, fmt.Sprintf("[%d->-%s]", slot, migratingSlots[slot].id))
+		}
+		for _, slot := range sortedSlots(importingSlots) {
+			fields = append(fields, fmt.Sprintf("[%d-<-%s]", slot, importingSlots[slot].id))
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func sortedSlots(slots map[int]*clusterNode) []int {
+	sorted := []int{}
+	for slot := range slots {
+		sorted = append(sorted, slot)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// Contiguous ranges of sorted slots.
+func slotRanges(slots []int) [][2]int {
+	ranges := [][2]int{}
+	for _, slot := range slots {
+		if last := len(ranges) - 1; last >= 0 && ranges[last][1] == slot-1 {
+			ranges[last][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+func parseSlot(value string) (int, error) {
+	slot, err := strconv.Atoi(value)
+	if err != nil || slot < 0 || slot >= utils.HashSlots {
+		return 0, errors.New("Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// A single slot or a start-end range.
+func parseSlotRange(value string) (int, int, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	start, err := parseSlot(first)
+	if err != nil || !isRange {
+		return start, start, err
+	}
+	end, err := parseSlot(last)
+	if err == nil && end < start {
+		err = errors.New("Invalid or out of range slot")
+	}
+	return start, end, err
+}
+
+func clusterNodeByAddr(ip string, port int) *clusterNode {
+	for _, node := range clusterNodes {
+		if node.ip == ip && node.port == port {
+			return node
+		}
+	}
+	return nil
+}
+
+func countKeysInSlot(slot int) int {
+	count := 0
+	databases[0].ForEach(func(key string, entry storage.Entry) {
+		if utils.HashSlot(key) == slot {
+			count++
+		}
+	})
+	return count
+}
+
+// The configuration of the node has to win over the others, e.g. after
+// taking over a slot, without waiting for an agreement.
+func bumpConfigEpoch() {
+	maxEpoch := int64(0)
+	for _, node := range clusterNodes {
+		maxEpoch = max(maxEpoch, node.configEpoch)
+	}
+	if myself.configEpoch == 0 || myself.configEpoch != maxEpoch {
+		clusterCurrentEpoch++
+		myself.configEpoch = clusterCurrentEpoch
+	}
+}
+
+func clusterInfo() string {
+	assigned, pfail, fail := 0, 0, 0
+	masters := map[*clusterNode]bool{}
+	for _, owner := range clusterSlots {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		masters[owner] = true
+		switch {
+		case owner.is(NODE_FAIL):
+			fail++
+		case owner.is(NODE_PFAIL):
+			pfail++
+		}
+	}
+	state := "fail"
+	if clusterStateOk() {
+		state = "ok"
+	}
+	return strings.Join([]string{
+		"cluster_enabled:1",
+		"cluster_state:" + state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", len(clusterNodes)),
+		fmt.Sprintf("cluster_size:%d", len(masters)),
+		fmt.Sprintf("cluster_current_epoch:%d", clusterCurrentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", myself.configEpoch),
+	}, "\r\n") + "\r\n"
+}
+
+func clusterSlotsResponse() *RespResponse {
+	type slotRange struct {
+		start, end int
+		node       *clusterNode
+	}
+	ranges := []slotRange{}
+	for _, node := range sortedClusterNodes() {
+		for _, slots := range slotRanges(node.slots()) {
+			ranges = append(ranges, slotRange{slots[0], slots[1], node})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	entries := []*RespResponse{}
+	for _, r := range ranges {
+		entries = append(entries, newRespArrayResponse([]*RespResponse{
+			integerResponse(r.start),
+			integerResponse(r.end),
+			newRespArrayResponse([]*RespResponse{
+				newRespResponse(DT_BULK_STRINGS, []string{r.node.ip}),
+				integerResponse(r.node.port),
+				newRespResponse(DT_BULK_STRINGS, []string{r.node.id}),
+			}),
+		}))
+	}
+	return newRespArrayResponse(entries)
+}
+
+func clusterShardsResponse() *RespResponse {
+	shards := []*RespResponse{}
+	for _, node := range sortedClusterNodes() {
+		if !node.is(NODE_MASTER) || node.is(NODE_HANDSHAKE) {
+			continue
+		}
+		slots := []*RespResponse{}
+		for _, r := range slotRanges(node.slots()) {
+			slots = append(slots, integerResponse(r[0]), integerResponse(r[1]))
+		}
+		health := "online"
+		if node.is(NODE_PFAIL | NODE_FAIL) {
+			health = "failed"
+		}
+		description := newRespMapResponse([]*RespResponse{
+			newRespResponse(DT_BULK_STRINGS, []string{"id"}), newRespResponse(DT_BULK_STRINGS, []string{node.id}),
+			newRespResponse(DT_BULK_STRINGS, []string{"port"}), integerResponse(node.port),
+			newRespResponse(DT_BULK_STRINGS, []string{"ip"}), newRespResponse(DT_BULK_STRINGS, []string{node.ip}),
+			newRespResponse(DT_BULK_STRINGS, []string{"endpoint"}), newRespResponse(DT_BULK_STRINGS, []string{node.ip}),
+			newRespResponse(DT_BULK_STRINGS, []string{"role"}), newRespResponse(DT_BULK_STRINGS, []string{"master"}),
+			newRespResponse(DT_BULK_STRINGS, []string{"replication-offset"}), newRespResponse(DT_INTEGER, []string{fmt.Sprint(replicationOffset)}),
+			newRespResponse(DT_BULK_STRINGS, []string{"health"}), newRespResponse(DT_BULK_STRINGS, []string{health}),
+		})
+		shards = append(shards, newRespMapResponse([]*RespResponse{
+			newRespResponse(DT_BULK_STRINGS, []string{"slots"}), newRespArrayResponse(slots),
+			newRespResponse(DT_BULK_STRINGS, []string{"nodes"}), newRespArrayResponse([]*RespResponse{description}),
+		}))
+	}
+	return newRespArrayResponse(shards)
+}
+
+// Slots given as arguments, each at most once.
+func parseSlotArgs(args []string, ranges bool) ([]int, error) {
+	if len(args) == 0 || ranges && len(args)%2 != 0 {
+		return nil, errors.New("wrong number of arguments")
+	}
+	seen := map[int]bool{}
+	slots := []int{}
+	step := 1
+	if ranges {
+		step = 2
+	}
+	for i := 0; i < len(args); i += step {
+		start, err := parseSlot(args[i])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if ranges {
+			if end, err = parseSlot(args[i+1]); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, fmt.Errorf("start slot number %d is greater than end slot number %d", start, end)
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			if seen[slot] {
+				return nil, fmt.Errorf("Slot %d specified multiple times", slot)
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+func process_cluster(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if !clusterEnabled {
+		return nil, errors.New("This instance has cluster support disabled")
+	}
+	if len(request.args) < 1 {
+		return nil, errors.New("wrong number of arguments for 'cluster' command")
+	}
+	defer clusterFlushChanges()
+	args := request.args[1:]
+	ok := newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK})
+	switch strings.ToUpper(request.args[0]) {
+	case "INFO":
+		return newRespResponse(DT_BULK_STRINGS, []string{clusterInfo()}), nil
+	case "MYID":
+		return newRespResponse(DT_BULK_STRINGS, []string{myself.id}), nil
+	case "NODES":
+		lines := []string{}
+		for _, node := range sortedClusterNodes() {
+			lines = append(lines, nodeLine(node))
+		}
+		return newRespResponse(DT_BULK_STRINGS, []string{strings.Join(lines, "\n") + "\n"}), nil
+	case "SLOTS":
+		return clusterSlotsResponse(), nil
+	case "SHARDS":
+		return clusterShardsResponse(), nil
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return nil, errors.New("wrong number of arguments for 'cluster|keyslot' command")
+		}
+		return integerResponse(utils.HashSlot(args[0])), nil
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return nil, errors.New("wrong number of arguments for 'cluster|countkeysinslot' command")
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return integerResponse(countKeysInSlot(slot)), nil
+	case "GETKEYSINSLOT":
+		if len(args) != 2 {
+			return nil, errors.New("wrong number of arguments for 'cluster|getkeysinslot' command")
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return nil, errors.New("Invalid number of keys")
+		}
+		keys := []string{}
+		kv.ForEach(func(key string, entry storage.Entry) {
+			if len(keys) < count && utils.HashSlot(key) == slot {
+				keys = append(keys, key)
+			}
+		})
+		sort.Strings(keys)
+		return newRespArrayResponse(bulkStrings(keys...)), nil
+	case "ADDSLOTS", "ADDSLOTSRANGE", "DELSLOTS", "DELSLOTSRANGE":
+		subcommand := strings.ToUpper(request.args[0])
+		slots, err := parseSlotArgs(args, strings.HasSuffix(subcommand, "RANGE"))
+		if err != nil {
+			return nil, err
+		}
+		adding := strings.HasPrefix(subcommand, "ADD")
+		for _, slot := range slots {
+			if adding && clusterSlots[slot] != nil {
+				return nil, fmt.Errorf("Slot %d is already busy", slot)
+			}
+			if !adding && clusterSlots[slot] == nil {
+				return nil, fmt.Errorf("Slot %d is already unassigned", slot)
+			}
+		}
+		for _, slot := range slots {
+			clusterSlots[slot] = nil
+			if adding {
+				clusterSlots[slot] = myself
+				delete(importingSlots, slot)
+			}
+		}
+		clusterChanged()
+		return ok, nil
+	case "MEET":
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errors.New("wrong number of arguments for 'cluster|meet' command")
+		}
+		port, err := strconv.Atoi(args[1])
+		busPort := port + 10000
+		if len(args) == 3 && err == nil {
+			busPort, err = strconv.Atoi(args[2])
+		}
+		if err != nil || net.ParseIP(args[0]) == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+			return nil, fmt.Errorf("Invalid node address specified: %s:%s", args[0], args[1])
+		}
+		if clusterNodeByAddr(args[0], port) == nil {
+			node := newClusterNode(newClusterNodeId(), args[0], port, busPort, NODE_HANDSHAKE|NODE_MASTER)
+			clusterNodes[node.id] = node
+		}
+		return ok, nil
+	case "SETSLOT":
+		if err := setSlot(args); err != nil {
+			return nil, err
+		}
+		return ok, nil
+	case "SAVECONFIG":
+		if err := saveClusterConfig(); err != nil {
+			return nil, fmt.Errorf("error saving the cluster node config: %s", err.Error())
+		}
+		return ok, nil
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+}
+
+// CLUSTER SETSLOT slot IMPORTING node | MIGRATING node | STABLE | NODE node
+func setSlot(args []string) error {
+	if len(args) < 2 {
+		return errors.New("wrong number of arguments for 'cluster|setslot' command")
+	}
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return err
+	}
+	action := strings.ToUpper(args[1])
+	if action == "STABLE" {
+		delete(migratingSlots, slot)
+		delete(importingSlots, slot)
+		clusterChanged()
+		return nil
+	}
+	if len(args) != 3 || action != "IMPORTING" && action != "MIGRATING" && action != "NODE" {
+		return errors.New("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	node := clusterNodes[args[2]]
+	if node == nil || node.is(NODE_HANDSHAKE) {
+		return fmt.Errorf("I don't know about node %s", args[2])
+	}
+
+	switch action {
+	case "MIGRATING":
+		if clusterSlots[slot] != myself {
+			return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		if node == myself {
+			return errors.New("Target node is myself")
+		}
+		migratingSlots[slot] = node
+	case "IMPORTING":
+		if clusterSlots[slot] == myself {
+			return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		if node == myself {
+			return errors.New("Source node is myself")
+		}
+		importingSlots[slot] = node
+	case "NODE":
+		if clusterSlots[slot] == myself && node != myself && countKeysInSlot(slot) > 0 {
+			return fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		if node != myself {
+			delete(migratingSlots, slot)
+		}
+		// Importing is done, the new owner announces the slot with a new
+		// epoch so that the other nodes take it over
+		if node == myself && importingSlots[slot] != nil {
+			delete(importingSlots, slot)
+			bumpConfigEpoch()
+		}
+		clusterSlots[slot] = node
+	}
+	clusterChanged()
+	return nil
+}
@@ -0,0 +1,431 @@
+// The cluster bus, on which the nodes ping each other every second. Every
+// message carries the slots and epochs of its sender and gossip about the
+// other nodes it knows, which is how new nodes and failures spread.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/aof"
+	"github.com/johanlantz/redis/utils"
+)
+
+const (
+	BUS_PING = "PING"
+	BUS_MEET = "MEET" // a PING that makes the receiver add the sender
+	BUS_PONG = "PONG"
+	BUS_FAIL = "FAIL"
+)
+
+const clusterPingInterval = time.Second
+
+// The fields of a message, followed by 5 for every gossiped node and the
+// id of the failed node for FAIL.
+const (
+	busFieldType = iota
+	busFieldSender
+	busFieldPort
+	busFieldBusPort
+	busFieldFlags
+	busFieldCurrentEpoch
+	busFieldConfigEpoch
+	busFieldSlots
+	busFieldGossipCount
+	busHeaderFields
+)
+
+func clusterBusPort() int {
+	if clusterPort != 0 {
+		return clusterPort
+	}
+	return serverPort + 10000
+}
+
+func startCluster() {
+	if err := loadClusterConfig(); err != nil {
+		log.Fatalf("Error loading the cluster config: %s", err.Error())
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", myself.busPort))
+	if err != nil {
+		log.Fatalf("Error starting the cluster bus: %s", err.Error())
+	}
+	go acceptBusConnections(listener)
+	updateClusterRouting()
+	if err := saveClusterConfig(); err != nil {
+		log.Fatalf("Error saving the cluster config: %s", err.Error())
+	}
+	log.Printf("Running in cluster mode, my id is %s", myself.id)
+}
+
+func acceptBusConnections(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error accepting cluster bus connection:", err.Error())
+			return
+		}
+		go handleBusConnection(conn)
+	}
+}
+
+// Answer every message with a PONG, the messages are processed by the
+// executor.
+func handleBusConnection(conn net.Conn) {
+	defer conn.Close()
+	remoteIp, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	localIp, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	reader := aof.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(clusterNodeTimeout + clusterPingInterval))
+		message, err := reader.ReadCommand()
+		if err != nil {
+			return
+		}
+		reply := make(chan []string)
+		taskChannel <- func() {
+			learnMyIp(localIp)
+			processBusMessage(message, remoteIp)
+			clusterFlushChanges()
+			reply <- busMessage(BUS_PONG)
+		}
+		conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+		if _, err := conn.Write(utils.MarshalArgsToResp(<-reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// The address of the node is the one the others use to reach it.
+func learnMyIp(ip string) {
+	if myself.ip == "" && ip != "" {
+		myself.ip = ip
+		clusterChanged()
+	}
+}
+
+func busMessage(messageType string, extra ...string) []string {
+	ranges := []string{}
+	for _, slots := range slotRanges(myself.slots()) {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", slots[0], slots[1]))
+	}
+	slots := strings.Join(ranges, ",")
+	if slots == "" {
+		slots = "-"
+	}
+	gossip := []string{}
+	for _, node := range clusterNodes {
+		if node != myself && !node.is(NODE_HANDSHAKE) {
+			gossip = append(gossip, node.id, node.ip, fmt.Sprint(node.port), fmt.Sprint(node.busPort), nodeFlags(node))
+		}
+	}
+	message := []string{
+		messageType, myself.id, fmt.Sprint(myself.port), fmt.Sprint(myself.busPort), nodeFlags(myself),
+		fmt.Sprint(clusterCurrentEpoch), fmt.Sprint(myself.configEpoch), slots, fmt.Sprint(len(gossip) / 5),
+	}
+	message = append(message, gossip...)
+	return append(message, extra...)
+}
+
+type busHeader struct {
+	messageType  string
+	sender       string
+	port         int
+	busPort      int
+	currentEpoch int64
+	configEpoch  int64
+	slots        []int
+	gossip       [][]string
+	extra        []string
+}
+
+func parseBusMessage(message []string) (*busHeader, error) {
+	if len(message) < busHeaderFields {
+		return nil, errors.New("message too short")
+	}
+	header := &busHeader{messageType: message[busFieldType], sender: message[busFieldSender]}
+	var err error
+	if header.port, err = strconv.Atoi(message[busFieldPort]); err != nil {
+		return nil, err
+	}
+	if header.busPort, err = strconv.Atoi(message[busFieldBusPort]); err != nil {
+		return nil, err
+	}
+	if header.currentEpoch, err = strconv.ParseInt(message[busFieldCurrentEpoch], 10, 64); err != nil {
+		return nil, err
+	}
+	if header.configEpoch, err = strconv.ParseInt(message[busFieldConfigEpoch], 10, 64); err != nil {
+		return nil, err
+	}
+	if message[busFieldSlots] != "-" {
+		for _, slots := range strings.Split(message[busFieldSlots], ",") {
+			start, end, err := parseSlotRange(slots)
+			if err != nil {
+				return nil, err
+			}
+			for slot := start; slot <= end; slot++ {
+				header.slots = append(header.slots, slot)
+			}
+		}
+	}
+	count, err := strconv.Atoi(message[busFieldGossipCount])
+	if err != nil || count < 0 || len(message) < busHeaderFields+count*5 {
+		return nil, errors.New("invalid gossip section")
+	}
+	rest := message[busHeaderFields:]
+	for i := 0; i < count; i++ {
+		header.gossip = append(header.gossip, rest[i*5:i*5+5])
+	}
+	header.extra = rest[count*5:]
+	return header, nil
+}
+
+// Process a message of another node, ip being the address it was received
+// from. PONGs are the replies to our own messages.
+func processBusMessage(message []string, ip string) {
+	header, err := parseBusMessage(message)
+	if err != nil {
+		log.Printf("Invalid cluster bus message: %s", err.Error())
+		return
+	}
+	if header.sender == myself.id {
+		return
+	}
+	if header.currentEpoch > clusterCurrentEpoch {
+		clusterCurrentEpoch = header.currentEpoch
+		clusterConfigDirty = true
+	}
+
+	sender := clusterNodes[header.sender]
+	if sender == nil && header.messageType == BUS_MEET {
+		sender = newClusterNode(header.sender, ip, header.port, header.busPort, NODE_MASTER)
+		clusterNodes[sender.id] = sender
+		clusterChanged()
+		log.Printf("Cluster node %s joined from %s", sender.id, sender.addr())
+	}
+	if sender == nil || sender.is(NODE_HANDSHAKE) {
+		return
+	}
+	if sender.ip != ip || sender.port != header.port || sender.busPort != header.busPort {
+		sender.ip, sender.port, sender.busPort = ip, header.port, header.busPort
+		sender.closeLink()
+		clusterChanged()
+	}
+	if header.messageType == BUS_PONG {
+		nodeReachable(sender)
+	}
+	if sender.configEpoch != header.configEpoch {
+		sender.configEpoch = header.configEpoch
+		clusterConfigDirty = true
+	}
+	updateSlotsOf(sender, header.slots)
+	handleConfigEpochCollision(sender)
+	for _, gossip := range header.gossip {
+		processGossip(sender, gossip)
+	}
+	if header.messageType == BUS_FAIL && len(header.extra) == 1 {
+		if failing := clusterNodes[header.extra[0]]; failing != nil && failing != myself && !failing.is(NODE_FAIL) {
+			markNodeFailed(failing)
+		}
+	}
+}
+
+func nodeReachable(node *clusterNode) {
+	node.pongReceived = time.Now()
+	node.pingSent = time.Time{}
+	if node.is(NODE_PFAIL | NODE_FAIL) {
+		node.flags &^= NODE_PFAIL | NODE_FAIL
+		clusterChanged()
+		log.Printf("Cluster node %s is reachable again", node.id)
+	}
+}
+
+// The claim with the newer config epoch wins a slot. Slots being imported
+// are left alone, the import decides who owns them in the end.
+func updateSlotsOf(sender *clusterNode, slots []int) {
+	for _, slot := range slots {
+		owner := clusterSlots[slot]
+		if owner == sender || importingSlots[slot] != nil {
+			continue
+		}
+		if owner == nil || owner.configEpoch < sender.configEpoch {
+			clusterSlots[slot] = sender
+			if owner == myself {
+				delete(migratingSlots, slot)
+			}
+			clusterChanged()
+		}
+	}
+}
+
+// Two masters with the same config epoch would never agree on the slots
+// they both claim, the one with the greater id moves on to a new epoch.
+func handleConfigEpochCollision(sender *clusterNode) {
+	if sender.configEpoch != myself.configEpoch || myself.id < sender.id {
+		return
+	}
+	clusterCurrentEpoch++
+	myself.configEpoch = clusterCurrentEpoch
+	clusterConfigDirty = true
+	log.Printf("Config epoch collision with node %s, my config epoch is now %d", sender.id, myself.configEpoch)
+}
+
+// Gossip is an id, ip, port, bus port and the flags of a node as seen by
+// the sender.
+func processGossip(sender *clusterNode, gossip []string) {
+	id, flags := gossip[0], gossip[4]
+	port, err := strconv.Atoi(gossip[2])
+	if err != nil {
+		return
+	}
+	busPort, err := strconv.Atoi(gossip[3])
+	if err != nil {
+		return
+	}
+	node := clusterNodes[id]
+	if node == nil {
+		if clusterNodeByAddr(gossip[1], port) != nil || strings.Contains(flags, "handshake") {
+			return
+		}
+		node = newClusterNode(id, gossip[1], port, busPort, NODE_MASTER)
+		clusterNodes[id] = node
+		clusterChanged()
+		log.Printf("Cluster node %s learned about from %s", id, sender.id)
+		return
+	}
+	if node == myself || !isVotingMaster(sender) {
+		return
+	}
+	if strings.Contains(flags, "fail") {
+		node.failReports[sender.id] = time.Now()
+		markNodeFailedIfNeeded(node)
+	} else {
+		delete(node.failReports, sender.id)
+	}
+}
+
+// Only masters serving slots decide about failures.
+func isVotingMaster(node *clusterNode) bool {
+	return node.is(NODE_MASTER) && len(node.slots()) > 0
+}
+
+func clusterVotingMasters() int {
+	masters := 0
+	for _, node := range clusterNodes {
+		if isVotingMaster(node) {
+			masters++
+		}
+	}
+	return masters
+}
+
+// A node this node considers unreachable fails once a majority of the
+// masters agrees, which is then announced to every node.
+func markNodeFailedIfNeeded(node *clusterNode) {
+	if !node.is(NODE_PFAIL) || node.is(NODE_FAIL) {
+		return
+	}
+	reports := 0
+	for id, reported := range node.failReports {
+		if time.Since(reported) > 2*clusterNodeTimeout || clusterNodes[id] == nil {
+			delete(node.failReports, id)
+		} else {
+			reports++
+		}
+	}
+	if isVotingMaster(myself) {
+		reports++
+	}
+	if reports < clusterVotingMasters()/2+1 {
+		return
+	}
+	markNodeFailed(node)
+	for _, other := range clusterNodes {
+		if other != myself && other != node && other.link != nil {
+			other.link.send(nil, busMessage(BUS_FAIL, node.id)...)
+		}
+	}
+}
+
+func markNodeFailed(node *clusterNode) {
+	node.flags = node.flags&^NODE_PFAIL | NODE_FAIL
+	clusterChanged()
+	log.Printf("Cluster node %s marked as failing", node.id)
+}
+
+// The reply to a PING or MEET, for a node met with CLUSTER MEET it tells
+// the real id.
+func processPong(node *clusterNode, reply any, err error) {
+	node.pingPending = false
+	if err != nil || clusterNodes[node.id] != node {
+		return
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		return
+	}
+	message := make([]string, len(items))
+	for i, item := range items {
+		message[i] = replyString(item)
+	}
+	if node.link != nil {
+		learnMyIp(node.link.localIp)
+	}
+	if node.is(NODE_HANDSHAKE) && len(message) > busFieldSender {
+		delete(clusterNodes, node.id)
+		if known := clusterNodes[message[busFieldSender]]; known != nil || message[busFieldSender] == myself.id {
+			node.closeLink()
+			return
+		}
+		node.id = message[busFieldSender]
+		node.flags &^= NODE_HANDSHAKE
+		clusterNodes[node.id] = node
+		clusterChanged()
+		log.Printf("Cluster handshake with %s completed, its id is %s", node.addr(), node.id)
+	}
+	processBusMessage(message, node.ip)
+	clusterFlushChanges()
+}
+
+// Ping every node once a second and consider the ones that do not answer
+// within the node timeout unreachable.
+func clusterCron() {
+	for _, node := range clusterNodes {
+		if node == myself {
+			continue
+		}
+		if node.is(NODE_HANDSHAKE) && time.Since(node.created) > max(clusterNodeTimeout, clusterPingInterval) {
+			node.closeLink()
+			delete(clusterNodes, node.id)
+			log.Printf("Cluster handshake with %s timed out", node.addr())
+			continue
+		}
+		if node.link == nil {
+			node.link = newInstanceLink(node.ip, node.busPort, false)
+		}
+		if !node.pingPending && time.Since(node.lastPing) >= clusterPingInterval {
+			messageType := BUS_PING
+			if node.is(NODE_HANDSHAKE) {
+				messageType = BUS_MEET
+			}
+			if node.link.send(func(reply any, err error) { processPong(node, reply, err) }, busMessage(messageType)...) {
+				node.pingPending, node.lastPing = true, time.Now()
+				if node.pingSent.IsZero() {
+					node.pingSent = node.lastPing
+				}
+			}
+		}
+		if !node.pingSent.IsZero() && time.Since(node.pingSent) > clusterNodeTimeout && !node.is(NODE_PFAIL|NODE_FAIL) {
+			node.flags |= NODE_PFAIL
+			clusterChanged()
+			log.Printf("Cluster node %s is not reachable", node.id)
+		}
+		markNodeFailedIfNeeded(node)
+	}
+	clusterFlushChanges()
+}
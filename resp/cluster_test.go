@@ -0,0 +1,171 @@
+package resp
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/johanlantz/redis/utils"
+	"github.com/stretchr/testify/require"
+)
+
+const otherNodeId = "0000000000000000000000000000000000000001"
+
+// Turn the running server into a cluster node next to another node at port
+// 7100 that serves no slots yet. The keys bar and hello hash to the lower
+// half of the slots, foo to the upper half.
+func enableTestCluster(t *testing.T) {
+	require.NoError(t, onExecutor(func() error {
+		clusterEnabled = true
+		clusterConfigFile = filepath.Join(t.TempDir(), "nodes.conf")
+		myself = newClusterNode(newClusterNodeId(), "127.0.0.1", serverPort, serverPort+10000, NODE_MYSELF|NODE_MASTER)
+		other := newClusterNode(otherNodeId, "127.0.0.1", 7100, 17100, NODE_MASTER)
+		clusterNodes = map[string]*clusterNode{myself.id: myself, other.id: other}
+		updateClusterRouting()
+		return nil
+	}))
+	t.Cleanup(func() {
+		onExecutor(func() error {
+			for _, node := range clusterNodes {
+				node.closeLink()
+			}
+			clusterEnabled, clusterConfigFile = false, "nodes.conf"
+			myself, clusterNodes, clusterCurrentEpoch = nil, map[string]*clusterNode{}, 0
+			clusterSlots = [utils.HashSlots]*clusterNode{}
+			migratingSlots, importingSlots = map[int]*clusterNode{}, map[int]*clusterNode{}
+			return nil
+		})
+		sendCommand(NewClient(), "DEL bar")
+	})
+}
+
+func assignTestSlots(t *testing.T) {
+	require.Equal(t, "+OK\r\n", sendCommand(NewClient(), "CLUSTER ADDSLOTSRANGE 0 8191"))
+	require.NoError(t, onExecutor(func() error {
+		for slot := 8192; slot < utils.HashSlots; slot++ {
+			clusterSlots[slot] = clusterNodes[otherNodeId]
+		}
+		updateClusterRouting()
+		return nil
+	}))
+}
+
+func TestClusterDisabled(t *testing.T) {
+	require.Equal(t, "-ERR This instance has cluster support disabled\r\n", sendCommand(NewClient(), "CLUSTER INFO"))
+}
+
+func TestClusterRedirection(t *testing.T) {
+	enableTestCluster(t)
+	client := NewClient()
+	require.Equal(t, "-CLUSTERDOWN The cluster is down\r\n", sendCommand(client, "GET bar"))
+	require.Contains(t, sendCommand(client, "CLUSTER INFO"), "cluster_state:fail")
+
+	assignTestSlots(t)
+	require.Contains(t, sendCommand(client, "CLUSTER INFO"), "cluster_state:ok")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET bar 1"))
+	require.Equal(t, "-MOVED 12182 127.0.0.1:7100\r\n", sendCommand(client, "GET foo"))
+	require.Equal(t, "-CROSSSLOT Keys in request don't hash to the same slot\r\n", sendCommand(client, "DEL bar hello"))
+	require.Equal(t, ":0\r\n", sendCommand(client, "DEL {bar}x {bar}y"))
+	require.Equal(t, "-ERR SELECT is not allowed in cluster mode\r\n", sendCommand(client, "SELECT 1"))
+
+	// A redirection inside a transaction aborts it
+	require.Equal(t, "+OK\r\n", sendCommand(client, "MULTI"))
+	require.Equal(t, "-MOVED 12182 127.0.0.1:7100\r\n", sendCommand(client, "GET foo"))
+	require.Contains(t, sendCommand(client, "EXEC"), "EXECABORT")
+
+	require.Equal(t, ":5061\r\n", sendCommand(client, "CLUSTER KEYSLOT bar"))
+	require.Equal(t, ":1\r\n", sendCommand(client, "CLUSTER COUNTKEYSINSLOT 5061"))
+	require.Equal(t, "*1\r\n$3\r\nbar\r\n", sendCommand(client, "CLUSTER GETKEYSINSLOT 5061 10"))
+	require.Equal(t, "-ERR Slot 100 is already busy\r\n", sendCommand(client, "CLUSTER ADDSLOTS 100"))
+	require.Contains(t, sendCommand(client, "CLUSTER SLOTS"), "*3\r\n:8192\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:7100\r\n")
+	// The cluster cron may already have tried to ping the other node
+	require.Regexp(t, otherNodeId+` 127\.0\.0\.1:7100@17100 master - \d+ \d+ 0 disconnected 8192-16383\n`, sendCommand(client, "CLUSTER NODES"))
+}
+
+func TestClusterResharding(t *testing.T) {
+	enableTestCluster(t)
+	assignTestSlots(t)
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET bar one"))
+
+	// Keys of a migrating slot that are gone have to be asked for at the target
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLUSTER SETSLOT 5061 MIGRATING "+otherNodeId))
+	require.Equal(t, "+one\r\n", sendCommand(client, "GET bar"))
+	require.Equal(t, "-ASK 5061 127.0.0.1:7100\r\n", sendCommand(client, "GET {bar}x"))
+	require.Equal(t, "-TRYAGAIN Multiple keys request during rehashing of slot\r\n", sendCommand(client, "DEL bar {bar}x"))
+	require.Contains(t, sendCommand(client, "CLUSTER SETSLOT 5061 NODE "+otherNodeId), "still hold keys")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLUSTER SETSLOT 5061 STABLE"))
+
+	// A slot being imported only serves clients that were sent with ASK
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLUSTER SETSLOT 12182 IMPORTING "+otherNodeId))
+	require.Equal(t, "-MOVED 12182 127.0.0.1:7100\r\n", sendCommand(client, "GET foo"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "ASKING"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET foo"))
+	require.Equal(t, "-MOVED 12182 127.0.0.1:7100\r\n", sendCommand(client, "GET foo"))
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLUSTER SETSLOT 12182 NODE "+testNodeId(t)))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET foo"))
+	require.Contains(t, sendCommand(client, "CLUSTER INFO"), "cluster_my_epoch:1")
+}
+
+func TestClusterGossip(t *testing.T) {
+	enableTestCluster(t)
+	assignTestSlots(t)
+	joinedId := "0000000000000000000000000000000000000002"
+
+	var owner, otherEpoch string
+	var known bool
+	require.NoError(t, onExecutor(func() error {
+		// The newer config epoch wins the slots both claim
+		processBusMessage([]string{BUS_PING, otherNodeId, "7100", "17100", "master", "2", "2", "0-10,8192-16383", "1",
+			joinedId, "127.0.0.1", "7200", "17200", "master"}, "127.0.0.1")
+		owner, otherEpoch = clusterSlots[5].id, fmt.Sprint(clusterNodes[otherNodeId].configEpoch)
+		_, known = clusterNodes[joinedId]
+		return nil
+	}))
+	require.Equal(t, otherNodeId, owner)
+	require.Equal(t, "2", otherEpoch)
+	require.True(t, known)
+	require.Equal(t, "-MOVED 5 127.0.0.1:7100\r\n", sendCommand(NewClient(), "GET "+keyInSlot(5)))
+	require.Contains(t, sendCommand(NewClient(), "CLUSTER INFO"), "cluster_current_epoch:2")
+}
+
+func TestClusterConfigFile(t *testing.T) {
+	enableTestCluster(t)
+	assignTestSlots(t)
+	require.Equal(t, "+OK\r\n", sendCommand(NewClient(), "CLUSTER SAVECONFIG"))
+
+	id := testNodeId(t)
+	var loadedId string
+	var mine, others int
+	require.NoError(t, onExecutor(func() error {
+		myself, clusterNodes = nil, map[string]*clusterNode{}
+		clusterSlots = [utils.HashSlots]*clusterNode{}
+		if err := loadClusterConfig(); err != nil {
+			return err
+		}
+		loadedId, mine, others = myself.id, len(myself.slots()), len(clusterNodes[otherNodeId].slots())
+		return nil
+	}))
+	require.Equal(t, id, loadedId)
+	require.Equal(t, 8192, mine)
+	require.Equal(t, 8192, others)
+}
+
+func testNodeId(t *testing.T) string {
+	var id string
+	require.NoError(t, onExecutor(func() error {
+		id = myself.id
+		return nil
+	}))
+	return id
+}
+
+// Any key that hashes to slot.
+func keyInSlot(slot int) string {
+	for i := 0; ; i++ {
+		if key := fmt.Sprint("key", i); utils.HashSlot(key) == slot {
+			return key
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Runtime configuration. Every parameter can be read and changed with
+// CONFIG GET and CONFIG SET, the same names are used in configuration files.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/johanlantz/redis/utils"
+)
+
+type configParameter struct {
+	get func() string
+	set func(value string) error
+}
+
+// Directory for persistence files.
+var workingDir = "."
+
+// Port of the server, announced to the master by replicas.
+var serverPort = 6379
+
+var configParameters = map[string]configParameter{
+	"dir": {
+		get: func() string { return workingDir },
+		set: func(value string) error {
+			workingDir = value
+			return nil
+		},
+	},
+	"port": {
+		get: func() string { return fmt.Sprint(serverPort) },
+		set: immutable(func(value string) error {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return errors.New("argument must be a port number")
+			}
+			serverPort = port
+			return nil
+		}),
+	},
+	"notify-keyspace-events": {
+		get: func() string { return keyspaceEventsToString(keyspaceEvents) },
+		set: func(value string) error {
+			flags, err := keyspaceEventsFromString(value)
+			if err == nil {
+				keyspaceEvents = flags
+			}
+			return err
+		},
+	},
+}
+
+// Parameters that can only be set before the server is started.
+func immutable(set func(value string) error) func(value string) error {
+	return func(value string) error {
+		if databases != nil {
+			return errors.New("can't set immutable config")
+		}
+		return set(value)
+	}
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+func parseNonNegative(value string) (int64, error) {
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0, errors.New("argument must be a non negative integer")
+	}
+	return number, nil
+}
+
+// Memory sizes like 100mb, k and m are powers of 1000, kb and mb of 1024.
+// Exported for the configuration loader, which checks maxmemory early.
+func ParseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	value = strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSuffix(value, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return number * multiplier, nil
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// Set a parameter by name, also used to apply configuration before the
+// server is started. It must not be called concurrently with the executor.
+func ConfigSet(name string, value string) error {
+	parameter, ok := configParameters[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	if err := parameter.set(value); err != nil {
+		return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %s", name, err.Error())
+	}
+	return nil
+}
+
+// Set a parameter read from a configuration file. Unlike ConfigSet the
+// error only tells what is wrong, the loader knows where.
+func ConfigLoad(name string, value string) error {
+	parameter, ok := configParameters[strings.ToLower(name)]
+	if !ok {
+		return errors.New("Bad directive or wrong number of arguments")
+	}
+	return parameter.set(value)
+}
+
+func process_config(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("config command requires a subcommand")
+	}
+	args := request.args[1:]
+	switch strings.ToUpper(request.args[0]) {
+	case "GET":
+		if len(args) < 1 {
+			return nil, errors.New("config get requires at least one parameter pattern")
+		}
+		names := []string{}
+		for name := range configParameters {
+			for _, pattern := range args {
+				if utils.GlobMatch(strings.ToLower(pattern), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+		pairs := []*RespResponse{}
+		for _, name := range names {
+			pairs = append(pairs, bulkStrings(name, configParameters[name].get())...)
+		}
+		return newRespMapResponse(pairs), nil
+	case "SET":
+		if len(args) < 2 || len(args)%2 != 0 {
+			return nil, errors.New("wrong number of arguments for 'config|set' command")
+		}
+		for i := 0; i < len(args); i += 2 {
+			if err := ConfigSet(args[i], args[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+}
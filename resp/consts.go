@@ -1,5 +1,8 @@
 package resp
 
+// Redis version the server is compatible with, reported to clients and in snapshots.
+const serverVersion = "7.2.0"
+
 const (
 	DT_SIMPLE_STRING    = '+'
 	DT_SIMPLE_ERROR     = '-'
@@ -18,8 +21,34 @@ const (
 )
 
 const (
-	RESP_OK  = "OK"
-	RESP_ERR = "ERR"
+	RESP_OK         = "OK"
+	RESP_ERR        = "ERR"
+	RESP_QUEUED     = "QUEUED"
+	RESP_EXECABORT  = "EXECABORT"
+	RESP_NOSCRIPT   = "NOSCRIPT"
+	RESP_BUSY       = "BUSY"
+	RESP_NOTBUSY    = "NOTBUSY"
+	RESP_UNKILLABLE = "UNKILLABLE"
+	RESP_NOPROTO    = "NOPROTO"
+	RESP_PONG       = "PONG"
+	RESP_CROSSSLOT  = "CROSSSLOT"
+	RESP_BUSYKEY    = "BUSYKEY"
+	RESP_IOERR      = "IOERR"
+	RESP_NOKEY      = "NOKEY"
+	RESP_OOM        = "OOM"
+
+	RESP_NOMASTERLINK = "NOMASTERLINK"
+	RESP_READONLY     = "READONLY"
+	RESP_MASTERDOWN   = "MASTERDOWN"
+	RESP_INPROG       = "INPROG"
+	RESP_NOGOODSLAVE  = "NOGOODSLAVE"
+	RESP_MOVED        = "MOVED"
+	RESP_ASK          = "ASK"
+	RESP_TRYAGAIN     = "TRYAGAIN"
+	RESP_CLUSTERDOWN  = "CLUSTERDOWN"
+	RESP_NOAUTH       = "NOAUTH"
+	RESP_WRONGPASS    = "WRONGPASS"
+	RESP_NOPERM       = "NOPERM"
 )
 
 const (
@@ -27,4 +56,74 @@ const (
 	RESP_SET  RespCommand = "SET"
 	RESP_INCR RespCommand = "INCR"
 	RESP_DEL  RespCommand = "DEL"
+
+	RESP_SELECT   RespCommand = "SELECT"
+	RESP_MOVE     RespCommand = "MOVE"
+	RESP_SWAPDB   RespCommand = "SWAPDB"
+	RESP_FLUSHDB  RespCommand = "FLUSHDB"
+	RESP_FLUSHALL RespCommand = "FLUSHALL"
+
+	RESP_MULTI   RespCommand = "MULTI"
+	RESP_EXEC    RespCommand = "EXEC"
+	RESP_DISCARD RespCommand = "DISCARD"
+	RESP_WATCH   RespCommand = "WATCH"
+	RESP_UNWATCH RespCommand = "UNWATCH"
+
+	RESP_EXPIRE    RespCommand = "EXPIRE"
+	RESP_PEXPIRE   RespCommand = "PEXPIRE"
+	RESP_EXPIREAT  RespCommand = "EXPIREAT"
+	RESP_PEXPIREAT RespCommand = "PEXPIREAT"
+	RESP_TTL       RespCommand = "TTL"
+	RESP_PTTL      RespCommand = "PTTL"
+	RESP_PERSIST   RespCommand = "PERSIST"
+
+	RESP_EVAL    RespCommand = "EVAL"
+	RESP_EVALSHA RespCommand = "EVALSHA"
+	RESP_SCRIPT  RespCommand = "SCRIPT"
+
+	RESP_FUNCTION RespCommand = "FUNCTION"
+	RESP_FCALL    RespCommand = "FCALL"
+	RESP_FCALL_RO RespCommand = "FCALL_RO"
+
+	RESP_PING  RespCommand = "PING"
+	RESP_HELLO RespCommand = "HELLO"
+	RESP_AUTH  RespCommand = "AUTH"
+	RESP_ACL   RespCommand = "ACL"
+
+	RESP_SUBSCRIBE    RespCommand = "SUBSCRIBE"
+	RESP_UNSUBSCRIBE  RespCommand = "UNSUBSCRIBE"
+	RESP_PSUBSCRIBE   RespCommand = "PSUBSCRIBE"
+	RESP_PUNSUBSCRIBE RespCommand = "PUNSUBSCRIBE"
+	RESP_PUBLISH      RespCommand = "PUBLISH"
+	RESP_PUBSUB       RespCommand = "PUBSUB"
+	RESP_SSUBSCRIBE   RespCommand = "SSUBSCRIBE"
+	RESP_SUNSUBSCRIBE RespCommand = "SUNSUBSCRIBE"
+	RESP_SPUBLISH     RespCommand = "SPUBLISH"
+
+	RESP_CONFIG RespCommand = "CONFIG"
+	RESP_CLIENT RespCommand = "CLIENT"
+
+	RESP_BGREWRITEAOF RespCommand = "BGREWRITEAOF"
+	RESP_SAVE         RespCommand = "SAVE"
+	RESP_BGSAVE       RespCommand = "BGSAVE"
+	RESP_LASTSAVE     RespCommand = "LASTSAVE"
+
+	RESP_DUMP    RespCommand = "DUMP"
+	RESP_RESTORE RespCommand = "RESTORE"
+	RESP_MIGRATE RespCommand = "MIGRATE"
+
+	RESP_REPLICAOF RespCommand = "REPLICAOF"
+	RESP_SLAVEOF   RespCommand = "SLAVEOF"
+	RESP_PSYNC     RespCommand = "PSYNC"
+	RESP_REPLCONF  RespCommand = "REPLCONF"
+	RESP_ROLE      RespCommand = "ROLE"
+
+	RESP_WAIT    RespCommand = "WAIT"
+	RESP_WAITAOF RespCommand = "WAITAOF"
+
+	RESP_SENTINEL RespCommand = "SENTINEL"
+
+	RESP_CLUSTER        RespCommand = "CLUSTER"
+	RESP_ASKING         RespCommand = "ASKING"
+	RESP_RESTORE_ASKING RespCommand = "RESTORE-ASKING"
 )
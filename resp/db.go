@@ -0,0 +1,167 @@
+// Logical databases. Every client has one of them selected and commands
+// operate on that one unless they explicitly address another index.
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/johanlantz/redis/storage"
+)
+
+var databases []KVStorage
+
+// The current index of a storage, which can change through SWAPDB.
+func dbIndex(db KVStorage) int {
+	for i, candidate := range databases {
+		if candidate == db {
+			return i
+		}
+	}
+	return -1
+}
+
+// React to changes reported by a storage, no matter which command made them.
+func listenToStorage(db KVStorage) {
+	db.SetListener(func(key string, event storage.KeyEvent) {
+		index := dbIndex(db)
+		touchWatchedKey(index, key)
+		invalidateTrackedKey(key)
+		if event == storage.KeyExpired {
+			notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key, index)
+			dirty++
+			propagate(index, "DEL", key)
+		}
+	})
+}
+
+func parseDbIndex(arg string) (int, error) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, errors.New("invalid database index, not an integer")
+	}
+	if index < 0 || index >= len(databases) {
+		return 0, errors.New("DB index is out of range")
+	}
+	return index, nil
+}
+
+// FLUSHDB and FLUSHALL accept an optional ASYNC or SYNC modifier.
+func parseFlushMode(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	if len(args) > 1 {
+		return false, errors.New("syntax error")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ASYNC":
+		return true, nil
+	case "SYNC":
+		return false, nil
+	}
+	return false, errors.New("syntax error")
+}
+
+func process_select(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 1 {
+		return nil, errors.New("select command requires only the db index argument")
+	}
+	index, err := parseDbIndex(request.args[0])
+	if err != nil {
+		return nil, err
+	}
+	if clusterEnabled && index != 0 {
+		return nil, errors.New("SELECT is not allowed in cluster mode")
+	}
+	request.client.db = index
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+func process_move(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, errors.New("move command requires key and db arguments")
+	}
+	key := request.args[0]
+	index, err := parseDbIndex(request.args[1])
+	if err != nil {
+		return nil, err
+	}
+	if index == request.client.db {
+		return nil, errors.New("source and destination objects are the same")
+	}
+	entry := kv.Get(key)
+	target := databases[index]
+	if entry.IsNull() || !target.Get(key).IsNull() {
+		return newRespResponse(DT_INTEGER, []string{"0"}), nil
+	}
+	if err := target.Set(key, entry); err != nil {
+		return nil, err
+	}
+	if err := kv.Delete(key); err != nil {
+		return nil, err
+	}
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "move_from", key, request.client.db)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "move_to", key, index)
+	return newRespResponse(DT_INTEGER, []string{"1"}), nil
+}
+
+// Storages that keep their data across restarts have to remember swaps.
+type swappableStorage interface {
+	SwapWith(other any) error
+}
+
+// Swapping the storages means every client connected to one of the
+// databases immediately sees the data of the other one.
+func process_swapdb(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, errors.New("swapdb command requires two db index arguments")
+	}
+	first, err := parseDbIndex(request.args[0])
+	if err != nil {
+		return nil, err
+	}
+	second, err := parseDbIndex(request.args[1])
+	if err != nil {
+		return nil, err
+	}
+	if swappable, ok := databases[first].(swappableStorage); ok && first != second {
+		if err := swappable.SwapWith(databases[second]); err != nil {
+			return nil, err
+		}
+	}
+	touchAllWatchedKeys(first, second)
+	touchAllWatchedKeys(second, first)
+	invalidateAllTrackedKeys()
+	databases[first], databases[second] = databases[second], databases[first]
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+func process_flushdb(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	async, err := parseFlushMode(request.args)
+	if err != nil {
+		return nil, err
+	}
+	touchAllWatchedKeys(request.client.db, request.client.db)
+	invalidateAllTrackedKeys()
+	if err := kv.Flush(async); err != nil {
+		return nil, err
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+func process_flushall(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	async, err := parseFlushMode(request.args)
+	if err != nil {
+		return nil, err
+	}
+	invalidateAllTrackedKeys()
+	for i, db := range databases {
+		touchAllWatchedKeys(i, i)
+		if err := db.Flush(async); err != nil {
+			return nil, err
+		}
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
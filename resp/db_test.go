@@ -0,0 +1,98 @@
+package resp
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/johanlantz/redis/storage"
+	"github.com/johanlantz/redis/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// Send a command on behalf of a specific client and wait for the response.
+func sendCommand(client *Client, cmd string) string {
+	requestChannel <- NetworkRequest{ResponseChannel: responseChannel, Data: utils.MarshalToResp(cmd), Client: client}
+	return string(<-responseChannel)
+}
+
+func TestSelect(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SELECT 1"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET dbKey one"))
+	require.Equal(t, "+one\r\n", sendCommand(client, "GET dbKey"))
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SELECT 0"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET dbKey"))
+
+	require.Contains(t, sendCommand(client, "SELECT 16"), "out of range")
+	require.Contains(t, sendCommand(client, "SELECT abc"), RESP_ERR)
+
+	sendCommand(client, "SELECT 1")
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestMove(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET moveKey hello"))
+	require.Equal(t, ":1\r\n", sendCommand(client, "MOVE moveKey 2"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET moveKey"))
+	require.Equal(t, ":0\r\n", sendCommand(client, "MOVE moveKey 2"))
+	require.Contains(t, sendCommand(client, "MOVE moveKey 0"), "same")
+
+	sendCommand(client, "SELECT 2")
+	require.Equal(t, "+hello\r\n", sendCommand(client, "GET moveKey"))
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestSwapDb(t *testing.T) {
+	client := NewClient()
+	other := NewClient()
+	sendCommand(client, "SELECT 3")
+	sendCommand(other, "SELECT 4")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET swapKey three"))
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SWAPDB 3 4"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET swapKey"))
+	require.Equal(t, "+three\r\n", sendCommand(other, "GET swapKey"))
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SWAPDB 3 4"))
+	require.Equal(t, "+three\r\n", sendCommand(client, "GET swapKey"))
+	sendCommand(client, "FLUSHDB ASYNC")
+	require.Equal(t, "_\r\n", sendCommand(client, "GET swapKey"))
+}
+
+// Serve the test from disk storages in a new file instead of the in memory
+// ones, which are put back when it ends.
+func useDiskStorage(t *testing.T, path string) []*storage.BoltStorage {
+	storages, err := storage.OpenBoltStorages(path, 2)
+	require.NoError(t, err)
+	var previous []KVStorage
+	onExecutor(func() error {
+		previous, databases = databases, []KVStorage{storages[0], storages[1]}
+		return nil
+	})
+	t.Cleanup(func() {
+		onExecutor(func() error {
+			databases = previous
+			return nil
+		})
+		storages[0].Close()
+	})
+	return storages
+}
+
+func TestSwapDbDiskStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bolt.db")
+	storages := useDiskStorage(t, path)
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET swapKey zero"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SWAPDB 0 1"))
+	onExecutor(func() error { return storages[0].Close() })
+
+	// The swap survives a restart
+	storages, err := storage.OpenBoltStorages(path, 2)
+	require.NoError(t, err)
+	defer storages[0].Close()
+	require.True(t, storages[0].Get("swapKey").IsNull())
+	require.Equal(t, []byte("zero"), storages[1].Get("swapKey").Value)
+}
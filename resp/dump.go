@@ -0,0 +1,300 @@
+// Key level serialization with DUMP and RESTORE in the payload format of
+// Redis, and MIGRATE which moves keys to another instance with them.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/rdb"
+	"github.com/johanlantz/redis/storage"
+	"github.com/johanlantz/redis/utils"
+)
+
+func dumpEntry(entry storage.Entry) string {
+	payload := rdb.AppendString([]byte{rdb.TypeString}, string(entry.Value))
+	return string(rdb.AppendFooter(payload))
+}
+
+func process_dump(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 1 {
+		return nil, errors.New("dump command requires only key argument")
+	}
+	entry := kv.Get(request.args[0])
+	if entry.IsNull() {
+		return newRespResponse(DT_NULLS, []string{}), nil
+	}
+	return newRespResponse(DT_BULK_STRINGS, []string{dumpEntry(entry)}), nil
+}
+
+// RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func process_restore(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 3 {
+		return nil, errors.New("restore command requires key, ttl and payload arguments")
+	}
+	key, payload := request.args[0], request.args[2]
+	ttl, err := strconv.ParseInt(request.args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return nil, errors.New("Invalid TTL value, must be >= 0")
+	}
+
+	replace, absTtl := false, false
+	idleTime, freq := int64(-1), -1
+	for i := 3; i < len(request.args); i++ {
+		switch strings.ToUpper(request.args[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTtl = true
+		case "IDLETIME":
+			if i+1 >= len(request.args) || freq >= 0 {
+				return nil, errors.New("syntax error")
+			}
+			i++
+			if idleTime, err = strconv.ParseInt(request.args[i], 10, 64); err != nil || idleTime < 0 {
+				return nil, errors.New("Invalid IDLETIME value, must be >= 0")
+			}
+		case "FREQ":
+			if i+1 >= len(request.args) || idleTime >= 0 {
+				return nil, errors.New("syntax error")
+			}
+			i++
+			if freq, err = strconv.Atoi(request.args[i]); err != nil || freq < 0 || freq > 255 {
+				return nil, errors.New("Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return nil, errors.New("syntax error")
+		}
+	}
+
+	if !replace && !kv.Get(key).IsNull() {
+		return nil, &respError{RESP_BUSYKEY, "Target key name already exists."}
+	}
+	body, err := rdb.VerifyFooter([]byte(payload))
+	if err != nil {
+		return nil, err
+	}
+	reader := rdb.NewReader(body)
+	valueType, err := reader.ReadByte()
+	if err != nil {
+		return nil, errors.New("Bad data format")
+	}
+	value, err := reader.ReadObject(valueType)
+	if err != nil || reader.Remaining() != 0 {
+		return nil, errors.New("Bad data format")
+	}
+	if value.Kind != rdb.KindString {
+		return nil, fmt.Errorf("values of type %s are not supported", value.Kind)
+	}
+
+	expireAt := int64(0)
+	if ttl > 0 {
+		expireAt = ttl
+		if !absTtl {
+			expireAt += time.Now().UnixMilli()
+		}
+	}
+	if expireAt != 0 && expireAt <= time.Now().UnixMilli() {
+		// Already expired, only the replaced key goes away
+		if !kv.Get(key).IsNull() {
+			if err := kv.Delete(key); err != nil {
+				return nil, err
+			}
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, request.client.db)
+		}
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	}
+	entry := stringEntry(value.String)
+	entry.ExpireAt = expireAt
+	if idleTime >= 0 {
+		entry.LastAccess = time.Now().UnixMilli() - idleTime*1000
+	}
+	if freq >= 0 {
+		entry.LastAccess = time.Now().UnixMilli()
+		entry.Frequency = uint8(freq)
+	}
+	if err := kv.Set(key, entry); err != nil {
+		return nil, err
+	}
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "restore", key, request.client.db)
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+type migrateOptions struct {
+	host     string
+	port     string
+	db       string
+	timeout  time.Duration
+	copy     bool
+	replace  bool
+	username string
+	password string
+	keys     []string
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+// The key of MIGRATE host port key db timeout, or the keys after its KEYS
+// option when key is empty. Passwords are skipped so that they are not
+// taken for the option.
+func migrateKeyArgs(args []string) []string {
+	if len(args) < 5 {
+		return nil
+	}
+	keys := []string{}
+	if args[2] != "" {
+		keys = append(keys, args[2])
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			return append(keys, args[i+1:]...)
+		}
+	}
+	return keys
+}
+
+func parseMigrate(args []string) (*migrateOptions, error) {
+	if len(args) < 5 {
+		return nil, errors.New("migrate command requires host, port, key, destination-db and timeout arguments")
+	}
+	options := &migrateOptions{host: args[0], port: args[1], db: args[3]}
+	if _, err := strconv.Atoi(args[3]); err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	options.timeout = time.Duration(timeout) * time.Millisecond
+
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			options.copy = true
+		case "REPLACE":
+			options.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			options.password = args[i+1]
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			options.username, options.password = args[i+1], args[i+2]
+			i += 2
+		case "KEYS":
+			if args[2] != "" {
+				return nil, errors.New("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			options.keys = args[i+1:]
+			i = len(args)
+		default:
+			return nil, errors.New("syntax error")
+		}
+	}
+	if args[2] != "" {
+		options.keys = []string{args[2]}
+	}
+	return options, nil
+}
+
+// Like Redis, MIGRATE blocks until the target has replied or the timeout
+// expired. Keys are sent as RESTORE commands, one at a time as the network
+// layer does not read pipelined commands.
+func process_migrate(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	options, err := parseMigrate(request.args)
+	if err != nil {
+		return nil, err
+	}
+
+	commands := [][]string{}
+	if options.password != "" {
+		if options.username != "" {
+			commands = append(commands, []string{"AUTH", options.username, options.password})
+		} else {
+			commands = append(commands, []string{"AUTH", options.password})
+		}
+	}
+	commands = append(commands, []string{string(RESP_SELECT), options.db})
+	migrated := []string{}
+	now := time.Now().UnixMilli()
+	for _, key := range options.keys {
+		entry := kv.Get(key)
+		if entry.IsNull() {
+			continue
+		}
+		ttl := int64(0)
+		if entry.ExpireAt != 0 {
+			ttl = max(entry.ExpireAt-now, 1)
+		}
+		// Nodes importing the slot only accept the key when asked to
+		restore := RESP_RESTORE
+		if clusterEnabled {
+			restore = RESP_RESTORE_ASKING
+		}
+		args := []string{string(restore), key, fmt.Sprint(ttl), dumpEntry(entry)}
+		if options.replace {
+			args = append(args, "REPLACE")
+		}
+		commands = append(commands, args)
+		migrated = append(migrated, key)
+	}
+	if len(migrated) == 0 {
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_NOKEY}), nil
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(options.host, options.port), options.timeout)
+	if err != nil {
+		return nil, &respError{RESP_IOERR, "error or timeout connecting to the client"}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(options.timeout))
+
+	reader := bufio.NewReader(conn)
+	replies := len(commands)
+	var targetErr error
+	for i, command := range commands {
+		if _, err := conn.Write(utils.MarshalArgsToResp(command...)); err != nil {
+			return nil, &respError{RESP_IOERR, "error or timeout writing to target instance"}
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, &respError{RESP_IOERR, "error or timeout reading to target instance"}
+		}
+		if strings.HasPrefix(line, "-") && targetErr == nil {
+			targetErr = fmt.Errorf("Target instance replied with error: %s", strings.TrimSpace(line[1:]))
+		}
+		// Only keys restored successfully are removed
+		key := i - (replies - len(migrated))
+		if key >= 0 && !strings.HasPrefix(line, "-") && !options.copy {
+			if err := kv.Delete(migrated[key]); err != nil && targetErr == nil {
+				targetErr = err
+				continue
+			}
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", migrated[key], request.client.db)
+		}
+	}
+	if targetErr != nil {
+		return nil, targetErr
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
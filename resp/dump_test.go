@@ -0,0 +1,106 @@
+package resp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/johanlantz/redis/aof"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpRestore(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SELECT 15")
+	require.Equal(t, "_\r\n", sendCommand(client, "DUMP missingKey"))
+	sendCommand(client, "SET dumpKey hello")
+	payload := bulkValue(sendCommand(client, "DUMP dumpKey"))
+
+	require.Contains(t, sendArgs(client, "RESTORE", "dumpKey", "0", payload), "BUSYKEY")
+	require.Equal(t, "+OK\r\n", sendArgs(client, "RESTORE", "restoredKey", "5000", payload))
+	require.Equal(t, "+hello\r\n", sendCommand(client, "GET restoredKey"))
+	require.Equal(t, ":5\r\n", sendCommand(client, "TTL restoredKey"))
+
+	require.Equal(t, "+OK\r\n", sendArgs(client, "RESTORE", "restoredKey", "0", payload, "REPLACE", "IDLETIME", "10"))
+	require.Equal(t, ":-1\r\n", sendCommand(client, "TTL restoredKey"))
+
+	// An absolute time in the past removes the replaced key
+	require.Equal(t, "+OK\r\n", sendArgs(client, "RESTORE", "restoredKey", "1", payload, "REPLACE", "ABSTTL"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET restoredKey"))
+
+	require.Contains(t, sendArgs(client, "RESTORE", "otherKey", "0", payload, "FREQ", "256"), "Invalid FREQ")
+	require.Contains(t, sendArgs(client, "RESTORE", "otherKey", "0", payload, "FREQ", "1", "IDLETIME", "1"), "syntax error")
+	require.Contains(t, sendArgs(client, "RESTORE", "otherKey", "-1", payload), "Invalid TTL")
+	require.Contains(t, sendArgs(client, "RESTORE", "otherKey", "0", payload[:len(payload)-1]+"x"), "checksum")
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestRestoreRedisPayload(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SELECT 15")
+	// DUMP of the integer 10 by Redis 5
+	require.Equal(t, "+OK\r\n", sendArgs(client, "RESTORE", "redisKey", "0", "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"))
+	require.Equal(t, ":10\r\n", sendCommand(client, "GET redisKey"))
+	sendCommand(client, "FLUSHDB")
+}
+
+// Accepts one connection and answers every command with OK.
+func fakeMigrateTarget(t *testing.T) (string, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	commands := make(chan []string, 10)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := aof.NewReader(conn)
+		for {
+			args, err := reader.ReadCommand()
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- args
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), commands
+}
+
+func TestMigrate(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SELECT 15")
+	require.Contains(t, sendArgs(client, "MIGRATE", "127.0.0.1", "1", "key", "0", "100", "KEYS", "a"), "empty string")
+	require.Equal(t, "+NOKEY\r\n", sendArgs(client, "MIGRATE", "127.0.0.1", "1", "", "0", "100", "KEYS", "missing"))
+
+	sendCommand(client, "SET migrateA 1")
+	sendCommand(client, "SET migrateB two")
+	sendCommand(client, "PEXPIRE migrateB 60000")
+	port, commands := fakeMigrateTarget(t)
+	require.Equal(t, "+OK\r\n", sendArgs(client, "MIGRATE", "127.0.0.1", port, "", "3", "1000", "REPLACE", "AUTH", "secret", "KEYS", "migrateA", "migrateB"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET migrateA"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET migrateB"))
+
+	require.Equal(t, []string{"AUTH", "secret"}, <-commands)
+	require.Equal(t, []string{"SELECT", "3"}, <-commands)
+	restoreA := <-commands
+	require.Equal(t, []string{"RESTORE", "migrateA", "0"}, restoreA[:3])
+	require.Equal(t, "REPLACE", restoreA[4])
+	restoreB := <-commands
+	ttl, err := strconv.Atoi(restoreB[2])
+	require.NoError(t, err)
+	require.InDelta(t, 60000, ttl, 1000)
+
+	// The payloads are restorable here as well
+	require.Equal(t, "+OK\r\n", sendArgs(client, "RESTORE", "migrateB", restoreB[2], restoreB[3]))
+	require.Equal(t, "+two\r\n", sendCommand(client, "GET migrateB"))
+	sendCommand(client, "FLUSHDB")
+
+	require.Contains(t, sendArgs(client, "MIGRATE", "127.0.0.1", port, "migrateB", "0", "100"), "NOKEY")
+	sendCommand(client, "SET migrateC 1")
+	require.Contains(t, sendArgs(client, "MIGRATE", "127.0.0.1", port, "migrateC", "0", "100"), "IOERR")
+	sendCommand(client, "FLUSHDB")
+}
@@ -0,0 +1,190 @@
+// Eviction of keys when the dataset uses more than maxmemory. Candidates
+// are sampled like Redis does, the best of each sample according to the
+// policy is evicted until the dataset fits again.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/storage"
+)
+
+const (
+	POLICY_NOEVICTION      = "noeviction"
+	POLICY_ALLKEYS_LRU     = "allkeys-lru"
+	POLICY_VOLATILE_LRU    = "volatile-lru"
+	POLICY_ALLKEYS_LFU     = "allkeys-lfu"
+	POLICY_VOLATILE_LFU    = "volatile-lfu"
+	POLICY_ALLKEYS_RANDOM  = "allkeys-random"
+	POLICY_VOLATILE_RANDOM = "volatile-random"
+	POLICY_VOLATILE_TTL    = "volatile-ttl"
+)
+
+var evictionPolicies = []string{
+	POLICY_NOEVICTION, POLICY_ALLKEYS_LRU, POLICY_VOLATILE_LRU, POLICY_ALLKEYS_LFU,
+	POLICY_VOLATILE_LFU, POLICY_ALLKEYS_RANDOM, POLICY_VOLATILE_RANDOM, POLICY_VOLATILE_TTL,
+}
+
+var maxMemory int64 = 0
+var maxMemoryPolicy = POLICY_NOEVICTION
+var maxMemorySamples = 5
+
+// The memory of storages on disk is not attributed to the dataset, so
+// there would be nothing to evict.
+var ErrMaxMemoryOnDisk = errors.New("maxmemory is not supported by the disk storage")
+
+func init() {
+	configParameters["maxmemory"] = configParameter{
+		get: func() string { return fmt.Sprint(maxMemory) },
+		set: func(value string) error {
+			size, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			if size != 0 && databases != nil && persistentDatabases() {
+				return ErrMaxMemoryOnDisk
+			}
+			maxMemory = size
+			return nil
+		},
+	}
+	configParameters["maxmemory-policy"] = configParameter{
+		get: func() string { return maxMemoryPolicy },
+		set: func(value string) error {
+			for _, policy := range evictionPolicies {
+				if strings.EqualFold(policy, value) {
+					maxMemoryPolicy = policy
+					return nil
+				}
+			}
+			return errors.New("argument must be one of " + strings.Join(evictionPolicies, ", "))
+		},
+	}
+	configParameters["maxmemory-samples"] = configParameter{
+		get: func() string { return fmt.Sprint(maxMemorySamples) },
+		set: func(value string) error {
+			samples, err := parseNonNegative(value)
+			if err != nil || samples < 1 || samples > 64 {
+				return errors.New("argument must be between 1 and 64")
+			}
+			maxMemorySamples = int(samples)
+			return nil
+		},
+	}
+	configParameters["lfu-log-factor"] = configParameter{
+		get: func() string { return fmt.Sprint(storage.LFULogFactor) },
+		set: func(value string) error {
+			factor, err := parseNonNegative(value)
+			if err == nil {
+				storage.LFULogFactor = int(factor)
+			}
+			return err
+		},
+	}
+	configParameters["lfu-decay-time"] = configParameter{
+		get: func() string { return fmt.Sprint(storage.LFUDecayTime) },
+		set: func(value string) error {
+			minutes, err := parseNonNegative(value)
+			if err == nil {
+				storage.LFUDecayTime = int(minutes)
+			}
+			return err
+		},
+	}
+}
+
+func usedMemory() int64 {
+	used := int64(0)
+	for _, db := range databases {
+		used += db.UsedMemory()
+	}
+	return used
+}
+
+func errOom() error {
+	return &respError{RESP_OOM, "command not allowed when used memory > 'maxmemory'."}
+}
+
+// Requests that may grow the dataset first make room for it. A transaction
+// is checked when EXEC is called as a whole.
+func mayUseMemory(request *RespRequest) bool {
+	if request.command == RESP_EXEC {
+		for _, queued := range request.client.queued {
+			if processors[queued.command].flags&CMD_DENYOOM != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return processors[request.command].flags&CMD_DENYOOM != 0
+}
+
+func freeMemoryIfNeeded(request *RespRequest) error {
+	if maxMemory == 0 || !mayUseMemory(request) {
+		return nil
+	}
+	for usedMemory() > maxMemory {
+		if maxMemoryPolicy == POLICY_NOEVICTION {
+			return errOom()
+		}
+		db, key, ok := evictionCandidate()
+		if !ok {
+			return errOom()
+		}
+		if err := evictKey(db, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The best candidate among a sample of every database, the lower the
+// score the sooner a key is evicted.
+func evictionCandidate() (int, string, bool) {
+	volatileOnly := strings.HasPrefix(maxMemoryPolicy, "volatile-")
+	if maxMemoryPolicy == POLICY_ALLKEYS_RANDOM || maxMemoryPolicy == POLICY_VOLATILE_RANDOM {
+		start := rand.Intn(len(databases))
+		for i := range databases {
+			db := (start + i) % len(databases)
+			for key := range databases[db].Sample(1, volatileOnly) {
+				return db, key, true
+			}
+		}
+		return 0, "", false
+	}
+
+	now := time.Now().UnixMilli()
+	bestDb, bestKey, bestScore := 0, "", int64(math.MaxInt64)
+	for db, kv := range databases {
+		for key, entry := range kv.Sample(maxMemorySamples, volatileOnly) {
+			var score int64
+			switch maxMemoryPolicy {
+			case POLICY_ALLKEYS_LRU, POLICY_VOLATILE_LRU:
+				score = entry.LastAccess
+			case POLICY_ALLKEYS_LFU, POLICY_VOLATILE_LFU:
+				score = int64(storage.DecayedFrequency(entry, now))
+			case POLICY_VOLATILE_TTL:
+				score = entry.ExpireAt
+			}
+			if bestKey == "" || score < bestScore {
+				bestDb, bestKey, bestScore = db, key, score
+			}
+		}
+	}
+	return bestDb, bestKey, bestKey != ""
+}
+
+func evictKey(db int, key string) error {
+	if err := databases[db].Delete(key); err != nil {
+		return err
+	}
+	dirty++
+	propagate(db, string(RESP_DEL), key)
+	notifyKeyspaceEvent(NOTIFY_EVICTED, "evicted", key, db)
+	return nil
+}
@@ -0,0 +1,124 @@
+package resp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// Limit memory to what the given number of keys like key0 with value v use.
+func setMaxMemoryForKeys(t *testing.T, client *Client, policy string, keys int) {
+	size := storage.EntrySize("key0", storage.Entry{Value: []byte("v")})
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET maxmemory-policy "+policy))
+	require.Equal(t, "+OK\r\n", sendCommand(client, fmt.Sprintf("CONFIG SET maxmemory %d", size*int64(keys))))
+}
+
+func resetMaxMemory(client *Client) {
+	sendCommand(client, "CONFIG SET maxmemory 0")
+	sendCommand(client, "CONFIG SET maxmemory-policy noeviction")
+	sendCommand(client, "FLUSHALL")
+}
+
+func TestNoEviction(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "FLUSHALL")
+	defer resetMaxMemory(client)
+	setMaxMemoryForKeys(t, client, "noeviction", 2)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, "+OK\r\n", sendCommand(client, fmt.Sprintf("SET key%d v", i)))
+	}
+	require.Equal(t, "-OOM command not allowed when used memory > 'maxmemory'.\r\n", sendCommand(client, "SET key3 v"))
+	require.Equal(t, "+v\r\n", sendCommand(client, "GET key0"))
+	require.Equal(t, ":1\r\n", sendCommand(client, "DEL key0"))
+
+	// A transaction is refused as a whole
+	sendCommand(client, "SET key0 v")
+	sendCommand(client, "MULTI")
+	require.Contains(t, sendCommand(client, "SET key3 v"), "OOM")
+	require.Contains(t, sendCommand(client, "EXEC"), "EXECABORT")
+}
+
+func TestAllKeysLruEviction(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "FLUSHALL")
+	defer resetMaxMemory(client)
+	sendCommand(client, "CONFIG SET maxmemory-samples 10")
+	defer sendCommand(client, "CONFIG SET maxmemory-samples 5")
+
+	for i := 0; i < 4; i++ {
+		sendCommand(client, fmt.Sprintf("SET key%d v", i))
+		time.Sleep(2 * time.Millisecond)
+	}
+	sendCommand(client, "GET key0")
+	// Memory is checked before a command runs, it can end up one key over
+	setMaxMemoryForKeys(t, client, "allkeys-lru", 3)
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET key4 v"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET key5 v"))
+	require.Equal(t, "+v\r\n", sendCommand(client, "GET key0"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET key1"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET key2"))
+	require.Equal(t, "+v\r\n", sendCommand(client, "GET key3"))
+}
+
+func TestVolatileEviction(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "FLUSHALL")
+	defer resetMaxMemory(client)
+
+	sendCommand(client, "SET key0 v")
+	sendCommand(client, "SET key1 v")
+	setMaxMemoryForKeys(t, client, "volatile-ttl", 1)
+	// Nothing can be evicted without volatile keys
+	require.Contains(t, sendCommand(client, "SET key2 v"), "OOM")
+
+	sendCommand(client, "CONFIG SET maxmemory 0")
+	sendCommand(client, "DEL key1")
+	sendCommand(client, "SET soon v")
+	sendCommand(client, "EXPIRE soon 100")
+	sendCommand(client, "SET late v")
+	sendCommand(client, "EXPIRE late 1000")
+	var used int64
+	require.NoError(t, onExecutor(func() error {
+		used = usedMemory()
+		return nil
+	}))
+	sendCommand(client, fmt.Sprintf("CONFIG SET maxmemory %d", used-1))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET key1 v"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET soon"))
+	require.Equal(t, "+v\r\n", sendCommand(client, "GET late"))
+	require.Equal(t, "+v\r\n", sendCommand(client, "GET key0"))
+}
+
+func TestRandomEviction(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "FLUSHALL")
+	defer resetMaxMemory(client)
+	setMaxMemoryForKeys(t, client, "allkeys-random", 4)
+
+	for i := 0; i < 10; i++ {
+		require.Equal(t, "+OK\r\n", sendCommand(client, fmt.Sprintf("SET key%d v", i)))
+	}
+	var used int64
+	require.NoError(t, onExecutor(func() error {
+		used = usedMemory()
+		return nil
+	}))
+	require.LessOrEqual(t, used, 5*storage.EntrySize("key0", storage.Entry{Value: []byte("v")}))
+}
+
+func TestMaxMemoryConfig(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET maxmemory 1mb"))
+	require.Contains(t, sendCommand(client, "CONFIG GET maxmemory"), "1048576")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET maxmemory 0"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET maxmemory-policy ALLKEYS-LFU"))
+	require.Contains(t, sendCommand(client, "CONFIG GET maxmemory-policy"), "allkeys-lfu")
+	require.Contains(t, sendCommand(client, "CONFIG SET maxmemory-policy lru"), "must be one of")
+	require.Contains(t, sendCommand(client, "CONFIG SET maxmemory-samples 0"), "between 1 and 64")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET maxmemory-policy noeviction"))
+}
@@ -0,0 +1,16 @@
+// Key expiry. Storages remove expired keys lazily on access, the active
+// expiry cycle takes care of keys that are never accessed again. Watched
+// keys that expire dirty their clients like any other change, see watch.go.
+// The commands that set and query expiry times are in ttl.go.
+package resp
+
+import "time"
+
+const activeExpireInterval = 100 * time.Millisecond
+const activeExpireSamples = 20
+
+func activeExpireCycle() {
+	for _, db := range databases {
+		db.DeleteExpired(activeExpireSamples)
+	}
+}
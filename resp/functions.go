@@ -0,0 +1,422 @@
+// Functions, named Lua libraries loaded with FUNCTION LOAD and called with
+// FCALL. Unlike EVAL scripts they are part of the dataset, so they can be
+// dumped and restored and are persisted together with the keys.
+package resp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/rdb"
+	"github.com/johanlantz/redis/utils"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type luaLibrary struct {
+	name      string
+	code      string
+	functions map[string]*luaFunction
+}
+
+type luaFunction struct {
+	name        string
+	description string
+	flags       []string
+	library     *luaLibrary
+	callback    *lua.LFunction
+}
+
+var libraries = map[string]*luaLibrary{}
+var registeredFunctions = map[string]*luaFunction{}
+
+// Functions live in their own interpreter, separate from EVAL scripts.
+var functionsState *lua.LState
+
+// The library whose code is being executed by FUNCTION LOAD, register_function
+// adds to it.
+var loadingLibrary *luaLibrary
+
+// Loading only registers functions, a library that takes longer than this
+// would otherwise block the server with nothing to kill it.
+const functionLoadTimeout = 500 * time.Millisecond
+
+var validFunctionName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+var validFunctionFlags = map[string]bool{
+	"no-writes": true, "allow-oom": true, "allow-stale": true, "no-cluster": true, "allow-cross-slot-keys": true,
+}
+
+func newFunctionsState() *lua.LState {
+	return newLuaState(map[string]lua.LGFunction{"register_function": luaRegisterFunction})
+}
+
+// Rebuild the interpreter and load all libraries into it again. A library
+// that fails to load now is dropped rather than taking the server down.
+func resetFunctionsState() {
+	if functionsState != nil {
+		functionsState.Close()
+	}
+	functionsState = newFunctionsState()
+	current := libraries
+	libraries, registeredFunctions = map[string]*luaLibrary{}, map[string]*luaFunction{}
+	for _, library := range current {
+		if _, err := loadLibrary(library.code, false); err != nil {
+			log.Printf("Dropped the function library %s, reloading it failed: %s", library.name, err.Error())
+		}
+	}
+}
+
+// Both redis.register_function('name', callback) and the table form with
+// function_name, callback, flags and description are supported.
+func luaRegisterFunction(L *lua.LState) int {
+	if loadingLibrary == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+	}
+	function := &luaFunction{library: loadingLibrary}
+	if table, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+		name, _ := table.RawGetString("function_name").(lua.LString)
+		function.name = string(name)
+		function.callback, _ = table.RawGetString("callback").(*lua.LFunction)
+		if description, ok := table.RawGetString("description").(lua.LString); ok {
+			function.description = string(description)
+		}
+		if flags, ok := table.RawGetString("flags").(*lua.LTable); ok {
+			for i := 1; flags.RawGetInt(i) != lua.LNil; i++ {
+				flag := flags.RawGetInt(i).String()
+				if !validFunctionFlags[flag] {
+					L.RaiseError("unknown flag given")
+				}
+				function.flags = append(function.flags, flag)
+			}
+		}
+	} else {
+		function.name = L.CheckString(1)
+		function.callback = L.CheckFunction(2)
+	}
+
+	if function.callback == nil {
+		L.RaiseError("callback is required and must be a function")
+	}
+	if !validFunctionName.MatchString(function.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if _, exists := loadingLibrary.functions[function.name]; exists {
+		L.RaiseError("Function already exists in the library")
+	}
+	loadingLibrary.functions[function.name] = function
+	return 0
+}
+
+// The first line of the code is the shebang, e.g. #!lua name=mylib
+func parseLibraryHeader(code string) (string, string, error) {
+	header, body, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(header, "#!") {
+		return "", "", errors.New("Missing library metadata")
+	}
+	fields := strings.Fields(header[2:])
+	if len(fields) == 0 || fields[0] != "lua" {
+		return "", "", errors.New("Engine not found")
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		if key != "name" {
+			return "", "", fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", errors.New("Library name was not given")
+	}
+	if !validFunctionName.MatchString(name) {
+		return "", "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	// Keep the line count so error messages point to the right line
+	return name, "\n" + body, nil
+}
+
+func loadLibrary(code string, replace bool) (string, error) {
+	name, body, err := parseLibraryHeader(code)
+	if err != nil {
+		return "", err
+	}
+	existing := libraries[name]
+	if existing != nil && !replace {
+		return "", fmt.Errorf("Library '%s' already exists", name)
+	}
+	if functionsState == nil {
+		functionsState = newFunctionsState()
+	}
+
+	library := &luaLibrary{name: name, code: code, functions: map[string]*luaFunction{}}
+	chunk, err := functionsState.Load(strings.NewReader(body), "@user_function")
+	if err != nil {
+		return "", fmt.Errorf("Error compiling function: %s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	loadingLibrary = library
+	functionsState.SetContext(ctx)
+	functionsState.Push(chunk)
+	err = functionsState.PCall(0, 0, nil)
+	functionsState.RemoveContext()
+	loadingLibrary = nil
+	if ctx.Err() == context.DeadlineExceeded {
+		// The interpreter was stopped at an unknown point
+		resetFunctionsState()
+		return "", errors.New("FUNCTION LOAD timeout")
+	}
+	if err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return "", fmt.Errorf("Error registering functions: %s", apiErr.Object.String())
+		}
+		return "", err
+	}
+	if len(library.functions) == 0 {
+		return "", errors.New("No functions registered")
+	}
+	for functionName := range library.functions {
+		if other, ok := registeredFunctions[functionName]; ok && other.library != existing {
+			return "", fmt.Errorf("Function %s already exists", functionName)
+		}
+	}
+
+	if existing != nil {
+		deleteLibrary(existing)
+	}
+	libraries[name] = library
+	for functionName, function := range library.functions {
+		registeredFunctions[functionName] = function
+	}
+	return name, nil
+}
+
+func deleteLibrary(library *luaLibrary) {
+	for functionName := range library.functions {
+		delete(registeredFunctions, functionName)
+	}
+	delete(libraries, library.name)
+}
+
+func flushLibraries() {
+	libraries, registeredFunctions = map[string]*luaLibrary{}, map[string]*luaFunction{}
+	if functionsState != nil {
+		functionsState.Close()
+		functionsState = nil
+	}
+}
+
+func sortedLibraries() []*luaLibrary {
+	sorted := make([]*luaLibrary, 0, len(libraries))
+	for _, library := range libraries {
+		sorted = append(sorted, library)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	return sorted
+}
+
+// The same payload format as Redis, one function opcode per library followed
+// by the RDB version and checksum.
+func dumpLibraries() []byte {
+	payload := []byte{}
+	for _, library := range sortedLibraries() {
+		payload = append(payload, rdb.OpcodeFunction2)
+		payload = rdb.AppendString(payload, library.code)
+	}
+	return rdb.AppendFooter(payload)
+}
+
+func readLibraryCodes(payload []byte) ([]string, error) {
+	body, err := rdb.VerifyFooter(payload)
+	if err != nil {
+		return nil, err
+	}
+	reader := rdb.NewReader(body)
+	codes := []string{}
+	for reader.Remaining() > 0 {
+		opcode, _ := reader.ReadByte()
+		if opcode != rdb.OpcodeFunction2 {
+			return nil, errors.New("given type is not a function")
+		}
+		code, err := reader.ReadString()
+		if err != nil {
+			return nil, errors.New("payload is corrupt")
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// Restore policies are APPEND, which fails on existing libraries, REPLACE
+// and FLUSH which removes all libraries first. All or nothing is restored.
+func restoreLibraries(payload []byte, policy string) error {
+	codes, err := readLibraryCodes(payload)
+	if err != nil {
+		return err
+	}
+	previous := maps.Clone(libraries)
+	switch policy {
+	case "FLUSH":
+		flushLibraries()
+	case "APPEND", "REPLACE":
+	default:
+		return errors.New("syntax error")
+	}
+	for _, code := range codes {
+		if _, err = loadLibrary(code, policy == "REPLACE"); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		libraries = previous
+		resetFunctionsState()
+	}
+	return err
+}
+
+func functionListEntry(library *luaLibrary, withCode bool) *RespResponse {
+	names := make([]string, 0, len(library.functions))
+	for name := range library.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	functions := []*RespResponse{}
+	for _, name := range names {
+		function := library.functions[name]
+		description := newRespResponse(DT_NULLS, []string{})
+		if function.description != "" {
+			description = newRespResponse(DT_BULK_STRINGS, []string{function.description})
+		}
+		flags := []*RespResponse{}
+		for _, flag := range function.flags {
+			flags = append(flags, newRespResponse(DT_SIMPLE_STRING, []string{flag}))
+		}
+		functions = append(functions, newRespArrayResponse([]*RespResponse{
+			newRespResponse(DT_BULK_STRINGS, []string{"name"}), newRespResponse(DT_BULK_STRINGS, []string{name}),
+			newRespResponse(DT_BULK_STRINGS, []string{"description"}), description,
+			newRespResponse(DT_BULK_STRINGS, []string{"flags"}), newRespArrayResponse(flags),
+		}))
+	}
+
+	entry := []*RespResponse{
+		newRespResponse(DT_BULK_STRINGS, []string{"library_name"}), newRespResponse(DT_BULK_STRINGS, []string{library.name}),
+		newRespResponse(DT_BULK_STRINGS, []string{"engine"}), newRespResponse(DT_BULK_STRINGS, []string{"LUA"}),
+		newRespResponse(DT_BULK_STRINGS, []string{"functions"}), newRespArrayResponse(functions),
+	}
+	if withCode {
+		entry = append(entry, newRespResponse(DT_BULK_STRINGS, []string{"library_code"}), newRespResponse(DT_BULK_STRINGS, []string{library.code}))
+	}
+	return newRespArrayResponse(entry)
+}
+
+func fcall(request *RespRequest, readOnly bool) (*RespResponse, error) {
+	if len(request.args) < 2 {
+		return nil, fmt.Errorf("%s command requires function and numkeys arguments", strings.ToLower(string(request.command)))
+	}
+	function, ok := registeredFunctions[request.args[0]]
+	if !ok {
+		return nil, errors.New("Function not found")
+	}
+	keys, args, err := parseScriptArgs(request.args[1:])
+	if err != nil {
+		return nil, err
+	}
+	noWrites := false
+	for _, flag := range function.flags {
+		noWrites = noWrites || flag == "no-writes"
+	}
+	if readOnly && !noWrites {
+		return nil, errors.New("Can not execute a script with write flag using *_ro command.")
+	}
+	L := functionsState
+	return runLua(L, function.callback, function.name, request.client, true, noWrites,
+		stringsToLuaTable(L, keys), stringsToLuaTable(L, args))
+}
+
+func process_fcall(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return fcall(request, false)
+}
+
+func process_fcall_ro(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return fcall(request, true)
+}
+
+func process_function(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("function command requires a subcommand")
+	}
+	args := request.args[1:]
+	switch strings.ToUpper(request.args[0]) {
+	case "LOAD":
+		replace := len(args) == 2 && strings.ToUpper(args[0]) == "REPLACE"
+		if len(args) != 1 && !replace {
+			return nil, errors.New("function load requires the library code and optionally REPLACE")
+		}
+		name, err := loadLibrary(args[len(args)-1], replace)
+		if err != nil {
+			return nil, err
+		}
+		return newRespResponse(DT_BULK_STRINGS, []string{name}), nil
+	case "DELETE":
+		if len(args) != 1 {
+			return nil, errors.New("function delete requires only the library name")
+		}
+		library, ok := libraries[args[0]]
+		if !ok {
+			return nil, errors.New("Library not found")
+		}
+		deleteLibrary(library)
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	case "FLUSH":
+		if _, err := parseFlushMode(args); err != nil {
+			return nil, err
+		}
+		flushLibraries()
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	case "LIST":
+		pattern, withCode := "*", false
+		for i := 0; i < len(args); i++ {
+			switch {
+			case strings.ToUpper(args[i]) == "WITHCODE":
+				withCode = true
+			case strings.ToUpper(args[i]) == "LIBRARYNAME" && i+1 < len(args):
+				pattern = args[i+1]
+				i++
+			default:
+				return nil, errors.New("syntax error")
+			}
+		}
+		entries := []*RespResponse{}
+		for _, library := range sortedLibraries() {
+			if utils.GlobMatch(pattern, library.name) {
+				entries = append(entries, functionListEntry(library, withCode))
+			}
+		}
+		return newRespArrayResponse(entries), nil
+	case "DUMP":
+		return newRespResponse(DT_BULK_STRINGS, []string{string(dumpLibraries())}), nil
+	case "RESTORE":
+		if len(args) < 1 || len(args) > 2 {
+			return nil, errors.New("function restore requires the payload and optionally a policy")
+		}
+		policy := "APPEND"
+		if len(args) == 2 {
+			policy = strings.ToUpper(args[1])
+		}
+		if err := restoreLibraries([]byte(args[0]), policy); err != nil {
+			return nil, err
+		}
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	case "KILL":
+		// A function that is actually running is killed from busyScriptResponse.
+		return nil, &respError{RESP_NOTBUSY, "No scripts in execution right now."}
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+}
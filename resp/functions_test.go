@@ -0,0 +1,150 @@
+package resp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/utils"
+	"github.com/stretchr/testify/require"
+)
+
+const testLibrary = `#!lua name=testlib
+local function incrby(keys, args)
+	local current = tonumber(redis.call('GET', keys[1]) or 0)
+	redis.call('SET', keys[1], current + tonumber(args[1]))
+	return current + tonumber(args[1])
+end
+redis.register_function('test_incrby', incrby)
+redis.register_function{
+	function_name = 'test_get',
+	callback = function(keys, args) return redis.call('GET', keys[1]) end,
+	flags = {'no-writes'},
+	description = 'read a key'
+}
+redis.register_function{
+	function_name = 'test_sneaky_set',
+	callback = function(keys, args) return redis.call('SET', keys[1], 'x') end,
+	flags = {'no-writes'}
+}`
+
+func TestFunctionLoadAndCall(t *testing.T) {
+	client := NewClient()
+	sendArgs(client, "FUNCTION", "FLUSH")
+	require.Equal(t, "$7\r\ntestlib\r\n", sendArgs(client, "FUNCTION", "LOAD", testLibrary))
+	require.Contains(t, sendArgs(client, "FUNCTION", "LOAD", testLibrary), "already exists")
+	require.Equal(t, "$7\r\ntestlib\r\n", sendArgs(client, "FUNCTION", "LOAD", "REPLACE", testLibrary))
+
+	require.Equal(t, ":5\r\n", sendArgs(client, "FCALL", "test_incrby", "1", "fnKey", "5"))
+	require.Equal(t, ":7\r\n", sendArgs(client, "FCALL", "test_incrby", "1", "fnKey", "2"))
+	require.Equal(t, ":7\r\n", sendArgs(client, "FCALL_RO", "test_get", "1", "fnKey"))
+	require.Contains(t, sendArgs(client, "FCALL", "nope", "0"), "Function not found")
+}
+
+func TestFunctionReadOnly(t *testing.T) {
+	client := NewClient()
+	sendArgs(client, "FUNCTION", "LOAD", "REPLACE", testLibrary)
+	require.Contains(t, sendArgs(client, "FCALL_RO", "test_incrby", "1", "roKey", "1"), "write flag")
+	require.Contains(t, sendArgs(client, "FCALL", "test_sneaky_set", "1", "roKey"), "not allowed from read-only")
+	require.Equal(t, "_\r\n", sendCommand(client, "GET roKey"))
+}
+
+func TestFunctionLoadErrors(t *testing.T) {
+	client := NewClient()
+	require.Contains(t, sendArgs(client, "FUNCTION", "LOAD", "return 1"), "Missing library metadata")
+	require.Contains(t, sendArgs(client, "FUNCTION", "LOAD", "#!python name=x\n"), "Engine not found")
+	require.Contains(t, sendArgs(client, "FUNCTION", "LOAD", "#!lua name=empty\nlocal a = 1"), "No functions registered")
+	require.Contains(t, sendArgs(client, "FUNCTION", "LOAD", "#!lua name=calls\nredis.call('GET', 'a')"), "not available while loading")
+	require.Contains(t, sendArgs(client, "FUNCTION", "LOAD", "#!lua name=bad\nredis.register_function('bad name', function() end)"), "Function names")
+
+	sendArgs(client, "FUNCTION", "LOAD", "REPLACE", testLibrary)
+	clash := "#!lua name=other\nredis.register_function('test_get', function() return 1 end)"
+	require.Contains(t, sendArgs(client, "FUNCTION", "LOAD", clash), "Function test_get already exists")
+}
+
+func TestFunctionLoadTimeout(t *testing.T) {
+	client := NewClient()
+	sendArgs(client, "FUNCTION", "LOAD", "REPLACE", testLibrary)
+	require.Equal(t, "-ERR FUNCTION LOAD timeout\r\n", sendArgs(client, "FUNCTION", "LOAD", "#!lua name=endless\nwhile true do end"))
+	require.Equal(t, ":3\r\n", sendArgs(client, "FCALL", "test_incrby", "1", "timeoutKey", "3"))
+	require.Equal(t, "*0\r\n", sendArgs(client, "FUNCTION", "LIST", "LIBRARYNAME", "endless"))
+	sendCommand(client, "DEL timeoutKey")
+}
+
+func TestFunctionResetDropsBrokenLibrary(t *testing.T) {
+	client := NewClient()
+	sendArgs(client, "FUNCTION", "FLUSH")
+	sendArgs(client, "FUNCTION", "LOAD", testLibrary)
+	require.NoError(t, onExecutor(func() error {
+		libraries["broken"] = &luaLibrary{name: "broken", code: "#!lua name=broken\nerror('no')"}
+		resetFunctionsState()
+		return nil
+	}))
+	require.Equal(t, "*0\r\n", sendArgs(client, "FUNCTION", "LIST", "LIBRARYNAME", "broken"))
+	require.Equal(t, ":1\r\n", sendArgs(client, "FCALL", "test_incrby", "1", "resetKey", "1"))
+	sendCommand(client, "DEL resetKey")
+}
+
+func TestFunctionListAndDelete(t *testing.T) {
+	client := NewClient()
+	sendArgs(client, "FUNCTION", "FLUSH")
+	sendArgs(client, "FUNCTION", "LOAD", testLibrary)
+
+	list := sendArgs(client, "FUNCTION", "LIST", "LIBRARYNAME", "test*")
+	require.True(t, strings.HasPrefix(list, "*1\r\n*6\r\n$12\r\nlibrary_name\r\n$7\r\ntestlib\r\n"))
+	require.Contains(t, list, "$8\r\ntest_get\r\n$11\r\ndescription\r\n$10\r\nread a key\r\n$5\r\nflags\r\n*1\r\n+no-writes\r\n")
+	require.NotContains(t, list, "library_code")
+	require.Contains(t, sendArgs(client, "FUNCTION", "LIST", "WITHCODE"), "library_code")
+	require.Equal(t, "*0\r\n", sendArgs(client, "FUNCTION", "LIST", "LIBRARYNAME", "other*"))
+
+	require.Equal(t, "+OK\r\n", sendArgs(client, "FUNCTION", "DELETE", "testlib"))
+	require.Contains(t, sendArgs(client, "FUNCTION", "DELETE", "testlib"), "Library not found")
+	require.Contains(t, sendArgs(client, "FCALL", "test_get", "1", "a"), "Function not found")
+}
+
+// Extract the bulk string of a response
+func bulkValue(response string) string {
+	_, value, _ := strings.Cut(response, "\r\n")
+	return value[:len(value)-2]
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	client := NewClient()
+	sendArgs(client, "FUNCTION", "FLUSH")
+	sendArgs(client, "FUNCTION", "LOAD", testLibrary)
+	payload := bulkValue(sendArgs(client, "FUNCTION", "DUMP"))
+
+	require.Contains(t, sendArgs(client, "FUNCTION", "RESTORE", payload), "already exists")
+	require.Equal(t, "+OK\r\n", sendArgs(client, "FUNCTION", "RESTORE", payload, "REPLACE"))
+
+	sendArgs(client, "FUNCTION", "FLUSH")
+	sendArgs(client, "FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('other_fn', function() return 1 end)")
+	require.Equal(t, "+OK\r\n", sendArgs(client, "FUNCTION", "RESTORE", payload, "FLUSH"))
+	require.Equal(t, "*0\r\n", sendArgs(client, "FUNCTION", "LIST", "LIBRARYNAME", "other"))
+	sendCommand(client, "SET restoredFnKey 3")
+	require.Equal(t, ":3\r\n", sendArgs(client, "FCALL_RO", "test_get", "1", "restoredFnKey"))
+
+	corrupt := []byte(payload)
+	corrupt[2] ^= 0xff
+	require.Contains(t, sendArgs(client, "FUNCTION", "RESTORE", string(corrupt)), "checksum")
+}
+
+func TestFunctionKill(t *testing.T) {
+	scriptTimeLimit = 50 * time.Millisecond
+	defer func() { scriptTimeLimit = 5 * time.Second }()
+	client := NewClient()
+	sendArgs(client, "FUNCTION", "LOAD", "REPLACE", testLibrary)
+	sendArgs(client, "FUNCTION", "LOAD", "REPLACE", "#!lua name=loop\nredis.register_function('loop', function() while true do end end)")
+
+	fcallChannel := make(chan []byte)
+	requestChannel <- NetworkRequest{ResponseChannel: fcallChannel, Data: utils.MarshalArgsToResp("FCALL", "loop", "0")}
+	time.Sleep(100 * time.Millisecond)
+
+	require.Contains(t, sendArgs(NewClient(), "SCRIPT", "KILL"), RESP_BUSY)
+	require.Equal(t, "+OK\r\n", sendArgs(NewClient(), "FUNCTION", "KILL"))
+	require.Contains(t, string(<-fcallChannel), "FUNCTION KILL")
+
+	// Libraries survive the interpreter being rebuilt
+	sendCommand(client, "SET killFnKey 1")
+	require.Equal(t, ":1\r\n", sendArgs(client, "FCALL_RO", "test_get", "1", "killFnKey"))
+}
@@ -0,0 +1,189 @@
+// Outgoing connections to other servers. Replies are handed to the executor
+// as tasks, like everything else arriving from the network.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/utils"
+)
+
+const linkTimeout = time.Second
+
+// An error reply of an instance, e.g. LOADING, as opposed to a failed
+// connection.
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// Read one RESP2 reply. Arrays become []any, integers int64, strings
+// string and nulls nil.
+func readReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case DT_SIMPLE_STRING:
+		return line[1:], nil
+	case DT_SIMPLE_ERROR:
+		return replyError(line[1:]), nil
+	case DT_INTEGER:
+		return strconv.ParseInt(line[1:], 10, 64)
+	case DT_BULK_STRINGS:
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case DT_ARRAYS:
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = readReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply: %q", line)
+}
+
+func replyString(reply any) string {
+	switch value := reply.(type) {
+	case string:
+		return value
+	case int64:
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+func replyInt(reply any) int64 {
+	switch value := reply.(type) {
+	case int64:
+		return value
+	case string:
+		number, _ := strconv.ParseInt(value, 10, 64)
+		return number
+	}
+	return 0
+}
+
+type linkCommand struct {
+	args []string
+	// Run on the executor, nil when the reply does not matter
+	callback func(reply any, err error)
+}
+
+// An outgoing connection to another server, used by sentinels to watch the
+// instances and by cluster nodes to talk on the bus. Commands are sent one
+// at a time, the link reconnects on the next command after a failure.
+// Sentinels get a second connection subscribed to the hello channel of
+// masters and replicas.
+type instanceLink struct {
+	host     string
+	port     int
+	commands chan linkCommand
+	stopped  chan struct{}
+	// The address of this server as seen by the other one, only used by
+	// the executor
+	localIp string
+}
+
+func newInstanceLink(host string, port int, subscribe bool) *instanceLink {
+	link := &instanceLink{host: host, port: port, commands: make(chan linkCommand, 16), stopped: make(chan struct{})}
+	go link.run()
+	if subscribe {
+		go link.receiveHellos()
+	}
+	return link
+}
+
+func (link *instanceLink) close() {
+	close(link.stopped)
+}
+
+// Queue a command without blocking the executor, false when the link is
+// too far behind.
+func (link *instanceLink) send(callback func(reply any, err error), args ...string) bool {
+	select {
+	case link.commands <- linkCommand{args, callback}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (link *instanceLink) dial() (net.Conn, error) {
+	return net.DialTimeout("tcp", net.JoinHostPort(link.host, fmt.Sprint(link.port)), linkTimeout)
+}
+
+func (link *instanceLink) run() {
+	var conn net.Conn
+	var reader *bufio.Reader
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var command linkCommand
+		select {
+		case <-link.stopped:
+			return
+		case command = <-link.commands:
+		}
+		var reply any
+		var err error
+		localIp := ""
+		if conn == nil {
+			if conn, err = link.dial(); err == nil {
+				reader = bufio.NewReader(conn)
+			}
+		}
+		if conn != nil {
+			localIp, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+			conn.SetDeadline(time.Now().Add(linkTimeout))
+			if _, err = conn.Write(utils.MarshalArgsToResp(command.args...)); err == nil {
+				reply, err = readReply(reader)
+			}
+			if err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+		select {
+		case taskChannel <- func() {
+			if localIp != "" {
+				link.localIp = localIp
+			}
+			if command.callback != nil {
+				command.callback(reply, err)
+			}
+		}:
+		case <-link.stopped:
+			return
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package resp
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadReply(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("*3\r\n$6\r\nmaster\r\n:28\r\n*1\r\n*2\r\n$9\r\n127.0.0.1\r\n$-1\r\n-LOADING busy\r\n"))
+	reply, err := readReply(reader)
+	require.NoError(t, err)
+	require.Equal(t, []any{"master", int64(28), []any{[]any{"127.0.0.1", nil}}}, reply)
+	reply, err = readReply(reader)
+	require.NoError(t, err)
+	require.Equal(t, replyError("LOADING busy"), reply)
+	_, err = readReply(reader)
+	require.Error(t, err)
+}
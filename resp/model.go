@@ -2,6 +2,7 @@
 package resp
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strconv"
@@ -17,62 +18,44 @@ func (e *incompleteRespCommandError) Error() string {
 	return "incomplete"
 }
 
+// Errors that are reported with their own prefix instead of the generic ERR,
+// clients use the prefix to tell different error conditions apart.
+type respError struct {
+	prefix string
+	msg    string
+}
+
+func (e *respError) Error() string {
+	return e.prefix + " " + e.msg
+}
+
 type RespCommand string
 
 type RespRequest struct {
 	command RespCommand
 	args    []string
+	client  *Client
 }
 
 // Perform basic validation and build a RespRequest from an incoming command.
-func newRespRequest(bytes []byte, processors *map[RespCommand]RespFunc) (*RespRequest, error) {
-	cmd := string(bytes)
-
-	// 1. Generate our array of command segments from the bulk string array.
-	bulkArray := strings.Split(cmd[:len(cmd)-len(suffix)], suffix)
-
-	// 2. The command must be fully received
-	var bulkStringCountWanted int
-	var err error
-	if bulkStringCountWanted, err = strconv.Atoi(bulkArray[0][1:]); err != nil {
-		return nil, errors.New("invalid array count argument ")
-	}
-
-	bulkStringCountReceived := (len(bulkArray) - 1) / 2
-	if bulkStringCountWanted != bulkStringCountReceived {
-		return nil, &incompleteRespCommandError{}
-	}
-
-	lastElementSize, err := strconv.Atoi(bulkArray[len(bulkArray)-2][1:])
+func newRespRequest(bytes []byte, processors *map[RespCommand]respCommand) (*RespRequest, error) {
+	// 1. The command must be fully received, bulk strings are read by their
+	// length so they may contain any bytes, including the suffix.
+	cmdArray, _, err := parseRespArray(bytes)
 	if err != nil {
-		return nil, errors.New("invalid command")
+		return nil, err
 	}
-
-	if lastElementSize != len(bulkArray[len(bulkArray)-1]) {
-		return nil, &incompleteRespCommandError{}
-	}
-
-	// 3. Now keep only the actual command and not the RESP info.
-	cmdArray := []string{}
-	for _, element := range bulkArray {
-		if element[0] != DT_BULK_STRINGS && element[0] != DT_ARRAYS {
-			cmdArray = append(cmdArray, element)
-		}
+	if len(cmdArray) == 0 {
+		return nil, errors.New("invalid command")
 	}
 	cmdVerb := RespCommand(cmdArray[0])
 
-	// 4. The command must be supported by our current implementation
-	cmdSupported := false
-	for key := range *processors {
-		if cmdVerb == key {
-			cmdSupported = true
-		}
-	}
-	if !cmdSupported {
+	// 2. The command must be supported by our current implementation
+	if _, cmdSupported := (*processors)[cmdVerb]; !cmdSupported {
 		return nil, fmt.Errorf("unknown command, %s", cmdVerb)
 	}
 
-	// 4. Each command processor is responsible for validating the args later on.
+	// 3. Each command processor is responsible for validating the args later on.
 	cmd_args := []string{}
 	if len(cmdArray) > 1 {
 		cmd_args = cmdArray[1:]
@@ -81,18 +64,123 @@ func newRespRequest(bytes []byte, processors *map[RespCommand]RespFunc) (*RespRe
 	return &RespRequest{command: cmdVerb, args: cmd_args}, nil
 }
 
+// Parse one array of bulk strings from the start of data and return its
+// elements together with the number of bytes it occupied.
+func parseRespArray(data []byte) ([]string, int, error) {
+	line, pos, err := readRespLine(data, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(line) == 0 || line[0] != DT_ARRAYS {
+		return nil, 0, errors.New("invalid array count argument ")
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 {
+		return nil, 0, errors.New("invalid array count argument ")
+	}
+
+	elements := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, pos, err = readRespLine(data, pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(line) == 0 || line[0] != DT_BULK_STRINGS {
+			return nil, 0, errors.New("invalid command")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, 0, errors.New("invalid command")
+		}
+		if len(data) < pos+size+len(suffix) {
+			return nil, 0, &incompleteRespCommandError{}
+		}
+		if string(data[pos+size:pos+size+len(suffix)]) != suffix {
+			return nil, 0, errors.New("invalid command")
+		}
+		elements = append(elements, string(data[pos:pos+size]))
+		pos += size + len(suffix)
+	}
+	return elements, pos, nil
+}
+
+// Read up to the next suffix starting at pos, returns the line without the
+// suffix and the position after it.
+func readRespLine(data []byte, pos int) (string, int, error) {
+	end := bytes.Index(data[pos:], []byte(suffix))
+	if end < 0 {
+		return "", 0, &incompleteRespCommandError{}
+	}
+	return string(data[pos : pos+end]), pos + end + len(suffix), nil
+}
+
 type ResponseDataType byte
 
 type RespResponse struct {
-	t    ResponseDataType
-	args []string
+	t        ResponseDataType
+	args     []string
+	elements []*RespResponse
 }
 
 func newRespResponse(responseType ResponseDataType, args []string) *RespResponse {
 	return &RespResponse{t: responseType, args: args}
 }
 
+func newRespArrayResponse(elements []*RespResponse) *RespResponse {
+	return &RespResponse{t: DT_ARRAYS, elements: elements}
+}
+
+func newRespMapResponse(pairs []*RespResponse) *RespResponse {
+	return &RespResponse{t: DT_MAPS, elements: pairs}
+}
+
+func bulkStrings(values ...string) []*RespResponse {
+	elements := make([]*RespResponse, len(values))
+	for i, value := range values {
+		elements[i] = newRespResponse(DT_BULK_STRINGS, []string{value})
+	}
+	return elements
+}
+
+func integerResponse(value int) *RespResponse {
+	return newRespResponse(DT_INTEGER, []string{fmt.Sprint(value)})
+}
+
+func newErrorResponse(err error) *RespResponse {
+	if e, ok := err.(*respError); ok {
+		return newRespResponse(DT_SIMPLE_ERROR, []string{e.prefix, e.msg})
+	}
+	return newRespResponse(DT_SIMPLE_ERROR, []string{RESP_ERR, err.Error()})
+}
+
+// RESP2 has no maps or pushes, they are sent as flat arrays instead.
+func (rr *RespResponse) forProtocol(protocol int) *RespResponse {
+	if protocol >= 3 || (rr.t != DT_ARRAYS && rr.t != DT_MAPS && rr.t != DT_PUSHES) {
+		return rr
+	}
+	elements := make([]*RespResponse, len(rr.elements))
+	for i, element := range rr.elements {
+		elements[i] = element.forProtocol(protocol)
+	}
+	return newRespArrayResponse(elements)
+}
+
 func (rr RespResponse) marshalToBytes() []byte {
+	if rr.t == DT_ARRAYS || rr.t == DT_PUSHES || rr.t == DT_MAPS {
+		count := len(rr.elements)
+		if rr.t == DT_MAPS {
+			count /= 2
+		}
+		bytes := fmt.Appendf([]byte{byte(rr.t)}, "%d%s", count, suffix)
+		for _, element := range rr.elements {
+			bytes = append(bytes, element.marshalToBytes()...)
+		}
+		return bytes
+	}
+	if rr.t == DT_BULK_STRINGS {
+		value := strings.Join(rr.args, " ")
+		return fmt.Appendf([]byte{}, "$%d%s%s%s", len(value), suffix, value, suffix)
+	}
 	bytes := []byte{byte(rr.t)}
 	bytes = fmt.Append(bytes, strings.Join(rr.args, " "))
 	bytes = fmt.Appendf(bytes, suffix)
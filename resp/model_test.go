@@ -72,3 +72,16 @@ func TestQuotesSetCommandWithNewlinesAndDollarSign(t *testing.T) {
 	require.Equal(t, cmd.command, RESP_SET)
 	require.Equal(t, len(cmd.args), 2)
 }
+
+func TestBinarySafeArguments(t *testing.T) {
+	cmd, err := newRespRequest([]byte("*3\r\n$3\r\nSET\r\n$2\r\ngg\r\n$6\r\na\r\nb\r\n\r\n"), &processors)
+	require.NoError(t, err)
+	require.Equal(t, "a\r\nb\r\n", cmd.args[1])
+}
+
+func TestIncompleteCommand(t *testing.T) {
+	for _, data := range []string{"*2\r\n$3\r\nGET\r\n", "*2\r\n$3\r\nGET\r\n$3\r\nke", "*2\r\n$3\r\nGET\r\n$3"} {
+		_, err := newRespRequest([]byte(data), &processors)
+		require.IsType(t, &incompleteRespCommandError{}, err)
+	}
+}
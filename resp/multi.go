@@ -0,0 +1,85 @@
+// Transactions. After MULTI the executor queues every command of the client
+// instead of running it, EXEC then runs the whole queue without letting any
+// other request in between since the executor is a single goroutine.
+package resp
+
+import (
+	"errors"
+)
+
+// These commands are always executed directly, also inside a transaction.
+func isTransactionCommand(command RespCommand) bool {
+	switch command {
+	case RESP_MULTI, RESP_EXEC, RESP_DISCARD, RESP_WATCH:
+		return true
+	}
+	return false
+}
+
+func (c *Client) resetTransaction() {
+	c.multi = false
+	c.multiAborted = false
+	c.queued = nil
+}
+
+func process_multi(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 0 {
+		return nil, errors.New("multi command takes no arguments")
+	}
+	if request.client.multi {
+		return nil, errors.New("MULTI calls can not be nested")
+	}
+	request.client.multi = true
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+func process_exec(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	client := request.client
+	if !client.multi {
+		return nil, errors.New("EXEC without MULTI")
+	}
+	defer client.resetTransaction()
+	defer unwatchAllKeys(client)
+
+	if client.multiAborted {
+		return nil, &respError{RESP_EXECABORT, "Transaction discarded because of previous errors."}
+	}
+
+	// Watched keys that expired in the meantime must abort the transaction
+	// even if nobody accessed them yet.
+	for _, watched := range client.watched {
+		databases[watched.db].Get(watched.key)
+	}
+	if client.dirty {
+		return newRespResponse(DT_NULLS, []string{}), nil
+	}
+
+	responses := make([]*RespResponse, 0, len(client.queued))
+	for _, queued := range client.queued {
+		response, err := executeRequest(queued)
+		if err != nil {
+			response = newErrorResponse(err)
+		} else if response == nil {
+			response = newRespResponse(DT_NULLS, []string{})
+		}
+		responses = append(responses, response)
+	}
+	return newRespArrayResponse(responses), nil
+}
+
+// EXEC refused before running, e.g. because of maxmemory, discards the
+// transaction like any other abort.
+func abortExec(client *Client, err error) error {
+	client.resetTransaction()
+	unwatchAllKeys(client)
+	return &respError{RESP_EXECABORT, "Transaction discarded because of: " + err.Error()}
+}
+
+func process_discard(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if !request.client.multi {
+		return nil, errors.New("DISCARD without MULTI")
+	}
+	request.client.resetTransaction()
+	unwatchAllKeys(request.client)
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
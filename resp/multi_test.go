@@ -0,0 +1,65 @@
+package resp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiExec(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "MULTI"))
+	require.Equal(t, "+QUEUED\r\n", sendCommand(client, "SET multiKey 1"))
+	require.Equal(t, "+QUEUED\r\n", sendCommand(client, "INCR multiKey"))
+	require.Equal(t, "+QUEUED\r\n", sendCommand(client, "GET multiKey"))
+
+	// Nothing is visible before EXEC
+	require.Equal(t, "_\r\n", sendCommand(NewClient(), "GET multiKey"))
+
+	require.Equal(t, "*3\r\n+OK\r\n+OK\r\n:2\r\n", sendCommand(client, "EXEC"))
+	require.Equal(t, ":2\r\n", sendCommand(client, "GET multiKey"))
+}
+
+func TestMultiExecRuntimeError(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "MULTI")
+	sendCommand(client, "SET multiString hello")
+	sendCommand(client, "INCR multiString")
+	response := sendCommand(client, "EXEC")
+	require.Contains(t, response, "*2\r\n+OK\r\n-ERR WRONGTYPE")
+}
+
+func TestMultiExecAbort(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "MULTI")
+	require.Equal(t, "+QUEUED\r\n", sendCommand(client, "SET abortKey 1"))
+	require.Contains(t, sendCommand(client, "NOSUCHCOMMAND abortKey"), RESP_ERR)
+	require.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", sendCommand(client, "EXEC"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET abortKey"))
+
+	// The transaction state is reset after EXEC
+	require.Contains(t, sendCommand(client, "EXEC"), "EXEC without MULTI")
+}
+
+func TestMultiExecArity(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "MULTI")
+	require.Equal(t, "+QUEUED\r\n", sendCommand(client, "SET arityKey 1"))
+	require.Equal(t, "-ERR wrong number of arguments for 'set' command\r\n", sendCommand(client, "SET arityKey"))
+	require.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", sendCommand(client, "EXEC"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET arityKey"))
+}
+
+func TestMultiDiscard(t *testing.T) {
+	client := NewClient()
+	require.Contains(t, sendCommand(client, "DISCARD"), "DISCARD without MULTI")
+	sendCommand(client, "MULTI")
+	require.Contains(t, sendCommand(client, "MULTI"), "nested")
+	sendCommand(client, "SET discardKey 1")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "DISCARD"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET discardKey"))
+	require.Equal(t, "*0\r\n", func() string {
+		sendCommand(client, "MULTI")
+		return sendCommand(client, "EXEC")
+	}())
+}
@@ -0,0 +1,89 @@
+// Keyspace notifications, pub/sub messages about changes to keys. Enabled
+// with the notify-keyspace-events parameter which uses the Redis flags.
+package resp
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	NOTIFY_KEYSPACE = 1 << iota // K
+	NOTIFY_KEYEVENT             // E
+	NOTIFY_GENERIC              // g
+	NOTIFY_STRING               // $
+	NOTIFY_LIST                 // l
+	NOTIFY_SET                  // s
+	NOTIFY_HASH                 // h
+	NOTIFY_ZSET                 // z
+	NOTIFY_EXPIRED              // x
+	NOTIFY_EVICTED              // e
+	NOTIFY_STREAM               // t
+	NOTIFY_KEY_MISS             // m
+	NOTIFY_MODULE               // d
+)
+
+// A is an alias for all classes except key misses
+const notifyAll = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+	NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM | NOTIFY_MODULE
+
+var keyspaceEventFlags = []struct {
+	flag  byte
+	class int
+}{
+	{'g', NOTIFY_GENERIC}, {'$', NOTIFY_STRING}, {'l', NOTIFY_LIST}, {'s', NOTIFY_SET},
+	{'h', NOTIFY_HASH}, {'z', NOTIFY_ZSET}, {'x', NOTIFY_EXPIRED}, {'e', NOTIFY_EVICTED},
+	{'t', NOTIFY_STREAM}, {'m', NOTIFY_KEY_MISS}, {'d', NOTIFY_MODULE},
+	{'K', NOTIFY_KEYSPACE}, {'E', NOTIFY_KEYEVENT},
+}
+
+// Disabled by default since every write then has to publish.
+var keyspaceEvents = 0
+
+func keyspaceEventsFromString(value string) (int, error) {
+	flags := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		found := false
+		for _, f := range keyspaceEventFlags {
+			if f.flag == value[i] {
+				flags |= f.class
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Invalid event class character '%c'", value[i])
+		}
+	}
+	return flags, nil
+}
+
+func keyspaceEventsToString(flags int) string {
+	var sb strings.Builder
+	if flags&notifyAll == notifyAll {
+		sb.WriteByte('A')
+		flags &^= notifyAll
+	}
+	for _, f := range keyspaceEventFlags {
+		if flags&f.class != 0 {
+			sb.WriteByte(f.flag)
+		}
+	}
+	return sb.String()
+}
+
+// Publish an event of the given class about key in database db.
+func notifyKeyspaceEvent(class int, event string, key string, db int) {
+	if keyspaceEvents&class == 0 {
+		return
+	}
+	if keyspaceEvents&NOTIFY_KEYSPACE != 0 {
+		publish(fmt.Sprintf("__keyspace@%d__:%s", db, key), event)
+	}
+	if keyspaceEvents&NOTIFY_KEYEVENT != 0 {
+		publish(fmt.Sprintf("__keyevent@%d__:%s", db, event), key)
+	}
+}
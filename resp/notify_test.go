@@ -0,0 +1,74 @@
+package resp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyspaceEventFlags(t *testing.T) {
+	flags, err := keyspaceEventsFromString("KEA")
+	require.NoError(t, err)
+	require.Equal(t, "AKE", keyspaceEventsToString(flags))
+
+	flags, err = keyspaceEventsFromString("Kx$")
+	require.NoError(t, err)
+	require.Equal(t, NOTIFY_KEYSPACE|NOTIFY_EXPIRED|NOTIFY_STRING, flags)
+	require.Equal(t, "$xK", keyspaceEventsToString(flags))
+
+	_, err = keyspaceEventsFromString("KQ")
+	require.Error(t, err)
+}
+
+func TestConfigGetSet(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "*2\r\n$22\r\nnotify-keyspace-events\r\n$0\r\n\r\n", sendCommand(client, "CONFIG GET notify-keyspace-*"))
+	require.Contains(t, sendCommand(client, "CONFIG SET notify-keyspace-events Q"), "Invalid event class")
+	require.Contains(t, sendCommand(client, "CONFIG SET no-such-option 1"), "Unknown option")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET notify-keyspace-events Eg"))
+	require.Equal(t, "*2\r\n$22\r\nnotify-keyspace-events\r\n$2\r\ngE\r\n", sendCommand(client, "CONFIG GET notify-keyspace-events"))
+	require.Equal(t, "+OK\r\n", sendArgs(client, "CONFIG", "SET", "notify-keyspace-events", ""))
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	client := NewClient()
+	sendArgs(client, "CONFIG", "SET", "notify-keyspace-events", "KEA")
+	defer sendArgs(client, "CONFIG", "SET", "notify-keyspace-events", "")
+
+	subscriber := NewClient()
+	defer CloseClient(subscriber)
+	sendCommand(subscriber, "PSUBSCRIBE __key*@10__:*")
+	nextPush(t, subscriber)
+
+	sendCommand(client, "SELECT 10")
+	sendCommand(client, "SET notifyKey 1")
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$13\r\n__key*@10__:*\r\n$25\r\n__keyspace@10__:notifyKey\r\n$3\r\nset\r\n", nextPush(t, subscriber))
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$13\r\n__key*@10__:*\r\n$19\r\n__keyevent@10__:set\r\n$9\r\nnotifyKey\r\n", nextPush(t, subscriber))
+
+	sendCommand(client, "INCR notifyKey")
+	require.Contains(t, nextPush(t, subscriber), "incrby")
+	nextPush(t, subscriber)
+
+	sendCommand(client, "PEXPIRE notifyKey 10")
+	require.Contains(t, nextPush(t, subscriber), "expire")
+	nextPush(t, subscriber)
+
+	// Expiry is reported by the storage, here through the active expiry cycle
+	time.Sleep(200 * time.Millisecond)
+	require.Contains(t, nextPush(t, subscriber), "$7\r\nexpired\r\n")
+	require.Contains(t, nextPush(t, subscriber), "__keyevent@10__:expired")
+
+	sendCommand(client, "SET notifyKey 1")
+	nextPush(t, subscriber)
+	nextPush(t, subscriber)
+	sendCommand(client, "DEL notifyKey")
+	require.Contains(t, nextPush(t, subscriber), "$3\r\ndel\r\n")
+	nextPush(t, subscriber)
+	sendCommand(client, "GET notifyKey")
+	select {
+	case push := <-subscriber.Pushes():
+		t.Fatalf("key misses are not part of A, got %s", push)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -6,7 +6,10 @@ package resp
 import (
 	"errors"
 	"fmt"
+	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/johanlantz/redis/storage"
 )
@@ -14,82 +17,431 @@ import (
 // Open up for different kinds of storage in the future
 type KVStorage interface {
 	Get(key string) storage.Entry
-	Set(key string, value storage.Entry)
-	Delete(key string)
+	Set(key string, value storage.Entry) error
+	Delete(key string) error
+	Flush(async bool) error
+	DeleteExpired(limit int) int
+	SetListener(listener storage.Listener)
+	ForEach(fn func(key string, entry storage.Entry))
+	UsedMemory() int64
+	Sample(count int, volatileOnly bool) map[string]storage.Entry
 }
 
 // Requests from the network layer now have their own ResponseChannels
 // The internal types are still generic.
+// The response is nil while the request is incomplete and empty when the
+// request was consumed without anything to reply.
+// A nil Client means the request is executed on behalf of a throwaway
+// client that has the default database selected.
 type NetworkRequest struct {
 	ResponseChannel chan<- []byte
 	Data            []byte
+	Client          *Client
 }
 
 // Actual execution of the validated commands are no offloaded to new goroutines.
+// Requests that failed validation are passed on with err set, the executor
+// needs to see them to abort an ongoing transaction.
 type RespExecRequest struct {
 	request         *RespRequest
 	ResponseChannel chan<- []byte
-	storage         KVStorage
+	err             error
 }
 
 var respExecChannel = make(chan RespExecRequest)
 
+// Internal work that must run on the executor, e.g. periodic jobs or
+// cleaning up after a client has disconnected.
+var taskChannel = make(chan func())
+
+// A processor returning neither a response nor an error has nothing to
+// reply, e.g. because everything was sent as pushes already.
 type RespFunc = func(request *RespRequest, kv KVStorage) (*RespResponse, error)
 
+// What kind of command an entry of the processors map is.
+type commandFlags int
+
+const (
+	CMD_WRITE    commandFlags = 1 << iota // modifies the dataset
+	CMD_READONLY                          // only reads the dataset
+	CMD_DENYOOM                           // may grow the dataset, refused when out of memory
+	CMD_NOSCRIPT                          // cannot be called from scripts
+	CMD_STALE                             // served by a replica that lost its master
+)
+
+// Where the keys of a command are, counting the command name as position 0
+// like Redis does. A negative last position counts from the end, commands
+// of scripts have the number of keys at numKeys followed by the keys.
+// Commands whose keys follow an option find them with find instead.
+type keySpec struct {
+	first, last, step int
+	numKeys           int
+	find              func(args []string) []string
+}
+
+var (
+	noKeys      = keySpec{}
+	firstKey    = keySpec{first: 1, last: 1, step: 1}
+	allKeys     = keySpec{first: 1, last: -1, step: 1}
+	scriptKeys  = keySpec{numKeys: 2}
+	migrateKeys = keySpec{find: migrateKeyArgs}
+)
+
+// The arity counts the command name like Redis does, a negative arity is
+// the minimum number of arguments.
+type respCommand struct {
+	process RespFunc
+	arity   int
+	flags   commandFlags
+	keys    keySpec
+}
+
 // Implementing new commands only requires adding an entry here.
-var processors = map[RespCommand]RespFunc{
-	RESP_GET:  process_get,
-	RESP_SET:  process_set,
-	RESP_INCR: process_incr,
-	RESP_DEL:  process_del,
+var processors = map[RespCommand]respCommand{
+	RESP_GET:  {process_get, 2, CMD_READONLY, firstKey},
+	RESP_SET:  {process_set, -3, CMD_WRITE | CMD_DENYOOM, firstKey},
+	RESP_INCR: {process_incr, 2, CMD_WRITE | CMD_DENYOOM, firstKey},
+	RESP_DEL:  {process_del, -2, CMD_WRITE, allKeys},
+
+	RESP_SELECT:   {process_select, 2, CMD_STALE, noKeys},
+	RESP_MOVE:     {process_move, 3, CMD_WRITE, firstKey},
+	RESP_SWAPDB:   {process_swapdb, 3, CMD_WRITE, noKeys},
+	RESP_FLUSHDB:  {process_flushdb, -1, CMD_WRITE, noKeys},
+	RESP_FLUSHALL: {process_flushall, -1, CMD_WRITE, noKeys},
+
+	RESP_MULTI:   {process_multi, 1, CMD_NOSCRIPT | CMD_STALE, noKeys},
+	RESP_DISCARD: {process_discard, 1, CMD_NOSCRIPT | CMD_STALE, noKeys},
+	RESP_WATCH:   {process_watch, -2, CMD_NOSCRIPT | CMD_STALE, allKeys},
+	RESP_UNWATCH: {process_unwatch, 1, CMD_NOSCRIPT | CMD_STALE, noKeys},
+
+	RESP_EXPIRE:    {process_expire, 3, CMD_WRITE, firstKey},
+	RESP_PEXPIRE:   {process_pexpire, 3, CMD_WRITE, firstKey},
+	RESP_EXPIREAT:  {process_expireat, 3, CMD_WRITE, firstKey},
+	RESP_PEXPIREAT: {process_pexpireat, 3, CMD_WRITE, firstKey},
+	RESP_TTL:       {process_ttl, 2, CMD_READONLY, firstKey},
+	RESP_PTTL:      {process_pttl, 2, CMD_READONLY, firstKey},
+	RESP_PERSIST:   {process_persist, 2, CMD_WRITE, firstKey},
+
+	RESP_PING:  {process_ping, -1, CMD_STALE, noKeys},
+	RESP_HELLO: {process_hello, -1, CMD_STALE, noKeys},
+	RESP_AUTH:  {process_auth, -2, CMD_NOSCRIPT | CMD_STALE, noKeys},
+
+	RESP_SUBSCRIBE:    {process_subscribe, -2, CMD_NOSCRIPT | CMD_STALE, noKeys},
+	RESP_UNSUBSCRIBE:  {process_unsubscribe, -1, CMD_NOSCRIPT | CMD_STALE, noKeys},
+	RESP_PSUBSCRIBE:   {process_psubscribe, -2, CMD_NOSCRIPT | CMD_STALE, noKeys},
+	RESP_PUNSUBSCRIBE: {process_punsubscribe, -1, CMD_NOSCRIPT | CMD_STALE, noKeys},
+	RESP_PUBLISH:      {process_publish, 3, CMD_STALE, noKeys},
+	RESP_PUBSUB:       {process_pubsub, -2, CMD_STALE, noKeys},
+	RESP_SSUBSCRIBE:   {process_ssubscribe, -2, CMD_NOSCRIPT | CMD_STALE, allKeys},
+	RESP_SUNSUBSCRIBE: {process_sunsubscribe, -1, CMD_NOSCRIPT | CMD_STALE, allKeys},
+	RESP_SPUBLISH:     {process_spublish, 3, CMD_STALE, firstKey},
+
+	RESP_CONFIG: {process_config, -2, CMD_STALE, noKeys},
+	RESP_CLIENT: {process_client, -2, CMD_STALE, noKeys},
+
+	RESP_BGREWRITEAOF: {process_bgrewriteaof, 1, 0, noKeys},
+	RESP_SAVE:         {process_save, 1, 0, noKeys},
+	RESP_BGSAVE:       {process_bgsave, -1, 0, noKeys},
+	RESP_LASTSAVE:     {process_lastsave, 1, CMD_STALE, noKeys},
+
+	RESP_DUMP:           {process_dump, 2, CMD_READONLY, firstKey},
+	RESP_RESTORE:        {process_restore, -4, CMD_WRITE | CMD_DENYOOM, firstKey},
+	RESP_RESTORE_ASKING: {process_restore, -4, CMD_WRITE | CMD_DENYOOM, firstKey},
+	RESP_MIGRATE:        {process_migrate, -6, CMD_WRITE, migrateKeys},
+
+	RESP_PSYNC:    {process_psync, -3, CMD_NOSCRIPT, noKeys},
+	RESP_REPLCONF: {process_replconf, -1, CMD_NOSCRIPT | CMD_STALE, noKeys},
+	RESP_ROLE:     {process_role, 1, CMD_STALE, noKeys},
+
+	RESP_WAIT:    {process_wait, 3, CMD_NOSCRIPT, noKeys},
+	RESP_WAITAOF: {process_waitaof, 4, CMD_NOSCRIPT, noKeys},
+
+	RESP_CLUSTER: {process_cluster, -2, CMD_STALE, noKeys},
+	RESP_ASKING:  {process_asking, 1, 0, noKeys},
+}
+
+// Commands that execute other commands or list them refer back to the
+// processors map, so they are registered here to avoid an initialization
+// cycle.
+func init() {
+	processors[RESP_ACL] = respCommand{process_acl, -2, CMD_NOSCRIPT | CMD_STALE, noKeys}
+	processors[RESP_EXEC] = respCommand{process_exec, 1, CMD_NOSCRIPT | CMD_STALE, noKeys}
+	processors[RESP_EVAL] = respCommand{process_eval, -3, CMD_NOSCRIPT | CMD_DENYOOM, scriptKeys}
+	processors[RESP_EVALSHA] = respCommand{process_evalsha, -3, CMD_NOSCRIPT | CMD_DENYOOM, scriptKeys}
+	processors[RESP_SCRIPT] = respCommand{process_script, -2, CMD_NOSCRIPT, noKeys}
+	processors[RESP_FCALL] = respCommand{process_fcall, -3, CMD_NOSCRIPT | CMD_DENYOOM, scriptKeys}
+	processors[RESP_FCALL_RO] = respCommand{process_fcall_ro, -3, CMD_NOSCRIPT, scriptKeys}
+	processors[RESP_FUNCTION] = respCommand{process_function, -2, CMD_NOSCRIPT | CMD_DENYOOM, noKeys}
+	processors[RESP_REPLICAOF] = respCommand{process_replicaof, 3, CMD_NOSCRIPT | CMD_STALE, noKeys}
+	processors[RESP_SLAVEOF] = respCommand{process_replicaof, 3, CMD_NOSCRIPT | CMD_STALE, noKeys}
+}
+
+// Only needed where a request is not run right away, processors validate
+// their arguments themselves.
+func checkArity(request *RespRequest) error {
+	arity := processors[request.command].arity
+	count := len(request.args) + 1
+	if (arity > 0 && count != arity) || (arity < 0 && count < -arity) {
+		return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(string(request.command)))
+	}
+	return nil
+}
+
+// The keys a request operates on according to the spec of its command.
+func commandKeys(request *RespRequest) []string {
+	spec := processors[request.command].keys
+	if spec.find != nil {
+		return spec.find(request.args)
+	}
+	if spec.numKeys > 0 {
+		if len(request.args) < spec.numKeys {
+			return nil
+		}
+		count, err := strconv.Atoi(request.args[spec.numKeys-1])
+		if err != nil || count < 0 || spec.numKeys+count > len(request.args) {
+			return nil
+		}
+		return request.args[spec.numKeys : spec.numKeys+count]
+	}
+	if spec.first == 0 || spec.first > len(request.args) {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(request.args) + 1
+	}
+	keys := []string{}
+	for position := spec.first; position <= min(last, len(request.args)); position += spec.step {
+		keys = append(keys, request.args[position-1])
+	}
+	return keys
 }
 
 // Redis proccesses in a single thread. This "event loop" provides the
 // same behaviour while offering concurrency for the incoming connections.
 // It also means the storage does not have to worry about race conditions.
-func StartCommandProcessor(requestChannel <-chan NetworkRequest, storage KVStorage) {
+// Each storage passed in is one logical database, selectable by index.
+func StartCommandProcessor(requestChannel <-chan NetworkRequest, storages ...KVStorage) {
+	if len(storages) == 0 {
+		panic("at least one database is required")
+	}
+	databases = storages
+	// The configuration loader rejects this already, the check remains for
+	// parameters loaded some other way
+	if maxMemory != 0 && persistentDatabases() {
+		log.Fatal(ErrMaxMemoryOnDisk)
+	}
+	if aclFile != "" {
+		if err := loadAclFile(); err != nil {
+			log.Fatalf("Error loading the ACL file: %s", err.Error())
+		}
+	}
+	if sentinelMode {
+		processors = sentinelProcessors
+		log.Printf("Running in sentinel mode, my id is %s", sentinelId)
+	} else {
+		for _, db := range databases {
+			listenToStorage(db)
+		}
+		if err := loadDataset(); err != nil {
+			log.Fatalf("Error loading the dataset: %s", err.Error())
+		}
+		startConfiguredReplication()
+		if clusterEnabled {
+			startCluster()
+		}
+	}
+
 	go func() {
 		for networkRequest := range requestChannel {
-			processNetworkRequest(networkRequest, storage)
+			processNetworkRequest(networkRequest)
 		}
 	}()
 
 	go func() {
-		for respExecRequest := range respExecChannel {
-			processRespExecRequest(respExecRequest)
+		for {
+			select {
+			case respExecRequest := <-respExecChannel:
+				processRespExecRequest(respExecRequest)
+			case task := <-taskChannel:
+				task()
+			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(activeExpireInterval) {
+			taskChannel <- serverCron
 		}
 	}()
 }
 
-func processNetworkRequest(networkRequest NetworkRequest, storage KVStorage) {
-	request, err := newRespRequest(networkRequest.Data, &processors)
-	var response *RespResponse
+// Periodic jobs of the executor.
+func serverCron() {
+	if sentinelMode {
+		sentinelCron()
+		return
+	}
+	activeExpireCycle()
+	closeIdleClients()
+	saveCron()
+	replicationCron()
+	checkDurabilityWaits()
+	if clusterEnabled {
+		clusterCron()
+	}
+}
+
+// Must be called by the network layer once the connection of a client is
+// gone so that any state referring to it can be released.
+func CloseClient(client *Client) {
+	taskChannel <- func() {
+		unwatchAllKeys(client)
+		unsubscribeAll(client)
+		disableTracking(client)
+		removeReplica(client)
+		unblockClient(client)
+		if _, registered := clientsById.LoadAndDelete(client.id); registered {
+			connectedClients.Add(-1)
+		}
+	}
+}
+
+func processNetworkRequest(networkRequest NetworkRequest) {
+	client := networkRequest.Client
+	if client == nil {
+		client = newClient()
+	}
 
+	request, err := newRespRequest(networkRequest.Data, &processors)
 	if err != nil {
-		switch err.(type) {
-		case *incompleteRespCommandError:
-			networkRequest.ResponseChannel <- []byte("")
-		default:
-			response = newRespResponse(DT_SIMPLE_ERROR, []string{RESP_ERR, err.Error()})
-			networkRequest.ResponseChannel <- response.marshalToBytes()
+		if _, incomplete := err.(*incompleteRespCommandError); incomplete {
+			networkRequest.ResponseChannel <- nil
+			return
 		}
+		request = &RespRequest{client: client}
+	}
+	request.client = client
+	if err == nil {
+		err = clusterRedirection(request)
+	}
+
+	if response := busyScriptResponse(request); response != nil {
+		networkRequest.ResponseChannel <- response.marshalToBytes()
 		return
 	}
 
-	// The preparsing was successful, handoff to the executor
+	// The preparsing is done, handoff to the executor
 	go func() {
-		storageRequest := RespExecRequest{request, networkRequest.ResponseChannel, storage}
+		storageRequest := RespExecRequest{request, networkRequest.ResponseChannel, err}
 		respExecChannel <- storageRequest
 	}()
 }
 
+// The client whose request the executor is currently running.
+var currentClient *Client
+
 func processRespExecRequest(storageRequest RespExecRequest) {
-	response, err := processors[storageRequest.request.command](storageRequest.request, storageRequest.storage)
+	request := storageRequest.request
+	var response *RespResponse
+	var err error
 
+	currentClient = request.client
+	defer func() { currentClient = nil }()
+	request.client.lastInteraction = time.Now()
+	defer request.client.tracking.afterCommand(request.command)
+
+	switch {
+	case storageRequest.err != nil:
+		err = storageRequest.err
+		if request.client.multi {
+			request.client.multiAborted = true
+		}
+	case request.command != "" && request.client.mustAuthenticate() && !allowedWithoutAuth[request.command]:
+		err = errNoAuth()
+		if request.client.multi {
+			request.client.multiAborted = true
+		}
+	case request.client.isSubscribed() && request.client.protocol < 3 && !allowedWhileSubscribed[request.command]:
+		err = fmt.Errorf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(string(request.command)))
+	case request.client.multi && !isTransactionCommand(request.command):
+		if err = checkArity(request); err != nil {
+			request.client.multiAborted = true
+			break
+		}
+		if err = admitRequest(request); err != nil {
+			request.client.multiAborted = true
+			break
+		}
+		request.client.queued = append(request.client.queued, request)
+		response = newRespResponse(DT_SIMPLE_STRING, []string{RESP_QUEUED})
+	default:
+		if err = admitRequest(request); err != nil {
+			if request.command == RESP_EXEC {
+				err = abortExec(request.client, err)
+			}
+			break
+		}
+		response, err = executeRequest(request)
+	}
+
+	if err == errBlocked {
+		request.client.blocked.response = storageRequest.ResponseChannel
+		return
+	}
 	if err != nil {
-		response = newRespResponse(DT_SIMPLE_ERROR, []string{RESP_ERR, err.Error()})
+		response = newErrorResponse(err)
 	}
-	storageRequest.ResponseChannel <- response.marshalToBytes()
+	if response == nil {
+		storageRequest.ResponseChannel <- []byte{}
+		return
+	}
+	storageRequest.ResponseChannel <- response.forProtocol(request.client.protocol).marshalToBytes()
+}
+
+// Checks made before a request is run or queued in a transaction.
+func admitRequest(request *RespRequest) error {
+	if err := aclCheck(request.client, request, aclContext(request.client)); err != nil {
+		return err
+	}
+	if err := clusterAdmit(request); err != nil {
+		return err
+	}
+	if err := replicaRejects(request); err != nil {
+		return err
+	}
+	return freeMemoryIfNeeded(request)
+}
+
+// Run a validated request against the database selected by its client.
+func executeRequest(request *RespRequest) (*RespResponse, error) {
+	kv := databases[request.client.db]
+	response, err := processors[request.command].process(request, kv)
+	if err == nil {
+		if isWriteRequest(request) {
+			dirty++
+			propagateWrite(request)
+			if currentClient != nil {
+				currentClient.writeOffset, currentClient.aofWriteOffset = replicationOffset, aofWritten
+			}
+		}
+		if currentClient != nil {
+			rememberTrackedKeys(currentClient, request)
+		}
+	}
+	return response, err
+}
+
+// FUNCTION subcommands that change the libraries.
+var functionWriteSubcommands = map[string]bool{
+	"LOAD": true, "DELETE": true, "FLUSH": true, "RESTORE": true,
+}
+
+func isWriteRequest(request *RespRequest) bool {
+	if request.command == RESP_FUNCTION {
+		return len(request.args) > 0 && functionWriteSubcommands[strings.ToUpper(request.args[0])]
+	}
+	return processors[request.command].flags&CMD_WRITE != 0
 }
 
 func process_get(request *RespRequest, kv KVStorage) (*RespResponse, error) {
@@ -98,26 +450,33 @@ func process_get(request *RespRequest, kv KVStorage) (*RespResponse, error) {
 	}
 	entry := kv.Get(request.args[0])
 	if entry.IsNull() {
+		notifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", request.args[0], request.client.db)
 		return newRespResponse(DT_NULLS, []string{}), nil
 	}
 	return newRespResponse(ResponseDataType(entry.DataType), []string{string(entry.Value)}), nil
 }
 
+// Values are stored with the RESP type they look like.
+func stringEntry(value string) storage.Entry {
+	if _, err := strconv.Atoi(value); err == nil {
+		return storage.Entry{DataType: DT_INTEGER, Value: []byte(value)}
+	} else if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return storage.Entry{DataType: DT_DOUBLES, Value: []byte(value)}
+	} else if _, err := strconv.ParseBool(value); err == nil {
+		return storage.Entry{DataType: DT_BOOLEANS, Value: []byte{value[0]}}
+	}
+	return storage.Entry{DataType: DT_SIMPLE_STRING, Value: []byte(value)}
+}
+
 func process_set(request *RespRequest, kv KVStorage) (*RespResponse, error) {
 	if len(request.args) < 2 {
 		return nil, errors.New("set command requires key and value parameters")
 	}
 	key := request.args[0]
-	value := request.args[1]
-	if _, err := strconv.Atoi(value); err == nil {
-		kv.Set(key, storage.Entry{DataType: DT_INTEGER, Value: []byte(value)})
-	} else if _, err := strconv.ParseFloat(value, 64); err == nil {
-		kv.Set(key, storage.Entry{DataType: DT_DOUBLES, Value: []byte(value)})
-	} else if _, err := strconv.ParseBool(value); err == nil {
-		kv.Set(key, storage.Entry{DataType: DT_BOOLEANS, Value: []byte{value[0]}})
-	} else {
-		kv.Set(key, storage.Entry{DataType: DT_SIMPLE_STRING, Value: []byte(value)})
+	if err := kv.Set(key, stringEntry(request.args[1])); err != nil {
+		return nil, err
 	}
+	notifyKeyspaceEvent(NOTIFY_STRING, "set", key, request.client.db)
 	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
 }
 
@@ -128,17 +487,22 @@ func process_incr(request *RespRequest, kv KVStorage) (*RespResponse, error) {
 	key := request.args[0]
 	entry := kv.Get(request.args[0])
 
+	var err error
 	if entry.IsNull() {
-		kv.Set(key, storage.Entry{DataType: DT_INTEGER, Value: []byte("1")})
+		err = kv.Set(key, storage.Entry{DataType: DT_INTEGER, Value: []byte("1")})
 	} else if entry.DataType != DT_INTEGER {
 		return nil, errors.New("WRONGTYPE existing value for key is not an integer")
 	} else {
 		if stored, err := strconv.Atoi(string(entry.Value)); err == nil {
-			kv.Set(key, storage.Entry{DataType: DT_INTEGER, Value: []byte(fmt.Sprint(stored + 1))})
+			err = kv.Set(key, storage.Entry{DataType: DT_INTEGER, Value: []byte(fmt.Sprint(stored + 1)), ExpireAt: entry.ExpireAt})
 		} else {
 			return nil, errors.New("FATAL storage corrupt")
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+	notifyKeyspaceEvent(NOTIFY_STRING, "incrby", key, request.client.db)
 	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
 }
 
@@ -150,7 +514,10 @@ func process_del(request *RespRequest, kv KVStorage) (*RespResponse, error) {
 	for _, arg := range request.args {
 		entry := kv.Get(arg)
 		if !entry.IsNull() {
-			kv.Delete(arg)
+			if err := kv.Delete(arg); err != nil {
+				return nil, err
+			}
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", arg, request.client.db)
 			deleteCount++
 		}
 	}
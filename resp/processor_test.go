@@ -16,7 +16,11 @@ var requestChannel = make(chan NetworkRequest)
 var responseChannel = make(chan []byte)
 
 func setup() {
-	StartCommandProcessor(requestChannel, storage.NewSimpleStorage())
+	databases := make([]KVStorage, 16)
+	for i := range databases {
+		databases[i] = storage.NewSimpleStorage()
+	}
+	StartCommandProcessor(requestChannel, databases...)
 }
 
 func TestMain(m *testing.M) {
@@ -0,0 +1,287 @@
+// Publish/subscribe. Subscriptions are kept per client and in the hub below,
+// messages are delivered as pushes which the network layer writes to the
+// connection independently of the request/response flow.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/johanlantz/redis/utils"
+)
+
+type subscriberHub = map[string]map[*Client]struct{}
+
+// Subscribers per channel and per pattern.
+var channelSubscribers = subscriberHub{}
+var patternSubscribers = subscriberHub{}
+
+// Sharded channels are kept apart from the regular ones and grouped by the
+// hash slot of the channel name, since in a cluster a slot is owned by one node.
+var shardSubscribers = map[int]subscriberHub{}
+
+// RESP2 clients with subscriptions can only run these commands.
+var allowedWhileSubscribed = map[RespCommand]bool{
+	RESP_SUBSCRIBE: true, RESP_UNSUBSCRIBE: true, RESP_PSUBSCRIBE: true, RESP_PUNSUBSCRIBE: true,
+	RESP_SSUBSCRIBE: true, RESP_SUNSUBSCRIBE: true, RESP_PING: true,
+}
+
+func (c *Client) isSubscribed() bool {
+	return len(c.channels)+len(c.patterns)+len(c.shardChannels) > 0
+}
+
+// One kind of subscription, regular channels, patterns or shard channels.
+type subscriptionKind struct {
+	subscribeName   string
+	unsubscribeName string
+	subscriptions   func(c *Client) map[string]struct{}
+	// The hub of the channel, nil if it does not exist and create is false
+	hub func(channel string, create bool) subscriberHub
+	// Forget the hub of the channel once it is empty, nil for fixed hubs
+	dropHub func(channel string)
+	// The count in confirmations, sharded subscriptions are counted separately
+	count func(c *Client) int
+}
+
+var channelKind = subscriptionKind{
+	"subscribe", "unsubscribe",
+	func(c *Client) map[string]struct{} { return c.channels },
+	func(channel string, create bool) subscriberHub { return channelSubscribers },
+	nil,
+	func(c *Client) int { return len(c.channels) + len(c.patterns) },
+}
+
+var patternKind = subscriptionKind{
+	"psubscribe", "punsubscribe",
+	func(c *Client) map[string]struct{} { return c.patterns },
+	func(channel string, create bool) subscriberHub { return patternSubscribers },
+	nil,
+	func(c *Client) int { return len(c.channels) + len(c.patterns) },
+}
+
+var shardKind = subscriptionKind{
+	"ssubscribe", "sunsubscribe",
+	func(c *Client) map[string]struct{} { return c.shardChannels },
+	func(channel string, create bool) subscriberHub {
+		slot := utils.HashSlot(channel)
+		if create && shardSubscribers[slot] == nil {
+			shardSubscribers[slot] = subscriberHub{}
+		}
+		return shardSubscribers[slot]
+	},
+	func(channel string) { delete(shardSubscribers, utils.HashSlot(channel)) },
+	func(c *Client) int { return len(c.shardChannels) },
+}
+
+// Confirm a (un)subscription, channel is nil when unsubscribing from nothing.
+func pushSubscription(client *Client, name string, channel *string, count int) {
+	elements := bulkStrings(name)
+	if channel != nil {
+		elements = append(elements, bulkStrings(*channel)...)
+	} else {
+		elements = append(elements, newRespResponse(DT_NULLS, []string{}))
+	}
+	client.push(append(elements, integerResponse(count)))
+}
+
+func subscribe(client *Client, kind subscriptionKind, channels []string) {
+	subscriptions := kind.subscriptions(client)
+	for _, channel := range channels {
+		if _, ok := subscriptions[channel]; !ok {
+			subscriptions[channel] = struct{}{}
+			hub := kind.hub(channel, true)
+			if hub[channel] == nil {
+				hub[channel] = map[*Client]struct{}{}
+			}
+			hub[channel][client] = struct{}{}
+		}
+		pushSubscription(client, kind.subscribeName, &channel, kind.count(client))
+	}
+}
+
+func removeSubscription(client *Client, kind subscriptionKind, channel string) {
+	delete(kind.subscriptions(client), channel)
+	hub := kind.hub(channel, false)
+	delete(hub[channel], client)
+	if len(hub[channel]) == 0 {
+		delete(hub, channel)
+	}
+	if len(hub) == 0 && kind.dropHub != nil {
+		kind.dropHub(channel)
+	}
+}
+
+// Without channels all subscriptions of the client are removed.
+func unsubscribe(client *Client, kind subscriptionKind, channels []string) {
+	subscriptions := kind.subscriptions(client)
+	if len(channels) == 0 {
+		for channel := range subscriptions {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+		if len(channels) == 0 {
+			pushSubscription(client, kind.unsubscribeName, nil, kind.count(client))
+		}
+	}
+	for _, channel := range channels {
+		if _, ok := subscriptions[channel]; ok {
+			removeSubscription(client, kind, channel)
+		}
+		pushSubscription(client, kind.unsubscribeName, &channel, kind.count(client))
+	}
+}
+
+func unsubscribeAll(client *Client) {
+	for _, kind := range []subscriptionKind{channelKind, patternKind, shardKind} {
+		for channel := range kind.subscriptions(client) {
+			removeSubscription(client, kind, channel)
+		}
+	}
+}
+
+// Deliver a message and return the number of clients that received it.
+func publish(channel string, message string) int {
+	receivers := 0
+	for client := range channelSubscribers[channel] {
+		client.push(bulkStrings("message", channel, message))
+		receivers++
+	}
+	for pattern, clients := range patternSubscribers {
+		if !utils.GlobMatch(pattern, channel) {
+			continue
+		}
+		for client := range clients {
+			client.push(bulkStrings("pmessage", pattern, channel, message))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+func publishShard(channel string, message string) int {
+	receivers := 0
+	for client := range shardSubscribers[utils.HashSlot(channel)][channel] {
+		client.push(bulkStrings("smessage", channel, message))
+		receivers++
+	}
+	return receivers
+}
+
+// All channels of one SSUBSCRIBE must belong to the same slot.
+func checkSameSlot(channels []string) error {
+	for _, channel := range channels[1:] {
+		if utils.HashSlot(channel) != utils.HashSlot(channels[0]) {
+			return &respError{RESP_CROSSSLOT, "Keys in request don't hash to the same slot"}
+		}
+	}
+	return nil
+}
+
+func process_subscribe(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("subscribe command requires at least one channel argument")
+	}
+	subscribe(request.client, channelKind, request.args)
+	return nil, nil
+}
+
+func process_unsubscribe(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	unsubscribe(request.client, channelKind, request.args)
+	return nil, nil
+}
+
+func process_psubscribe(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("psubscribe command requires at least one pattern argument")
+	}
+	subscribe(request.client, patternKind, request.args)
+	return nil, nil
+}
+
+func process_punsubscribe(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	unsubscribe(request.client, patternKind, request.args)
+	return nil, nil
+}
+
+func process_ssubscribe(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("ssubscribe command requires at least one channel argument")
+	}
+	if err := checkSameSlot(request.args); err != nil {
+		return nil, err
+	}
+	subscribe(request.client, shardKind, request.args)
+	return nil, nil
+}
+
+func process_sunsubscribe(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	unsubscribe(request.client, shardKind, request.args)
+	return nil, nil
+}
+
+func process_spublish(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, errors.New("spublish command requires channel and message arguments")
+	}
+	return integerResponse(publishShard(request.args[0], request.args[1])), nil
+}
+
+func process_publish(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, errors.New("publish command requires channel and message arguments")
+	}
+	return integerResponse(publish(request.args[0], request.args[1])), nil
+}
+
+func process_pubsub(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("pubsub command requires a subcommand")
+	}
+	args := request.args[1:]
+	switch strings.ToUpper(request.args[0]) {
+	case "CHANNELS":
+		if len(args) > 1 {
+			return nil, errors.New("pubsub channels takes at most one pattern argument")
+		}
+		channels := []string{}
+		for channel := range channelSubscribers {
+			if len(args) == 0 || utils.GlobMatch(args[0], channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		return newRespArrayResponse(bulkStrings(channels...)), nil
+	case "NUMSUB":
+		elements := []*RespResponse{}
+		for _, channel := range args {
+			elements = append(elements, newRespResponse(DT_BULK_STRINGS, []string{channel}), integerResponse(len(channelSubscribers[channel])))
+		}
+		return newRespArrayResponse(elements), nil
+	case "NUMPAT":
+		return integerResponse(len(patternSubscribers)), nil
+	case "SHARDCHANNELS":
+		if len(args) > 1 {
+			return nil, errors.New("pubsub shardchannels takes at most one pattern argument")
+		}
+		channels := []string{}
+		for _, hub := range shardSubscribers {
+			for channel := range hub {
+				if len(args) == 0 || utils.GlobMatch(args[0], channel) {
+					channels = append(channels, channel)
+				}
+			}
+		}
+		sort.Strings(channels)
+		return newRespArrayResponse(bulkStrings(channels...)), nil
+	case "SHARDNUMSUB":
+		elements := []*RespResponse{}
+		for _, channel := range args {
+			subscribers := len(shardSubscribers[utils.HashSlot(channel)][channel])
+			elements = append(elements, newRespResponse(DT_BULK_STRINGS, []string{channel}), integerResponse(subscribers))
+		}
+		return newRespArrayResponse(elements), nil
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+}
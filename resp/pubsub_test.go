@@ -0,0 +1,159 @@
+package resp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// Wait for the next push queued for a client.
+func nextPush(t *testing.T, client *Client) string {
+	select {
+	case push := <-client.Pushes():
+		return string(push)
+	case <-time.After(time.Second):
+		t.Fatal("no push received")
+		return ""
+	}
+}
+
+func TestSubscribePublish(t *testing.T) {
+	subscriber := NewClient()
+	defer CloseClient(subscriber)
+	require.Equal(t, "", sendCommand(subscriber, "SUBSCRIBE news sport"))
+	require.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n", nextPush(t, subscriber))
+	require.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n", nextPush(t, subscriber))
+
+	publisher := NewClient()
+	require.Equal(t, ":1\r\n", sendCommand(publisher, "PUBLISH news hello"))
+	require.Equal(t, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n", nextPush(t, subscriber))
+	require.Equal(t, ":0\r\n", sendCommand(publisher, "PUBLISH weather sunny"))
+
+	sendCommand(subscriber, "UNSUBSCRIBE news")
+	require.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n", nextPush(t, subscriber))
+	require.Equal(t, ":0\r\n", sendCommand(publisher, "PUBLISH news hello"))
+
+	sendCommand(subscriber, "UNSUBSCRIBE")
+	require.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:0\r\n", nextPush(t, subscriber))
+	sendCommand(subscriber, "UNSUBSCRIBE")
+	require.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n_\r\n:0\r\n", nextPush(t, subscriber))
+}
+
+func TestPatternSubscribe(t *testing.T) {
+	subscriber := NewClient()
+	defer CloseClient(subscriber)
+	sendCommand(subscriber, "PSUBSCRIBE news.*")
+	require.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:1\r\n", nextPush(t, subscriber))
+
+	require.Equal(t, ":1\r\n", sendCommand(NewClient(), "PUBLISH news.tech launch"))
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n$6\r\nlaunch\r\n", nextPush(t, subscriber))
+
+	sendCommand(subscriber, "PUNSUBSCRIBE news.*")
+	require.Equal(t, "*3\r\n$12\r\npunsubscribe\r\n$6\r\nnews.*\r\n:0\r\n", nextPush(t, subscriber))
+}
+
+func TestSlowSubscriberDisconnected(t *testing.T) {
+	subscriber := NewClient()
+	defer CloseClient(subscriber)
+	sendCommand(subscriber, "SUBSCRIBE flood")
+	publisher := NewClient()
+	for i := 1; i < pushBufferSize; i++ {
+		sendCommand(publisher, "PUBLISH flood message")
+	}
+	select {
+	case <-subscriber.Done():
+		t.Fatal("subscriber disconnected before its buffer was full")
+	default:
+	}
+
+	sendCommand(publisher, "PUBLISH flood message")
+	select {
+	case <-subscriber.Done():
+	case <-time.After(time.Second):
+		t.Fatal("slow subscriber was not disconnected")
+	}
+}
+
+func TestSubscribedRestrictions(t *testing.T) {
+	subscriber := NewClient()
+	defer CloseClient(subscriber)
+	sendCommand(subscriber, "SUBSCRIBE restricted")
+	nextPush(t, subscriber)
+	require.Contains(t, sendCommand(subscriber, "GET someKey"), "only (P|S)SUBSCRIBE")
+	require.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", sendCommand(subscriber, "PING"))
+
+	// RESP3 clients can do anything while subscribed and get real pushes
+	resp3 := NewClient()
+	defer CloseClient(resp3)
+	sendCommand(resp3, "HELLO 3")
+	sendCommand(resp3, "SUBSCRIBE restricted")
+	require.Equal(t, ">3\r\n$9\r\nsubscribe\r\n$10\r\nrestricted\r\n:1\r\n", nextPush(t, resp3))
+	require.Equal(t, "_\r\n", sendCommand(resp3, "GET someKey"))
+	sendCommand(NewClient(), "PUBLISH restricted hi")
+	require.Equal(t, ">3\r\n$7\r\nmessage\r\n$10\r\nrestricted\r\n$2\r\nhi\r\n", nextPush(t, resp3))
+}
+
+func TestPubsubIntrospection(t *testing.T) {
+	first, second := NewClient(), NewClient()
+	defer CloseClient(first)
+	defer CloseClient(second)
+	sendCommand(first, "SUBSCRIBE intro.a intro.b")
+	sendCommand(second, "SUBSCRIBE intro.a")
+	sendCommand(second, "PSUBSCRIBE intro.*")
+
+	require.Equal(t, "*2\r\n$7\r\nintro.a\r\n$7\r\nintro.b\r\n", sendCommand(NewClient(), "PUBSUB CHANNELS intro.*"))
+	require.Equal(t, "*4\r\n$7\r\nintro.a\r\n:2\r\n$7\r\nintro.c\r\n:0\r\n", sendCommand(NewClient(), "PUBSUB NUMSUB intro.a intro.c"))
+	require.Equal(t, ":1\r\n", sendCommand(NewClient(), "PUBSUB NUMPAT"))
+
+	// Closing a client removes its subscriptions
+	CloseClient(first)
+	require.Equal(t, "*2\r\n$7\r\nintro.a\r\n:1\r\n", sendCommand(NewClient(), "PUBSUB NUMSUB intro.a"))
+}
+
+func TestPingAndHello(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "+PONG\r\n", sendCommand(client, "PING"))
+	require.Equal(t, "$5\r\nhello\r\n", sendCommand(client, "PING hello"))
+	require.Contains(t, sendCommand(client, "HELLO 4"), RESP_NOPROTO)
+	require.Contains(t, sendCommand(client, "HELLO 2"), "*14\r\n$6\r\nserver\r\n")
+	require.Contains(t, sendCommand(client, "HELLO 3"), "%7\r\n$6\r\nserver\r\n")
+}
+
+func TestShardedPubsub(t *testing.T) {
+	subscriber := NewClient()
+	defer CloseClient(subscriber)
+	sendCommand(subscriber, "SUBSCRIBE {orders}.created")
+	nextPush(t, subscriber)
+
+	sendCommand(subscriber, "SSUBSCRIBE {orders}.created {orders}.paid")
+	require.Equal(t, "*3\r\n$10\r\nssubscribe\r\n$16\r\n{orders}.created\r\n:1\r\n", nextPush(t, subscriber))
+	require.Equal(t, "*3\r\n$10\r\nssubscribe\r\n$13\r\n{orders}.paid\r\n:2\r\n", nextPush(t, subscriber))
+	require.Contains(t, sendCommand(subscriber, "SSUBSCRIBE a b"), RESP_CROSSSLOT)
+
+	// Sharded and regular channels with the same name are independent
+	publisher := NewClient()
+	require.Equal(t, ":1\r\n", sendCommand(publisher, "SPUBLISH {orders}.paid 42"))
+	require.Equal(t, "*3\r\n$8\r\nsmessage\r\n$13\r\n{orders}.paid\r\n$2\r\n42\r\n", nextPush(t, subscriber))
+	require.Equal(t, ":1\r\n", sendCommand(publisher, "PUBLISH {orders}.created 7"))
+	require.Equal(t, "*3\r\n$7\r\nmessage\r\n$16\r\n{orders}.created\r\n$1\r\n7\r\n", nextPush(t, subscriber))
+	require.Equal(t, ":0\r\n", sendCommand(publisher, "PUBLISH {orders}.paid 42"))
+
+	require.Equal(t, "*2\r\n$16\r\n{orders}.created\r\n$13\r\n{orders}.paid\r\n", sendCommand(publisher, "PUBSUB SHARDCHANNELS {orders}*"))
+	require.Equal(t, "*2\r\n$13\r\n{orders}.paid\r\n:1\r\n", sendCommand(publisher, "PUBSUB SHARDNUMSUB {orders}.paid"))
+	require.Equal(t, "*1\r\n$16\r\n{orders}.created\r\n", sendCommand(publisher, "PUBSUB CHANNELS {orders}*"))
+
+	sendCommand(subscriber, "SUNSUBSCRIBE")
+	require.Equal(t, "*3\r\n$12\r\nsunsubscribe\r\n$16\r\n{orders}.created\r\n:1\r\n", nextPush(t, subscriber))
+	require.Equal(t, "*3\r\n$12\r\nsunsubscribe\r\n$13\r\n{orders}.paid\r\n:0\r\n", nextPush(t, subscriber))
+	require.Equal(t, ":0\r\n", sendCommand(publisher, "SPUBLISH {orders}.paid 42"))
+
+	// The hub of the slot is gone with its last subscriber
+	slotHub := true
+	require.NoError(t, onExecutor(func() error {
+		_, slotHub = shardSubscribers[utils.HashSlot("{orders}.paid")]
+		return nil
+	}))
+	require.False(t, slotHub)
+}
@@ -0,0 +1,902 @@
+// Master-replica replication. A replica connects to its master like any
+// other client and asks with PSYNC for the writes following the offset it
+// has. If the master still has them in its backlog it continues from there,
+// otherwise it sends a snapshot followed by the writes made since it was
+// taken. Offsets count the bytes of the replication stream, together with
+// a replication id they identify a point in the history of a dataset.
+//
+// Replicas forward the stream of their master as is, so a replica of a
+// replica has the same ids and offsets and can continue with either of
+// them.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johanlantz/redis/aof"
+	"github.com/johanlantz/redis/utils"
+)
+
+const noReplicationId = "0000000000000000000000000000000000000000"
+
+var replicationId = newReplicationId()
+var replicationOffset int64 = 0
+
+// The id of the previous history, kept when a replica is promoted so that
+// the other replicas of the old master can continue up to where the
+// histories diverge.
+var replicationId2 = noReplicationId
+var secondReplicationOffset int64 = -1
+
+// The snapshot sent on a full resynchronization is loaded from memory.
+const maxSyncPayloadSize int64 = 4 * 1024 * 1024 * 1024
+
+var replBacklogSize int64 = 1024 * 1024
+var replTimeout = 60 * time.Second
+var replPingPeriod = 10 * time.Second
+
+// Created once the first replica connects.
+var backlog *replicationBacklog
+
+var replicas []*Client
+
+// The database the replication stream currently applies to.
+var replicationSelectedDb = -1
+var lastReplicationPing time.Time
+
+// Set while this server is a replica.
+var masterLink *replicationLink
+
+// The replicaof parameter given before the server was started.
+var configuredMaster []string
+
+// Replicas only take writes from their master and keep answering while the
+// link to it is down unless told otherwise.
+var replicaReadOnly = true
+var replicaServeStaleData = true
+
+// What the master knows about one of its replicas.
+type replicaState struct {
+	listeningPort int
+	announcedIp   string
+	// False while the snapshot is prepared, writes are held back until then
+	online     bool
+	pending    [][]byte
+	ackOffset  int64
+	fackOffset int64 // acknowledged as on disk by the replica
+	ackTime    time.Time
+	registered bool
+}
+
+func init() {
+	configParameters["repl-backlog-size"] = configParameter{
+		get: func() string { return fmt.Sprint(replBacklogSize) },
+		set: func(value string) error {
+			size, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			replBacklogSize = max(size, 16*1024)
+			if backlog != nil {
+				backlog = backlog.resize(replBacklogSize)
+			}
+			return nil
+		},
+	}
+	configParameters["repl-timeout"] = configParameter{
+		get: func() string { return fmt.Sprint(int(replTimeout.Seconds())) },
+		set: func(value string) error {
+			seconds, err := parseNonNegative(value)
+			if err != nil || seconds == 0 {
+				return errors.New("argument must be a positive number of seconds")
+			}
+			replTimeout = time.Duration(seconds) * time.Second
+			return nil
+		},
+	}
+	configParameters["repl-ping-replica-period"] = configParameter{
+		get: func() string { return fmt.Sprint(int(replPingPeriod.Seconds())) },
+		set: func(value string) error {
+			seconds, err := parseNonNegative(value)
+			if err != nil || seconds == 0 {
+				return errors.New("argument must be a positive number of seconds")
+			}
+			replPingPeriod = time.Duration(seconds) * time.Second
+			return nil
+		},
+	}
+	configParameters["replica-read-only"] = configParameter{
+		get: func() string { return yesNo(replicaReadOnly) },
+		set: func(value string) error {
+			enable, err := parseYesNo(value)
+			if err == nil {
+				replicaReadOnly = enable
+			}
+			return err
+		},
+	}
+	configParameters["replica-serve-stale-data"] = configParameter{
+		get: func() string { return yesNo(replicaServeStaleData) },
+		set: func(value string) error {
+			enable, err := parseYesNo(value)
+			if err == nil {
+				replicaServeStaleData = enable
+			}
+			return err
+		},
+	}
+	configParameters["replicaof"] = configParameter{
+		get: func() string {
+			if masterLink == nil {
+				return ""
+			}
+			return fmt.Sprintf("%s %d", masterLink.host, masterLink.port)
+		},
+		set: func(value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				fields = []string{"no", "one"}
+			}
+			if len(fields) != 2 {
+				return errors.New("argument must be 'host port' or 'no one'")
+			}
+			if databases == nil {
+				configuredMaster = fields
+				return nil
+			}
+			_, err := setMaster(fields[0], fields[1])
+			return err
+		},
+	}
+}
+
+func errReadOnlyReplica() error {
+	return &respError{RESP_READONLY, "You can't write against a read only replica."}
+}
+
+// Refuse requests of clients a replica should not serve. The master itself
+// applies its stream without going through here.
+func replicaRejects(request *RespRequest) error {
+	if masterLink == nil {
+		return nil
+	}
+	if masterLink.state != "connected" && !replicaServeStaleData && processors[request.command].flags&CMD_STALE == 0 {
+		return &respError{RESP_MASTERDOWN, "Link with MASTER is down and replica-serve-stale-data is set to 'no'."}
+	}
+	if replicaReadOnly && isWriteRequest(request) {
+		return errReadOnlyReplica()
+	}
+	return nil
+}
+
+func newReplicationId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func role() string {
+	if masterLink != nil {
+		return "replica"
+	}
+	return "master"
+}
+
+// Circular buffer with the latest part of the replication stream.
+type replicationBacklog struct {
+	buffer []byte
+	next   int   // where the next byte is written
+	length int   // number of bytes held
+	end    int64 // offset of the last byte written
+}
+
+func newReplicationBacklog(size int64, offset int64) *replicationBacklog {
+	return &replicationBacklog{buffer: make([]byte, size), end: offset}
+}
+
+func (b *replicationBacklog) write(data []byte) {
+	b.end += int64(len(data))
+	if len(data) > len(b.buffer) {
+		data = data[len(data)-len(b.buffer):]
+	}
+	n := copy(b.buffer[b.next:], data)
+	copy(b.buffer, data[n:])
+	b.next = (b.next + len(data)) % len(b.buffer)
+	b.length = min(b.length+len(data), len(b.buffer))
+}
+
+// The stream from offset on, offset being the first byte the reader lacks.
+// False if that part is no longer held.
+func (b *replicationBacklog) since(offset int64) ([]byte, bool) {
+	if offset <= b.end-int64(b.length) || offset > b.end+1 {
+		return nil, false
+	}
+	count := int(b.end + 1 - offset)
+	data := make([]byte, count)
+	start := (b.next - count + len(b.buffer)) % len(b.buffer)
+	n := copy(data, b.buffer[start:])
+	copy(data[n:], b.buffer)
+	return data, true
+}
+
+func (b *replicationBacklog) resize(size int64) *replicationBacklog {
+	data, _ := b.since(b.end - int64(b.length) + 1)
+	resized := newReplicationBacklog(size, b.end-int64(len(data)))
+	resized.write(data)
+	return resized
+}
+
+// Log a write to the append only file and send it to the replicas.
+func propagate(db int, args ...string) {
+	appendCommand(db, args...)
+	if backlog == nil || masterLink != nil {
+		return
+	}
+	data := []byte{}
+	if db != replicationSelectedDb {
+		data = utils.MarshalArgsToResp(string(RESP_SELECT), fmt.Sprint(db))
+		replicationSelectedDb = db
+	}
+	feedReplicationStream(append(data, utils.MarshalArgsToResp(args...)...))
+}
+
+func feedReplicationStream(data []byte) {
+	replicationOffset += int64(len(data))
+	backlog.write(data)
+	for _, replica := range replicas {
+		sendToReplica(replica, data)
+	}
+}
+
+// Replicas that cannot keep up are disconnected, they continue from the
+// backlog once they are back.
+func sendToReplica(client *Client, data []byte) {
+	state := client.replica
+	if !state.online {
+		state.pending = append(state.pending, data)
+		return
+	}
+	if !client.pushRaw(data) {
+		log.Printf("Replica %s is not keeping up, disconnecting it", replicaAddr(client))
+		removeReplica(client)
+		client.kill()
+	}
+}
+
+func (c *Client) replicaInfo() *replicaState {
+	if c.replica == nil {
+		c.replica = &replicaState{}
+	}
+	return c.replica
+}
+
+func addReplica(client *Client, online bool) {
+	state := client.replicaInfo()
+	state.online, state.registered = online, true
+	replicas = append(replicas, client)
+}
+
+func removeReplica(client *Client) {
+	if client.replica == nil || !client.replica.registered {
+		return
+	}
+	client.replica.registered = false
+	remaining := make([]*Client, 0, len(replicas))
+	for _, replica := range replicas {
+		if replica != client {
+			remaining = append(remaining, replica)
+		}
+	}
+	replicas = remaining
+}
+
+// Replicas reconnect and continue where they were, e.g. to learn about a
+// new replication id.
+func disconnectReplicas() {
+	for _, replica := range replicas {
+		replica.replica.registered = false
+		replica.kill()
+	}
+	replicas = nil
+}
+
+func replicaAddr(client *Client) string {
+	host, _, err := net.SplitHostPort(client.addr)
+	if err != nil {
+		host = client.addr
+	}
+	if client.replica.announcedIp != "" {
+		host = client.replica.announcedIp
+	}
+	return net.JoinHostPort(host, fmt.Sprint(client.replica.listeningPort))
+}
+
+// Start over with a new history, replicas of the previous one can still
+// continue up to the current offset.
+func shiftReplicationId() {
+	replicationId2, secondReplicationOffset = replicationId, replicationOffset+1
+	replicationId = newReplicationId()
+}
+
+// Ping the replicas so they can tell a silent master from a lost one and
+// drop the ones that no longer acknowledge.
+func replicationCron() {
+	if masterLink == nil && len(replicas) > 0 && time.Since(lastReplicationPing) >= replPingPeriod {
+		lastReplicationPing = time.Now()
+		feedReplicationStream(utils.MarshalArgsToResp(string(RESP_PING)))
+	}
+	if masterLink != nil {
+		masterLink.advanceFsynced()
+	}
+	for _, replica := range replicas {
+		state := replica.replica
+		if state.online && !state.ackTime.IsZero() && time.Since(state.ackTime) > replTimeout {
+			log.Printf("Replica %s timed out, disconnecting it", replicaAddr(replica))
+			removeReplica(replica)
+			replica.kill()
+		}
+	}
+}
+
+// PSYNC replicationid offset
+func process_psync(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, errors.New("wrong number of arguments for 'psync' command")
+	}
+	if masterLink != nil && masterLink.state != "connected" {
+		return nil, &respError{RESP_NOMASTERLINK, "Can't SYNC while not connected with my master"}
+	}
+	client := request.client
+	if client.replica != nil && client.replica.registered {
+		return nil, nil
+	}
+	offset, err := strconv.ParseInt(request.args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	if backlog == nil {
+		backlog = newReplicationBacklog(replBacklogSize, replicationOffset)
+	}
+
+	if id := request.args[0]; id == replicationId || (id == replicationId2 && offset <= secondReplicationOffset) {
+		if data, ok := backlog.since(offset); ok {
+			client.pushRaw([]byte("+CONTINUE " + replicationId + "\r\n"))
+			addReplica(client, true)
+			client.replica.ackOffset = offset - 1
+			sendToReplica(client, data)
+			log.Printf("Partial resynchronization of replica %s from offset %d", replicaAddr(client), offset)
+			return nil, nil
+		}
+	}
+	fullResync(client)
+	return nil, nil
+}
+
+// Send a snapshot taken now and the writes that follow it. The snapshot is
+// encoded in the background, writes are queued for the replica meanwhile.
+func fullResync(client *Client) {
+	client.pushRaw([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", replicationId, replicationOffset)))
+	addReplica(client, false)
+	// The first write after the snapshot must select its database again
+	replicationSelectedDb = -1
+	snapshot, libraryCode := snapshotDatabases(), snapshotLibraries()
+	log.Printf("Full resynchronization of replica %s", replicaAddr(client))
+
+	go func() {
+		var payload bytes.Buffer
+		err := encodeSnapshot(&payload, snapshot, libraryCode)
+		closeSnapshot(snapshot)
+		taskChannel <- func() {
+			state := client.replica
+			if !state.registered {
+				return
+			}
+			if err != nil {
+				log.Printf("Error creating the snapshot for replica %s: %s", replicaAddr(client), err.Error())
+				removeReplica(client)
+				client.kill()
+				return
+			}
+			pending := state.pending
+			state.online, state.pending = true, nil
+			sendToReplica(client, append([]byte(fmt.Sprintf("$%d\r\n", payload.Len())), payload.Bytes()...))
+			for _, data := range pending {
+				sendToReplica(client, data)
+			}
+		}
+	}()
+}
+
+// REPLCONF option value [option value ...]
+func process_replconf(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	args := request.args
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("syntax error")
+	}
+	state := request.client.replicaInfo()
+	reply := true
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(args[i+1])
+			if err != nil || port < 0 || port > 65535 {
+				return nil, errors.New("value is not an integer or out of range")
+			}
+			state.listeningPort = port
+		case "ip-address":
+			state.announcedIp = args[i+1]
+		case "capa":
+		case "ack":
+			// Acknowledgements are not replied to
+			offset, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, nil
+			}
+			state.ackOffset = max(state.ackOffset, offset)
+			state.ackTime = time.Now()
+			reply = false
+		case "fack":
+			if offset, err := strconv.ParseInt(args[i+1], 10, 64); err == nil {
+				state.fackOffset = max(state.fackOffset, offset)
+			}
+		case "getack":
+			reply = false
+		default:
+			return nil, fmt.Errorf("Unrecognized REPLCONF option: %s", args[i])
+		}
+	}
+	if !reply {
+		checkDurabilityWaits()
+		return nil, nil
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+// REPLICAOF host port | REPLICAOF NO ONE
+func process_replicaof(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(string(request.command)))
+	}
+	if clusterEnabled {
+		return nil, errors.New("REPLICAOF not allowed in cluster mode.")
+	}
+	connected, err := setMaster(request.args[0], request.args[1])
+	if err != nil {
+		return nil, err
+	}
+	if connected {
+		return newRespResponse(DT_SIMPLE_STRING, []string{"OK Already connected to specified master"}), nil
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+// Replicate from host and port, "no one" turns a replica into a master.
+// True if the server already replicates from there.
+func setMaster(host string, port string) (bool, error) {
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if masterLink != nil {
+			masterLink.stop()
+			masterLink = nil
+			shiftReplicationId()
+			disconnectReplicas()
+			log.Printf("Master mode enabled")
+		}
+		return false, nil
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return false, errors.New("Invalid master port")
+	}
+	if masterLink != nil && masterLink.host == host && masterLink.port == portNumber {
+		return true, nil
+	}
+	if masterLink != nil {
+		masterLink.stop()
+	}
+	disconnectReplicas()
+	masterLink = newReplicationLink(host, portNumber)
+	go masterLink.run()
+	log.Printf("Replicating from %s:%d", host, portNumber)
+	return false, nil
+}
+
+func startConfiguredReplication() {
+	if configuredMaster != nil {
+		if _, err := setMaster(configuredMaster[0], configuredMaster[1]); err != nil {
+			log.Fatalf("Error configuring replication: %s", err.Error())
+		}
+	}
+}
+
+func process_role(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if masterLink != nil {
+		return newRespArrayResponse([]*RespResponse{
+			newRespResponse(DT_BULK_STRINGS, []string{"slave"}),
+			newRespResponse(DT_BULK_STRINGS, []string{masterLink.host}),
+			integerResponse(masterLink.port),
+			newRespResponse(DT_BULK_STRINGS, []string{masterLink.state}),
+			newRespResponse(DT_INTEGER, []string{fmt.Sprint(replicationOffset)}),
+		}), nil
+	}
+	entries := []*RespResponse{}
+	for _, replica := range replicas {
+		host, port, _ := net.SplitHostPort(replicaAddr(replica))
+		entries = append(entries, newRespArrayResponse(bulkStrings(host, port, fmt.Sprint(replica.replica.ackOffset))))
+	}
+	return newRespArrayResponse([]*RespResponse{
+		newRespResponse(DT_BULK_STRINGS, []string{"master"}),
+		newRespResponse(DT_INTEGER, []string{fmt.Sprint(replicationOffset)}),
+		newRespArrayResponse(entries),
+	}), nil
+}
+
+var errLinkStopped = errors.New("replication link stopped")
+
+// The connection of a replica to its master. It runs in a goroutine of its
+// own and hands everything it receives to the executor, where the commands
+// are executed on behalf of a client of the link.
+type replicationLink struct {
+	host    string
+	port    int
+	timeout time.Duration
+	client  *Client
+	// connect, connecting, sync or connected, only used by the executor
+	state string
+
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+	conn       net.Conn
+	stopped    bool
+
+	// The offsets to acknowledge, updated by the executor
+	processed   atomic.Int64
+	fsynced     atomic.Int64
+	ackRequests chan int64
+	syncPoints  []syncPoint
+}
+
+// Where a command of the master ended in the append only file, it is on
+// disk once the file is synced up to there.
+type syncPoint struct {
+	aofOffset         int64
+	replicationOffset int64
+}
+
+func newReplicationLink(host string, port int) *replicationLink {
+	return &replicationLink{
+		host:        host,
+		port:        port,
+		timeout:     replTimeout,
+		client:      newClient(),
+		state:       "connect",
+		ackRequests: make(chan int64, 1),
+	}
+}
+
+func (link *replicationLink) stop() {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	link.stopped = true
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+func (link *replicationLink) isStopped() bool {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	return link.stopped
+}
+
+func (link *replicationLink) setConn(conn net.Conn) bool {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	link.conn = conn
+	return !link.stopped
+}
+
+// Run f on the executor and wait for it, unless the link was replaced
+// meanwhile.
+func (link *replicationLink) onExecutor(f func()) bool {
+	done := make(chan bool)
+	taskChannel <- func() {
+		current := masterLink == link
+		if current {
+			f()
+		}
+		done <- current
+	}
+	return <-done
+}
+
+func (link *replicationLink) run() {
+	for !link.isStopped() {
+		err := link.sync()
+		if link.isStopped() {
+			return
+		}
+		log.Printf("Lost the connection with master %s:%d: %s", link.host, link.port, err.Error())
+		link.onExecutor(func() { link.state = "connect" })
+		time.Sleep(time.Second)
+	}
+}
+
+// Fails reads when the master is silent for too long, it pings its
+// replicas regularly.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+func (link *replicationLink) write(args ...string) error {
+	link.writeMutex.Lock()
+	defer link.writeMutex.Unlock()
+	link.conn.SetWriteDeadline(time.Now().Add(link.timeout))
+	_, err := link.conn.Write(utils.MarshalArgsToResp(args...))
+	return err
+}
+
+// Send a command of the handshake and read its single line reply.
+func (link *replicationLink) request(reader *bufio.Reader, args ...string) (string, error) {
+	if err := link.write(args...); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Connect, synchronize and then apply the stream until the connection is lost.
+func (link *replicationLink) sync() error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(link.host, fmt.Sprint(link.port)), link.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !link.setConn(conn) {
+		return errLinkStopped
+	}
+	var id string
+	var offset int64
+	var port int
+	var password string
+	if !link.onExecutor(func() {
+		link.state = "connecting"
+		id, offset, port, password = replicationId, replicationOffset+1, serverPort, masterAuth
+	}) {
+		return errLinkStopped
+	}
+	reader := bufio.NewReader(deadlineReader{conn, link.timeout})
+
+	reply, err := link.request(reader, "PING")
+	if err != nil {
+		return err
+	}
+	// A master with a password only answers once authenticated
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-"+RESP_NOAUTH) {
+		return fmt.Errorf("error reply to PING: %s", reply[1:])
+	}
+	if password != "" {
+		if reply, err = link.request(reader, string(RESP_AUTH), password); err != nil {
+			return err
+		}
+		if strings.HasPrefix(reply, "-") {
+			return fmt.Errorf("error reply to AUTH: %s", reply[1:])
+		}
+	}
+	for _, capability := range [][]string{{"listening-port", fmt.Sprint(port)}, {"capa", "psync2"}} {
+		reply, err = link.request(reader, append([]string{string(RESP_REPLCONF)}, capability...)...)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(reply, "-") {
+			log.Printf("Master does not understand REPLCONF %s: %s", capability[0], reply[1:])
+		}
+	}
+
+	reply, err = link.request(reader, string(RESP_PSYNC), id, fmt.Sprint(offset))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid reply to PSYNC: %s", reply)
+		}
+		link.onExecutor(func() { link.state = "sync" })
+		payload, err := readSyncPayload(reader)
+		if err != nil {
+			return err
+		}
+		var loadErr error
+		if !link.onExecutor(func() { loadErr = link.loadSnapshot(fields[1], masterOffset, payload) }) {
+			return errLinkStopped
+		}
+		if loadErr != nil {
+			return loadErr
+		}
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		if !link.onExecutor(func() {
+			if len(fields) == 2 && fields[1] != replicationId {
+				shiftReplicationId()
+				replicationId = fields[1]
+				disconnectReplicas()
+			}
+		}) {
+			return errLinkStopped
+		}
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC: %s", reply)
+	}
+
+	if !link.onExecutor(func() {
+		link.state = "connected"
+		if backlog == nil {
+			backlog = newReplicationBacklog(replBacklogSize, replicationOffset)
+		}
+		link.processed.Store(replicationOffset)
+	}) {
+		return errLinkStopped
+	}
+	log.Printf("Synchronized with master %s:%d", link.host, link.port)
+
+	done := make(chan struct{})
+	defer close(done)
+	go link.sendAcks(done)
+	commands := aof.NewReader(reader)
+	for {
+		args, err := commands.ReadCommand()
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		taskChannel <- func() {
+			if masterLink == link {
+				link.apply(args)
+			}
+		}
+	}
+}
+
+// The snapshot of a full resynchronization, masters may send newlines to
+// keep the connection alive while they prepare it.
+func readSyncPayload(reader *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header := strings.TrimRight(line, "\r\n")
+		if header == "" {
+			continue
+		}
+		size, err := strconv.ParseInt(header[1:], 10, 64)
+		if header[0] != DT_BULK_STRINGS || err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid snapshot header: %q", line)
+		}
+		if size > maxSyncPayloadSize {
+			return nil, fmt.Errorf("snapshot of %d bytes exceeds the limit of %d bytes", size, maxSyncPayloadSize)
+		}
+		// Grown as the data arrives rather than trusting the announced size
+		var payload bytes.Buffer
+		if _, err := payload.ReadFrom(io.LimitReader(reader, size)); err != nil {
+			return nil, err
+		}
+		if int64(payload.Len()) < size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return payload.Bytes(), nil
+	}
+}
+
+// Replace the dataset with the snapshot of the master.
+func (link *replicationLink) loadSnapshot(id string, offset int64, payload []byte) error {
+	invalidateAllTrackedKeys()
+	for i, db := range databases {
+		touchAllWatchedKeys(i, i)
+		if err := db.Flush(true); err != nil {
+			return err
+		}
+	}
+	flushLibraries()
+	if err := loadSnapshotData(payload); err != nil {
+		return fmt.Errorf("error loading the snapshot of the master: %w", err)
+	}
+	replicationId, replicationOffset = id, offset
+	replicationId2, secondReplicationOffset = noReplicationId, -1
+	backlog = newReplicationBacklog(replBacklogSize, offset)
+	disconnectReplicas()
+	link.client.db = 0
+	dirty++
+	if aofFile != nil {
+		if err := rewriteAppendOnlyFile(); err != nil {
+			log.Printf("Error rewriting the append only file: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Execute a command of the master and forward it to the own replicas.
+func (link *replicationLink) apply(args []string) {
+	command := RespCommand(strings.ToUpper(args[0]))
+	switch {
+	case command == RESP_REPLCONF && len(args) > 1 && strings.EqualFold(args[1], "GETACK"):
+		// The acknowledged offset does not include the request itself
+		select {
+		case link.ackRequests <- replicationOffset:
+		default:
+		}
+	case processors[command].process == nil:
+		log.Printf("Unknown command '%s' from master", args[0])
+	default:
+		if _, err := executeRequest(&RespRequest{command: command, args: args[1:], client: link.client}); err != nil {
+			log.Printf("Error executing '%s' from master: %s", args[0], err.Error())
+		}
+	}
+	feedReplicationStream(utils.MarshalArgsToResp(args...))
+	link.processed.Store(replicationOffset)
+	if aofFile != nil {
+		link.syncPoints = append(link.syncPoints, syncPoint{aofWritten, replicationOffset})
+		link.advanceFsynced()
+	}
+}
+
+// Replicas without an append only file never acknowledge an fsync.
+func (link *replicationLink) advanceFsynced() {
+	if aofFile == nil {
+		link.syncPoints = nil
+		return
+	}
+	synced, done := aofFsyncedOffset(), 0
+	for _, point := range link.syncPoints {
+		if point.aofOffset > synced {
+			break
+		}
+		link.fsynced.Store(point.replicationOffset)
+		done++
+	}
+	link.syncPoints = link.syncPoints[done:]
+}
+
+// Acknowledge the processed offset every second and when the master asks.
+func (link *replicationLink) sendAcks(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var offset int64
+		select {
+		case <-done:
+			return
+		case offset = <-link.ackRequests:
+		case <-ticker.C:
+			offset = link.processed.Load()
+		}
+		if err := link.write(string(RESP_REPLCONF), "ACK", fmt.Sprint(offset), "FACK", fmt.Sprint(link.fsynced.Load())); err != nil {
+			return
+		}
+	}
+}
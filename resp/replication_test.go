@@ -0,0 +1,212 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/aof"
+	"github.com/johanlantz/redis/storage"
+	"github.com/johanlantz/redis/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationBacklog(t *testing.T) {
+	backlog := newReplicationBacklog(8, 0)
+	backlog.write([]byte("abcdef"))
+	data, ok := backlog.since(1)
+	require.True(t, ok)
+	require.Equal(t, "abcdef", string(data))
+
+	backlog.write([]byte("ghij"))
+	data, ok = backlog.since(3)
+	require.True(t, ok)
+	require.Equal(t, "cdefghij", string(data))
+	_, ok = backlog.since(2)
+	require.False(t, ok)
+	data, ok = backlog.since(11)
+	require.True(t, ok)
+	require.Empty(t, data)
+	_, ok = backlog.since(12)
+	require.False(t, ok)
+
+	backlog = backlog.resize(4)
+	data, ok = backlog.since(7)
+	require.True(t, ok)
+	require.Equal(t, "ghij", string(data))
+	_, ok = backlog.since(6)
+	require.False(t, ok)
+}
+
+func TestFullAndPartialResync(t *testing.T) {
+	replica := NewClient()
+	replica.SetAddr("127.0.0.1:50000")
+	defer CloseClient(replica)
+	require.Equal(t, "+OK\r\n", sendCommand(replica, "REPLCONF listening-port 7001 capa psync2"))
+	require.Equal(t, "", sendCommand(replica, "PSYNC ? -1"))
+	header := strings.Fields(nextPush(t, replica))
+	require.Equal(t, "+FULLRESYNC", header[0])
+	id := header[1]
+	offset, err := strconv.ParseInt(header[2], 10, 64)
+	require.NoError(t, err)
+	require.Contains(t, nextPush(t, replica), "REDIS")
+
+	writer := NewClient()
+	sendCommand(writer, "SELECT 15")
+	sendCommand(writer, "SET replicatedKey 1")
+	sendCommand(writer, "GET replicatedKey")
+	stream := string(utils.MarshalArgsToResp("SELECT", "15")) + string(utils.MarshalArgsToResp("SET", "replicatedKey", "1"))
+	require.Equal(t, stream, nextPush(t, replica))
+
+	end := offset + int64(len(stream))
+	require.Equal(t, "", sendCommand(replica, fmt.Sprintf("REPLCONF ACK %d", end)))
+	role := sendCommand(writer, "ROLE")
+	require.Contains(t, role, "master")
+	require.Contains(t, role, "127.0.0.1")
+	require.Contains(t, role, "7001")
+	require.Contains(t, role, fmt.Sprint(end))
+
+	// A replica that knows the history continues from the backlog
+	other := NewClient()
+	defer CloseClient(other)
+	require.Equal(t, "", sendCommand(other, fmt.Sprintf("PSYNC %s %d", id, offset+1)))
+	require.Equal(t, "+CONTINUE "+id+"\r\n", nextPush(t, other))
+	require.Equal(t, stream, nextPush(t, other))
+
+	unknown := NewClient()
+	defer CloseClient(unknown)
+	require.Equal(t, "", sendCommand(unknown, fmt.Sprintf("PSYNC %s %d", noReplicationId, offset+1)))
+	require.Contains(t, nextPush(t, unknown), "+FULLRESYNC")
+	sendCommand(writer, "FLUSHDB")
+}
+
+// Serves a snapshot with one key to the first replica and streams a write
+// after it, the acknowledged offsets are handed back.
+func fakeMaster(t *testing.T, id string, offset int64) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var payload bytes.Buffer
+	require.NoError(t, encodeSnapshot(&payload, []storage.Snapshot{memorySnapshot{{"snapshotKey", stringEntry("1")}}}, nil))
+
+	acks := make(chan string, 10)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := aof.NewReader(conn)
+		for {
+			args, err := reader.ReadCommand()
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(args[0]) {
+			case "PING":
+				conn.Write([]byte("+PONG\r\n"))
+			case "PSYNC":
+				conn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n\n$%d\r\n", id, offset, payload.Len())))
+				conn.Write(payload.Bytes())
+				conn.Write(utils.MarshalArgsToResp("SELECT", "0"))
+				conn.Write(utils.MarshalArgsToResp("SET", "streamedKey", "2"))
+				conn.Write(utils.MarshalArgsToResp("REPLCONF", "GETACK", "*"))
+			case "REPLCONF":
+				if strings.EqualFold(args[1], "ACK") {
+					acks <- args[2]
+				} else {
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}
+		}
+	}()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), acks
+}
+
+func TestReplicaOf(t *testing.T) {
+	masterId := strings.Repeat("ab", 20)
+	port, acks := fakeMaster(t, masterId, 100)
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "REPLICAOF 127.0.0.1 "+port))
+	require.Equal(t, "+OK Already connected to specified master\r\n", sendCommand(client, "SLAVEOF 127.0.0.1 "+port))
+
+	stream := len(utils.MarshalArgsToResp("SELECT", "0")) + len(utils.MarshalArgsToResp("SET", "streamedKey", "2"))
+	select {
+	case ack := <-acks:
+		require.Equal(t, fmt.Sprint(100+stream), ack)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no acknowledgement from the replica")
+	}
+	require.Equal(t, ":1\r\n", sendCommand(client, "GET snapshotKey"))
+	require.Equal(t, ":2\r\n", sendCommand(client, "GET streamedKey"))
+	role := sendCommand(client, "ROLE")
+	require.Contains(t, role, "slave")
+	require.Contains(t, role, "connected")
+	require.Contains(t, sendCommand(client, "CONFIG GET replicaof"), "127.0.0.1 "+port)
+
+	// Once promoted the history of the master continues under a new id
+	require.Equal(t, "+OK\r\n", sendCommand(client, "REPLICAOF NO ONE"))
+	require.Contains(t, sendCommand(client, "ROLE"), "master")
+	var id, id2 string
+	var offset2 int64
+	require.NoError(t, onExecutor(func() error {
+		id, id2, offset2 = replicationId, replicationId2, secondReplicationOffset
+		return nil
+	}))
+	require.Equal(t, masterId, id2)
+	require.NotEqual(t, masterId, id)
+	getAck := len(utils.MarshalArgsToResp("REPLCONF", "GETACK", "*"))
+	require.Equal(t, int64(100+stream+getAck+1), offset2)
+	require.Contains(t, sendCommand(client, "REPLICAOF localhost notaport"), "Invalid master port")
+	sendCommand(client, "FLUSHALL")
+}
+
+func TestReadSyncPayload(t *testing.T) {
+	read := func(data string) ([]byte, error) {
+		return readSyncPayload(bufio.NewReader(strings.NewReader(data)))
+	}
+	payload, err := read("\n\r\n$3\r\nabc")
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(payload))
+
+	for _, data := range []string{"$\r\n", "+\r\n", "*3\r\n", "$-1\r\n", "$5\r\nabc", "$99999999999\r\n"} {
+		_, err := read(data)
+		require.Error(t, err, data)
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	// Nothing listens there, the replica never gets connected
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "REPLICAOF 127.0.0.1 "+port))
+	defer sendCommand(client, "REPLICAOF NO ONE")
+
+	require.Contains(t, sendCommand(client, "SET readOnlyKey 1"), "-READONLY")
+	require.Contains(t, sendArgs(client, "EVAL", "return redis.call('DEL', KEYS[1])", "1", "readOnlyKey"), "READONLY")
+	require.Equal(t, "_\r\n", sendCommand(client, "GET readOnlyKey"))
+	sendCommand(client, "MULTI")
+	require.Contains(t, sendCommand(client, "INCR readOnlyKey"), "-READONLY")
+	require.Contains(t, sendCommand(client, "EXEC"), "-EXECABORT")
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET replica-serve-stale-data no"))
+	defer sendCommand(client, "CONFIG SET replica-serve-stale-data yes")
+	require.Contains(t, sendCommand(client, "GET readOnlyKey"), "-MASTERDOWN")
+	require.Equal(t, "+PONG\r\n", sendCommand(client, "PING"))
+	require.Contains(t, sendCommand(client, "ROLE"), "slave")
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET replica-read-only no"))
+	defer sendCommand(client, "CONFIG SET replica-read-only yes")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET replica-serve-stale-data yes"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SET readOnlyKey 1"))
+	sendCommand(client, "DEL readOnlyKey")
+}
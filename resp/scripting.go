@@ -0,0 +1,418 @@
+// Server side scripting with an embedded Lua interpreter. Scripts run on the
+// executor like any other command which makes them atomic, redis.call and
+// redis.pcall dispatch back into the processors map.
+package resp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// After this long a running script makes the server answer BUSY to other
+// clients and accept SCRIPT KILL.
+var scriptTimeLimit = 5 * time.Second
+
+// Script bodies by sha1, compiled lazily into the current Lua state.
+var scripts = map[string]string{}
+var compiledScripts = map[string]*lua.LFunction{}
+var luaState *lua.LState
+
+// The client on whose behalf redis.call executes commands, only set while
+// a script is running. Read only scripts may not call write commands.
+var scriptClient *Client
+var scriptNoWrites bool
+
+// The script currently running on the executor. This is shared with the
+// network request goroutine which keeps serving SCRIPT KILL while the
+// executor is busy, hence the mutex.
+var runningScript struct {
+	sync.Mutex
+	active   bool
+	function bool
+	killed   bool
+	wrote    bool
+	started  time.Time
+	cancel   context.CancelFunc
+}
+
+func sha1hex(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// A sandboxed interpreter with the redis library, without io, os or any
+// way to load code from disk. Extra functions are added to the redis table.
+func newLuaState(extra map[string]lua.LGFunction) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, unsafe := range []string{"dofile", "loadfile", "print"} {
+		L.SetGlobal(unsafe, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":         func(L *lua.LState) int { return luaRedisCall(L, true) },
+		"pcall":        func(L *lua.LState) int { return luaRedisCall(L, false) },
+		"sha1hex":      func(L *lua.LState) int { L.Push(lua.LString(sha1hex(L.CheckString(1)))); return 1 },
+		"error_reply":  func(L *lua.LState) int { return luaReplyTable(L, "err") },
+		"status_reply": func(L *lua.LState) int { return luaReplyTable(L, "ok") },
+	})
+	L.SetFuncs(redis, extra)
+	L.SetGlobal("redis", redis)
+	return L
+}
+
+func resetLuaState() {
+	if luaState != nil {
+		luaState.Close()
+	}
+	luaState = newLuaState(nil)
+	compiledScripts = map[string]*lua.LFunction{}
+}
+
+func luaReplyTable(L *lua.LState, field string) int {
+	table := L.NewTable()
+	table.RawSetString(field, lua.LString(L.CheckString(1)))
+	L.Push(table)
+	return 1
+}
+
+// redis.call raises errors returned by the command, redis.pcall returns them
+// as a table with an err field.
+func luaRedisCall(L *lua.LState, raise bool) int {
+	if scriptClient == nil {
+		L.RaiseError("redis.call and redis.pcall are not available while loading a library")
+	}
+	argc := L.GetTop()
+	if argc == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+	}
+	args := make([]string, argc)
+	for i := 1; i <= argc; i++ {
+		switch value := L.Get(i).(type) {
+		case lua.LString, lua.LNumber:
+			args[i-1] = value.String()
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	response, err := executeScriptCommand(args)
+	if err != nil {
+		response = newErrorResponse(err)
+	}
+	value := respToLua(L, response)
+	if raise && response.t == DT_SIMPLE_ERROR {
+		L.Error(value, 1)
+		return 0
+	}
+	L.Push(value)
+	return 1
+}
+
+func executeScriptCommand(args []string) (*RespResponse, error) {
+	command := RespCommand(strings.ToUpper(args[0]))
+	entry, ok := processors[command]
+	if !ok {
+		return nil, errors.New("Unknown Redis command called from script")
+	}
+	if entry.flags&CMD_NOSCRIPT != 0 {
+		return nil, errors.New("This Redis command is not allowed from script")
+	}
+	if scriptNoWrites && entry.flags&CMD_WRITE != 0 {
+		return nil, errors.New("Write commands are not allowed from read-only scripts.")
+	}
+	if masterLink != nil && replicaReadOnly && entry.flags&CMD_WRITE != 0 {
+		return nil, errReadOnlyReplica()
+	}
+	request := &RespRequest{command: command, args: args[1:], client: scriptClient}
+	if currentClient != nil {
+		if err := aclCheck(currentClient, request, "lua"); err != nil {
+			return nil, err
+		}
+	}
+	if entry.flags&CMD_WRITE != 0 {
+		runningScript.Lock()
+		runningScript.wrote = true
+		runningScript.Unlock()
+	}
+	return executeRequest(request)
+}
+
+// Values are stored with their RESP type, strings and numbers are handed to
+// Lua as plain values so scripts can work with them directly.
+func respToLua(L *lua.LState, response *RespResponse) lua.LValue {
+	value := strings.Join(response.args, " ")
+	switch response.t {
+	case DT_INTEGER, DT_DOUBLES:
+		number, _ := strconv.ParseFloat(value, 64)
+		return lua.LNumber(number)
+	case DT_BOOLEANS:
+		return lua.LBool(value == "t" || value == "T")
+	case DT_NULLS:
+		return lua.LFalse
+	case DT_SIMPLE_ERROR:
+		table := L.NewTable()
+		table.RawSetString("err", lua.LString(value))
+		return table
+	case DT_ARRAYS:
+		table := L.NewTable()
+		for _, element := range response.elements {
+			table.Append(respToLua(L, element))
+		}
+		return table
+	}
+	return lua.LString(value)
+}
+
+func luaToResp(value lua.LValue) *RespResponse {
+	switch value := value.(type) {
+	case lua.LString:
+		return newRespResponse(DT_BULK_STRINGS, []string{string(value)})
+	case lua.LNumber:
+		return newRespResponse(DT_INTEGER, []string{fmt.Sprint(int64(value))})
+	case lua.LBool:
+		if value {
+			return newRespResponse(DT_INTEGER, []string{"1"})
+		}
+	case *lua.LTable:
+		if ok, isString := value.RawGetString("ok").(lua.LString); isString {
+			return newRespResponse(DT_SIMPLE_STRING, []string{string(ok)})
+		}
+		if err, isString := value.RawGetString("err").(lua.LString); isString {
+			return newRespResponse(DT_SIMPLE_ERROR, []string{string(err)})
+		}
+		elements := []*RespResponse{}
+		for i := 1; value.RawGetInt(i) != lua.LNil; i++ {
+			elements = append(elements, luaToResp(value.RawGetInt(i)))
+		}
+		return newRespArrayResponse(elements)
+	}
+	return newRespResponse(DT_NULLS, []string{})
+}
+
+func stringsToLuaTable(L *lua.LState, values []string) *lua.LTable {
+	table := L.NewTable()
+	for _, value := range values {
+		table.Append(lua.LString(value))
+	}
+	return table
+}
+
+// Run fn on behalf of client. Killing it leaves the interpreter in an
+// unknown state, so the state it belongs to is rebuilt in that case.
+func runLua(L *lua.LState, fn *lua.LFunction, name string, client *Client, function bool, noWrites bool, params ...lua.LValue) (*RespResponse, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	L.SetContext(ctx)
+	runningScript.Lock()
+	runningScript.active, runningScript.function, runningScript.killed, runningScript.wrote = true, function, false, false
+	runningScript.started, runningScript.cancel = time.Now(), cancel
+	runningScript.Unlock()
+
+	scriptClient, scriptNoWrites = &Client{db: client.db}, noWrites
+	defer func() {
+		runningScript.Lock()
+		runningScript.active = false
+		runningScript.Unlock()
+		cancel()
+		L.RemoveContext()
+		scriptClient, scriptNoWrites = nil, false
+	}()
+
+	L.Push(fn)
+	for _, param := range params {
+		L.Push(param)
+	}
+	err := L.PCall(len(params), 1, nil)
+
+	runningScript.Lock()
+	killed := runningScript.killed
+	runningScript.Unlock()
+	if killed {
+		if function {
+			resetFunctionsState()
+			return nil, errors.New("Script killed by user with FUNCTION KILL...")
+		}
+		resetLuaState()
+		return nil, errors.New("Script killed by user with SCRIPT KILL...")
+	}
+	if err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if table, ok := apiErr.Object.(*lua.LTable); ok {
+				return luaToResp(table), nil
+			}
+			return nil, fmt.Errorf("Error running script (call to %s): %s", name, apiErr.Object.String())
+		}
+		return nil, err
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	return luaToResp(result), nil
+}
+
+// Called from the network request goroutine. Once a script has been running
+// for longer than scriptTimeLimit, SCRIPT KILL is handled right here and all
+// other commands are refused since the executor is not available. Scripts
+// that wrote cannot be killed, that would leave half of their writes.
+func busyScriptResponse(request *RespRequest) *RespResponse {
+	runningScript.Lock()
+	defer runningScript.Unlock()
+	if !runningScript.active || time.Since(runningScript.started) < scriptTimeLimit {
+		return nil
+	}
+	killCommand := RESP_SCRIPT
+	if runningScript.function {
+		killCommand = RESP_FUNCTION
+	}
+	if request.command == killCommand && len(request.args) == 1 && strings.ToUpper(request.args[0]) == "KILL" {
+		if runningScript.wrote {
+			return newErrorResponse(&respError{RESP_UNKILLABLE, "Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."})
+		}
+		runningScript.killed = true
+		runningScript.cancel()
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK})
+	}
+	return newErrorResponse(&respError{RESP_BUSY, "Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."})
+}
+
+func compileScript(sha string) (*lua.LFunction, error) {
+	if luaState == nil {
+		resetLuaState()
+	}
+	if fn, ok := compiledScripts[sha]; ok {
+		return fn, nil
+	}
+	fn, err := luaState.Load(strings.NewReader(scripts[sha]), "@user_script")
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling script (new function): %s", err.Error())
+	}
+	compiledScripts[sha] = fn
+	return fn, nil
+}
+
+func loadScript(body string) (string, error) {
+	sha := sha1hex(body)
+	if _, ok := scripts[sha]; ok {
+		return sha, nil
+	}
+	scripts[sha] = body
+	if _, err := compileScript(sha); err != nil {
+		delete(scripts, sha)
+		return "", err
+	}
+	return sha, nil
+}
+
+// Split the arguments following the script or sha into KEYS and ARGV.
+func parseScriptArgs(args []string) ([]string, []string, error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, errors.New("value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, errors.New("Number of keys can't be negative")
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, errors.New("Number of keys can't be greater than number of args")
+	}
+	return args[1 : numKeys+1], args[numKeys+1:], nil
+}
+
+func evalScript(request *RespRequest, sha string) (*RespResponse, error) {
+	keys, args, err := parseScriptArgs(request.args[1:])
+	if err != nil {
+		return nil, err
+	}
+	fn, err := compileScript(sha)
+	if err != nil {
+		return nil, err
+	}
+	luaState.SetGlobal("KEYS", stringsToLuaTable(luaState, keys))
+	luaState.SetGlobal("ARGV", stringsToLuaTable(luaState, args))
+	return runLua(luaState, fn, "f_"+sha, request.client, false, false)
+}
+
+func process_eval(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 2 {
+		return nil, errors.New("eval command requires script and numkeys arguments")
+	}
+	sha, err := loadScript(request.args[0])
+	if err != nil {
+		return nil, err
+	}
+	return evalScript(request, sha)
+}
+
+func process_evalsha(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 2 {
+		return nil, errors.New("evalsha command requires sha1 and numkeys arguments")
+	}
+	sha := strings.ToLower(request.args[0])
+	if _, ok := scripts[sha]; !ok {
+		return nil, &respError{RESP_NOSCRIPT, "No matching script. Please use EVAL."}
+	}
+	return evalScript(request, sha)
+}
+
+func process_script(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("script command requires a subcommand")
+	}
+	args := request.args[1:]
+	switch strings.ToUpper(request.args[0]) {
+	case "LOAD":
+		if len(args) != 1 {
+			return nil, errors.New("script load requires only the script argument")
+		}
+		sha, err := loadScript(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return newRespResponse(DT_BULK_STRINGS, []string{sha}), nil
+	case "EXISTS":
+		if len(args) < 1 {
+			return nil, errors.New("script exists requires at least one sha1 argument")
+		}
+		elements := []*RespResponse{}
+		for _, sha := range args {
+			exists := "0"
+			if _, ok := scripts[strings.ToLower(sha)]; ok {
+				exists = "1"
+			}
+			elements = append(elements, newRespResponse(DT_INTEGER, []string{exists}))
+		}
+		return newRespArrayResponse(elements), nil
+	case "FLUSH":
+		if _, err := parseFlushMode(args); err != nil {
+			return nil, err
+		}
+		scripts = map[string]string{}
+		resetLuaState()
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	case "KILL":
+		// A script that is actually running is killed from busyScriptResponse.
+		return nil, &respError{RESP_NOTBUSY, "No scripts in execution right now."}
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+}
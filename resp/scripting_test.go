@@ -0,0 +1,119 @@
+package resp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// Like sendCommand but for arguments containing whitespace, e.g. scripts.
+func sendArgs(client *Client, args ...string) string {
+	requestChannel <- NetworkRequest{ResponseChannel: responseChannel, Data: utils.MarshalArgsToResp(args...), Client: client}
+	return string(<-responseChannel)
+}
+
+func TestEvalReturnTypes(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, ":42\r\n", sendArgs(client, "EVAL", "return 42", "0"))
+	require.Equal(t, "$5\r\nhello\r\n", sendArgs(client, "EVAL", "return 'hello'", "0"))
+	require.Equal(t, "_\r\n", sendArgs(client, "EVAL", "return nil", "0"))
+	require.Equal(t, "+fine\r\n", sendArgs(client, "EVAL", "return redis.status_reply('fine')", "0"))
+	require.Equal(t, "-MYERR bad\r\n", sendArgs(client, "EVAL", "return redis.error_reply('MYERR bad')", "0"))
+	require.Equal(t, "*3\r\n:1\r\n$1\r\nb\r\n*1\r\n:3\r\n\r\n", sendArgs(client, "EVAL", "return {1, 'b', {3}}", "0")+"\r\n")
+}
+
+func TestEvalKeysAndArgv(t *testing.T) {
+	client := NewClient()
+	response := sendArgs(client, "EVAL", "return {KEYS[1], KEYS[2], ARGV[1]}", "2", "k1", "k2", "a1")
+	require.Equal(t, "*3\r\n$2\r\nk1\r\n$2\r\nk2\r\n$2\r\na1\r\n", response)
+	require.Contains(t, sendArgs(client, "EVAL", "return 1", "3", "k1"), "greater than number of args")
+	require.Contains(t, sendArgs(client, "EVAL", "return 1", "-1"), "negative")
+}
+
+func TestEvalRedisCall(t *testing.T) {
+	client := NewClient()
+	script := `
+		local current = tonumber(redis.call('get', KEYS[1]) or ARGV[1])
+		if current <= 0 then
+			return 0
+		end
+		redis.call('SET', KEYS[1], current - 1)
+		return current - 1`
+	require.Equal(t, ":2\r\n", sendArgs(client, "EVAL", script, "1", "tokens", "3"))
+	require.Equal(t, ":1\r\n", sendArgs(client, "EVAL", script, "1", "tokens", "3"))
+	require.Equal(t, ":0\r\n", sendArgs(client, "EVAL", script, "1", "tokens", "3"))
+	require.Equal(t, ":0\r\n", sendArgs(client, "EVAL", script, "1", "tokens", "3"))
+	require.Equal(t, ":0\r\n", sendCommand(client, "GET tokens"))
+}
+
+func TestEvalErrors(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SET scriptString hello")
+	require.Contains(t, sendArgs(client, "EVAL", "return redis.call('INCR', KEYS[1])", "1", "scriptString"), "WRONGTYPE")
+	require.Equal(t, "$7\r\ncaught!\r\n", sendArgs(client, "EVAL", "local r = redis.pcall('INCR', KEYS[1]); if r.err then return 'caught!' end", "1", "scriptString"))
+	require.Contains(t, sendArgs(client, "EVAL", "return redis.call('NOPE')", "0"), "Unknown Redis command")
+	require.Contains(t, sendArgs(client, "EVAL", "return redis.call('MULTI')", "0"), "not allowed")
+	require.Contains(t, sendArgs(client, "EVAL", "return (", "0"), "Error compiling script")
+	require.Contains(t, sendArgs(client, "EVAL", "return nil + 1", "0"), "Error running script")
+	require.Contains(t, sendArgs(client, "EVAL", "return dofile('/etc/passwd')", "0"), "Error running script")
+}
+
+func TestEvalSelectedDb(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SELECT 8")
+	sendArgs(client, "EVAL", "redis.call('SELECT', 9); return redis.call('SET', KEYS[1], 'x')", "1", "scriptDbKey")
+	require.Equal(t, "_\r\n", sendCommand(client, "GET scriptDbKey"))
+	sendCommand(client, "SELECT 9")
+	require.Equal(t, "+x\r\n", sendCommand(client, "GET scriptDbKey"))
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestScriptLoadAndEvalSha(t *testing.T) {
+	client := NewClient()
+	sha := "e0e1f9fabfc9d4800c877a703b823ac0578ff8db"
+	sendArgs(client, "SCRIPT", "FLUSH")
+	require.Contains(t, sendArgs(client, "EVALSHA", sha, "0"), "NOSCRIPT")
+	require.Equal(t, "$40\r\n"+sha+"\r\n", sendArgs(client, "SCRIPT", "LOAD", "return 1"))
+	require.Equal(t, ":1\r\n", sendArgs(client, "EVALSHA", sha, "0"))
+	require.Equal(t, "*2\r\n:1\r\n:0\r\n", sendArgs(client, "SCRIPT", "EXISTS", sha, "ffff"))
+
+	require.Equal(t, "+OK\r\n", sendArgs(client, "SCRIPT", "FLUSH"))
+	require.Equal(t, "*1\r\n:0\r\n", sendArgs(client, "SCRIPT", "EXISTS", sha))
+	require.Contains(t, sendArgs(client, "SCRIPT", "KILL"), RESP_NOTBUSY)
+}
+
+func TestScriptKill(t *testing.T) {
+	scriptTimeLimit = 50 * time.Millisecond
+	defer func() { scriptTimeLimit = 5 * time.Second }()
+
+	evalChannel := make(chan []byte)
+	requestChannel <- NetworkRequest{ResponseChannel: evalChannel, Data: utils.MarshalArgsToResp("EVAL", "while true do end", "0")}
+	time.Sleep(100 * time.Millisecond)
+
+	require.Contains(t, sendCommand(NewClient(), "GET someKey"), RESP_BUSY)
+	require.Equal(t, "+OK\r\n", sendCommand(NewClient(), "SCRIPT KILL"))
+	require.Contains(t, string(<-evalChannel), "killed")
+
+	// The interpreter is usable again afterwards
+	require.Equal(t, ":1\r\n", sendArgs(NewClient(), "EVAL", "return 1", "0"))
+}
+
+func TestScriptKillAfterWrite(t *testing.T) {
+	scriptTimeLimit = 50 * time.Millisecond
+	defer func() { scriptTimeLimit = 5 * time.Second }()
+
+	evalChannel := make(chan []byte)
+	requestChannel <- NetworkRequest{ResponseChannel: evalChannel, Data: utils.MarshalArgsToResp("EVAL", "redis.call('SET', KEYS[1], 'half') while true do end", "1", "half")}
+	time.Sleep(100 * time.Millisecond)
+	require.Contains(t, sendCommand(NewClient(), "SCRIPT KILL"), "-UNKILLABLE Sorry the script already executed write commands")
+
+	// Only stopping the server ends such a script, which the test does directly
+	runningScript.Lock()
+	runningScript.killed = true
+	runningScript.cancel()
+	runningScript.Unlock()
+	<-evalChannel
+	sendCommand(NewClient(), "DEL half")
+}
@@ -0,0 +1,961 @@
+// Sentinel mode monitors masters and their replicas instead of serving a
+// dataset. Sentinels watching the same master find each other through hello
+// messages published on it, agree that it is down and elect one of them to
+// promote a replica. As everywhere else the state belongs to the executor,
+// the connections to the instances run in goroutines of their own and hand
+// their replies over as tasks.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/utils"
+)
+
+const sentinelHelloChannel = "__sentinel__:hello"
+
+const (
+	sentinelPingPeriod  = time.Second
+	sentinelRolePeriod  = time.Second
+	sentinelHelloPeriod = 2 * time.Second
+	sentinelAskPeriod   = time.Second
+	// How long the answer of another sentinel about the master counts
+	sentinelDownReplyValidity = 5 * time.Second
+	// Instances reporting the wrong role are reconfigured after this long
+	sentinelReconfigureDelay = 4 * time.Second
+	sentinelMaxDesync        = time.Second
+	sentinelElectionTimeout  = 10 * time.Second
+)
+
+const (
+	FAILOVER_WAIT_START      = "wait_start"
+	FAILOVER_SELECT_SLAVE    = "select_slave"
+	FAILOVER_WAIT_PROMOTION  = "wait_promotion"
+	FAILOVER_RECONF_REPLICAS = "reconf_slaves"
+)
+
+var sentinelMode = false
+var sentinelDownAfter = 30 * time.Second
+var sentinelFailoverTimeout = 3 * time.Minute
+
+// Identifies this sentinel in hello messages and leader elections.
+var sentinelId = newReplicationId()
+var currentEpoch int64 = 0
+
+var sentinelMasters = map[string]*sentinelMaster{}
+
+// A master, replica or other sentinel as seen by this sentinel.
+type sentinelInstance struct {
+	host string
+	port int
+	link *instanceLink
+
+	lastPing    time.Time
+	pingPending bool
+	// The first PING still waiting for a valid reply, instances not
+	// answering for too long are down
+	unansweredSince time.Time
+	lastPong        time.Time
+	sdown           bool
+	sdownSince      time.Time
+
+	// Reported by ROLE, masters and replicas only
+	lastRole      time.Time
+	rolePending   bool
+	roleReported  string
+	roleTime      time.Time
+	masterHost    string
+	masterPort    int
+	masterLinkUp  bool
+	offset        int64
+	lastHelloSent time.Time
+	// Since when the instance has not been what it should be
+	misconfiguredSince time.Time
+
+	// Other sentinels only: their view of the master and their vote
+	runId          string
+	lastHello      time.Time
+	lastAsk        time.Time
+	askPending     bool
+	masterDown     bool
+	masterDownTime time.Time
+	leader         string
+	leaderEpoch    int64
+}
+
+type sentinelMaster struct {
+	*sentinelInstance
+	name        string
+	quorum      int
+	configEpoch int64
+	odown       bool
+	replicas    map[string]*sentinelInstance // by address
+	sentinels   map[string]*sentinelInstance // by run id
+
+	// The vote of this sentinel for the failover of the epoch
+	leader      string
+	leaderEpoch int64
+
+	failover *sentinelFailover
+	// A new failover is only attempted twice the failover timeout later
+	failoverStart time.Time
+}
+
+type sentinelFailover struct {
+	state       string
+	epoch       int64
+	start       time.Time
+	stateChange time.Time
+	promoted    *sentinelInstance
+	// Started by SENTINEL FAILOVER, no agreement is needed
+	forced bool
+}
+
+func init() {
+	configParameters["sentinel"] = configParameter{
+		get: func() string { return yesNo(sentinelMode) },
+		set: immutable(func(value string) error {
+			enable, err := parseYesNo(value)
+			if err == nil {
+				sentinelMode = enable
+			}
+			return err
+		}),
+	}
+	configParameters["sentinel-monitor"] = configParameter{
+		get: func() string {
+			monitors := []string{}
+			for _, name := range sentinelMasterNames() {
+				master := sentinelMasters[name]
+				monitors = append(monitors, fmt.Sprintf("%s %s %d %d", name, master.host, master.port, master.quorum))
+			}
+			return strings.Join(monitors, ", ")
+		},
+		set: immutable(func(value string) error {
+			fields := strings.Fields(value)
+			if len(fields) != 4 {
+				return errors.New("argument must be 'name host port quorum'")
+			}
+			return monitorMaster(fields[0], fields[1], fields[2], fields[3])
+		}),
+	}
+	configParameters["sentinel-down-after-milliseconds"] = configParameter{
+		get: func() string { return fmt.Sprint(sentinelDownAfter.Milliseconds()) },
+		set: func(value string) error {
+			milliseconds, err := parseNonNegative(value)
+			if err != nil || milliseconds == 0 {
+				return errors.New("argument must be a positive number of milliseconds")
+			}
+			sentinelDownAfter = time.Duration(milliseconds) * time.Millisecond
+			return nil
+		},
+	}
+	configParameters["sentinel-failover-timeout"] = configParameter{
+		get: func() string { return fmt.Sprint(sentinelFailoverTimeout.Milliseconds()) },
+		set: func(value string) error {
+			milliseconds, err := parseNonNegative(value)
+			if err != nil || milliseconds == 0 {
+				return errors.New("argument must be a positive number of milliseconds")
+			}
+			sentinelFailoverTimeout = time.Duration(milliseconds) * time.Millisecond
+			return nil
+		},
+	}
+}
+
+// Sentinels understand their own small set of commands.
+var sentinelProcessors = map[RespCommand]respCommand{
+	RESP_PING:         {process_ping, -1, CMD_STALE, noKeys},
+	RESP_HELLO:        {process_hello, -1, CMD_STALE, noKeys},
+	RESP_AUTH:         {process_auth, -2, CMD_STALE, noKeys},
+	RESP_SUBSCRIBE:    {process_subscribe, -2, CMD_STALE, noKeys},
+	RESP_UNSUBSCRIBE:  {process_unsubscribe, -1, CMD_STALE, noKeys},
+	RESP_PSUBSCRIBE:   {process_psubscribe, -2, CMD_STALE, noKeys},
+	RESP_PUNSUBSCRIBE: {process_punsubscribe, -1, CMD_STALE, noKeys},
+	RESP_CONFIG:       {process_config, -2, CMD_STALE, noKeys},
+	RESP_CLIENT:       {process_client, -2, CMD_STALE, noKeys},
+	RESP_ROLE:         {process_sentinel_role, 1, CMD_STALE, noKeys},
+	RESP_SENTINEL:     {process_sentinel, -2, CMD_STALE, noKeys},
+}
+
+func sentinelMasterNames() []string {
+	names := []string{}
+	for name := range sentinelMasters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newSentinelInstance(host string, port int) *sentinelInstance {
+	return &sentinelInstance{host: host, port: port, lastPong: time.Now()}
+}
+
+func (i *sentinelInstance) addr() string {
+	return net.JoinHostPort(i.host, fmt.Sprint(i.port))
+}
+
+func (i *sentinelInstance) closeLink() {
+	if i.link != nil {
+		i.link.close()
+		i.link = nil
+	}
+	i.pingPending, i.rolePending, i.askPending = false, false, false
+	i.unansweredSince = time.Time{}
+}
+
+func parseSentinelPort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.New("Invalid port number")
+	}
+	return port, nil
+}
+
+func monitorMaster(name string, host string, port string, quorum string) error {
+	if _, ok := sentinelMasters[name]; ok {
+		return errors.New("Duplicated master name")
+	}
+	portNumber, err := parseSentinelPort(port)
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(quorum)
+	if err != nil || count <= 0 {
+		return errors.New("Quorum must be 1 or greater.")
+	}
+	sentinelMasters[name] = &sentinelMaster{
+		sentinelInstance: newSentinelInstance(host, portNumber),
+		name:             name,
+		quorum:           count,
+		replicas:         map[string]*sentinelInstance{},
+		sentinels:        map[string]*sentinelInstance{},
+	}
+	return nil
+}
+
+func removeMaster(master *sentinelMaster) {
+	master.closeLink()
+	for _, replica := range master.replicas {
+		replica.closeLink()
+	}
+	for _, sentinel := range master.sentinels {
+		sentinel.closeLink()
+	}
+	delete(sentinelMasters, master.name)
+}
+
+// Events are logged and published to the clients of the sentinel, the
+// message describes the instance like Redis does.
+func (m *sentinelMaster) event(kind string, instance *sentinelInstance, extra string) {
+	var message string
+	switch {
+	case instance == m.sentinelInstance:
+		message = fmt.Sprintf("master %s %s %d", m.name, m.host, m.port)
+	case instance.runId != "":
+		message = fmt.Sprintf("sentinel %s %s %d @ %s %s %d", instance.runId, instance.host, instance.port, m.name, m.host, m.port)
+	default:
+		message = fmt.Sprintf("slave %s %s %d @ %s %s %d", instance.addr(), instance.host, instance.port, m.name, m.host, m.port)
+	}
+	if extra != "" {
+		message += " " + extra
+	}
+	log.Printf("%s %s", kind, message)
+	publish(kind, message)
+}
+
+func sentinelCron() {
+	now := time.Now()
+	for _, name := range sentinelMasterNames() {
+		sentinelMasters[name].cron(now)
+	}
+}
+
+func (m *sentinelMaster) cron(now time.Time) {
+	for _, instance := range m.monitoredInstances() {
+		if instance.link == nil {
+			instance.link = newInstanceLink(instance.host, instance.port, true)
+		}
+		instance.ping(now)
+		m.refreshRole(instance, now)
+		m.sendHello(instance, now)
+		m.checkSubjectivelyDown(instance, now)
+	}
+	for _, sentinel := range m.sentinels {
+		if sentinel.link == nil {
+			sentinel.link = newInstanceLink(sentinel.host, sentinel.port, false)
+		}
+		sentinel.ping(now)
+		m.checkSubjectivelyDown(sentinel, now)
+	}
+	m.checkObjectivelyDown(now)
+	if m.sdown || m.failover != nil && m.failover.state == FAILOVER_WAIT_START {
+		m.askOtherSentinels(now)
+	}
+	m.failoverCron(now)
+}
+
+// The master followed by its replicas.
+func (m *sentinelMaster) monitoredInstances() []*sentinelInstance {
+	instances := []*sentinelInstance{m.sentinelInstance}
+	addrs := []string{}
+	for addr := range m.replicas {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		instances = append(instances, m.replicas[addr])
+	}
+	return instances
+}
+
+func (i *sentinelInstance) ping(now time.Time) {
+	if i.pingPending || now.Sub(i.lastPing) < min(sentinelPingPeriod, sentinelDownAfter) {
+		return
+	}
+	i.lastPing = now
+	if i.unansweredSince.IsZero() {
+		i.unansweredSince = now
+	}
+	i.pingPending = i.link.send(func(reply any, err error) {
+		i.pingPending = false
+		if err != nil {
+			return
+		}
+		// Busy instances are alive too
+		switch value := reply.(type) {
+		case string:
+			if value == RESP_PONG {
+				i.lastPong, i.unansweredSince = time.Now(), time.Time{}
+			}
+		case replyError:
+			if strings.HasPrefix(string(value), "LOADING") || strings.HasPrefix(string(value), RESP_MASTERDOWN) {
+				i.lastPong, i.unansweredSince = time.Now(), time.Time{}
+			}
+		}
+	}, string(RESP_PING))
+}
+
+func (m *sentinelMaster) checkSubjectivelyDown(instance *sentinelInstance, now time.Time) {
+	down := !instance.unansweredSince.IsZero() && now.Sub(instance.unansweredSince) > sentinelDownAfter
+	if down == instance.sdown {
+		return
+	}
+	instance.sdown = down
+	if down {
+		instance.sdownSince = now
+		m.event("+sdown", instance, "")
+	} else {
+		m.event("-sdown", instance, "")
+	}
+}
+
+func (m *sentinelMaster) refreshRole(instance *sentinelInstance, now time.Time) {
+	if instance.rolePending || now.Sub(instance.lastRole) < sentinelRolePeriod {
+		return
+	}
+	instance.lastRole = now
+	instance.rolePending = instance.link.send(func(reply any, err error) {
+		instance.rolePending = false
+		if err == nil && (instance == m.sentinelInstance || m.replicas[instance.addr()] == instance) {
+			m.processRole(instance, reply)
+		}
+	}, string(RESP_ROLE))
+}
+
+func (m *sentinelMaster) processRole(instance *sentinelInstance, reply any) {
+	fields, ok := reply.([]any)
+	if !ok || len(fields) == 0 {
+		return
+	}
+	now := time.Now()
+	instance.roleReported = replyString(fields[0])
+	instance.roleTime = now
+	switch {
+	case instance.roleReported == "master" && len(fields) == 3:
+		instance.offset = replyInt(fields[1])
+		if instance == m.sentinelInstance {
+			entries, _ := fields[2].([]any)
+			for _, entry := range entries {
+				replica, ok := entry.([]any)
+				if !ok || len(replica) < 2 {
+					continue
+				}
+				if port, err := parseSentinelPort(replyString(replica[1])); err == nil {
+					m.addReplica(replyString(replica[0]), port)
+				}
+			}
+		}
+	case instance.roleReported == "slave" && len(fields) == 5:
+		instance.masterHost = replyString(fields[1])
+		instance.masterPort = int(replyInt(fields[2]))
+		instance.masterLinkUp = replyString(fields[3]) == "connected"
+		instance.offset = replyInt(fields[4])
+	default:
+		return
+	}
+
+	if f := m.failover; f != nil && f.state == FAILOVER_WAIT_PROMOTION && f.promoted == instance && instance.roleReported == "master" {
+		m.event("+promoted-slave", instance, "")
+		f.state, f.stateChange = FAILOVER_RECONF_REPLICAS, now
+		return
+	}
+	m.checkReplicaConfig(instance, now)
+}
+
+func (m *sentinelMaster) addReplica(host string, port int) *sentinelInstance {
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+	if replica, ok := m.replicas[addr]; ok || addr == m.addr() {
+		return replica
+	}
+	replica := newSentinelInstance(host, port)
+	m.replicas[addr] = replica
+	m.event("+slave", replica, "")
+	return replica
+}
+
+// Replicas following another master and old masters coming back are turned
+// into replicas of the current master, unless it is being replaced.
+func (m *sentinelMaster) checkReplicaConfig(instance *sentinelInstance, now time.Time) {
+	if instance == m.sentinelInstance {
+		return
+	}
+	correct := instance.roleReported == "slave" && instance.masterHost == m.host && instance.masterPort == m.port
+	if correct || m.sdown || m.failover != nil {
+		instance.misconfiguredSince = time.Time{}
+		return
+	}
+	if instance.misconfiguredSince.IsZero() {
+		instance.misconfiguredSince = now
+		return
+	}
+	if now.Sub(instance.misconfiguredSince) < sentinelReconfigureDelay {
+		return
+	}
+	instance.misconfiguredSince = now
+	if instance.roleReported == "master" {
+		m.event("+convert-to-slave", instance, "")
+	} else {
+		m.event("+fix-slave-config", instance, "")
+	}
+	instance.link.send(nil, string(RESP_REPLICAOF), m.host, fmt.Sprint(m.port))
+}
+
+// Announce this sentinel and its view of the master on every instance,
+// the other sentinels are subscribed to the hello channel there.
+func (m *sentinelMaster) sendHello(instance *sentinelInstance, now time.Time) {
+	if now.Sub(instance.lastHelloSent) < sentinelHelloPeriod || instance.link.localIp == "" {
+		return
+	}
+	instance.lastHelloSent = now
+	hello := fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d", instance.link.localIp, serverPort, sentinelId, currentEpoch,
+		m.name, m.host, m.port, m.configEpoch)
+	instance.link.send(nil, string(RESP_PUBLISH), sentinelHelloChannel, hello)
+}
+
+func processHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 || fields[2] == sentinelId {
+		return
+	}
+	master := sentinelMasters[fields[4]]
+	if master == nil {
+		return
+	}
+	port, err := parseSentinelPort(fields[1])
+	if err != nil {
+		return
+	}
+	epoch, _ := strconv.ParseInt(fields[3], 10, 64)
+	masterPort, _ := strconv.Atoi(fields[6])
+	masterEpoch, _ := strconv.ParseInt(fields[7], 10, 64)
+
+	runId := fields[2]
+	sentinel := master.sentinels[runId]
+	if sentinel == nil {
+		// A restarted sentinel comes back with a new id
+		for id, other := range master.sentinels {
+			if other.host == fields[0] && other.port == port {
+				other.closeLink()
+				delete(master.sentinels, id)
+			}
+		}
+		sentinel = newSentinelInstance(fields[0], port)
+		sentinel.runId = runId
+		master.sentinels[runId] = sentinel
+		master.event("+sentinel", sentinel, "")
+	} else if sentinel.host != fields[0] || sentinel.port != port {
+		sentinel.closeLink()
+		sentinel.host, sentinel.port = fields[0], port
+	}
+	sentinel.lastHello = time.Now()
+
+	if epoch > currentEpoch {
+		currentEpoch = epoch
+		master.event("+new-epoch", master.sentinelInstance, fmt.Sprint(epoch))
+	}
+	// Another sentinel completed a failover
+	if masterEpoch > master.configEpoch {
+		if fields[5] != master.host || masterPort != master.port {
+			master.switchMaster(fields[5], masterPort, masterEpoch)
+		}
+		master.configEpoch = masterEpoch
+	}
+}
+
+func (m *sentinelMaster) checkObjectivelyDown(now time.Time) {
+	odown := false
+	if m.sdown {
+		count := 1
+		for _, sentinel := range m.sentinels {
+			if sentinel.masterDown && now.Sub(sentinel.masterDownTime) < sentinelDownReplyValidity {
+				count++
+			}
+		}
+		odown = count >= m.quorum
+	}
+	if odown == m.odown {
+		return
+	}
+	m.odown = odown
+	if odown {
+		m.event("+odown", m.sentinelInstance, fmt.Sprintf("#quorum %d", m.quorum))
+	} else {
+		m.event("-odown", m.sentinelInstance, "")
+	}
+}
+
+// Ask the other sentinels whether they consider the master down, while
+// waiting to start a failover this also asks for their vote.
+func (m *sentinelMaster) askOtherSentinels(now time.Time) {
+	runId := "*"
+	if f := m.failover; f != nil && f.state == FAILOVER_WAIT_START && !f.forced {
+		runId = sentinelId
+	}
+	for _, sentinel := range m.sentinels {
+		if sentinel.askPending || sentinel.sdown || now.Sub(sentinel.lastAsk) < sentinelAskPeriod {
+			continue
+		}
+		sentinel.lastAsk = now
+		sentinel.askPending = sentinel.link.send(func(reply any, err error) {
+			sentinel.askPending = false
+			fields, ok := reply.([]any)
+			if err != nil || !ok || len(fields) != 3 {
+				return
+			}
+			sentinel.masterDown = replyInt(fields[0]) == 1
+			sentinel.masterDownTime = time.Now()
+			if leader := replyString(fields[1]); leader != "*" {
+				sentinel.leader, sentinel.leaderEpoch = leader, replyInt(fields[2])
+			}
+		}, string(RESP_SENTINEL), "is-master-down-by-addr", m.host, fmt.Sprint(m.port), fmt.Sprint(currentEpoch), runId)
+	}
+}
+
+// Vote for the leader of the failover of epoch, the first candidate asking
+// gets the vote.
+func (m *sentinelMaster) voteLeader(runId string, epoch int64) {
+	if epoch > currentEpoch {
+		currentEpoch = epoch
+		m.event("+new-epoch", m.sentinelInstance, fmt.Sprint(epoch))
+	}
+	if m.leaderEpoch >= epoch || currentEpoch > epoch {
+		return
+	}
+	m.leader, m.leaderEpoch = runId, epoch
+	m.event("+vote-for-leader", m.sentinelInstance, fmt.Sprintf("%s %d", runId, epoch))
+	// Leave the failover to the candidate for a while
+	if runId != sentinelId {
+		m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+	}
+}
+
+// The sentinel that got a majority of the votes for epoch, if any.
+func (m *sentinelMaster) electedLeader(epoch int64) string {
+	votes := map[string]int{}
+	for _, sentinel := range m.sentinels {
+		if sentinel.leader != "" && sentinel.leaderEpoch == epoch {
+			votes[sentinel.leader]++
+		}
+	}
+	if m.leaderEpoch == epoch {
+		votes[m.leader]++
+	}
+	needed := max(m.quorum, (len(m.sentinels)+1)/2+1)
+	for leader, count := range votes {
+		if count >= needed {
+			return leader
+		}
+	}
+	return ""
+}
+
+func (m *sentinelMaster) startFailover(now time.Time, forced bool) {
+	currentEpoch++
+	m.event("+new-epoch", m.sentinelInstance, fmt.Sprint(currentEpoch))
+	m.event("+try-failover", m.sentinelInstance, "")
+	m.failover = &sentinelFailover{state: FAILOVER_WAIT_START, epoch: currentEpoch, start: now, stateChange: now, forced: forced}
+	m.failoverStart = now.Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+	if !forced {
+		m.voteLeader(sentinelId, currentEpoch)
+	}
+	for _, sentinel := range m.sentinels {
+		sentinel.lastAsk = time.Time{}
+	}
+}
+
+func (m *sentinelMaster) abortFailover(reason string) {
+	m.event(reason, m.sentinelInstance, "")
+	m.failover = nil
+}
+
+func (m *sentinelMaster) failoverCron(now time.Time) {
+	f := m.failover
+	if f == nil {
+		if m.odown && now.Sub(m.failoverStart) > 2*sentinelFailoverTimeout {
+			m.startFailover(now, false)
+		}
+		return
+	}
+	switch f.state {
+	case FAILOVER_WAIT_START:
+		leader := m.electedLeader(f.epoch)
+		if !f.forced && leader != sentinelId {
+			if now.Sub(f.start) > min(sentinelElectionTimeout, sentinelFailoverTimeout) {
+				m.abortFailover("-failover-abort-not-elected")
+			}
+			return
+		}
+		m.event("+elected-leader", m.sentinelInstance, "")
+		f.state, f.stateChange = FAILOVER_SELECT_SLAVE, now
+		fallthrough
+	case FAILOVER_SELECT_SLAVE:
+		replica := m.selectReplica(now)
+		if replica == nil {
+			m.abortFailover("-failover-abort-no-good-slave")
+			return
+		}
+		m.event("+selected-slave", replica, "")
+		replica.link.send(nil, string(RESP_REPLICAOF), "NO", "ONE")
+		m.event("+failover-state-send-slaveof-noone", replica, "")
+		f.promoted, f.state, f.stateChange = replica, FAILOVER_WAIT_PROMOTION, now
+	case FAILOVER_WAIT_PROMOTION:
+		if now.Sub(f.stateChange) > sentinelFailoverTimeout {
+			m.abortFailover("-failover-abort-slave-timeout")
+		}
+	case FAILOVER_RECONF_REPLICAS:
+		promoted := f.promoted
+		for _, replica := range m.replicas {
+			if replica != promoted && !replica.sdown {
+				replica.link.send(nil, string(RESP_REPLICAOF), promoted.host, fmt.Sprint(promoted.port))
+				m.event("+slave-reconf-sent", replica, "")
+			}
+		}
+		m.event("+failover-end", m.sentinelInstance, "")
+		m.switchMaster(promoted.host, promoted.port, f.epoch)
+	}
+}
+
+// The replica with the most data among those that are reachable.
+func (m *sentinelMaster) selectReplica(now time.Time) *sentinelInstance {
+	var best *sentinelInstance
+	for _, replica := range m.monitoredInstances()[1:] {
+		if replica.sdown || replica.roleReported != "slave" ||
+			now.Sub(replica.lastPong) > 5*sentinelPingPeriod || now.Sub(replica.roleTime) > 5*sentinelRolePeriod {
+			continue
+		}
+		if best == nil || replica.offset > best.offset {
+			best = replica
+		}
+	}
+	return best
+}
+
+// Monitor the new master, the old one and the other replicas become its
+// replicas.
+func (m *sentinelMaster) switchMaster(host string, port int, epoch int64) {
+	message := fmt.Sprintf("%s %s %d %s %d", m.name, m.host, m.port, host, port)
+	log.Printf("+switch-master %s", message)
+	publish("+switch-master", message)
+	oldAddr := m.addr()
+	replicas := []*sentinelInstance{newSentinelInstance(m.host, m.port)}
+	for addr, replica := range m.replicas {
+		replica.closeLink()
+		if addr != net.JoinHostPort(host, fmt.Sprint(port)) && addr != oldAddr {
+			replicas = append(replicas, newSentinelInstance(replica.host, replica.port))
+		}
+	}
+	m.closeLink()
+	m.sentinelInstance = newSentinelInstance(host, port)
+	m.replicas = map[string]*sentinelInstance{}
+	for _, replica := range replicas {
+		m.replicas[replica.addr()] = replica
+	}
+	m.configEpoch, m.odown, m.failover = epoch, false, nil
+}
+
+func (m *sentinelMaster) flags(instance *sentinelInstance) string {
+	flags := []string{"slave"}
+	switch {
+	case instance == m.sentinelInstance:
+		flags = []string{"master"}
+	case instance.runId != "":
+		flags = []string{"sentinel"}
+	}
+	if instance.sdown {
+		flags = append(flags, "s_down")
+	}
+	if instance == m.sentinelInstance {
+		if m.odown {
+			flags = append(flags, "o_down")
+		}
+		if m.failover != nil {
+			flags = append(flags, "failover_in_progress")
+		}
+	}
+	if m.failover != nil && m.failover.promoted == instance {
+		flags = append(flags, "promoted")
+	}
+	return strings.Join(flags, ",")
+}
+
+func (m *sentinelMaster) instanceInfo(instance *sentinelInstance) []*RespResponse {
+	name := instance.addr()
+	switch {
+	case instance == m.sentinelInstance:
+		name = m.name
+	case instance.runId != "":
+		name = instance.runId
+	}
+	info := bulkStrings(
+		"name", name,
+		"ip", instance.host,
+		"port", fmt.Sprint(instance.port),
+		"flags", m.flags(instance),
+		"last-ok-ping-reply", fmt.Sprint(time.Since(instance.lastPong).Milliseconds()),
+		"down-after-milliseconds", fmt.Sprint(sentinelDownAfter.Milliseconds()),
+	)
+	switch {
+	case instance == m.sentinelInstance:
+		info = append(info, bulkStrings(
+			"role-reported", instance.roleReported,
+			"config-epoch", fmt.Sprint(m.configEpoch),
+			"num-slaves", fmt.Sprint(len(m.replicas)),
+			"num-other-sentinels", fmt.Sprint(len(m.sentinels)),
+			"quorum", fmt.Sprint(m.quorum),
+			"failover-timeout", fmt.Sprint(sentinelFailoverTimeout.Milliseconds()),
+		)...)
+		if m.failover != nil {
+			info = append(info, bulkStrings("failover-state", m.failover.state)...)
+		}
+	case instance.runId != "":
+		info = append(info, bulkStrings(
+			"runid", instance.runId,
+			"last-hello-message", fmt.Sprint(time.Since(instance.lastHello).Milliseconds()),
+			"voted-leader", instance.leader,
+			"voted-leader-epoch", fmt.Sprint(instance.leaderEpoch),
+		)...)
+	default:
+		linkStatus := "err"
+		if instance.masterLinkUp {
+			linkStatus = "ok"
+		}
+		info = append(info, bulkStrings(
+			"role-reported", instance.roleReported,
+			"master-host", instance.masterHost,
+			"master-port", fmt.Sprint(instance.masterPort),
+			"master-link-status", linkStatus,
+			"slave-repl-offset", fmt.Sprint(instance.offset),
+		)...)
+	}
+	return info
+}
+
+func masterByName(name string) (*sentinelMaster, error) {
+	master, ok := sentinelMasters[name]
+	if !ok {
+		return nil, errors.New("No such master with that name")
+	}
+	return master, nil
+}
+
+func masterByAddr(host string, port int) *sentinelMaster {
+	for _, master := range sentinelMasters {
+		if master.host == host && master.port == port {
+			return master
+		}
+	}
+	return nil
+}
+
+func process_sentinel_role(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return newRespArrayResponse([]*RespResponse{
+		newRespResponse(DT_BULK_STRINGS, []string{"sentinel"}),
+		newRespArrayResponse(bulkStrings(sentinelMasterNames()...)),
+	}), nil
+}
+
+func process_sentinel(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("wrong number of arguments for 'sentinel' command")
+	}
+	args := request.args[1:]
+	arity := map[string]int{
+		"MYID": 0, "MASTERS": 0, "MASTER": 1, "REPLICAS": 1, "SLAVES": 1, "SENTINELS": 1,
+		"GET-MASTER-ADDR-BY-NAME": 1, "IS-MASTER-DOWN-BY-ADDR": 4, "MONITOR": 4, "REMOVE": 1, "FAILOVER": 1,
+	}
+	subcommand := strings.ToUpper(request.args[0])
+	count, ok := arity[subcommand]
+	if !ok {
+		return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+	}
+	if len(args) != count {
+		return nil, fmt.Errorf("wrong number of arguments for 'sentinel|%s' command", strings.ToLower(subcommand))
+	}
+
+	switch subcommand {
+	case "MYID":
+		return newRespResponse(DT_BULK_STRINGS, []string{sentinelId}), nil
+	case "MASTERS":
+		masters := []*RespResponse{}
+		for _, name := range sentinelMasterNames() {
+			master := sentinelMasters[name]
+			masters = append(masters, newRespMapResponse(master.instanceInfo(master.sentinelInstance)))
+		}
+		return newRespArrayResponse(masters), nil
+	case "GET-MASTER-ADDR-BY-NAME":
+		master, ok := sentinelMasters[args[0]]
+		if !ok {
+			return newRespResponse(DT_NULLS, []string{}), nil
+		}
+		return newRespArrayResponse(bulkStrings(master.host, fmt.Sprint(master.port))), nil
+	case "IS-MASTER-DOWN-BY-ADDR":
+		port, err := parseSentinelPort(args[1])
+		if err != nil {
+			return nil, err
+		}
+		epoch, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("value is not an integer or out of range")
+		}
+		down, leader, leaderEpoch := 0, "*", int64(0)
+		if master := masterByAddr(args[0], port); master != nil {
+			if master.sdown {
+				down = 1
+			}
+			if args[3] != "*" {
+				master.voteLeader(args[3], epoch)
+				leader, leaderEpoch = master.leader, master.leaderEpoch
+			}
+		}
+		return newRespArrayResponse([]*RespResponse{
+			integerResponse(down),
+			newRespResponse(DT_BULK_STRINGS, []string{leader}),
+			newRespResponse(DT_INTEGER, []string{fmt.Sprint(leaderEpoch)}),
+		}), nil
+	case "MONITOR":
+		if err := monitorMaster(args[0], args[1], args[2], args[3]); err != nil {
+			return nil, err
+		}
+		master := sentinelMasters[args[0]]
+		master.event("+monitor", master.sentinelInstance, fmt.Sprintf("quorum %d", master.quorum))
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	}
+
+	master, err := masterByName(args[0])
+	if err != nil {
+		return nil, err
+	}
+	switch subcommand {
+	case "MASTER":
+		return newRespMapResponse(master.instanceInfo(master.sentinelInstance)), nil
+	case "REPLICAS", "SLAVES":
+		replicas := []*RespResponse{}
+		for _, replica := range master.monitoredInstances()[1:] {
+			replicas = append(replicas, newRespMapResponse(master.instanceInfo(replica)))
+		}
+		return newRespArrayResponse(replicas), nil
+	case "SENTINELS":
+		ids := []string{}
+		for id := range master.sentinels {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		sentinels := []*RespResponse{}
+		for _, id := range ids {
+			sentinels = append(sentinels, newRespMapResponse(master.instanceInfo(master.sentinels[id])))
+		}
+		return newRespArrayResponse(sentinels), nil
+	case "REMOVE":
+		master.event("-monitor", master.sentinelInstance, "")
+		removeMaster(master)
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	}
+
+	// FAILOVER
+	if master.failover != nil {
+		return nil, &respError{RESP_INPROG, "Failover already in progress"}
+	}
+	if master.selectReplica(time.Now()) == nil {
+		return nil, &respError{RESP_NOGOODSLAVE, "No suitable replica to promote"}
+	}
+	master.startFailover(time.Now(), true)
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+// Deliver the hello messages of other sentinels published on the instance.
+func (link *instanceLink) receiveHellos() {
+	for {
+		conn, err := link.dial()
+		if err == nil {
+			closed := make(chan struct{})
+			go func() {
+				select {
+				case <-link.stopped:
+					conn.Close()
+				case <-closed:
+				}
+			}()
+			link.readHellos(conn)
+			conn.Close()
+			close(closed)
+		}
+		select {
+		case <-link.stopped:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (link *instanceLink) readHellos(conn net.Conn) {
+	if _, err := conn.Write(utils.MarshalArgsToResp(string(RESP_SUBSCRIBE), sentinelHelloChannel)); err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		message, ok := reply.([]any)
+		if !ok || len(message) != 3 || replyString(message[0]) != "message" {
+			continue
+		}
+		hello := replyString(message[2])
+		select {
+		case taskChannel <- func() { processHello(hello) }:
+		case <-link.stopped:
+			return
+		}
+	}
+}
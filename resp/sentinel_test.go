@@ -0,0 +1,86 @@
+package resp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Run SENTINEL against a monitored master on the executor, SENTINEL is not
+// a command outside of sentinel mode.
+func sentinelArgs(t *testing.T, args ...string) string {
+	var reply string
+	require.NoError(t, onExecutor(func() error {
+		response, err := process_sentinel(&RespRequest{command: RESP_SENTINEL, args: args, client: NewClient()}, nil)
+		if err != nil {
+			response = newErrorResponse(err)
+		}
+		reply = string(response.marshalToBytes())
+		return nil
+	}))
+	return reply
+}
+
+func monitorTestMaster(t *testing.T) {
+	require.Equal(t, "+OK\r\n", sentinelArgs(t, "MONITOR", "testmaster", "127.0.0.1", "7000", "2"))
+	t.Cleanup(func() {
+		onExecutor(func() error {
+			removeMaster(sentinelMasters["testmaster"])
+			currentEpoch = 0
+			return nil
+		})
+	})
+}
+
+func TestSentinelLeaderVote(t *testing.T) {
+	monitorTestMaster(t)
+	require.Equal(t, "*2\r\n$9\r\n127.0.0.1\r\n$4\r\n7000\r\n", sentinelArgs(t, "GET-MASTER-ADDR-BY-NAME", "testmaster"))
+	require.Contains(t, sentinelArgs(t, "MONITOR", "testmaster", "127.0.0.1", "7000", "2"), "Duplicated")
+
+	// Not down for this sentinel, the first candidate of an epoch gets the vote
+	require.Equal(t, "*3\r\n:0\r\n$1\r\n*\r\n:0\r\n", sentinelArgs(t, "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "7000", "0", "*"))
+	require.Equal(t, "*3\r\n:0\r\n$1\r\na\r\n:1\r\n", sentinelArgs(t, "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "7000", "1", "a"))
+	require.Equal(t, "*3\r\n:0\r\n$1\r\na\r\n:1\r\n", sentinelArgs(t, "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "7000", "1", "b"))
+	require.Equal(t, "*3\r\n:0\r\n$1\r\nb\r\n:2\r\n", sentinelArgs(t, "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "7000", "2", "b"))
+	require.Equal(t, "*3\r\n:0\r\n$1\r\n*\r\n:0\r\n", sentinelArgs(t, "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "7001", "3", "c"))
+
+	var leader string
+	var epoch int64
+	require.NoError(t, onExecutor(func() error {
+		master := sentinelMasters["testmaster"]
+		master.sentinels["b"] = &sentinelInstance{runId: "b", leader: "b", leaderEpoch: 2}
+		master.sentinels["c"] = &sentinelInstance{runId: "c", leader: "a", leaderEpoch: 2}
+		leader, epoch = master.electedLeader(2), currentEpoch
+		return nil
+	}))
+	require.Equal(t, "b", leader)
+	require.Equal(t, int64(2), epoch)
+}
+
+func TestSentinelHello(t *testing.T) {
+	monitorTestMaster(t)
+	client := NewClient()
+	sendCommand(client, "SUBSCRIBE +switch-master")
+	nextPush(t, client)
+	defer sendCommand(client, "UNSUBSCRIBE")
+
+	var sentinels int
+	require.NoError(t, onExecutor(func() error {
+		processHello("127.0.0.1,26380,other,3,testmaster,127.0.0.1,7000,0")
+		processHello("127.0.0.1,26381," + sentinelId + ",3,testmaster,127.0.0.1,7000,0")
+		sentinels = len(sentinelMasters["testmaster"].sentinels)
+		return nil
+	}))
+	require.Equal(t, 1, sentinels)
+	require.Contains(t, sentinelArgs(t, "SENTINELS", "testmaster"), "26380")
+
+	// A failover completed by another sentinel is taken over
+	require.NoError(t, onExecutor(func() error {
+		processHello("127.0.0.1,26380,other,4,testmaster,127.0.0.1,7001,4")
+		return nil
+	}))
+	require.Contains(t, nextPush(t, client), "testmaster 127.0.0.1 7000 127.0.0.1 7001")
+	require.Equal(t, "*2\r\n$9\r\n127.0.0.1\r\n$4\r\n7001\r\n", sentinelArgs(t, "GET-MASTER-ADDR-BY-NAME", "testmaster"))
+	require.Contains(t, sentinelArgs(t, "REPLICAS", "testmaster"), "127.0.0.1:7000")
+	require.Contains(t, sentinelArgs(t, "MASTER", "testmaster"), "config-epoch\r\n$1\r\n4")
+}
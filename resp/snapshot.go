@@ -0,0 +1,359 @@
+// Point in time snapshots in the Redis RDB format. Saving in the background
+// copies the entries on the executor and writes them from a goroutine, the
+// values themselves are never modified in place so they can be shared.
+// Storages on disk are not copied on the executor, they hand out a view of
+// their own that is read in the background.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/johanlantz/redis/rdb"
+	"github.com/johanlantz/redis/storage"
+)
+
+type savePolicy struct {
+	seconds int64
+	changes int64
+}
+
+var dbFilename = "dump.rdb"
+var savePolicies = []savePolicy{{3600, 1}, {300, 100}, {60, 10000}}
+
+// Writes since the last successful save.
+var dirty int64
+
+var lastSave = time.Now()
+var bgsaveInProgress = false
+var lastBgsaveFailed = false
+var lastBgsaveTry time.Time
+
+// A failed background save is not retried by the save policies right away.
+const bgsaveRetryDelay = 5 * time.Second
+
+func init() {
+	configParameters["dbfilename"] = configParameter{
+		get: func() string { return dbFilename },
+		set: func(value string) error {
+			if value == "" || filepath.Base(value) != value {
+				return errors.New("dbfilename can't be a path, just a filename")
+			}
+			dbFilename = value
+			return nil
+		},
+	}
+	configParameters["save"] = configParameter{
+		get: func() string {
+			parts := []string{}
+			for _, policy := range savePolicies {
+				parts = append(parts, fmt.Sprint(policy.seconds), fmt.Sprint(policy.changes))
+			}
+			return strings.Join(parts, " ")
+		},
+		set: func(value string) error {
+			fields := strings.Fields(value)
+			if len(fields)%2 != 0 {
+				return errors.New("save requires pairs of seconds and changes")
+			}
+			policies := []savePolicy{}
+			for i := 0; i < len(fields); i += 2 {
+				seconds, err := parseNonNegative(fields[i])
+				if err != nil {
+					return err
+				}
+				changes, err := parseNonNegative(fields[i+1])
+				if err != nil {
+					return err
+				}
+				policies = append(policies, savePolicy{seconds, changes})
+			}
+			savePolicies = policies
+			return nil
+		},
+	}
+}
+
+type snapshotEntry struct {
+	key   string
+	entry storage.Entry
+}
+
+// The entries of an in memory storage, copied on the executor.
+type memorySnapshot []snapshotEntry
+
+func (s memorySnapshot) Len() (int, int) {
+	volatile := 0
+	for _, e := range s {
+		if e.entry.ExpireAt != 0 {
+			volatile++
+		}
+	}
+	return len(s), volatile
+}
+
+func (s memorySnapshot) ForEach(fn func(key string, entry storage.Entry) error) error {
+	for _, e := range s {
+		if err := fn(e.key, e.entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s memorySnapshot) Close() {}
+
+// Storages that provide a point in time view without being copied on the
+// executor.
+type snapshottingStorage interface {
+	Snapshot() storage.Snapshot
+}
+
+// Must be called on the executor, the result can be read from any
+// goroutine and has to be closed with closeSnapshot.
+func snapshotDatabases() []storage.Snapshot {
+	snapshot := make([]storage.Snapshot, len(databases))
+	for i, db := range databases {
+		if snapshotting, ok := db.(snapshottingStorage); ok {
+			snapshot[i] = snapshotting.Snapshot()
+			continue
+		}
+		entries := memorySnapshot{}
+		db.ForEach(func(key string, entry storage.Entry) {
+			entries = append(entries, snapshotEntry{key, entry})
+		})
+		snapshot[i] = entries
+	}
+	return snapshot
+}
+
+func closeSnapshot(snapshot []storage.Snapshot) {
+	for _, db := range snapshot {
+		db.Close()
+	}
+}
+
+func snapshotLibraries() []string {
+	codes := []string{}
+	for _, library := range sortedLibraries() {
+		codes = append(codes, library.code)
+	}
+	return codes
+}
+
+// Storages that keep their data across restarts.
+type persistentStorage interface {
+	Persistent() bool
+}
+
+func persistentDatabases() bool {
+	persistent, ok := databases[0].(persistentStorage)
+	return ok && persistent.Persistent()
+}
+
+// The append only file is more complete than a snapshot and wins if enabled.
+// Persistent storages already hold the dataset, loading it again would
+// replay old writes on top of newer ones. The append only file is then
+// started over from the dataset instead.
+func loadDataset() error {
+	if persistentDatabases() {
+		if appendOnly {
+			return enableAppendOnly()
+		}
+		return nil
+	}
+	if appendOnly {
+		return startAppendOnly()
+	}
+	return loadSnapshot(filepath.Join(workingDir, dbFilename))
+}
+
+// Only strings can be stored, keys of other types are skipped so that dumps
+// of a real Redis can still seed the dataset with their strings. How many
+// were skipped is logged per type. Keys that expired while the server was
+// down are not loaded.
+func loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = loadSnapshotData(data); err != nil {
+		return fmt.Errorf("error loading %s: %w", path, err)
+	}
+	return nil
+}
+
+// Add the keys and libraries of an RDB payload to the dataset.
+func loadSnapshotData(data []byte) error {
+	now := time.Now().UnixMilli()
+	skipped := map[rdb.Kind]int{}
+	err := rdb.Parse(data, rdb.Handlers{
+		Function: func(code string) error {
+			_, err := loadLibrary(code, false)
+			return err
+		},
+		Key: func(db int, key string, value rdb.Object, expireAt int64) error {
+			if db >= len(databases) {
+				return fmt.Errorf("DB index %d is out of range", db)
+			}
+			if value.Kind != rdb.KindString {
+				skipped[value.Kind]++
+				return nil
+			}
+			if expireAt != 0 && expireAt <= now {
+				return nil
+			}
+			entry := stringEntry(value.String)
+			entry.ExpireAt = expireAt
+			return databases[db].Set(key, entry)
+		},
+	})
+	for kind, count := range skipped {
+		log.Printf("Skipped %d keys of type %s, only strings are supported", count, kind)
+	}
+	return err
+}
+
+// Written to a temporary file first so that a failed save never replaces
+// the previous snapshot.
+func writeSnapshot(path string, snapshot []storage.Snapshot, libraryCode []string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = encodeSnapshot(file, snapshot, libraryCode)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func encodeSnapshot(out io.Writer, snapshot []storage.Snapshot, libraryCode []string) error {
+	w := rdb.NewWriter(out)
+	err := w.WriteHeader()
+	for _, aux := range [][2]string{
+		{"redis-ver", serverVersion},
+		{"redis-bits", "64"},
+		{"ctime", fmt.Sprint(time.Now().Unix())},
+	} {
+		if err == nil {
+			err = w.WriteAux(aux[0], aux[1])
+		}
+	}
+	for _, code := range libraryCode {
+		if err == nil {
+			err = w.WriteFunction(code)
+		}
+	}
+	for db, entries := range snapshot {
+		keys, expires := entries.Len()
+		if keys == 0 || err != nil {
+			continue
+		}
+		if err = w.WriteSelectDB(db, keys, expires); err == nil {
+			err = entries.ForEach(func(key string, entry storage.Entry) error {
+				return w.WriteString(key, string(entry.Value), entry.ExpireAt)
+			})
+		}
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	return err
+}
+
+func save() error {
+	snapshot := snapshotDatabases()
+	defer closeSnapshot(snapshot)
+	if err := writeSnapshot(filepath.Join(workingDir, dbFilename), snapshot, snapshotLibraries()); err != nil {
+		return err
+	}
+	dirty = 0
+	lastSave = time.Now()
+	return nil
+}
+
+func bgsave() error {
+	if bgsaveInProgress {
+		return errors.New("Background save already in progress")
+	}
+	path := filepath.Join(workingDir, dbFilename)
+	snapshot, libraryCode := snapshotDatabases(), snapshotLibraries()
+	dirtyBefore := dirty
+	bgsaveInProgress, lastBgsaveTry = true, time.Now()
+	go func() {
+		err := writeSnapshot(path, snapshot, libraryCode)
+		closeSnapshot(snapshot)
+		taskChannel <- func() {
+			bgsaveInProgress = false
+			lastBgsaveFailed = err != nil
+			if err != nil {
+				log.Printf("Background saving error: %s", err.Error())
+				return
+			}
+			dirty -= dirtyBefore
+			lastSave = time.Now()
+			log.Printf("Background saving terminated with success")
+		}
+	}()
+	return nil
+}
+
+func saveCron() {
+	if bgsaveInProgress || (lastBgsaveFailed && time.Since(lastBgsaveTry) < bgsaveRetryDelay) {
+		return
+	}
+	for _, policy := range savePolicies {
+		if dirty >= policy.changes && time.Since(lastSave) >= time.Duration(policy.seconds)*time.Second {
+			log.Printf("%d changes in %d seconds. Saving...", policy.changes, policy.seconds)
+			bgsave()
+			return
+		}
+	}
+}
+
+func process_save(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 0 {
+		return nil, errors.New("save command takes no arguments")
+	}
+	if bgsaveInProgress {
+		return nil, errors.New("Background save already in progress")
+	}
+	if err := save(); err != nil {
+		return nil, err
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+// Saving and rewriting the append only file can run at the same time so
+// SCHEDULE is accepted but never needed.
+func process_bgsave(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) > 1 || (len(request.args) == 1 && strings.ToUpper(request.args[0]) != "SCHEDULE") {
+		return nil, errors.New("syntax error")
+	}
+	if err := bgsave(); err != nil {
+		return nil, err
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{"Background saving started"}), nil
+}
+
+func process_lastsave(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return newRespResponse(DT_INTEGER, []string{fmt.Sprint(lastSave.Unix())}), nil
+}
@@ -0,0 +1,117 @@
+package resp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/rdb"
+	"github.com/johanlantz/redis/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	sendArgs(NewClient(), "CONFIG", "SET", "dir", dir)
+	defer sendArgs(NewClient(), "CONFIG", "SET", "dir", ".")
+
+	client := NewClient()
+	sendCommand(client, "SELECT 14")
+	sendCommand(client, "SET savedString hello")
+	sendCommand(client, "SET savedInteger 42")
+	sendCommand(client, "SET savedVolatile 1")
+	sendCommand(client, "EXPIRE savedVolatile 100")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "SAVE"))
+	require.Equal(t, fmt.Sprintf(":%d\r\n", time.Now().Unix()), sendCommand(client, "LASTSAVE"))
+
+	sendCommand(client, "FLUSHDB")
+	sendCommand(client, "FUNCTION FLUSH")
+	require.NoError(t, onExecutor(func() error { return loadSnapshot(filepath.Join(dir, "dump.rdb")) }))
+	require.Equal(t, "+hello\r\n", sendCommand(client, "GET savedString"))
+	require.Equal(t, ":42\r\n", sendCommand(client, "GET savedInteger"))
+	require.Equal(t, ":100\r\n", sendCommand(client, "TTL savedVolatile"))
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestBgsave(t *testing.T) {
+	dir := t.TempDir()
+	sendArgs(NewClient(), "CONFIG", "SET", "dir", dir)
+	defer sendArgs(NewClient(), "CONFIG", "SET", "dir", ".")
+	sendArgs(NewClient(), "CONFIG", "SET", "dbfilename", "background.rdb")
+	defer sendArgs(NewClient(), "CONFIG", "SET", "dbfilename", "dump.rdb")
+
+	client := NewClient()
+	require.Contains(t, sendCommand(client, "BGSAVE NOW"), "syntax error")
+	require.Equal(t, "+Background saving started\r\n", sendCommand(client, "BGSAVE"))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "background.rdb"))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSnapshotDiskStorage(t *testing.T) {
+	useDiskStorage(t, filepath.Join(t.TempDir(), "bolt.db"))
+	client := NewClient()
+	sendCommand(client, "SET diskKey before")
+
+	// The snapshot is read while the executor moves on
+	var snapshot []storage.Snapshot
+	onExecutor(func() error {
+		snapshot = snapshotDatabases()
+		return nil
+	})
+	var payload bytes.Buffer
+	encoded := make(chan error)
+	go func() {
+		err := encodeSnapshot(&payload, snapshot, nil)
+		closeSnapshot(snapshot)
+		encoded <- err
+	}()
+	sendCommand(client, "SET diskKey after")
+	require.NoError(t, <-encoded)
+
+	sendCommand(client, "FLUSHDB")
+	require.NoError(t, onExecutor(func() error { return loadSnapshotData(payload.Bytes()) }))
+	require.Equal(t, "+before\r\n", sendCommand(client, "GET diskKey"))
+
+	require.Contains(t, sendCommand(client, "CONFIG SET maxmemory 100mb"), "not supported by the disk storage")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CONFIG SET maxmemory 0"))
+}
+
+func TestLoadCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	require.NoError(t, os.WriteFile(path, []byte("REDIS0011\x00\x03k"), 0644))
+	require.Error(t, onExecutor(func() error { return loadSnapshot(path) }))
+	require.NoError(t, onExecutor(func() error { return loadSnapshot(path + ".missing") }))
+}
+
+func TestLoadUnsupportedSnapshotType(t *testing.T) {
+	payload := []byte("REDIS0011")
+	payload = append(payload, rdb.OpcodeSelectDB, 0, rdb.TypeList)
+	payload = rdb.AppendString(payload, "listKey")
+	payload = rdb.AppendLength(payload, 1)
+	payload = rdb.AppendString(payload, "element")
+	payload = append(payload, rdb.TypeString)
+	payload = rdb.AppendString(payload, "stringKey")
+	payload = rdb.AppendString(payload, "value")
+	payload = append(payload, rdb.OpcodeEOF, 0, 0, 0, 0, 0, 0, 0, 0)
+	require.NoError(t, onExecutor(func() error { return loadSnapshotData(payload) }))
+
+	client := NewClient()
+	require.Equal(t, "+value\r\n", sendCommand(client, "GET stringKey"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET listKey"))
+	sendCommand(client, "DEL stringKey")
+}
+
+func TestSaveConfig(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "*2\r\n$4\r\nsave\r\n$23\r\n3600 1 300 100 60 10000\r\n", sendCommand(client, "CONFIG GET save"))
+	require.Contains(t, sendArgs(client, "CONFIG", "SET", "save", "60"), "pairs")
+	require.Equal(t, "+OK\r\n", sendArgs(client, "CONFIG", "SET", "save", ""))
+	require.Equal(t, "*2\r\n$4\r\nsave\r\n$0\r\n\r\n", sendCommand(client, "CONFIG GET save"))
+	require.Equal(t, "+OK\r\n", sendArgs(client, "CONFIG", "SET", "save", "3600 1 300 100 60 10000"))
+	require.Contains(t, sendArgs(client, "CONFIG", "SET", "dbfilename", "../dump.rdb"), "filename")
+}
@@ -0,0 +1,253 @@
+// Client side caching. Clients with tracking enabled are told when keys
+// they have read, or keys matching their prefixes in broadcast mode, are
+// modified so they can drop them from their local cache.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const invalidationChannel = "__redis__:invalidate"
+
+type tracking struct {
+	enabled   bool
+	bcast     bool
+	optin     bool
+	optout    bool
+	noloop    bool
+	redirect  int64
+	prefixes  []string
+	caching   bool // CLIENT CACHING yes or no, applies to the next command only
+	cachingOn bool
+}
+
+// Commands whose first argument is a key that is read.
+var trackedReadCommands = map[RespCommand]bool{
+	RESP_GET: true, RESP_TTL: true, RESP_PTTL: true,
+}
+
+// Ids of the clients that have read a key, for the default mode.
+var trackingTable = map[string]map[int64]struct{}{}
+
+// Broadcasting clients per prefix, the empty prefix matches all keys.
+var trackingPrefixes = map[string]map[*Client]struct{}{}
+
+func (t *tracking) afterCommand(command RespCommand) {
+	if command != RESP_CLIENT {
+		t.caching = false
+	}
+}
+
+// In OPTIN mode only keys read right after CLIENT CACHING yes are tracked,
+// in OPTOUT mode all keys except those read right after CLIENT CACHING no.
+func (t *tracking) tracksReads() bool {
+	switch {
+	case !t.enabled || t.bcast:
+		return false
+	case t.optin:
+		return t.caching && t.cachingOn
+	case t.optout:
+		return !(t.caching && !t.cachingOn)
+	}
+	return true
+}
+
+func rememberTrackedKeys(client *Client, request *RespRequest) {
+	if !trackedReadCommands[request.command] || len(request.args) == 0 || !client.tracking.tracksReads() {
+		return
+	}
+	key := request.args[0]
+	if trackingTable[key] == nil {
+		trackingTable[key] = map[int64]struct{}{}
+	}
+	trackingTable[key][client.id] = struct{}{}
+}
+
+// Deliver an invalidation for keys, nil meaning all keys, to the client or
+// the client it redirects to.
+func sendInvalidation(client *Client, keys []string) {
+	var invalidated *RespResponse
+	if keys == nil {
+		invalidated = newRespResponse(DT_NULLS, []string{})
+	} else {
+		invalidated = newRespArrayResponse(bulkStrings(keys...))
+	}
+
+	target := client
+	if client.tracking.redirect != 0 {
+		target = lookupClient(client.tracking.redirect)
+		if target == nil {
+			client.push(bulkStrings("tracking-redir-broken", fmt.Sprint(client.tracking.redirect)))
+			return
+		}
+	}
+	if target.protocol >= 3 {
+		target.push([]*RespResponse{newRespResponse(DT_BULK_STRINGS, []string{"invalidate"}), invalidated})
+		return
+	}
+	// RESP2 clients receive invalidations as messages on a pub/sub channel
+	if _, subscribed := target.channels[invalidationChannel]; subscribed {
+		target.push(append(bulkStrings("message", invalidationChannel), invalidated))
+	}
+}
+
+func invalidateTrackedKey(key string) {
+	if ids, ok := trackingTable[key]; ok {
+		delete(trackingTable, key)
+		for id := range ids {
+			client := lookupClient(id)
+			if client == nil || !client.tracking.enabled || client.tracking.bcast {
+				continue
+			}
+			if client.tracking.noloop && client == currentClient {
+				continue
+			}
+			sendInvalidation(client, []string{key})
+		}
+	}
+	for prefix, clients := range trackingPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for client := range clients {
+			if client.tracking.noloop && client == currentClient {
+				continue
+			}
+			sendInvalidation(client, []string{key})
+		}
+	}
+}
+
+// Used when whole databases are flushed or swapped.
+func invalidateAllTrackedKeys() {
+	clientsById.Range(func(_, value any) bool {
+		if client := value.(*Client); client.tracking.enabled {
+			sendInvalidation(client, nil)
+		}
+		return true
+	})
+	clear(trackingTable)
+}
+
+func disableTracking(client *Client) {
+	for _, prefix := range client.tracking.prefixes {
+		delete(trackingPrefixes[prefix], client)
+		if len(trackingPrefixes[prefix]) == 0 {
+			delete(trackingPrefixes, prefix)
+		}
+	}
+	client.tracking = tracking{}
+}
+
+// CLIENT TRACKING on|off [REDIRECT id] [PREFIX prefix ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func clientTracking(client *Client, args []string) error {
+	if len(args) < 1 {
+		return errors.New("client tracking requires on or off")
+	}
+	settings := tracking{}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return errors.New("syntax error")
+			}
+			i++
+			id, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return errors.New("value is not an integer or out of range")
+			}
+			if id != client.id && lookupClient(id) == nil {
+				return errors.New("The client ID you want redirect to does not exist")
+			}
+			settings.redirect = id
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return errors.New("syntax error")
+			}
+			i++
+			settings.prefixes = append(settings.prefixes, args[i])
+		case "BCAST":
+			settings.bcast = true
+		case "OPTIN":
+			settings.optin = true
+		case "OPTOUT":
+			settings.optout = true
+		case "NOLOOP":
+			settings.noloop = true
+		default:
+			return errors.New("syntax error")
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "OFF":
+		disableTracking(client)
+		return nil
+	case "ON":
+	default:
+		return errors.New("syntax error")
+	}
+	if len(settings.prefixes) > 0 && !settings.bcast {
+		return errors.New("PREFIX option requires BCAST mode to be enabled")
+	}
+	if settings.optin && settings.optout {
+		return errors.New("You can't use both OPTIN and OPTOUT")
+	}
+	if settings.bcast && (settings.optin || settings.optout) {
+		return errors.New("OPTIN and OPTOUT are not compatible with BCAST")
+	}
+
+	disableTracking(client)
+	settings.enabled = true
+	if settings.bcast && len(settings.prefixes) == 0 {
+		settings.prefixes = []string{""}
+	}
+	for _, prefix := range settings.prefixes {
+		if trackingPrefixes[prefix] == nil {
+			trackingPrefixes[prefix] = map[*Client]struct{}{}
+		}
+		trackingPrefixes[prefix][client] = struct{}{}
+	}
+	client.tracking = settings
+	return nil
+}
+
+func process_client(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) < 1 {
+		return nil, errors.New("client command requires a subcommand")
+	}
+	client := request.client
+	args := request.args[1:]
+	switch strings.ToUpper(request.args[0]) {
+	case "ID":
+		return newRespResponse(DT_INTEGER, []string{fmt.Sprint(client.id)}), nil
+	case "TRACKING":
+		if err := clientTracking(client, args); err != nil {
+			return nil, err
+		}
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	case "CACHING":
+		if len(args) != 1 {
+			return nil, errors.New("client caching requires yes or no")
+		}
+		yes := strings.ToUpper(args[0]) == "YES"
+		if !yes && strings.ToUpper(args[0]) != "NO" {
+			return nil, errors.New("syntax error")
+		}
+		if (yes && !client.tracking.optin) || (!yes && !client.tracking.optout) {
+			return nil, errors.New("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+		}
+		client.tracking.caching, client.tracking.cachingOn = true, yes
+		return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+	case "GETREDIR":
+		redirect := int64(-1)
+		if client.tracking.enabled {
+			redirect = client.tracking.redirect
+		}
+		return newRespResponse(DT_INTEGER, []string{fmt.Sprint(redirect)}), nil
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'", request.args[0])
+}
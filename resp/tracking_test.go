@@ -0,0 +1,115 @@
+package resp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireNoPush(t *testing.T, client *Client) {
+	select {
+	case push := <-client.Pushes():
+		t.Fatalf("unexpected push %q", push)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTrackingDefaultMode(t *testing.T) {
+	reader := NewClient()
+	defer CloseClient(reader)
+	sendCommand(reader, "HELLO 3")
+	require.Equal(t, "+OK\r\n", sendCommand(reader, "CLIENT TRACKING on"))
+	require.Equal(t, ":-1\r\n", sendCommand(NewClient(), "CLIENT GETREDIR"))
+	require.Equal(t, ":0\r\n", sendCommand(reader, "CLIENT GETREDIR"))
+
+	writer := NewClient()
+	sendCommand(writer, "SET trackedKey 1")
+	requireNoPush(t, reader)
+
+	sendCommand(reader, "GET trackedKey")
+	sendCommand(writer, "SET trackedKey 2")
+	require.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$10\r\ntrackedKey\r\n", nextPush(t, reader))
+
+	// The key has to be read again to be tracked again
+	sendCommand(writer, "SET trackedKey 3")
+	requireNoPush(t, reader)
+
+	sendCommand(reader, "GET trackedKey")
+	sendCommand(writer, "FLUSHALL")
+	require.Equal(t, ">2\r\n$10\r\ninvalidate\r\n_\r\n", nextPush(t, reader))
+
+	require.Equal(t, "+OK\r\n", sendCommand(reader, "CLIENT TRACKING off"))
+	sendCommand(reader, "GET trackedKey")
+	sendCommand(writer, "SET trackedKey 4")
+	requireNoPush(t, reader)
+}
+
+func TestTrackingBroadcast(t *testing.T) {
+	client := NewClient()
+	defer CloseClient(client)
+	sendCommand(client, "HELLO 3")
+	require.Contains(t, sendCommand(client, "CLIENT TRACKING on PREFIX user:"), "requires BCAST")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLIENT TRACKING on BCAST PREFIX user: NOLOOP"))
+
+	sendCommand(NewClient(), "SET user:1 alice")
+	require.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n", nextPush(t, client))
+	sendCommand(NewClient(), "SET order:1 book")
+	requireNoPush(t, client)
+
+	// NOLOOP skips the client's own writes
+	sendCommand(client, "SET user:2 bob")
+	requireNoPush(t, client)
+}
+
+func TestTrackingOptInOptOut(t *testing.T) {
+	client := NewClient()
+	defer CloseClient(client)
+	sendCommand(client, "HELLO 3")
+	require.Contains(t, sendCommand(client, "CLIENT CACHING yes"), "OPTIN or OPTOUT")
+	require.Contains(t, sendCommand(client, "CLIENT TRACKING on OPTIN OPTOUT"), "both OPTIN and OPTOUT")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLIENT TRACKING on OPTIN"))
+
+	sendCommand(client, "GET optKey")
+	sendCommand(NewClient(), "SET optKey 1")
+	requireNoPush(t, client)
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLIENT CACHING yes"))
+	sendCommand(client, "GET optKey")
+	sendCommand(NewClient(), "SET optKey 2")
+	require.Contains(t, nextPush(t, client), "optKey")
+
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLIENT TRACKING on OPTOUT"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "CLIENT CACHING no"))
+	sendCommand(client, "GET optKey")
+	sendCommand(NewClient(), "SET optKey 3")
+	requireNoPush(t, client)
+
+	sendCommand(client, "GET optKey")
+	sendCommand(NewClient(), "SET optKey 4")
+	require.Contains(t, nextPush(t, client), "optKey")
+}
+
+func TestTrackingRedirect(t *testing.T) {
+	target := NewClient()
+	defer CloseClient(target)
+	sendCommand(target, "SUBSCRIBE __redis__:invalidate")
+	nextPush(t, target)
+
+	client := NewClient()
+	defer CloseClient(client)
+	require.Contains(t, sendCommand(client, "CLIENT TRACKING on REDIRECT 999999"), "does not exist")
+	require.Equal(t, "+OK\r\n", sendCommand(client, fmt.Sprintf("CLIENT TRACKING on REDIRECT %d", target.id)))
+	require.Equal(t, fmt.Sprintf(":%d\r\n", target.id), sendCommand(client, "CLIENT GETREDIR"))
+
+	sendCommand(client, "GET redirectedKey")
+	sendCommand(NewClient(), "SET redirectedKey 1")
+	require.Equal(t, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$13\r\nredirectedKey\r\n", nextPush(t, target))
+	requireNoPush(t, client)
+
+	CloseClient(target)
+	sendCommand(client, "GET redirectedKey")
+	sendCommand(NewClient(), "SET redirectedKey 2")
+	require.Contains(t, nextPush(t, client), "tracking-redir-broken")
+}
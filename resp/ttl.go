@@ -0,0 +1,107 @@
+// The EXPIRE family of commands, which set, query and remove the expiry
+// time of keys. How keys expire is up to the storages, see expire.go.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shared implementation for EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, unit
+// converts the timeout to milliseconds. Absolute timeouts are unix times.
+func setExpire(request *RespRequest, kv KVStorage, unit int64, absolute bool) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, fmt.Errorf("%s command requires key and timeout arguments", request.command)
+	}
+	key := request.args[0]
+	timeout, err := strconv.ParseInt(request.args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	now := time.Now().UnixMilli()
+	if timeout > math.MaxInt64/unit || timeout < math.MinInt64/unit || (!absolute && timeout*unit > math.MaxInt64-now) {
+		return nil, fmt.Errorf("invalid expire time in '%s' command", strings.ToLower(string(request.command)))
+	}
+	expireAt := timeout * unit
+	if !absolute {
+		expireAt += now
+	}
+	entry := kv.Get(key)
+	if entry.IsNull() {
+		return newRespResponse(DT_INTEGER, []string{"0"}), nil
+	}
+	if expireAt <= now {
+		if err := kv.Delete(key); err != nil {
+			return nil, err
+		}
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, request.client.db)
+		return newRespResponse(DT_INTEGER, []string{"1"}), nil
+	}
+	entry.ExpireAt = expireAt
+	if err := kv.Set(key, entry); err != nil {
+		return nil, err
+	}
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key, request.client.db)
+	return newRespResponse(DT_INTEGER, []string{"1"}), nil
+}
+
+// Shared implementation for TTL and PTTL, unit converts milliseconds to the reply unit.
+func getTtl(request *RespRequest, kv KVStorage, unit int64) (*RespResponse, error) {
+	if len(request.args) != 1 {
+		return nil, fmt.Errorf("%s command requires only key argument", request.command)
+	}
+	entry := kv.Get(request.args[0])
+	if entry.IsNull() {
+		return newRespResponse(DT_INTEGER, []string{"-2"}), nil
+	}
+	if entry.ExpireAt == 0 {
+		return newRespResponse(DT_INTEGER, []string{"-1"}), nil
+	}
+	remaining := entry.ExpireAt - time.Now().UnixMilli()
+	return newRespResponse(DT_INTEGER, []string{fmt.Sprint((remaining + unit - 1) / unit)}), nil
+}
+
+func process_expire(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return setExpire(request, kv, 1000, false)
+}
+
+func process_pexpire(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return setExpire(request, kv, 1, false)
+}
+
+func process_expireat(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return setExpire(request, kv, 1000, true)
+}
+
+func process_pexpireat(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return setExpire(request, kv, 1, true)
+}
+
+func process_ttl(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return getTtl(request, kv, 1000)
+}
+
+func process_pttl(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	return getTtl(request, kv, 1)
+}
+
+func process_persist(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 1 {
+		return nil, errors.New("persist command requires only key argument")
+	}
+	key := request.args[0]
+	entry := kv.Get(key)
+	if entry.IsNull() || entry.ExpireAt == 0 {
+		return newRespResponse(DT_INTEGER, []string{"0"}), nil
+	}
+	entry.ExpireAt = 0
+	if err := kv.Set(key, entry); err != nil {
+		return nil, err
+	}
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "persist", key, request.client.db)
+	return newRespResponse(DT_INTEGER, []string{"1"}), nil
+}
@@ -0,0 +1,50 @@
+package resp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpire(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, ":0\r\n", sendCommand(client, "EXPIRE missingExpireKey 10"))
+	require.Equal(t, ":-2\r\n", sendCommand(client, "TTL missingExpireKey"))
+
+	sendCommand(client, "SET expireKey value")
+	require.Equal(t, ":-1\r\n", sendCommand(client, "TTL expireKey"))
+	require.Equal(t, ":1\r\n", sendCommand(client, "EXPIRE expireKey 100"))
+	require.Equal(t, ":100\r\n", sendCommand(client, "TTL expireKey"))
+
+	require.Equal(t, ":1\r\n", sendCommand(client, "PERSIST expireKey"))
+	require.Equal(t, ":0\r\n", sendCommand(client, "PERSIST expireKey"))
+	require.Equal(t, ":-1\r\n", sendCommand(client, "TTL expireKey"))
+
+	require.Contains(t, sendCommand(client, "EXPIRE expireKey soon"), RESP_ERR)
+	require.Equal(t, "-ERR invalid expire time in 'expire' command\r\n", sendCommand(client, "EXPIRE expireKey 9223372036854775"))
+	require.Equal(t, "-ERR invalid expire time in 'pexpire' command\r\n", sendCommand(client, "PEXPIRE expireKey 9223372036854775807"))
+	require.Equal(t, "-ERR invalid expire time in 'expireat' command\r\n", sendCommand(client, "EXPIREAT expireKey -9223372036854776"))
+	require.Equal(t, ":-1\r\n", sendCommand(client, "TTL expireKey"))
+	require.Equal(t, ":1\r\n", sendCommand(client, "EXPIRE expireKey 0"))
+	require.Equal(t, "_\r\n", sendCommand(client, "GET expireKey"))
+}
+
+func TestPexpire(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SET pexpireKey 1")
+	require.Equal(t, ":1\r\n", sendCommand(client, "PEXPIRE pexpireKey 30"))
+	require.Equal(t, "+OK\r\n", sendCommand(client, "INCR pexpireKey"))
+	require.NotEqual(t, ":-1\r\n", sendCommand(client, "PTTL pexpireKey"))
+
+	time.Sleep(40 * time.Millisecond)
+	require.Equal(t, "_\r\n", sendCommand(client, "GET pexpireKey"))
+}
+
+func TestSetClearsExpire(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SET clearExpireKey 1")
+	sendCommand(client, "EXPIRE clearExpireKey 100")
+	sendCommand(client, "SET clearExpireKey 2")
+	require.Equal(t, ":-1\r\n", sendCommand(client, "TTL clearExpireKey"))
+}
@@ -0,0 +1,191 @@
+// WAIT and WAITAOF block the calling client until its writes have reached
+// enough replicas or are on disk. The executor carries on meanwhile, the
+// reply is sent once the condition holds or the timeout expires.
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/johanlantz/redis/utils"
+)
+
+// Returned by processors whose reply is sent later, the client has been
+// blocked by then.
+var errBlocked = errors.New("client blocked")
+
+type durabilityWait struct {
+	client   *Client
+	response chan<- []byte
+	timer    *time.Timer
+
+	// WAITAOF also asks for the local file and counts replicas that synced
+	// their file instead of those that received the writes
+	aof         bool
+	numLocal    int
+	numReplicas int
+
+	// The position of the last write of the client
+	offset    int64
+	aofOffset int64
+}
+
+var durabilityWaits []*durabilityWait
+
+// Replicas that acknowledged everything up to offset.
+func ackedReplicas(offset int64, fsynced bool) int {
+	count := 0
+	for _, replica := range replicas {
+		acked := replica.replica.ackOffset
+		if fsynced {
+			acked = replica.replica.fackOffset
+		}
+		if replica.replica.online && acked >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+func (w *durabilityWait) localSynced() int {
+	if aofFile != nil && aofFsyncedOffset() >= w.aofOffset {
+		return 1
+	}
+	return 0
+}
+
+func (w *durabilityWait) satisfied() bool {
+	if w.aof && w.localSynced() < w.numLocal {
+		return false
+	}
+	return ackedReplicas(w.offset, w.aof) >= w.numReplicas
+}
+
+func (w *durabilityWait) result() *RespResponse {
+	acked := integerResponse(ackedReplicas(w.offset, w.aof))
+	if !w.aof {
+		return acked
+	}
+	return newRespArrayResponse([]*RespResponse{integerResponse(w.localSynced()), acked})
+}
+
+// Block the client of the request until the wait is over. Inside a
+// transaction there is no blocking, the current state is replied instead.
+func blockForDurability(request *RespRequest, w *durabilityWait, timeout time.Duration) (*RespResponse, error) {
+	if w.satisfied() || request.client.multi {
+		return w.result(), nil
+	}
+	// Ask for acknowledgements now rather than waiting for the next ones
+	if len(replicas) > 0 {
+		feedReplicationStream(utils.MarshalArgsToResp(string(RESP_REPLCONF), "GETACK", "*"))
+	}
+	request.client.blocked = w
+	durabilityWaits = append(durabilityWaits, w)
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() {
+			taskChannel <- func() {
+				if w.client.blocked == w {
+					w.finish()
+				}
+			}
+		})
+	}
+	return nil, errBlocked
+}
+
+// Reply to the blocked client, from a goroutine since the network layer
+// may have given up on the connection already.
+func (w *durabilityWait) finish() {
+	unblockClient(w.client)
+	data := w.result().forProtocol(w.client.protocol).marshalToBytes()
+	go func() { w.response <- data }()
+}
+
+func unblockClient(client *Client) {
+	w := client.blocked
+	if w == nil {
+		return
+	}
+	client.blocked = nil
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	remaining := durabilityWaits[:0]
+	for _, other := range durabilityWaits {
+		if other != w {
+			remaining = append(remaining, other)
+		}
+	}
+	durabilityWaits = remaining
+}
+
+// Called when replicas acknowledge and periodically for the local file.
+func checkDurabilityWaits() {
+	for _, w := range append([]*durabilityWait(nil), durabilityWaits...) {
+		if w.satisfied() {
+			w.finish()
+		}
+	}
+}
+
+func parseWaitTimeout(arg string) (time.Duration, error) {
+	timeout, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errors.New("timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return 0, errors.New("timeout is negative")
+	}
+	return time.Duration(timeout) * time.Millisecond, nil
+}
+
+// WAIT numreplicas timeout
+func process_wait(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 2 {
+		return nil, errors.New("wrong number of arguments for 'wait' command")
+	}
+	if masterLink != nil {
+		return nil, errors.New("WAIT cannot be used with replica instances.")
+	}
+	numReplicas, err := strconv.Atoi(request.args[0])
+	if err != nil {
+		return nil, errors.New("value is not an integer or out of range")
+	}
+	timeout, err := parseWaitTimeout(request.args[1])
+	if err != nil {
+		return nil, err
+	}
+	w := &durabilityWait{client: request.client, numReplicas: numReplicas, offset: request.client.writeOffset}
+	return blockForDurability(request, w, timeout)
+}
+
+// WAITAOF numlocal numreplicas timeout
+func process_waitaof(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if len(request.args) != 3 {
+		return nil, errors.New("wrong number of arguments for 'waitaof' command")
+	}
+	if masterLink != nil {
+		return nil, errors.New("WAITAOF cannot be used with replica instances.")
+	}
+	numLocal, err := strconv.Atoi(request.args[0])
+	if err != nil || numLocal < 0 {
+		return nil, errors.New("value is out of range, must be positive")
+	}
+	numReplicas, err := strconv.Atoi(request.args[1])
+	if err != nil || numReplicas < 0 {
+		return nil, errors.New("value is out of range, must be positive")
+	}
+	timeout, err := parseWaitTimeout(request.args[2])
+	if err != nil {
+		return nil, err
+	}
+	if numLocal > 0 && aofFile == nil {
+		return nil, errors.New("WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+	w := &durabilityWait{
+		client: request.client, aof: true, numLocal: numLocal, numReplicas: numReplicas,
+		offset: request.client.writeOffset, aofOffset: request.client.aofWriteOffset,
+	}
+	return blockForDurability(request, w, timeout)
+}
@@ -0,0 +1,100 @@
+package resp
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johanlantz/redis/aof"
+	"github.com/johanlantz/redis/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// Send a command whose reply may be delayed, the reply arrives on the
+// returned channel.
+func sendBlockingCommand(client *Client, cmd string) <-chan []byte {
+	response := make(chan []byte, 1)
+	requestChannel <- NetworkRequest{ResponseChannel: response, Data: utils.MarshalToResp(cmd), Client: client}
+	return response
+}
+
+func TestWaitWithoutReplicas(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, ":0\r\n", sendCommand(client, "WAIT 0 0"))
+	start := time.Now()
+	require.Equal(t, ":0\r\n", sendCommand(client, "WAIT 1 50"))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Contains(t, sendCommand(client, "WAIT 1 -1"), "timeout is negative")
+
+	sendCommand(client, "MULTI")
+	sendCommand(client, "WAIT 1 0")
+	require.Equal(t, "*1\r\n:0\r\n", sendCommand(client, "EXEC"))
+}
+
+func TestWaitForReplica(t *testing.T) {
+	replica := NewClient()
+	defer CloseClient(replica)
+	sendCommand(replica, "PSYNC ? -1")
+	nextPush(t, replica)
+	nextPush(t, replica)
+
+	writer := NewClient()
+	sendCommand(writer, "SELECT 15")
+	sendCommand(writer, "SET waitKey 1")
+	var offset int64
+	require.NoError(t, onExecutor(func() error {
+		offset = replicationOffset
+		return nil
+	}))
+	response := sendBlockingCommand(writer, "WAIT 1 0")
+	require.Contains(t, nextPush(t, replica), "waitKey")
+	require.Contains(t, nextPush(t, replica), "GETACK")
+	select {
+	case <-response:
+		t.Fatal("WAIT returned before the replica acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Equal(t, "", sendCommand(replica, fmt.Sprintf("REPLCONF ACK %d", offset)))
+	select {
+	case reply := <-response:
+		require.Equal(t, ":1\r\n", string(reply))
+	case <-time.After(time.Second):
+		t.Fatal("WAIT did not return after the acknowledgement")
+	}
+
+	// The replica has no append only file on disk yet
+	require.Equal(t, "*2\r\n:0\r\n:0\r\n", sendCommand(writer, "WAITAOF 0 1 50"))
+	require.Equal(t, "", sendCommand(replica, fmt.Sprintf("REPLCONF ACK %d FACK %d", offset, offset)))
+	require.Equal(t, "*2\r\n:0\r\n:1\r\n", sendCommand(writer, "WAITAOF 0 1 0"))
+	sendCommand(writer, "FLUSHDB")
+}
+
+func TestWaitAof(t *testing.T) {
+	client := NewClient()
+	require.Contains(t, sendCommand(client, "WAITAOF 1 0 0"), "appendonly is disabled")
+
+	file, err := aof.Open(filepath.Join(t.TempDir(), "appendonly.aof"), aof.FsyncEverySec)
+	require.NoError(t, err)
+	onExecutor(func() error {
+		aofFile, aofSelectedDb, aofFileStart = file, -1, aofWritten
+		return nil
+	})
+	defer onExecutor(func() error {
+		stopAppendOnly()
+		return nil
+	})
+
+	sendCommand(client, "SELECT 15")
+	sendCommand(client, "SET waitAofKey 1")
+	// Synced within a second by the everysec policy
+	response := sendBlockingCommand(client, "WAITAOF 1 0 0")
+	select {
+	case reply := <-response:
+		require.Equal(t, "*2\r\n:1\r\n:0\r\n", string(reply))
+	case <-time.After(3 * time.Second):
+		t.Fatal("WAITAOF did not return after the fsync")
+	}
+	sendCommand(client, "FLUSHDB")
+}
@@ -0,0 +1,88 @@
+// Optimistic locking. The storages report every modified key and any client
+// watching that key gets flagged as dirty, which makes its next EXEC fail.
+package resp
+
+import (
+	"errors"
+)
+
+type watchedKey struct {
+	db  int
+	key string
+}
+
+// Clients watching a key, per database index. Like in Redis a watch stays
+// with its index when SWAPDB moves the data to another one.
+var watchedKeys = map[int]map[string][]*Client{}
+
+func touchWatchedKey(db int, key string) {
+	for _, client := range watchedKeys[db][key] {
+		client.dirty = true
+	}
+}
+
+// Flag all clients watching keys in db that exist either in db itself or in
+// other, used when the content of db is about to be replaced wholesale.
+func touchAllWatchedKeys(db int, other int) {
+	for key, clients := range watchedKeys[db] {
+		if databases[db].Get(key).IsNull() && databases[other].Get(key).IsNull() {
+			continue
+		}
+		for _, client := range clients {
+			client.dirty = true
+		}
+	}
+}
+
+func watchKey(client *Client, db int, key string) {
+	for _, watched := range client.watched {
+		if watched.db == db && watched.key == key {
+			return
+		}
+	}
+	// Drop an already expired value first so it does not dirty the client later
+	databases[db].Get(key)
+
+	if watchedKeys[db] == nil {
+		watchedKeys[db] = map[string][]*Client{}
+	}
+	watchedKeys[db][key] = append(watchedKeys[db][key], client)
+	client.watched = append(client.watched, watchedKey{db, key})
+}
+
+func unwatchAllKeys(client *Client) {
+	for _, watched := range client.watched {
+		clients := watchedKeys[watched.db][watched.key]
+		for i, c := range clients {
+			if c == client {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(watchedKeys[watched.db], watched.key)
+		} else {
+			watchedKeys[watched.db][watched.key] = clients
+		}
+	}
+	client.watched = nil
+	client.dirty = false
+}
+
+func process_watch(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	if request.client.multi {
+		return nil, errors.New("WATCH inside MULTI is not allowed")
+	}
+	if len(request.args) < 1 {
+		return nil, errors.New("watch command requires at least one key argument")
+	}
+	for _, key := range request.args {
+		watchKey(request.client, request.client.db, key)
+	}
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
+
+func process_unwatch(request *RespRequest, kv KVStorage) (*RespResponse, error) {
+	unwatchAllKeys(request.client)
+	return newRespResponse(DT_SIMPLE_STRING, []string{RESP_OK}), nil
+}
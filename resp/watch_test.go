@@ -0,0 +1,96 @@
+package resp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchUntouched(t *testing.T) {
+	client := NewClient()
+	require.Equal(t, "+OK\r\n", sendCommand(client, "WATCH watchKey"))
+	sendCommand(client, "MULTI")
+	sendCommand(client, "SET watchKey mine")
+	require.Equal(t, "*1\r\n+OK\r\n", sendCommand(client, "EXEC"))
+}
+
+func TestWatchModifiedByOtherClient(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SET casKey 1")
+	sendCommand(client, "WATCH casKey")
+	sendCommand(NewClient(), "INCR casKey")
+
+	sendCommand(client, "MULTI")
+	sendCommand(client, "SET casKey 10")
+	require.Equal(t, "_\r\n", sendCommand(client, "EXEC"))
+	require.Equal(t, ":2\r\n", sendCommand(client, "GET casKey"))
+
+	// EXEC always unwatches so the next transaction succeeds
+	sendCommand(client, "MULTI")
+	sendCommand(client, "SET casKey 10")
+	require.Equal(t, "*1\r\n+OK\r\n", sendCommand(client, "EXEC"))
+}
+
+func TestUnwatch(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "WATCH unwatchKey")
+	sendCommand(NewClient(), "SET unwatchKey other")
+	require.Equal(t, "+OK\r\n", sendCommand(client, "UNWATCH"))
+	sendCommand(client, "MULTI")
+	sendCommand(client, "SET unwatchKey mine")
+	require.Equal(t, "*1\r\n+OK\r\n", sendCommand(client, "EXEC"))
+}
+
+func TestWatchInsideMulti(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "MULTI")
+	require.Contains(t, sendCommand(client, "WATCH someKey"), "not allowed")
+	require.Equal(t, "*0\r\n", sendCommand(client, "EXEC"))
+}
+
+func TestWatchExpiredKey(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SET expiringWatchKey 1")
+	sendCommand(client, "PEXPIRE expiringWatchKey 20")
+	sendCommand(client, "WATCH expiringWatchKey")
+	time.Sleep(30 * time.Millisecond)
+
+	sendCommand(client, "MULTI")
+	sendCommand(client, "GET expiringWatchKey")
+	require.Equal(t, "_\r\n", sendCommand(client, "EXEC"))
+}
+
+func TestWatchFlush(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SELECT 7")
+	sendCommand(client, "SET flushWatchKey 1")
+	sendCommand(client, "WATCH flushWatchKey")
+	other := NewClient()
+	sendCommand(other, "SELECT 7")
+	sendCommand(other, "FLUSHDB")
+
+	sendCommand(client, "MULTI")
+	sendCommand(client, "SET flushWatchKey 2")
+	require.Equal(t, "_\r\n", sendCommand(client, "EXEC"))
+	sendCommand(client, "FLUSHDB")
+}
+
+func TestWatchAfterSwapdb(t *testing.T) {
+	client := NewClient()
+	sendCommand(client, "SELECT 8")
+	sendCommand(client, "WATCH swapWatchKey")
+	other := NewClient()
+	sendCommand(other, "SWAPDB 8 9")
+
+	// The watch stays with database 8, whatever data it holds now
+	sendCommand(other, "SELECT 8")
+	sendCommand(other, "SET swapWatchKey 1")
+	sendCommand(client, "MULTI")
+	sendCommand(client, "SET swapWatchKey 2")
+	require.Equal(t, "_\r\n", sendCommand(client, "EXEC"))
+
+	sendCommand(other, "SWAPDB 8 9")
+	sendCommand(other, "FLUSHDB")
+	sendCommand(client, "FLUSHDB")
+}
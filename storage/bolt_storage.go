@@ -0,0 +1,478 @@
+// Disk backed storage on top of bbolt, an embedded B+tree. Only the pages
+// in use are held in memory so the dataset can be larger than RAM, and it
+// survives restarts without a snapshot or append only file.
+// Like SimpleStorage it relies on the resp processor for sequential access.
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every logical database has a bucket for its entries and one with the
+// expiry times of its volatile keys. Buckets are named after the index of
+// the database they were created for, SWAPDB records the index they moved
+// to in the positions bucket.
+type BoltStorage struct {
+	db       *bolt.DB
+	file     *boltFile
+	position int
+	data     []byte
+	expires  []byte
+	listener Listener
+	// Where the next active expiry continues scanning
+	expireCursor []byte
+	done         chan struct{}
+}
+
+// Shared by the databases of one file.
+type boltFile struct {
+	sync.Mutex
+	// Counts the write transactions, snapshots taken without a write in
+	// between share their copy of the file
+	writes   int64
+	snapshot *boltCopy
+}
+
+// Open count databases stored in one file. Commits are not synced to disk
+// individually but once per second, like the everysec policy of the
+// append only file.
+func OpenBoltStorages(path string, count int) ([]*BoltStorage, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, NoSync: true})
+	if err != nil {
+		return nil, err
+	}
+	storages := make([]*BoltStorage, count)
+	err = db.Update(func(tx *bolt.Tx) error {
+		positions, err := tx.CreateBucketIfNotExists(positionsBucket)
+		if err != nil {
+			return err
+		}
+		used := map[string]bool{}
+		for i := range storages {
+			name := fmt.Sprintf("db%d", i)
+			if moved := positions.Get([]byte(fmt.Sprint(i))); moved != nil {
+				name = string(moved)
+			}
+			if used[name] {
+				return fmt.Errorf("database positions are corrupt, %s is used twice", name)
+			}
+			used[name] = true
+			storages[i] = &BoltStorage{db: db, position: i, data: []byte(name), expires: []byte(name + "-expires")}
+			for _, bucket := range [][]byte{storages[i].data, storages[i].expires} {
+				if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	done, file := make(chan struct{}), &boltFile{}
+	for _, storage := range storages {
+		storage.done, storage.file = done, file
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := db.Sync(); err != nil {
+					log.Printf("Error syncing the storage: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return storages, nil
+}
+
+// Database index to bucket name, for the databases swapped by SwapWith.
+var positionsBucket = []byte("positions")
+
+// Swap the indexes of this database and other, which must have been opened
+// by the same OpenBoltStorages, so that the swap survives a restart.
+func (kv *BoltStorage) SwapWith(other any) error {
+	swapped, ok := other.(*BoltStorage)
+	if !ok || swapped.db != kv.db {
+		return errors.New("only databases of the same file can be swapped")
+	}
+	err := kv.update(func(tx *bolt.Tx) error {
+		positions := tx.Bucket(positionsBucket)
+		if err := positions.Put([]byte(fmt.Sprint(kv.position)), swapped.data); err != nil {
+			return err
+		}
+		return positions.Put([]byte(fmt.Sprint(swapped.position)), kv.data)
+	})
+	if err != nil {
+		return err
+	}
+	kv.position, swapped.position = swapped.position, kv.position
+	return nil
+}
+
+// Close the file shared by all databases returned by the same OpenBoltStorages.
+func (kv *BoltStorage) Close() error {
+	select {
+	case <-kv.done:
+		return nil
+	default:
+		close(kv.done)
+	}
+	if err := kv.db.Sync(); err != nil {
+		kv.db.Close()
+		return err
+	}
+	return kv.db.Close()
+}
+
+// Data survives restarts, the server does not have to load it.
+func (kv *BoltStorage) Persistent() bool {
+	return true
+}
+
+func (kv *BoltStorage) SetListener(listener Listener) {
+	kv.listener = listener
+}
+
+func (kv *BoltStorage) notify(key string, event KeyEvent) {
+	if kv.listener != nil {
+		kv.listener(key, event)
+	}
+}
+
+// Failed writes are returned to the command that made them. Nothing was
+// changed in that case since the transaction was rolled back.
+func (kv *BoltStorage) update(fn func(tx *bolt.Tx) error) error {
+	kv.file.writes++
+	if err := kv.db.Update(fn); err != nil {
+		return fmt.Errorf("error writing to the storage: %w", err)
+	}
+	return nil
+}
+
+// Reads have no way to report an error, a failed read finds nothing.
+func (kv *BoltStorage) view(fn func(tx *bolt.Tx) error) {
+	if err := kv.db.View(fn); err != nil {
+		log.Printf("Error reading from the storage: %s", err.Error())
+	}
+}
+
+// Stored as data type, expiry time and value. The value is copied since
+// bbolt memory is only valid during the transaction.
+func encodeEntry(entry Entry) []byte {
+	encoded := make([]byte, 0, 9+len(entry.Value))
+	encoded = append(encoded, entry.DataType)
+	encoded = binary.BigEndian.AppendUint64(encoded, uint64(entry.ExpireAt))
+	return append(encoded, entry.Value...)
+}
+
+func decodeEntry(encoded []byte) Entry {
+	if len(encoded) < 9 {
+		return Entry{}
+	}
+	return Entry{
+		DataType: encoded[0],
+		ExpireAt: int64(binary.BigEndian.Uint64(encoded[1:9])),
+		Value:    bytes.Clone(encoded[9:]),
+	}
+}
+
+// Expired entries are removed lazily when they are accessed.
+func (kv *BoltStorage) Get(key string) Entry {
+	var entry Entry
+	kv.view(func(tx *bolt.Tx) error {
+		entry = decodeEntry(tx.Bucket(kv.data).Get([]byte(key)))
+		return nil
+	})
+	if entry.IsExpired(time.Now().UnixMilli()) {
+		kv.expire([]string{key})
+		return Entry{}
+	}
+	return entry
+}
+
+func (kv *BoltStorage) Set(key string, value Entry) error {
+	err := kv.update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(kv.data).Put([]byte(key), encodeEntry(value)); err != nil {
+			return err
+		}
+		if value.ExpireAt != 0 {
+			return tx.Bucket(kv.expires).Put([]byte(key), binary.BigEndian.AppendUint64(nil, uint64(value.ExpireAt)))
+		}
+		return tx.Bucket(kv.expires).Delete([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+	kv.notify(key, KeyModified)
+	return nil
+}
+
+func (kv *BoltStorage) Delete(key string) error {
+	err := kv.update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(kv.data).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(kv.expires).Delete([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+	kv.notify(key, KeyModified)
+	return nil
+}
+
+// Expired keys that could not be removed stay invisible and are tried
+// again later.
+func (kv *BoltStorage) expire(keys []string) {
+	err := kv.update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := tx.Bucket(kv.data).Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(kv.expires).Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error removing expired keys: %s", err.Error())
+		return
+	}
+	for _, key := range keys {
+		kv.notify(key, KeyExpired)
+	}
+}
+
+// Active expiry, checks at most limit volatile keys and removes the ones
+// that have expired. Keys are sorted so every call continues where the
+// previous one stopped, starting over once the end is reached.
+func (kv *BoltStorage) DeleteExpired(limit int) int {
+	now := time.Now().UnixMilli()
+	expired := []string{}
+	kv.view(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(kv.expires).Cursor()
+		key, value := cursor.Seek(kv.expireCursor)
+		for checked := 0; key != nil && checked < limit; checked++ {
+			if int64(binary.BigEndian.Uint64(value)) <= now {
+				expired = append(expired, string(key))
+			}
+			key, value = cursor.Next()
+		}
+		kv.expireCursor = bytes.Clone(key)
+		return nil
+	})
+	if len(expired) > 0 {
+		kv.expire(expired)
+	}
+	return len(expired)
+}
+
+// Remove all keys. Dropping a bucket only releases its pages, so there is
+// nothing left to do in the background for an async flush.
+func (kv *BoltStorage) Flush(async bool) error {
+	err := kv.update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{kv.data, kv.expires} {
+			if err := tx.DeleteBucket(bucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	kv.expireCursor = nil
+	return nil
+}
+
+// Entries live on disk and pages are cached by the operating system, so
+// none of the memory is attributed to the dataset. maxmemory is therefore
+// refused for this storage, see evict.go.
+func (kv *BoltStorage) UsedMemory() int64 {
+	return 0
+}
+
+// Up to count consecutive entries from a random position. Access
+// statistics are not kept on disk.
+func (kv *BoltStorage) Sample(count int, volatileOnly bool) map[string]Entry {
+	sample := make(map[string]Entry, count)
+	kv.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(kv.data)
+		if volatileOnly {
+			bucket = tx.Bucket(kv.expires)
+		}
+		cursor := bucket.Cursor()
+		key, _ := cursor.Seek([]byte{byte(rand.Intn(256))})
+		if key == nil {
+			key, _ = cursor.First()
+		}
+		for ; key != nil && len(sample) < count; key, _ = cursor.Next() {
+			sample[string(key)] = decodeEntry(tx.Bucket(kv.data).Get(key))
+		}
+		return nil
+	})
+	return sample
+}
+
+// A read transaction sees the storage as it was when it began. Encoding
+// the snapshot from it would keep it open for as long as that takes, and
+// writers that need to grow the file wait for open read transactions. The
+// file is therefore copied as of the transaction by the first reader and
+// the snapshot is read from that copy, which is removed once closed.
+func (kv *BoltStorage) Snapshot() Snapshot {
+	kv.file.Lock()
+	defer kv.file.Unlock()
+	if kv.file.snapshot == nil || kv.file.snapshot.writes != kv.file.writes {
+		source, err := kv.db.Begin(false)
+		kv.file.snapshot = &boltCopy{file: kv.file, source: source, writes: kv.file.writes, err: err}
+	}
+	kv.file.snapshot.refs++
+	return &boltSnapshot{copy: kv.file.snapshot, data: kv.data, expires: kv.expires}
+}
+
+type boltCopy struct {
+	file   *boltFile
+	source *bolt.Tx
+	writes int64
+	// Guarded by the mutex of file
+	refs int
+
+	once sync.Once
+	db   *bolt.DB
+	path string
+	err  error
+}
+
+func (c *boltCopy) open() error {
+	c.once.Do(func() {
+		if c.err == nil {
+			c.err = c.copy()
+			c.source.Rollback()
+		}
+	})
+	return c.err
+}
+
+func (c *boltCopy) copy() error {
+	file, err := os.CreateTemp(filepath.Dir(c.source.DB().Path()), "temp-snapshot-")
+	if err != nil {
+		return err
+	}
+	c.path = file.Name()
+	_, err = c.source.WriteTo(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	c.db, err = bolt.Open(c.path, 0600, &bolt.Options{ReadOnly: true})
+	return err
+}
+
+func (c *boltCopy) release() {
+	c.file.Lock()
+	c.refs--
+	last := c.refs == 0
+	if last && c.file.snapshot == c {
+		c.file.snapshot = nil
+	}
+	c.file.Unlock()
+	if !last {
+		return
+	}
+	c.once.Do(func() {
+		if c.err == nil {
+			c.source.Rollback()
+		}
+	})
+	if c.db != nil {
+		c.db.Close()
+	}
+	if c.path != "" {
+		os.Remove(c.path)
+	}
+}
+
+// Every snapshot reads the copy with a transaction of its own since
+// transactions must not be shared between goroutines.
+type boltSnapshot struct {
+	copy    *boltCopy
+	tx      *bolt.Tx
+	data    []byte
+	expires []byte
+	err     error
+}
+
+func (s *boltSnapshot) begin() error {
+	if s.tx == nil && s.err == nil {
+		if s.err = s.copy.open(); s.err == nil {
+			s.tx, s.err = s.copy.db.Begin(false)
+		}
+	}
+	return s.err
+}
+
+// Nothing is counted if the copy failed, ForEach reports the error.
+func (s *boltSnapshot) Len() (int, int) {
+	if s.begin() != nil {
+		return 0, 0
+	}
+	return s.tx.Bucket(s.data).Stats().KeyN, s.tx.Bucket(s.expires).Stats().KeyN
+}
+
+func (s *boltSnapshot) ForEach(fn func(key string, entry Entry) error) error {
+	if err := s.begin(); err != nil {
+		return fmt.Errorf("error copying the storage: %w", err)
+	}
+	now := time.Now().UnixMilli()
+	return s.tx.Bucket(s.data).ForEach(func(key []byte, value []byte) error {
+		if entry := decodeEntry(value); !entry.IsExpired(now) {
+			return fn(string(key), entry)
+		}
+		return nil
+	})
+}
+
+func (s *boltSnapshot) Close() {
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+	s.copy.release()
+}
+
+// Visit every entry that has not expired. The entries must not be modified
+// from fn.
+func (kv *BoltStorage) ForEach(fn func(key string, entry Entry)) {
+	now := time.Now().UnixMilli()
+	kv.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(kv.data).ForEach(func(key []byte, value []byte) error {
+			if entry := decodeEntry(value); !entry.IsExpired(now) {
+				fn(string(key), entry)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func openBolt(t *testing.T, path string, count int) []*BoltStorage {
+	storages, err := OpenBoltStorages(path, count)
+	require.NoError(t, err)
+	t.Cleanup(func() { storages[0].Close() })
+	return storages
+}
+
+func TestBoltSetGetDelete(t *testing.T) {
+	storage := openBolt(t, filepath.Join(t.TempDir(), "bolt.db"), 1)[0]
+	require.Condition(t, storage.Get("masterKey").IsNull)
+
+	storage.Set("masterKey", Entry{DataType: '+', Value: []byte("hello")})
+	entry := storage.Get("masterKey")
+	require.Equal(t, []byte("hello"), entry.Value)
+	require.Equal(t, byte('+'), entry.DataType)
+
+	storage.Delete("masterKey")
+	require.Condition(t, storage.Get("masterKey").IsNull)
+}
+
+func TestBoltPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bolt.db")
+	storages, err := OpenBoltStorages(path, 2)
+	require.NoError(t, err)
+	expireAt := time.Now().UnixMilli() + 10000
+	storages[0].Set("a", Entry{DataType: ':', Value: []byte("1"), ExpireAt: expireAt})
+	storages[1].Set("b", Entry{DataType: '+', Value: []byte("2")})
+	require.NoError(t, storages[0].Close())
+
+	storages = openBolt(t, path, 2)
+	require.Equal(t, Entry{DataType: ':', Value: []byte("1"), ExpireAt: expireAt}, storages[0].Get("a"))
+	require.Condition(t, storages[0].Get("b").IsNull)
+	require.Equal(t, []byte("2"), storages[1].Get("b").Value)
+	require.True(t, storages[0].Persistent())
+}
+
+func TestBoltSwap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bolt.db")
+	storages, err := OpenBoltStorages(path, 3)
+	require.NoError(t, err)
+	storages[0].Set("a", Entry{DataType: '+', Value: []byte("1")})
+	storages[2].Set("c", Entry{DataType: '+', Value: []byte("3")})
+	// Like SWAPDB does it
+	swap := func(i, j int) {
+		require.NoError(t, storages[i].SwapWith(storages[j]))
+		storages[i], storages[j] = storages[j], storages[i]
+	}
+	swap(0, 2)
+	swap(2, 1)
+	require.NoError(t, storages[0].Close())
+
+	// Index 0 has the data of 2 and the data of 0 ended up at 1
+	storages = openBolt(t, path, 3)
+	require.Equal(t, []byte("3"), storages[0].Get("c").Value)
+	require.Equal(t, []byte("1"), storages[1].Get("a").Value)
+	require.Condition(t, storages[2].Get("a").IsNull)
+	require.Error(t, storages[0].SwapWith(NewSimpleStorage()))
+}
+
+func TestBoltFlush(t *testing.T) {
+	storages := openBolt(t, filepath.Join(t.TempDir(), "bolt.db"), 2)
+	for _, async := range []bool{false, true} {
+		storages[0].Set("a", Entry{DataType: '+', Value: []byte("1")})
+		storages[1].Set("b", Entry{DataType: '+', Value: []byte("2")})
+		storages[0].Flush(async)
+		require.Condition(t, storages[0].Get("a").IsNull)
+		require.False(t, storages[1].Get("b").IsNull())
+	}
+}
+
+func TestBoltExpiry(t *testing.T) {
+	storage := openBolt(t, filepath.Join(t.TempDir(), "bolt.db"), 1)[0]
+	var expired []string
+	storage.SetListener(func(key string, event KeyEvent) {
+		if event == KeyExpired {
+			expired = append(expired, key)
+		}
+	})
+	past := time.Now().UnixMilli() - 1
+	storage.Set("lazy", Entry{DataType: '+', Value: []byte("1"), ExpireAt: past})
+	storage.Set("active", Entry{DataType: '+', Value: []byte("1"), ExpireAt: past})
+	storage.Set("later", Entry{DataType: '+', Value: []byte("1"), ExpireAt: past + 10000})
+	storage.Set("persistent", Entry{DataType: '+', Value: []byte("1")})
+
+	require.Condition(t, storage.Get("lazy").IsNull)
+	require.Equal(t, []string{"lazy"}, expired)
+
+	require.Equal(t, 1, storage.DeleteExpired(10))
+	require.Equal(t, []string{"lazy", "active"}, expired)
+	require.Equal(t, 0, storage.DeleteExpired(10))
+	require.False(t, storage.Get("persistent").IsNull())
+	require.False(t, storage.Get("later").IsNull())
+}
+
+func TestBoltForEach(t *testing.T) {
+	storage := openBolt(t, filepath.Join(t.TempDir(), "bolt.db"), 1)[0]
+	storage.Set("a", Entry{DataType: '+', Value: []byte("1")})
+	storage.Set("b", Entry{DataType: '+', Value: []byte("2"), ExpireAt: time.Now().UnixMilli() - 1})
+	visited := map[string]string{}
+	storage.ForEach(func(key string, entry Entry) {
+		visited[key] = string(entry.Value)
+	})
+	require.Equal(t, map[string]string{"a": "1"}, visited)
+}
+
+func TestBoltSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	storages := openBolt(t, filepath.Join(dir, "bolt.db"), 2)
+	storages[0].Set("a", Entry{DataType: '+', Value: []byte("before")})
+	first, second := storages[0].Snapshot(), storages[1].Snapshot()
+	keys, _ := first.Len()
+	require.Equal(t, 1, keys)
+
+	// Once copied, writes that grow the file do not wait for the snapshot
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		large := Entry{DataType: '+', Value: make([]byte, 1024*1024)}
+		for i := 0; i < 64; i++ {
+			storages[0].Set(fmt.Sprint("large", i), large)
+		}
+		storages[0].Set("a", Entry{DataType: '+', Value: []byte("after")})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes are blocked by the snapshot")
+	}
+
+	visited := map[string]string{}
+	require.NoError(t, first.ForEach(func(key string, entry Entry) error {
+		visited[key] = string(entry.Value)
+		return nil
+	}))
+	require.Equal(t, map[string]string{"a": "before"}, visited)
+	keys, _ = second.Len()
+	require.Equal(t, 0, keys)
+
+	// Both snapshots share one copy, removed with the last of them
+	copies, _ := filepath.Glob(filepath.Join(dir, "temp-snapshot-*"))
+	require.Len(t, copies, 1)
+	first.Close()
+	second.Close()
+	copies, _ = filepath.Glob(filepath.Join(dir, "temp-snapshot-*"))
+	require.Empty(t, copies)
+}
+
+func TestBoltWriteErrors(t *testing.T) {
+	storages, err := OpenBoltStorages(filepath.Join(t.TempDir(), "bolt.db"), 2)
+	require.NoError(t, err)
+	require.NoError(t, storages[0].Close())
+	require.Error(t, storages[0].Set("a", Entry{DataType: '+', Value: []byte("1")}))
+	require.Error(t, storages[0].Delete("a"))
+	require.Error(t, storages[0].Flush(false))
+	require.Error(t, storages[0].SwapWith(storages[1]))
+	require.Equal(t, 0, storages[0].position)
+}
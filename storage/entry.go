@@ -1,10 +1,97 @@
 package storage
 
+import (
+	"math/rand"
+	"time"
+)
+
 type Entry struct {
 	DataType byte
 	Value    []byte
+	ExpireAt int64 // Unix time in milliseconds, 0 means the entry never expires
+
+	// Access statistics for eviction, maintained by storages that support it
+	LastAccess int64 // Unix time in milliseconds
+	Frequency  uint8 // Logarithmic access counter
 }
 
 func (se Entry) IsNull() bool {
 	return se.DataType == 0
 }
+
+func (se Entry) IsExpired(now int64) bool {
+	return se.ExpireAt != 0 && se.ExpireAt <= now
+}
+
+// Approximate memory used by a key and its entry, including the bookkeeping
+// of the storage.
+func EntrySize(key string, entry Entry) int64 {
+	const entryOverhead = 64
+	size := int64(len(key) + len(entry.Value) + entryOverhead)
+	if entry.ExpireAt != 0 {
+		size += int64(len(key)) + 16
+	}
+	return size
+}
+
+// Tuning of the logarithmic access counter, the same as the lfu-log-factor
+// and lfu-decay-time settings of Redis.
+var LFULogFactor = 10
+var LFUDecayTime = 1 // minutes
+
+// New keys start with some accesses so they are not evicted right away.
+const LFUInitValue = 5
+
+// The counter is decremented by one for every LFUDecayTime minutes the key
+// has not been accessed.
+func DecayedFrequency(entry Entry, now int64) uint8 {
+	if LFUDecayTime == 0 || entry.LastAccess == 0 {
+		return entry.Frequency
+	}
+	periods := (now - entry.LastAccess) / (int64(LFUDecayTime) * time.Minute.Milliseconds())
+	if periods >= int64(entry.Frequency) {
+		return 0
+	}
+	return entry.Frequency - uint8(periods)
+}
+
+// Record an access, the counter grows more slowly the larger it is.
+func Touch(entry Entry, now int64) Entry {
+	frequency := DecayedFrequency(entry, now)
+	if frequency < 255 {
+		base := float64(frequency) - LFUInitValue
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1.0/(base*float64(LFULogFactor)+1) {
+			frequency++
+		}
+	}
+	entry.Frequency = frequency
+	entry.LastAccess = now
+	return entry
+}
+
+// Why a key changed, reported to the Listener of a storage.
+type KeyEvent int
+
+const (
+	KeyModified KeyEvent = iota
+	KeyExpired
+)
+
+// Storages report every change to a key so that the layers above can react,
+// e.g. to invalidate optimistic locks. Flushes are not reported per key.
+type Listener func(key string, event KeyEvent)
+
+// A point in time view of the entries of a storage that can be read from
+// another goroutine while the storage keeps changing. It must be closed
+// once read.
+type Snapshot interface {
+	// The number of keys and of those with an expiry time, which may
+	// include keys that expire before they are visited.
+	Len() (keys int, volatile int)
+	// Visit every entry that has not expired, stopping at the first error.
+	ForEach(fn func(key string, entry Entry) error) error
+	Close()
+}
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecayedFrequency(t *testing.T) {
+	now := time.Now().UnixMilli()
+	entry := Entry{LastAccess: now - 3*time.Minute.Milliseconds(), Frequency: 10}
+	require.Equal(t, uint8(7), DecayedFrequency(entry, now))
+	entry.Frequency = 2
+	require.Equal(t, uint8(0), DecayedFrequency(entry, now))
+}
+
+func TestTouch(t *testing.T) {
+	now := time.Now().UnixMilli()
+	entry := Touch(Entry{Frequency: 0}, now)
+	// Counters below the initial value always grow
+	require.Equal(t, uint8(1), entry.Frequency)
+	require.Equal(t, now, entry.LastAccess)
+	entry = Touch(Entry{Frequency: 255, LastAccess: now}, now)
+	require.Equal(t, uint8(255), entry.Frequency)
+}
@@ -3,23 +3,158 @@
 // resp processor so this is ok.
 package storage
 
+import "time"
+
 type SimpleStorage struct {
 	data map[string]Entry
+	// Keys with an expiry, kept separately so the active expiry only has
+	// to look at volatile keys.
+	expires  map[string]struct{}
+	listener Listener
+	used     int64
 }
 
 func NewSimpleStorage() *SimpleStorage {
 
-	return &SimpleStorage{data: make(map[string]Entry)}
+	return &SimpleStorage{data: make(map[string]Entry), expires: make(map[string]struct{})}
+}
+
+func (kv *SimpleStorage) SetListener(listener Listener) {
+	kv.listener = listener
+}
+
+func (kv *SimpleStorage) notify(key string, event KeyEvent) {
+	if kv.listener != nil {
+		kv.listener(key, event)
+	}
 }
 
+// Expired entries are removed lazily when they are accessed. Every access
+// is recorded for eviction.
 func (kv *SimpleStorage) Get(key string) Entry {
-	return kv.data[key]
+	entry, ok := kv.data[key]
+	if !ok {
+		return Entry{}
+	}
+	now := time.Now().UnixMilli()
+	if entry.IsExpired(now) {
+		kv.expire(key)
+		return Entry{}
+	}
+	entry = Touch(entry, now)
+	kv.data[key] = entry
+	return entry
 }
 
-func (kv *SimpleStorage) Set(key string, value Entry) {
+// New entries start with fresh access statistics, entries that were read
+// before keep theirs. Writes to memory cannot fail.
+func (kv *SimpleStorage) Set(key string, value Entry) error {
+	if value.LastAccess == 0 {
+		value.LastAccess = time.Now().UnixMilli()
+		if value.Frequency == 0 {
+			value.Frequency = LFUInitValue
+		}
+	}
+	kv.remove(key)
 	kv.data[key] = value
+	kv.used += EntrySize(key, value)
+	if value.ExpireAt != 0 {
+		kv.expires[key] = struct{}{}
+	} else {
+		delete(kv.expires, key)
+	}
+	kv.notify(key, KeyModified)
+	return nil
+}
+
+func (kv *SimpleStorage) Delete(key string) error {
+	kv.remove(key)
+	kv.notify(key, KeyModified)
+	return nil
+}
+
+func (kv *SimpleStorage) expire(key string) {
+	kv.remove(key)
+	kv.notify(key, KeyExpired)
+}
+
+func (kv *SimpleStorage) remove(key string) {
+	if entry, ok := kv.data[key]; ok {
+		kv.used -= EntrySize(key, entry)
+		delete(kv.data, key)
+		delete(kv.expires, key)
+	}
+}
+
+// Approximate memory used by all entries.
+func (kv *SimpleStorage) UsedMemory() int64 {
+	return kv.used
+}
+
+// Up to count entries, without recording an access. Map iteration order is
+// random which makes this a sample.
+func (kv *SimpleStorage) Sample(count int, volatileOnly bool) map[string]Entry {
+	sample := make(map[string]Entry, count)
+	if volatileOnly {
+		for key := range kv.expires {
+			if len(sample) == count {
+				break
+			}
+			sample[key] = kv.data[key]
+		}
+		return sample
+	}
+	for key, entry := range kv.data {
+		if len(sample) == count {
+			break
+		}
+		sample[key] = entry
+	}
+	return sample
+}
+
+// Active expiry, checks at most limit volatile keys and removes the ones
+// that have expired. Map iteration order is random which makes this a sample.
+func (kv *SimpleStorage) DeleteExpired(limit int) int {
+	now := time.Now().UnixMilli()
+	removed := 0
+	for key := range kv.expires {
+		if limit == 0 {
+			break
+		}
+		limit--
+		if kv.data[key].IsExpired(now) {
+			kv.expire(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Visit every entry that has not expired. The entries must not be modified
+// from fn.
+func (kv *SimpleStorage) ForEach(fn func(key string, entry Entry)) {
+	now := time.Now().UnixMilli()
+	for key, entry := range kv.data {
+		if !entry.IsExpired(now) {
+			fn(key, entry)
+		}
+	}
 }
 
-func (kv *SimpleStorage) Delete(key string) {
-	delete(kv.data, key)
+// Remove all keys. An async flush swaps in an empty map and leaves the
+// release of the old one to a background goroutine.
+func (kv *SimpleStorage) Flush(async bool) error {
+	kv.expires = make(map[string]struct{})
+	kv.used = 0
+	if !async {
+		clear(kv.data)
+		return nil
+	}
+	old := kv.data
+	kv.data = make(map[string]Entry)
+	go func() {
+		clear(old)
+	}()
+	return nil
 }
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -22,3 +24,82 @@ func TestSimpleSetGetSimpleString(t *testing.T) {
 	require.Equal(t, setValue, getValue.Value)
 	require.Equal(t, dt, getValue.DataType)
 }
+
+func TestSimpleFlush(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		storage := NewSimpleStorage()
+		storage.Set("a", Entry{DataType: '+', Value: []byte("1")})
+		storage.Set("b", Entry{DataType: '+', Value: []byte("2")})
+		storage.Flush(async)
+		require.Condition(t, storage.Get("a").IsNull)
+		require.Condition(t, storage.Get("b").IsNull)
+	}
+}
+
+func TestSimpleExpiry(t *testing.T) {
+	storage := NewSimpleStorage()
+	var expired []string
+	storage.SetListener(func(key string, event KeyEvent) {
+		if event == KeyExpired {
+			expired = append(expired, key)
+		}
+	})
+	past := time.Now().UnixMilli() - 1
+	storage.Set("lazy", Entry{DataType: '+', Value: []byte("1"), ExpireAt: past})
+	storage.Set("active", Entry{DataType: '+', Value: []byte("1"), ExpireAt: past})
+	storage.Set("persistent", Entry{DataType: '+', Value: []byte("1")})
+
+	require.Condition(t, storage.Get("lazy").IsNull)
+	require.Equal(t, []string{"lazy"}, expired)
+
+	require.Equal(t, 1, storage.DeleteExpired(10))
+	require.Equal(t, []string{"lazy", "active"}, expired)
+	require.False(t, storage.Get("persistent").IsNull())
+}
+
+func TestSimpleForEach(t *testing.T) {
+	storage := NewSimpleStorage()
+	storage.Set("a", Entry{DataType: '+', Value: []byte("1")})
+	storage.Set("b", Entry{DataType: '+', Value: []byte("2"), ExpireAt: time.Now().UnixMilli() - 1})
+	visited := map[string]string{}
+	storage.ForEach(func(key string, entry Entry) {
+		visited[key] = string(entry.Value)
+	})
+	require.Equal(t, map[string]string{"a": "1"}, visited)
+}
+
+func TestSimpleUsedMemory(t *testing.T) {
+	storage := NewSimpleStorage()
+	a := Entry{DataType: '+', Value: []byte("1")}
+	b := Entry{DataType: '+', Value: []byte("22"), ExpireAt: time.Now().UnixMilli() + 10000}
+	storage.Set("a", a)
+	storage.Set("b", b)
+	require.Equal(t, EntrySize("a", a)+EntrySize("b", b), storage.UsedMemory())
+	storage.Set("b", a)
+	require.Equal(t, 2*EntrySize("a", a), storage.UsedMemory())
+	storage.Delete("a")
+	require.Equal(t, EntrySize("b", a), storage.UsedMemory())
+	storage.Flush(false)
+	require.Equal(t, int64(0), storage.UsedMemory())
+}
+
+func TestSimpleSample(t *testing.T) {
+	storage := NewSimpleStorage()
+	for i := 0; i < 10; i++ {
+		storage.Set(fmt.Sprint(i), Entry{DataType: '+', Value: []byte("1")})
+	}
+	storage.Set("volatile", Entry{DataType: '+', Value: []byte("1"), ExpireAt: time.Now().UnixMilli() + 10000})
+	require.Len(t, storage.Sample(5, false), 5)
+	require.Len(t, storage.Sample(20, false), 11)
+	sample := storage.Sample(5, true)
+	require.Len(t, sample, 1)
+	require.Contains(t, sample, "volatile")
+}
+
+func TestSimpleAccessStatistics(t *testing.T) {
+	storage := NewSimpleStorage()
+	storage.Set("a", Entry{DataType: '+', Value: []byte("1")})
+	entry := storage.Get("a")
+	require.NotZero(t, entry.LastAccess)
+	require.GreaterOrEqual(t, entry.Frequency, uint8(LFUInitValue))
+}
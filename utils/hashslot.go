@@ -0,0 +1,32 @@
+package utils
+
+import "strings"
+
+const HashSlots = 16384
+
+// CRC16 XMODEM, the checksum Redis Cluster uses to map keys to slots.
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Only the part between the first { and the following } is hashed if it is
+// not empty, which lets related keys be placed in the same slot.
+func HashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % HashSlots
+}
@@ -15,3 +15,88 @@ func MarshalToResp(cmd string) []byte {
 	}
 	return bytes
 }
+
+// Same as MarshalToResp but for arguments that may contain whitespace.
+func MarshalArgsToResp(args ...string) []byte {
+	bytes := []byte("")
+	bytes = fmt.Append(bytes, "*", len(args), "\r\n")
+
+	for _, v := range args {
+		bytes = fmt.Append(bytes, "$", len(v), "\r\n", v, "\r\n")
+	}
+	return bytes
+}
+
+// Glob style matching as used by Redis for key, channel and name patterns.
+// Supports *, ?, [abc], [^abc], [a-z] and backslash escaping.
+func GlobMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if GlobMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			pattern = pattern[end+2:]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if class[i] == '\\' && i+1 < len(class) {
+					i++
+					matched = matched || class[i] == s[0]
+				} else if i+2 < len(class) && class[i+1] == '-' {
+					low, high := class[i], class[i+2]
+					if low > high {
+						low, high = high, low
+					}
+					matched = matched || (s[0] >= low && s[0] <= high)
+					i += 2
+				} else {
+					matched = matched || class[i] == s[0]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobMatch(t *testing.T) {
+	matches := [][2]string{
+		{"*", "anything"}, {"*", ""}, {"h?llo", "hello"}, {"h*llo", "heeeello"},
+		{"h[ae]llo", "hallo"}, {"h[^e]llo", "hallo"}, {"h[a-b]llo", "hbllo"},
+		{"news.*", "news.sport"}, {"\\*", "*"}, {"a**b", "ab"},
+	}
+	for _, m := range matches {
+		require.True(t, GlobMatch(m[0], m[1]), "%s should match %s", m[0], m[1])
+	}
+	misses := [][2]string{
+		{"h?llo", "hllo"}, {"h[ae]llo", "hillo"}, {"h[^e]llo", "hello"},
+		{"news.*", "new.sport"}, {"\\*", "a"}, {"abc", "abcd"}, {"[a", "a"},
+	}
+	for _, m := range misses {
+		require.False(t, GlobMatch(m[0], m[1]), "%s should not match %s", m[0], m[1])
+	}
+}
+
+func TestMarshalArgsToResp(t *testing.T) {
+	require.Equal(t, "*2\r\n$3\r\nGET\r\n$5\r\na key\r\n", string(MarshalArgsToResp("GET", "a key")))
+}
+
+func TestHashSlot(t *testing.T) {
+	// Reference values from the Redis cluster specification and CLUSTER KEYSLOT
+	require.Equal(t, uint16(0x31c3), crc16("123456789"))
+	require.Equal(t, 12182, HashSlot("foo"))
+	require.Equal(t, 11058, HashSlot("somekey"))
+	require.Equal(t, HashSlot("user1000"), HashSlot("{user1000}.following"))
+	require.Equal(t, HashSlot("{user1000}.followers"), HashSlot("{user1000}.following"))
+	require.Equal(t, HashSlot("{}foo"), int(crc16("{}foo"))%HashSlots)
+	require.Equal(t, HashSlot("bar"), HashSlot("foo{bar}{zap}"))
+}